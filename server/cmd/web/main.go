@@ -26,6 +26,7 @@ func main() {
 
 	// Setup routes
 	handlers.SetupPipelines(app)
+	handlers.SetupTemplates(app)
 	handlers.SetupImageBuilder(app)
 	handlers.SetupRegistry(app)
 	handlers.SetupConfig(app)
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
@@ -45,6 +46,8 @@ func SetupImageBuilder(app *fiber.App) {
 type BuildImageRequest struct {
 	URL         string `json:"url" form:"url"`
 	Branch      string `json:"branch" form:"branch"`
+	Ref         string `json:"ref" form:"ref"`
+	Commit      string `json:"commit" form:"commit"`
 	ServicePath string `json:"servicePath" form:"servicePath"`
 	Tag         string `json:"tag" form:"tag"`
 	Registry    string `json:"registry" form:"registry"`
@@ -68,6 +71,8 @@ type BuildImageResponse struct {
 type BuildMultipleRequest struct {
 	URL          string   `json:"url" form:"url"`
 	Branch       string   `json:"branch" form:"branch"`
+	Ref          string   `json:"ref" form:"ref"`
+	Commit       string   `json:"commit" form:"commit"`
 	ServicePaths []string `json:"servicePaths" form:"servicePaths"`
 	Tag          string   `json:"tag" form:"tag"`
 	Registry     string   `json:"registry" form:"registry"`
@@ -122,9 +127,15 @@ func postBuildImage(repoManager *repository.RepositoryManager) fiber.Handler {
 		}
 
 		// Validate required fields
-		if req.URL == "" || req.Branch == "" || req.ServicePath == "" || req.Registry == "" {
+		if req.URL == "" || req.ServicePath == "" || req.Registry == "" {
 			return c.Status(400).JSON(fiber.Map{
-				"error": "Missing required fields: url, branch, servicePath, and registry are required",
+				"error": "Missing required fields: url, servicePath, and registry are required",
+			})
+		}
+		rev, err := requestRevision(req.Branch, req.Ref, req.Commit)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
 			})
 		}
 
@@ -133,13 +144,13 @@ func postBuildImage(repoManager *repository.RepositoryManager) fiber.Handler {
 			req.Tag = "latest"
 		}
 
-		log.Printf("Building image for service %s from %s (branch: %s)", req.ServicePath, req.URL, req.Branch)
+		log.Printf("Building image for service %s from %s (%s)", req.ServicePath, req.URL, rev)
 
 		// Get or clone repository
 		repo, err := repoManager.GetRepositoryByURL(c.Context(), req.URL)
 		if err != nil {
 			// Repository not found, clone it
-			repo, err = repoManager.CloneRepository(c.Context(), req.URL, req.ServicePath, "Repository for building Docker images")
+			repo, err = repoManager.CloneRepository(c.Context(), req.URL, req.ServicePath, "Repository for building Docker images", nil)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{
 					"error": "Failed to clone repository: " + err.Error(),
@@ -147,16 +158,18 @@ func postBuildImage(repoManager *repository.RepositoryManager) fiber.Handler {
 			}
 		}
 
-		// Checkout the specified branch
-		err = repoManager.CheckoutBranch(c.Context(), repo.ID, req.Branch)
+		// Checkout the specified revision in a worktree of its own, so that
+		// concurrent builds do not disturb each other
+		worktree, err := repoManager.CreateWorktree(c.Context(), repo.ID, rev)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
-				"error": "Failed to checkout branch: " + err.Error(),
+				"error": "Failed to checkout " + rev.String() + ": " + err.Error(),
 			})
 		}
+		defer removeWorktree(repoManager, worktree)
 
-		// Create workspace from repository
-		ws, err := ci.NewWorkspaceFromPath(repo.LocalPath)
+		// Create workspace from the worktree
+		ws, err := ci.NewWorkspaceFromPath(worktree.Dir)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": "Failed to create workspace: " + err.Error(),
@@ -180,7 +193,7 @@ func postBuildImage(repoManager *repository.RepositoryManager) fiber.Handler {
 			Service:   result.Service,
 			Tag:       result.Tag,
 			Commit:    result.Commit,
-			Branch:    result.Branch,
+			Branch:    rev.Branch(),
 			BuildTime: result.BuildTime,
 			Success:   result.Success,
 			Output:    result.Output,
@@ -201,9 +214,15 @@ func postBuildMultipleImages(repoManager *repository.RepositoryManager) fiber.Ha
 		}
 
 		// Validate required fields
-		if req.URL == "" || req.Branch == "" || len(req.ServicePaths) == 0 || req.Registry == "" {
+		if req.URL == "" || len(req.ServicePaths) == 0 || req.Registry == "" {
 			return c.Status(400).JSON(fiber.Map{
-				"error": "Missing required fields: url, branch, servicePaths, and registry are required",
+				"error": "Missing required fields: url, servicePaths, and registry are required",
+			})
+		}
+		rev, err := requestRevision(req.Branch, req.Ref, req.Commit)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
 			})
 		}
 
@@ -212,13 +231,13 @@ func postBuildMultipleImages(repoManager *repository.RepositoryManager) fiber.Ha
 			req.Tag = "latest"
 		}
 
-		log.Printf("Building images for %d services from %s (branch: %s)", len(req.ServicePaths), req.URL, req.Branch)
+		log.Printf("Building images for %d services from %s (%s)", len(req.ServicePaths), req.URL, rev)
 
 		// Get or clone repository
 		repo, err := repoManager.GetRepositoryByURL(c.Context(), req.URL)
 		if err != nil {
 			// Repository not found, clone it
-			repo, err = repoManager.CloneRepository(c.Context(), req.URL, req.ServicePaths[0], "Repository for building Docker images")
+			repo, err = repoManager.CloneRepository(c.Context(), req.URL, req.ServicePaths[0], "Repository for building Docker images", nil)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{
 					"error": "Failed to clone repository: " + err.Error(),
@@ -226,16 +245,18 @@ func postBuildMultipleImages(repoManager *repository.RepositoryManager) fiber.Ha
 			}
 		}
 
-		// Checkout the specified branch
-		err = repoManager.CheckoutBranch(c.Context(), repo.ID, req.Branch)
+		// Checkout the specified revision in a worktree of its own, so that
+		// concurrent builds do not disturb each other
+		worktree, err := repoManager.CreateWorktree(c.Context(), repo.ID, rev)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
-				"error": "Failed to checkout branch: " + err.Error(),
+				"error": "Failed to checkout " + rev.String() + ": " + err.Error(),
 			})
 		}
+		defer removeWorktree(repoManager, worktree)
 
-		// Create workspace from repository
-		ws, err := ci.NewWorkspaceFromPath(repo.LocalPath)
+		// Create workspace from the worktree
+		ws, err := ci.NewWorkspaceFromPath(worktree.Dir)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": "Failed to create workspace: " + err.Error(),
@@ -277,7 +298,7 @@ func postBuildMultipleImages(repoManager *repository.RepositoryManager) fiber.Ha
 				Service:   result.Service,
 				Tag:       result.Tag,
 				Commit:    result.Commit,
-				Branch:    result.Branch,
+				Branch:    rev.Branch(),
 				BuildTime: result.BuildTime,
 				Success:   result.Success,
 				Output:    result.Output,
@@ -290,6 +311,13 @@ func postBuildMultipleImages(repoManager *repository.RepositoryManager) fiber.Ha
 	}
 }
 
+// removeWorktree deletes the worktree of a finished build
+func removeWorktree(repoManager *repository.RepositoryManager, worktree *repository.Worktree) {
+	if err := repoManager.RemoveWorktree(context.Background(), worktree); err != nil {
+		log.Printf("Failed to remove worktree %s: %v", worktree.Dir, err)
+	}
+}
+
 // postDetectChanges handles requests to detect which services have changed between branches
 func postDetectChanges(repoManager *repository.RepositoryManager) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -322,7 +350,7 @@ func postDetectChanges(repoManager *repository.RepositoryManager) fiber.Handler
 		repo, err := repoManager.GetRepositoryByURL(c.Context(), req.URL)
 		if err != nil {
 			// Repository doesn't exist, clone it
-			repo, err = repoManager.CloneRepository(c.Context(), req.URL, repoID, "Repository for detecting changes")
+			repo, err = repoManager.CloneRepository(c.Context(), req.URL, repoID, "Repository for detecting changes", nil)
 			if err != nil {
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 					"error": fmt.Sprintf("Failed to clone repository: %v", err),
@@ -492,7 +520,7 @@ func getBranches(repoManager *repository.RepositoryManager) fiber.Handler {
 		if err != nil {
 			log.Printf("Repository not found, attempting to clone: %v", err)
 			// Repository not found, clone it
-			repo, err = repoManager.CloneRepository(c.Context(), req.URL, "temp", "Repository for listing branches")
+			repo, err = repoManager.CloneRepository(c.Context(), req.URL, "temp", "Repository for listing branches", nil)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{
 					"error": "Failed to clone repository: " + err.Error(),
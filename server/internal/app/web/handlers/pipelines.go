@@ -1,18 +1,170 @@
 package handlers
 
 import (
-	//"fmt"
-	"log"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/valyala/fasthttp"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/cache"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/mirrors"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/config"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/poller"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/templates"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/status"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// pipelineWorkers is the number of pipeline runs executed at the same time
+const pipelineWorkers = 4
+
+// artifactsDir is where the local artifact store keeps step artifacts
+const artifactsDir = "/home/anhcv/workspace/artifacts"
+
+// cacheDir is where step caches are kept, up to cacheMaxSize bytes
+const (
+	cacheDir     = "/home/anhcv/workspace/cache"
+	cacheMaxSize = 10 << 30
+)
+
+// workspaceDir is where run workspaces are cloned. Workspaces of failed
+// runs are kept for failedWorkspaceRetention for debugging, and expired or
+// orphaned ones are reclaimed every workspaceJanitorInterval.
+const (
+	workspaceDir             = "/tmp/pipeslicer-workspaces"
+	failedWorkspaceRetention = 24 * time.Hour
+	workspaceJanitorInterval = 10 * time.Minute
 )
 
+// mirrorDir is where bare mirrors of the built repositories are kept, so
+// that run workspaces are cloned from local disk rather than the network
+const mirrorDir = "/home/anhcv/workspace/mirrors"
+
+// pollInterval is how often repositories are checked for being due to be polled
+const pollInterval = 30 * time.Second
+
+// publicURLEnv is the environment variable holding the address of this
+// server used in links posted to Git hosts. Statuses and comments are
+// posted without links when it is not set.
+const publicURLEnv = "PIPESLICER_PUBLIC_URL"
+
+// SetupPipelines registers the pipeline endpoints
 func SetupPipelines(app *fiber.App) {
 	pipelinesGroup := app.Group("/pipelines")
 
-	pipelinesGroup.Post("/build", postBuild)
+	// Open database connection
+	db, err := gorm.Open(postgres.Open(config.PostgresConnectionString), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	manager, err := runs.NewRunManager(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize run manager: %v", err)
+	}
+
+	store, err := artifacts.NewLocalStore(artifactsDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize artifact store: %v", err)
+	}
+
+	stepCache, err := cache.NewCache(cacheDir, cacheMaxSize)
+	if err != nil {
+		log.Fatalf("Failed to initialize step cache: %v", err)
+	}
+
+	repoManager, err := repository.NewRepositoryManager(db, "/home/anhcv/workspace/repositories")
+	if err != nil {
+		log.Fatalf("Failed to initialize repository manager: %v", err)
+	}
+
+	templateManager, err := templates.NewTemplateManager(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize template manager: %v", err)
+	}
+
+	workspaces, err := ci.NewWorkspaceManager(workspaceDir, ci.Retention{Failed: failedWorkspaceRetention})
+	if err != nil {
+		log.Fatalf("Failed to initialize workspace manager: %v", err)
+	}
+	workspaces.StartJanitor(context.Background(), workspaceJanitorInterval)
+
+	repoMirrors, err := mirrors.NewCache(mirrorDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize mirror cache: %v", err)
+	}
+	workspaces.SetMirror(func(url string, auth transport.AuthMethod) (string, func(), error) {
+		return repoMirrors.Acquire(context.Background(), url, auth)
+	})
+
+	broker := logs.NewBroker()
+	queue := runs.NewRunQueue(manager, broker, store, workspaces, pipelineWorkers)
+	queue.SetCache(stepCache)
+	queue.SetTemplateSource(templateManager)
+	queue.SetStatusReporter(repositoryReporter(repoManager), os.Getenv(publicURLEnv))
+	queue.SetAuth(repoManager.AuthForURL)
+	if err := queue.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start pipeline run queue: %v", err)
+	}
+
+	pipelinesGroup.Post("/build", postBuild(queue, repoManager))
+	pipelinesGroup.Post("/validate", validatePipeline(templateManager))
+	pipelinesGroup.Get("/schema", getPipelineSchema)
+	pipelinesGroup.Get("/runs", listRuns(manager))
+	pipelinesGroup.Get("/runs/:id", getRun(manager))
+	pipelinesGroup.Post("/runs/:id/cancel", cancelRun(queue))
+	pipelinesGroup.Post("/runs/:id/approve", decideApproval(manager, queue, true))
+	pipelinesGroup.Post("/runs/:id/reject", decideApproval(manager, queue, false))
+	pipelinesGroup.Get("/runs/:id/logs", streamRunLogs(manager, broker))
+	pipelinesGroup.Get("/runs/:id/pipeline", getResolvedPipeline(manager))
+	pipelinesGroup.Get("/runs/:id/artifacts", listArtifacts(manager))
+	pipelinesGroup.Get("/runs/:id/artifacts/:artifactId", downloadArtifact(manager, queue))
+	pipelinesGroup.Get("/workspaces", getWorkspaceUsage(workspaces))
+	pipelinesGroup.Post("/workspaces/clean", cleanWorkspaces(workspaces))
+	pipelinesGroup.Get("/mirrors", getMirrorStats(repoMirrors))
+	pipelinesGroup.Post("/mirrors/prune", pruneMirrors(repoMirrors))
+	pipelinesGroup.Get("/caches", listCaches(stepCache))
+	pipelinesGroup.Delete("/caches", purgeCaches(stepCache))
+	pipelinesGroup.Delete("/caches/:key", purgeCache(stepCache))
+
+	setupWebhooks(app, queue, repoManager)
+	setupSchedules(app, db, queue)
+	poller.NewPoller(repoManager, queue, pollInterval).Start(context.Background())
+}
+
+// repositoryReporter returns the status reporter configured for a
+// registered repository, or nil when it has no status token
+func repositoryReporter(repoManager *repository.RepositoryManager) runs.StatusReporterFunc {
+	return func(ctx context.Context, url string) status.StatusReporter {
+		repo, err := repoManager.GetRepositoryByURL(ctx, url)
+		if err != nil || repo.StatusToken == "" {
+			return nil
+		}
+		reporter, err := status.NewReporter(repo.GitProvider, repo.URL, repo.StatusToken)
+		if err != nil {
+			log.Printf("Failed to create status reporter for %s: %v", repo.URL, err)
+			return nil
+		}
+		return reporter
+	}
 }
 
 type RequestBody struct {
@@ -20,44 +172,734 @@ type RequestBody struct {
 	Branch string `json:"branch" xml:"branch" form:"branch"`
 }
 
-func postBuild(c *fiber.Ctx) error {
-	url := c.FormValue("url")
-	branch := c.FormValue("branch")
+// postBuild returns a handler that queues a pipeline run and responds with its ID.
+// The run builds a branch, a full reference such as refs/pull/12/head, or an
+// exact commit. Without an uploaded file the pipeline is read from the
+// repository itself, from the path configured for it or else from a default location.
+func postBuild(queue *runs.RunQueue, repoManager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		url := c.FormValue("url")
+		if url == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "url is required",
+			})
+		}
+		rev, err := requestRevision(c.FormValue("branch"), c.FormValue("ref"), c.FormValue("commit"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		log.Printf("Failed to read uploaded file: %v", err)
-		return c.Status(400).SendString("Invalid file upload: " + err.Error())
+		var data []byte
+		var pipelinePath string
+		file, err := c.FormFile("file")
+		switch {
+		case err == nil:
+			f, err := file.Open()
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to open uploaded file: " + err.Error(),
+				})
+			}
+			defer f.Close()
+
+			data, err = io.ReadAll(f)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to read file: " + err.Error(),
+				})
+			}
+		case errors.Is(err, fasthttp.ErrMissingFile), errors.Is(err, fasthttp.ErrNoMultipartForm):
+			// The pipeline is versioned in the repository
+			if repo, err := repoManager.GetRepositoryByURL(c.Context(), url); err == nil {
+				pipelinePath = repo.PipelinePath
+			}
+		default:
+			log.Printf("Failed to read uploaded file: %v", err)
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid file upload: " + err.Error(),
+			})
+		}
+
+		log.Printf("Received request: URL=%s, Revision=%s, File Size=%d", url, rev, len(data))
+
+		run, err := queue.Submit(c.Context(), runs.RunRequest{
+			URL:          url,
+			Branch:       rev.Ref,
+			Commit:       rev.Commit,
+			Pinned:       rev.Commit != "",
+			PipelineYAML: data,
+			PipelinePath: pipelinePath,
+			Trigger:      runs.TriggerManual,
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to queue pipeline run: " + err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"id":     run.ID,
+			"status": run.Status,
+		})
 	}
+}
 
-	f, err := file.Open()
-	if err != nil {
-		return c.Status(500).SendString("Failed to open uploaded file: " + err.Error())
+// validatePipeline returns a handler that checks a pipeline definition without
+// running it. The YAML is sent as the "file" form field or as the raw body.
+// Invalid pipelines get a 422 listing every problem with its line and column.
+func validatePipeline(source ci.TemplateSource) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		data := c.Body()
+		if file, err := c.FormFile("file"); err == nil {
+			f, err := file.Open()
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to open uploaded file: " + err.Error(),
+				})
+			}
+			defer f.Close()
+
+			data, err = io.ReadAll(f)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to read file: " + err.Error(),
+				})
+			}
+		}
+		if len(data) == 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "pipeline YAML is required",
+			})
+		}
+
+		errs, warnings := ci.ValidatePipeline(data, source)
+		if errs == nil {
+			errs = []ci.ValidationError{}
+		}
+		if warnings == nil {
+			warnings = []ci.ValidationError{}
+		}
+
+		status := 200
+		if len(errs) > 0 {
+			status = 422
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"valid":    len(errs) == 0,
+			"errors":   errs,
+			"warnings": warnings,
+		})
 	}
-	defer f.Close()
+}
 
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return c.Status(500).SendString("Failed to read file: " + err.Error())
+// getPipelineSchema serves the JSON Schema of the pipeline format
+func getPipelineSchema(c *fiber.Ctx) error {
+	c.Set("Content-Type", "application/schema+json")
+	return c.Send(ci.PipelineSchema)
+}
+
+// listRuns returns a handler for listing pipeline runs
+func listRuns(manager *runs.RunManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filter := runs.ListFilter{
+			URL:    c.Query("url"),
+			Branch: c.Query("branch"),
+			Status: c.Query("status"),
+			Limit:  c.QueryInt("limit", 50),
+		}
+
+		list, err := manager.ListRuns(c.Context(), filter)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to list pipeline runs: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"runs": list,
+		})
 	}
+}
 
-	log.Printf("Received request: URL=%s, Branch=%s, File Size=%d", url, branch, len(data))
+// getRun returns a handler for getting a pipeline run with its steps
+func getRun(manager *runs.RunManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
 
-	ws, err := ci.NewWorkspaceFromGit("/tmp", url, branch)
-	if err != nil {
-		return c.Status(500).SendString("Failed to create workspace: " + err.Error())
+		run, err := manager.GetRun(c.Context(), int64(id))
+		if err != nil {
+			if errors.Is(err, runs.ErrRunNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get pipeline run: " + err.Error(),
+			})
+		}
+
+		return c.JSON(run)
 	}
+}
 
-	pipeline, err := ws.LoadPipeline(data)
-	if err != nil {
-		return c.Status(400).SendString("Invalid YAML file: " + err.Error())
+// getResolvedPipeline returns a handler that shows the pipeline of a run
+// after its includes and extends were merged
+func getResolvedPipeline(manager *runs.RunManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
+
+		run, err := manager.GetRun(c.Context(), int64(id))
+		if err != nil {
+			if errors.Is(err, runs.ErrRunNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get pipeline run: " + err.Error(),
+			})
+		}
+		if run.ResolvedYAML == "" {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Pipeline of this run has not been resolved",
+			})
+		}
+
+		c.Set("Content-Type", "application/yaml")
+		return c.SendString(run.ResolvedYAML)
 	}
+}
+
+// cancelRun returns a handler for cancelling a queued or running pipeline run
+func cancelRun(queue *runs.RunQueue) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
+
+		err = queue.Cancel(c.Context(), int64(id))
+		if err != nil {
+			switch {
+			case errors.Is(err, runs.ErrRunNotFound):
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			case errors.Is(err, runs.ErrRunFinished):
+				return c.Status(409).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to cancel pipeline run: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Pipeline run cancelled",
+		})
+	}
+}
+
+// ApprovalRequest is the body of the approve and reject endpoints. Step may
+// be left out when the run waits for a single approval.
+type ApprovalRequest struct {
+	Step    string `json:"step"`
+	User    string `json:"user"`
+	Comment string `json:"comment"`
+}
+
+// decideApproval returns a handler that approves or rejects an approval
+// step of a pipeline run
+func decideApproval(manager *runs.RunManager, queue *runs.RunQueue, approved bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
 
-	executor := ci.NewExecutor(ws)
-	output, err := executor.Run(c.UserContext(), pipeline)
+		var req ApprovalRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+		if req.User == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "user is required",
+			})
+		}
+
+		if req.Step == "" {
+			run, err := manager.GetRun(c.Context(), int64(id))
+			if err != nil {
+				if errors.Is(err, runs.ErrRunNotFound) {
+					return c.Status(404).JSON(fiber.Map{
+						"error": err.Error(),
+					})
+				}
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to get pipeline run: " + err.Error(),
+				})
+			}
+			var pending []string
+			for _, approval := range run.Approvals {
+				if approval.Status == runs.ApprovalPending {
+					pending = append(pending, approval.Step)
+				}
+			}
+			if len(pending) != 1 {
+				return c.Status(400).JSON(fiber.Map{
+					"error": fmt.Sprintf("step is required, the run waits for %d approvals", len(pending)),
+				})
+			}
+			req.Step = pending[0]
+		}
+
+		err = queue.Decide(c.Context(), int64(id), req.Step, approved, req.User, req.Comment)
+		if err != nil {
+			switch {
+			case errors.Is(err, runs.ErrRunNotFound):
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			case errors.Is(err, runs.ErrRunFinished), errors.Is(err, runs.ErrApprovalNotPending):
+				return c.Status(409).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to record approval: " + err.Error(),
+			})
+		}
+
+		message := "Step " + req.Step + " approved"
+		if !approved {
+			message = "Step " + req.Step + " rejected"
+		}
+		return c.JSON(fiber.Map{
+			"message": message,
+		})
+	}
+}
+
+// listArtifacts returns a handler for listing the artifacts of a pipeline run
+func listArtifacts(manager *runs.RunManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
+
+		list, err := manager.ListArtifacts(c.Context(), int64(id))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to list artifacts: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"artifacts": list,
+		})
+	}
+}
+
+// downloadArtifact returns a handler that sends an artifact as a .tar.gz archive
+func downloadArtifact(manager *runs.RunManager, queue *runs.RunQueue) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
+		artifactID, err := c.ParamsInt("artifactId")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid artifact ID",
+			})
+		}
+
+		artifact, err := manager.GetArtifact(c.Context(), int64(id), int64(artifactID))
+		if err != nil {
+			if errors.Is(err, runs.ErrArtifactNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get artifact: " + err.Error(),
+			})
+		}
+		if artifact.Expired() {
+			return c.Status(410).JSON(fiber.Map{
+				"error": "Artifact has expired",
+			})
+		}
+
+		r, err := queue.OpenArtifact(c.Context(), artifact)
+		if err != nil {
+			if errors.Is(err, artifacts.ErrNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to open artifact: " + err.Error(),
+			})
+		}
+
+		c.Set("Content-Type", "application/gzip")
+		c.Attachment(fmt.Sprintf("run-%d-%s.tar.gz", id, artifact.StepName))
+		return c.SendStream(r, int(artifact.Size))
+	}
+}
+
+// listCaches returns a handler for listing step cache entries
+func listCaches(stepCache *cache.Cache) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		entries := stepCache.List()
+		var total int64
+		for _, entry := range entries {
+			total += entry.Size
+		}
+
+		return c.JSON(fiber.Map{
+			"entries":   entries,
+			"totalSize": total,
+			"maxSize":   int64(cacheMaxSize),
+		})
+	}
+}
+
+// getWorkspaceUsage returns a handler for reporting the disk space taken
+// by run workspaces
+func getWorkspaceUsage(workspaces *ci.WorkspaceManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		usage, err := workspaces.Usage()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get workspace usage: " + err.Error(),
+			})
+		}
+
+		return c.JSON(usage)
+	}
+}
+
+// cleanWorkspaces returns a handler for reclaiming expired and orphaned
+// workspaces without waiting for the janitor
+func cleanWorkspaces(workspaces *ci.WorkspaceManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		result, err := workspaces.Clean(time.Now())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to clean workspaces: " + err.Error(),
+			})
+		}
+
+		return c.JSON(result)
+	}
+}
+
+// getMirrorStats returns a handler for listing the repository mirrors
+func getMirrorStats(repoMirrors *mirrors.Cache) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(repoMirrors.Stats())
+	}
+}
+
+// pruneMirrors returns a handler for deleting the mirrors not used for the
+// unusedFor query duration, or every mirror not in use without it
+func pruneMirrors(repoMirrors *mirrors.Cache) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var cutoff time.Time
+		if unusedFor := c.Query("unusedFor"); unusedFor != "" {
+			d, err := time.ParseDuration(unusedFor)
+			if err != nil || d <= 0 {
+				return c.Status(400).JSON(fiber.Map{
+					"error": "Invalid unusedFor duration, expected a positive duration such as 168h",
+				})
+			}
+			cutoff = time.Now().Add(-d)
+		}
+
+		result, err := repoMirrors.Prune(cutoff)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to prune mirrors: " + err.Error(),
+			})
+		}
+
+		return c.JSON(result)
+	}
+}
+
+// purgeCache returns a handler for deleting a single step cache entry
+func purgeCache(stepCache *cache.Cache) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, err := url.PathUnescape(c.Params("key"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid cache key",
+			})
+		}
+
+		if err := stepCache.Purge(key); err != nil {
+			if errors.Is(err, cache.ErrNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to purge cache: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Cache entry purged",
+		})
+	}
+}
+
+// purgeCaches returns a handler for deleting every step cache entry
+func purgeCaches(stepCache *cache.Cache) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		n, err := stepCache.PurgeAll()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to purge caches: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Cache purged",
+			"purged":  n,
+		})
+	}
+}
+
+// logHeartbeatInterval is how often idle log followers get a keep-alive
+const logHeartbeatInterval = 15 * time.Second
+
+// runLogPollInterval is how often the logs of a run that is not executing
+// on this server are looked up in the database
+const runLogPollInterval = 2 * time.Second
+
+// streamRunLogs returns a handler that follows the output of a pipeline run.
+// WebSocket upgrade requests receive one JSON message per line; all other
+// requests get Server-Sent Events. Clients resume after a reconnect with
+// ?offset=N or, for SSE, the standard Last-Event-ID header.
+func streamRunLogs(manager *runs.RunManager, broker *logs.Broker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid run ID",
+			})
+		}
+		runID := int64(id)
+
+		offset := c.QueryInt("offset", 0)
+		if lastID := c.Get("Last-Event-ID"); lastID != "" {
+			if n, err := strconv.Atoi(lastID); err == nil {
+				offset = n + 1
+			}
+		}
+
+		// Following a run executing elsewhere polls the database until the
+		// client leaves
+		follow, stop := context.WithCancel(context.Background())
+		stream, err := runLogStream(follow, manager, broker, runID)
+		if err != nil {
+			stop()
+			if errors.Is(err, runs.ErrRunNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to open run logs: " + err.Error(),
+			})
+		}
+
+		if websocket.IsWebSocketUpgrade(c) {
+			return websocket.New(func(conn *websocket.Conn) {
+				defer conn.Close()
+				defer stop()
+				err := followLogs(stream, offset,
+					func(line logs.Line) error { return conn.WriteJSON(line) },
+					func() error { return conn.WriteMessage(websocket.PingMessage, nil) },
+				)
+				if err != nil {
+					return
+				}
+				conn.WriteJSON(fiber.Map{
+					"event":  "end",
+					"status": finalRunStatus(manager, runID),
+				})
+			})(c)
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer stop()
+			err := followLogs(stream, offset,
+				func(line logs.Line) error {
+					data, err := json.Marshal(line)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(w, "id: %d\nevent: line\ndata: %s\n\n", line.Offset, data)
+					return w.Flush()
+				},
+				func() error {
+					fmt.Fprint(w, ": keep-alive\n\n")
+					return w.Flush()
+				},
+			)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: end\ndata: {\"status\":%q}\n\n", finalRunStatus(manager, runID))
+			w.Flush()
+		})
+		return nil
+	}
+}
+
+// runLogStream finds the log stream of a run. Runs executing on this
+// server share the live stream. The logs of other runs are replayed from
+// the step output stored in the database, and for runs that are not
+// finished, such as runs executing on another server, the database is
+// polled until ctx is done or the run finishes.
+func runLogStream(ctx context.Context, manager *runs.RunManager, broker *logs.Broker, id int64) (*logs.Stream, error) {
+	if stream, ok := broker.Get(id); ok {
+		return stream, nil
+	}
+
+	run, err := manager.GetRun(ctx, id)
 	if err != nil {
-		return c.Status(500).SendString("Pipeline execution failed: " + err.Error())
+		return nil, err
+	}
+	stream := logs.NewStream()
+	replayed := make(map[string]bool)
+	if replayStoredLogs(stream, run, replayed) {
+		return stream, nil
+	}
+	go pollRunLogs(ctx, manager, stream, id, replayed)
+	return stream, nil
+}
+
+// replayStoredLogs appends the output of the steps of run that finished
+// and are not in replayed yet to stream. Once the run is finished, its
+// error is appended and the stream closed, and it returns true.
+func replayStoredLogs(stream *logs.Stream, run *runs.PipelineRun, replayed map[string]bool) bool {
+	for _, step := range run.Steps {
+		switch ci.StepStatus(step.Status) {
+		case ci.StepPending, ci.StepRunning, ci.StepWaiting:
+			continue
+		}
+		if replayed[step.Name] {
+			continue
+		}
+		replayed[step.Name] = true
+		if step.Output == "" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimRight(step.Output, "\n"), "\n") {
+			stream.Append(step.Name, line)
+		}
+	}
+	if !run.Finished() {
+		return false
+	}
+	if run.Error != "" {
+		stream.Append("", "Error: "+run.Error)
+	}
+	stream.Close()
+	return true
+}
+
+// pollRunLogs appends the stored output of the run id to stream every
+// runLogPollInterval until it finishes or ctx is done
+func pollRunLogs(ctx context.Context, manager *runs.RunManager, stream *logs.Stream, id int64, replayed map[string]bool) {
+	ticker := time.NewTicker(runLogPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		run, err := manager.GetRun(ctx, id)
+		if errors.Is(err, runs.ErrRunNotFound) {
+			stream.Close()
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to follow logs of pipeline run %d: %v", id, err)
+			continue
+		}
+		if replayStoredLogs(stream, run, replayed) {
+			return
+		}
 	}
+}
+
+// followLogs sends every line from offset on until the stream is complete
+// or send fails. heartbeat is called while the stream is idle.
+func followLogs(stream *logs.Stream, offset int, send func(logs.Line) error, heartbeat func() error) error {
+	for {
+		lines, closed, changed := stream.ReadFrom(offset)
+		for _, line := range lines {
+			if err := send(line); err != nil {
+				return err
+			}
+			offset = line.Offset + 1
+		}
+		if len(lines) > 0 {
+			continue
+		}
+		if closed {
+			return nil
+		}
 
-	return c.SendString("Successfully executed pipeline.\n" + output)
-}
\ No newline at end of file
+		select {
+		case <-changed:
+		case <-time.After(logHeartbeatInterval):
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// finalRunStatus looks up the status of a run once its log stream has ended
+func finalRunStatus(manager *runs.RunManager, id int64) string {
+	run, err := manager.GetRun(context.Background(), id)
+	if err != nil {
+		return "unknown"
+	}
+	return run.Status
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestRunManager returns a RunManager backed by a fresh SQLite database
+func newTestRunManager(t *testing.T) *runs.RunManager {
+	dsn := filepath.Join(t.TempDir(), "runs.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.Nil(t, err)
+	manager, err := runs.NewRunManager(db)
+	assert.Nil(t, err)
+	return manager
+}
+
+// lineTexts returns the text of every line of stream and whether it is complete
+func lineTexts(stream *logs.Stream) ([]string, bool) {
+	lines, complete, _ := stream.ReadFrom(0)
+	var texts []string
+	for _, line := range lines {
+		texts = append(texts, line.Text)
+	}
+	return texts, complete
+}
+
+func TestRunLogStreamOfRunExecutingElsewhere(t *testing.T) {
+	manager := newTestRunManager(t)
+	broker := logs.NewBroker()
+	ctx := context.Background()
+
+	// The run executes on another server, which records its steps
+	run := &runs.PipelineRun{URL: "https://github.com/acme/shop.git", Branch: "main"}
+	assert.Nil(t, manager.CreateRun(ctx, run))
+	claimed, err := manager.ClaimRun(ctx, run)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	assert.Nil(t, manager.SaveStep(ctx, &runs.StepRun{RunID: run.ID, Name: "Build", Status: "success", Output: "built\n"}))
+	assert.Nil(t, manager.SaveStep(ctx, &runs.StepRun{RunID: run.ID, Name: "Test", Status: "running"}))
+
+	follow, stop := context.WithCancel(ctx)
+	defer stop()
+	stream, err := runLogStream(follow, manager, broker, run.ID)
+	assert.Nil(t, err)
+	texts, complete := lineTexts(stream)
+	assert.Equal(t, []string{"built"}, texts)
+	assert.False(t, complete)
+	_, ok := broker.Get(run.ID)
+	assert.False(t, ok)
+
+	assert.Nil(t, manager.SaveStep(ctx, &runs.StepRun{RunID: run.ID, Name: "Test", Status: "success", Output: "tested\n"}))
+	run.Status = runs.StatusSuccess
+	updated, err := manager.UpdateRun(ctx, run, runs.StatusRunning)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	assert.Eventually(t, func() bool {
+		_, complete := lineTexts(stream)
+		return complete
+	}, 3*runLogPollInterval, 50*time.Millisecond)
+	texts, _ = lineTexts(stream)
+	assert.Equal(t, []string{"built", "tested"}, texts)
+
+	// Finished runs are replayed at once
+	stream, err = runLogStream(ctx, manager, broker, run.ID)
+	assert.Nil(t, err)
+	texts, complete = lineTexts(stream)
+	assert.Equal(t, []string{"built", "tested"}, texts)
+	assert.True(t, complete)
+}
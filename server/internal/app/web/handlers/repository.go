@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
 	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/config"
 	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
 	"gorm.io/driver/postgres"
@@ -40,6 +44,10 @@ func SetupRepository(app *fiber.App) {
 	repositoryGroup.Post("/:id/checkout", checkoutBranch(manager))
 	repositoryGroup.Get("/:id/commits", getBranchCommits(manager))
 	repositoryGroup.Post("/:id/sync", syncRepository(manager))
+	repositoryGroup.Put("/:id/settings", updateRepositorySettings(manager))
+	repositoryGroup.Get("/:id/credential", getRepositoryCredential(manager))
+	repositoryGroup.Put("/:id/credential", setRepositoryCredential(manager))
+	repositoryGroup.Delete("/:id/credential", deleteRepositoryCredential(manager))
 
 	// Add new endpoint for detecting microservices
 	repositoryGroup.Post("/:id/detect-microservices", func(c *fiber.Ctx) error {
@@ -100,23 +108,86 @@ func SetupRepository(app *fiber.App) {
 	})
 }
 
-// RepositoryResponse represents a repository in API responses
+// RepositoryResponse represents a repository in API responses. The webhook
+// secret and status token themselves are never returned, only whether they are set.
 type RepositoryResponse struct {
-	ID          int64     `json:"id"`
-	URL         string    `json:"url"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	LocalPath   string    `json:"localPath"`
-	LastUpdated time.Time `json:"lastUpdated"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID               int64      `json:"id"`
+	URL              string     `json:"url"`
+	Name             string     `json:"name"`
+	Description      string     `json:"description"`
+	LocalPath        string     `json:"localPath"`
+	PipelinePath     string     `json:"pipelinePath"`
+	WebhookSecretSet bool       `json:"webhookSecretSet"`
+	BranchFilter     []string   `json:"branchFilter"`
+	TagFilter        []string   `json:"tagFilter"`
+	GitProvider      string     `json:"gitProvider"`
+	StatusTokenSet   bool       `json:"statusTokenSet"`
+	PollEnabled      bool       `json:"pollEnabled"`
+	PollInterval     string     `json:"pollInterval"`
+	PollBranches     []string   `json:"pollBranches"`
+	LastPolledAt     *time.Time `json:"lastPolledAt,omitempty"`
+	LastUpdated      time.Time  `json:"lastUpdated"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
 }
 
-// CloneRequest represents the request body for cloning a repository
+// RepositorySettingsRequest represents the request body for updating
+// repository settings. Fields left out of the body are not changed.
+type RepositorySettingsRequest struct {
+	PipelinePath  *string   `json:"pipelinePath"`
+	WebhookSecret *string   `json:"webhookSecret"`
+	BranchFilter  *[]string `json:"branchFilter"`
+	TagFilter     *[]string `json:"tagFilter"`
+	GitProvider   *string   `json:"gitProvider"`
+	StatusToken   *string   `json:"statusToken"`
+	PollEnabled   *bool     `json:"pollEnabled"`
+	// PollInterval is a Go duration such as "2m"; "" restores the default
+	PollInterval *string   `json:"pollInterval"`
+	PollBranches *[]string `json:"pollBranches"`
+}
+
+// CloneRequest represents the request body for cloning a repository.
+// Credential is needed for private repositories.
 type CloneRequest struct {
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	URL         string             `json:"url"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Credential  *CredentialRequest `json:"credential"`
+}
+
+// CredentialRequest represents a Git credential in request bodies. Secret
+// is the PEM private key of an SSH deploy key, or the token or password
+// for HTTPS.
+type CredentialRequest struct {
+	Kind       string `json:"kind"`
+	Username   string `json:"username"`
+	Secret     string `json:"secret"`
+	Passphrase string `json:"passphrase"`
+	KnownHosts string `json:"knownHosts"`
+}
+
+// credential converts the request to a stored credential
+func (r *CredentialRequest) credential() *repository.GitCredential {
+	if r == nil {
+		return nil
+	}
+	return &repository.GitCredential{
+		Kind:       r.Kind,
+		Username:   r.Username,
+		Secret:     r.Secret,
+		Passphrase: r.Passphrase,
+		KnownHosts: r.KnownHosts,
+	}
+}
+
+// CredentialResponse represents a Git credential in API responses. The
+// secret and passphrase are never returned.
+type CredentialResponse struct {
+	Kind       string    `json:"kind"`
+	Username   string    `json:"username"`
+	KnownHosts string    `json:"knownHosts"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
 }
 
 // cloneRepository returns a handler for cloning a Git repository
@@ -137,7 +208,7 @@ func cloneRepository(manager *repository.RepositoryManager) fiber.Handler {
 		}
 
 		// Clone the repository
-		metadata, err := manager.CloneRepository(c.Context(), req.URL, req.Name, req.Description)
+		metadata, err := manager.CloneRepository(c.Context(), req.URL, req.Name, req.Description, req.Credential.credential())
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": "Failed to clone repository: " + err.Error(),
@@ -146,14 +217,24 @@ func cloneRepository(manager *repository.RepositoryManager) fiber.Handler {
 
 		// Convert to response format
 		response := RepositoryResponse{
-			ID:          metadata.ID,
-			URL:         metadata.URL,
-			Name:        metadata.Name,
-			Description: metadata.Description,
-			LocalPath:   metadata.LocalPath,
-			LastUpdated: metadata.LastUpdated,
-			CreatedAt:   metadata.CreatedAt,
-			UpdatedAt:   metadata.UpdatedAt,
+			ID:               metadata.ID,
+			URL:              metadata.URL,
+			Name:             metadata.Name,
+			Description:      metadata.Description,
+			LocalPath:        metadata.LocalPath,
+			PipelinePath:     metadata.PipelinePath,
+			WebhookSecretSet: metadata.WebhookSecret != "",
+			BranchFilter:     metadata.BranchFilter,
+			TagFilter:        metadata.TagFilter,
+			GitProvider:      metadata.GitProvider,
+			StatusTokenSet:   metadata.StatusToken != "",
+			PollEnabled:      metadata.PollEnabled,
+			PollInterval:     metadata.EffectivePollInterval().String(),
+			PollBranches:     metadata.PollBranches,
+			LastPolledAt:     metadata.LastPolledAt,
+			LastUpdated:      metadata.LastUpdated,
+			CreatedAt:        metadata.CreatedAt,
+			UpdatedAt:        metadata.UpdatedAt,
 		}
 
 		return c.JSON(response)
@@ -174,14 +255,24 @@ func listAllRepositories(manager *repository.RepositoryManager) fiber.Handler {
 		var response []RepositoryResponse
 		for _, repo := range repositories {
 			response = append(response, RepositoryResponse{
-				ID:          repo.ID,
-				URL:         repo.URL,
-				Name:        repo.Name,
-				Description: repo.Description,
-				LocalPath:   repo.LocalPath,
-				LastUpdated: repo.LastUpdated,
-				CreatedAt:   repo.CreatedAt,
-				UpdatedAt:   repo.UpdatedAt,
+				ID:               repo.ID,
+				URL:              repo.URL,
+				Name:             repo.Name,
+				Description:      repo.Description,
+				LocalPath:        repo.LocalPath,
+				PipelinePath:     repo.PipelinePath,
+				WebhookSecretSet: repo.WebhookSecret != "",
+				BranchFilter:     repo.BranchFilter,
+				TagFilter:        repo.TagFilter,
+				GitProvider:      repo.GitProvider,
+				StatusTokenSet:   repo.StatusToken != "",
+				PollEnabled:      repo.PollEnabled,
+				PollInterval:     repo.EffectivePollInterval().String(),
+				PollBranches:     repo.PollBranches,
+				LastPolledAt:     repo.LastPolledAt,
+				LastUpdated:      repo.LastUpdated,
+				CreatedAt:        repo.CreatedAt,
+				UpdatedAt:        repo.UpdatedAt,
 			})
 		}
 
@@ -210,14 +301,24 @@ func getRepository(manager *repository.RepositoryManager) fiber.Handler {
 
 		// Convert to response format
 		response := RepositoryResponse{
-			ID:          metadata.ID,
-			URL:         metadata.URL,
-			Name:        metadata.Name,
-			Description: metadata.Description,
-			LocalPath:   metadata.LocalPath,
-			LastUpdated: metadata.LastUpdated,
-			CreatedAt:   metadata.CreatedAt,
-			UpdatedAt:   metadata.UpdatedAt,
+			ID:               metadata.ID,
+			URL:              metadata.URL,
+			Name:             metadata.Name,
+			Description:      metadata.Description,
+			LocalPath:        metadata.LocalPath,
+			PipelinePath:     metadata.PipelinePath,
+			WebhookSecretSet: metadata.WebhookSecret != "",
+			BranchFilter:     metadata.BranchFilter,
+			TagFilter:        metadata.TagFilter,
+			GitProvider:      metadata.GitProvider,
+			StatusTokenSet:   metadata.StatusToken != "",
+			PollEnabled:      metadata.PollEnabled,
+			PollInterval:     metadata.EffectivePollInterval().String(),
+			PollBranches:     metadata.PollBranches,
+			LastPolledAt:     metadata.LastPolledAt,
+			LastUpdated:      metadata.LastUpdated,
+			CreatedAt:        metadata.CreatedAt,
+			UpdatedAt:        metadata.UpdatedAt,
 		}
 
 		return c.JSON(response)
@@ -251,14 +352,24 @@ func updateRepository(manager *repository.RepositoryManager) fiber.Handler {
 
 		// Convert to response format
 		response := RepositoryResponse{
-			ID:          updated.ID,
-			URL:         updated.URL,
-			Name:        updated.Name,
-			Description: updated.Description,
-			LocalPath:   updated.LocalPath,
-			LastUpdated: updated.LastUpdated,
-			CreatedAt:   updated.CreatedAt,
-			UpdatedAt:   updated.UpdatedAt,
+			ID:               updated.ID,
+			URL:              updated.URL,
+			Name:             updated.Name,
+			Description:      updated.Description,
+			LocalPath:        updated.LocalPath,
+			PipelinePath:     updated.PipelinePath,
+			WebhookSecretSet: updated.WebhookSecret != "",
+			BranchFilter:     updated.BranchFilter,
+			TagFilter:        updated.TagFilter,
+			GitProvider:      updated.GitProvider,
+			StatusTokenSet:   updated.StatusToken != "",
+			PollEnabled:      updated.PollEnabled,
+			PollInterval:     updated.EffectivePollInterval().String(),
+			PollBranches:     updated.PollBranches,
+			LastPolledAt:     updated.LastPolledAt,
+			LastUpdated:      updated.LastUpdated,
+			CreatedAt:        updated.CreatedAt,
+			UpdatedAt:        updated.UpdatedAt,
 		}
 
 		return c.JSON(response)
@@ -288,9 +399,29 @@ func deleteRepository(manager *repository.RepositoryManager) fiber.Handler {
 	}
 }
 
-// CheckoutRequest represents the request body for checking out a branch
+// CheckoutRequest represents the request body for checking out a branch,
+// a full reference such as refs/pull/12/head, or a commit
 type CheckoutRequest struct {
 	Branch string `json:"branch"`
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// requestRevision returns the revision named by the branch, ref and commit
+// fields of a request. branch and ref are alternatives, and a commit given
+// with either must be in its history.
+func requestRevision(branch, ref, commit string) (ci.Revision, error) {
+	if branch != "" && ref != "" {
+		return ci.Revision{}, errors.New("branch and ref cannot both be set")
+	}
+	if ref != "" && !strings.HasPrefix(ref, "refs/") {
+		return ci.Revision{}, fmt.Errorf("ref %q is not a full reference name such as refs/pull/12/head", ref)
+	}
+	rev := ci.Revision{Ref: branch + ref, Commit: commit}
+	if err := rev.Validate(); err != nil {
+		return ci.Revision{}, err
+	}
+	return rev, nil
 }
 
 // checkoutBranch returns a handler for checking out a branch in a repository
@@ -310,21 +441,22 @@ func checkoutBranch(manager *repository.RepositoryManager) fiber.Handler {
 			})
 		}
 
-		if req.Branch == "" {
+		rev, err := requestRevision(req.Branch, req.Ref, req.Commit)
+		if err != nil {
 			return c.Status(400).JSON(fiber.Map{
-				"error": "Branch name is required",
+				"error": err.Error(),
 			})
 		}
 
-		err = manager.CheckoutBranch(c.Context(), int64(id), req.Branch)
+		err = manager.CheckoutRevision(c.Context(), int64(id), rev)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
-				"error": "Failed to checkout branch: " + err.Error(),
+				"error": "Failed to checkout " + rev.String() + ": " + err.Error(),
 			})
 		}
 
 		return c.JSON(fiber.Map{
-			"message": "Branch checked out successfully",
+			"message": "Checked out " + rev.String() + " successfully",
 		})
 	}
 }
@@ -382,3 +514,191 @@ func syncRepository(manager *repository.RepositoryManager) fiber.Handler {
 		})
 	}
 }
+
+// updateRepositorySettings returns a handler that updates the settings of a repository
+func updateRepositorySettings(manager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid repository ID",
+			})
+		}
+
+		var req RepositorySettingsRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		if _, err := manager.GetRepositoryByID(c.Context(), int64(id)); err != nil {
+			return c.Status(404).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if req.PipelinePath != nil {
+			path := strings.TrimSpace(*req.PipelinePath)
+			req.PipelinePath = &path
+		}
+		var pollInterval *time.Duration
+		if req.PollInterval != nil {
+			var d time.Duration
+			if s := strings.TrimSpace(*req.PollInterval); s != "" {
+				if d, err = time.ParseDuration(s); err != nil {
+					return c.Status(400).JSON(fiber.Map{
+						"error": "Invalid poll interval: " + err.Error(),
+					})
+				}
+			}
+			pollInterval = &d
+		}
+		updated, err := manager.UpdateSettings(c.Context(), int64(id), repository.RepositorySettings{
+			PipelinePath:  req.PipelinePath,
+			WebhookSecret: req.WebhookSecret,
+			BranchFilter:  req.BranchFilter,
+			TagFilter:     req.TagFilter,
+			GitProvider:   req.GitProvider,
+			StatusToken:   req.StatusToken,
+			PollEnabled:   req.PollEnabled,
+			PollInterval:  pollInterval,
+			PollBranches:  req.PollBranches,
+		})
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to update repository settings: " + err.Error(),
+			})
+		}
+
+		return c.JSON(RepositoryResponse{
+			ID:               updated.ID,
+			URL:              updated.URL,
+			Name:             updated.Name,
+			Description:      updated.Description,
+			LocalPath:        updated.LocalPath,
+			PipelinePath:     updated.PipelinePath,
+			WebhookSecretSet: updated.WebhookSecret != "",
+			BranchFilter:     updated.BranchFilter,
+			TagFilter:        updated.TagFilter,
+			GitProvider:      updated.GitProvider,
+			StatusTokenSet:   updated.StatusToken != "",
+			PollEnabled:      updated.PollEnabled,
+			PollInterval:     updated.EffectivePollInterval().String(),
+			PollBranches:     updated.PollBranches,
+			LastPolledAt:     updated.LastPolledAt,
+			LastUpdated:      updated.LastUpdated,
+			CreatedAt:        updated.CreatedAt,
+			UpdatedAt:        updated.UpdatedAt,
+		})
+	}
+}
+
+// getRepositoryCredential returns a handler for showing the Git credential
+// of a repository without its secret
+func getRepositoryCredential(manager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid repository ID",
+			})
+		}
+
+		credential, err := manager.GetCredential(c.Context(), int64(id))
+		if err != nil {
+			if errors.Is(err, repository.ErrNoCredential) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get Git credential: " + err.Error(),
+			})
+		}
+
+		return c.JSON(CredentialResponse{
+			Kind:       credential.Kind,
+			Username:   credential.Username,
+			KnownHosts: credential.KnownHosts,
+			CreatedAt:  credential.CreatedAt,
+			UpdatedAt:  credential.UpdatedAt,
+		})
+	}
+}
+
+// setRepositoryCredential returns a handler for storing the Git credential
+// used to clone and fetch a repository
+func setRepositoryCredential(manager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid repository ID",
+			})
+		}
+
+		var req CredentialRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		if _, err := manager.GetRepositoryByID(c.Context(), int64(id)); err != nil {
+			return c.Status(404).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err := manager.SetCredential(c.Context(), int64(id), req.credential()); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to set Git credential: " + err.Error(),
+			})
+		}
+
+		credential, err := manager.GetCredential(c.Context(), int64(id))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get Git credential: " + err.Error(),
+			})
+		}
+
+		return c.JSON(CredentialResponse{
+			Kind:       credential.Kind,
+			Username:   credential.Username,
+			KnownHosts: credential.KnownHosts,
+			CreatedAt:  credential.CreatedAt,
+			UpdatedAt:  credential.UpdatedAt,
+		})
+	}
+}
+
+// deleteRepositoryCredential returns a handler for removing the Git
+// credential of a repository
+func deleteRepositoryCredential(manager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid repository ID",
+			})
+		}
+
+		err = manager.DeleteCredential(c.Context(), int64(id))
+		if err != nil {
+			if errors.Is(err, repository.ErrNoCredential) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to delete Git credential: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Git credential deleted",
+		})
+	}
+}
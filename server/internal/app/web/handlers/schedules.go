@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/schedules"
+	"gorm.io/gorm"
+)
+
+// scheduleInterval is how often due schedules are looked for
+const scheduleInterval = 30 * time.Second
+
+// Number of activations returned by the preview endpoints by default and at most
+const (
+	defaultPreviewCount = 5
+	maxPreviewCount     = 100
+)
+
+// setupSchedules registers the schedule endpoints and starts the scheduler
+// that submits runs to queue. It is called by SetupPipelines, which owns
+// the run queue.
+func setupSchedules(app *fiber.App, db *gorm.DB, queue *runs.RunQueue) {
+	schedulesGroup := app.Group("/schedules")
+
+	manager, err := schedules.NewScheduleManager(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize schedule manager: %v", err)
+	}
+	schedules.NewScheduler(manager, queue, scheduleInterval).Start(context.Background())
+
+	// Register routes
+	schedulesGroup.Get("/", listSchedules(manager))
+	schedulesGroup.Post("/", createSchedule(manager))
+	schedulesGroup.Get("/preview", previewSchedule)
+	schedulesGroup.Get("/:id", getSchedule(manager))
+	schedulesGroup.Put("/:id", updateSchedule(manager))
+	schedulesGroup.Delete("/:id", deleteSchedule(manager))
+	schedulesGroup.Get("/:id/next", getScheduleNextRuns(manager))
+}
+
+// ScheduleRequest is the body of schedule create and update requests.
+// Enabled defaults to true.
+type ScheduleRequest struct {
+	Name         string            `json:"name"`
+	URL          string            `json:"url"`
+	Branch       string            `json:"branch"`
+	PipelinePath string            `json:"pipelinePath"`
+	Cron         string            `json:"cron"`
+	Timezone     string            `json:"timezone"`
+	Env          map[string]string `json:"env"`
+	Enabled      *bool             `json:"enabled"`
+}
+
+// schedule builds the schedule described by the request
+func (r *ScheduleRequest) schedule() *schedules.Schedule {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+	return &schedules.Schedule{
+		Name:         r.Name,
+		URL:          r.URL,
+		Branch:       r.Branch,
+		PipelinePath: r.PipelinePath,
+		Cron:         r.Cron,
+		Timezone:     r.Timezone,
+		Env:          r.Env,
+		Enabled:      enabled,
+	}
+}
+
+// previewCount reads the count query parameter of the preview endpoints
+func previewCount(c *fiber.Ctx) int {
+	count := c.QueryInt("count", defaultPreviewCount)
+	if count <= 0 {
+		count = defaultPreviewCount
+	}
+	if count > maxPreviewCount {
+		count = maxPreviewCount
+	}
+	return count
+}
+
+// listSchedules returns a handler for listing schedules
+func listSchedules(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		list, err := manager.ListSchedules(c.Context())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to list schedules: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"schedules": list,
+		})
+	}
+}
+
+// createSchedule returns a handler for creating a schedule
+func createSchedule(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req ScheduleRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		s := req.schedule()
+		if err := manager.CreateSchedule(c.Context(), s); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to create schedule: " + err.Error(),
+			})
+		}
+
+		return c.Status(201).JSON(s)
+	}
+}
+
+// getSchedule returns a handler for getting a schedule by ID
+func getSchedule(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid schedule ID",
+			})
+		}
+
+		s, err := manager.GetSchedule(c.Context(), id)
+		if err != nil {
+			if errors.Is(err, schedules.ErrScheduleNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get schedule: " + err.Error(),
+			})
+		}
+
+		return c.JSON(s)
+	}
+}
+
+// updateSchedule returns a handler for replacing the definition of a schedule
+func updateSchedule(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid schedule ID",
+			})
+		}
+
+		var req ScheduleRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		s := req.schedule()
+		s.ID = id
+		if err := manager.UpdateSchedule(c.Context(), s); err != nil {
+			if errors.Is(err, schedules.ErrScheduleNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to update schedule: " + err.Error(),
+			})
+		}
+
+		updated, err := manager.GetSchedule(c.Context(), id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get schedule: " + err.Error(),
+			})
+		}
+		return c.JSON(updated)
+	}
+}
+
+// deleteSchedule returns a handler for deleting a schedule
+func deleteSchedule(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid schedule ID",
+			})
+		}
+
+		if err := manager.DeleteSchedule(c.Context(), id); err != nil {
+			if errors.Is(err, schedules.ErrScheduleNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to delete schedule: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Schedule deleted",
+		})
+	}
+}
+
+// getScheduleNextRuns returns a handler for previewing the next runs of a schedule
+func getScheduleNextRuns(manager *schedules.ScheduleManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid schedule ID",
+			})
+		}
+
+		s, err := manager.GetSchedule(c.Context(), id)
+		if err != nil {
+			if errors.Is(err, schedules.ErrScheduleNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get schedule: " + err.Error(),
+			})
+		}
+
+		next, err := s.NextRuns(time.Now(), previewCount(c))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to compute next runs: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"cron":     s.Cron,
+			"timezone": s.Timezone,
+			"enabled":  s.Enabled,
+			"nextRuns": next,
+		})
+	}
+}
+
+// previewSchedule lists the next activations of the cron and timezone
+// query parameters, to check an expression before saving it
+func previewSchedule(c *fiber.Ctx) error {
+	s := &schedules.Schedule{
+		Cron:     c.Query("cron"),
+		Timezone: c.Query("timezone"),
+	}
+	if s.Cron == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "cron is required",
+		})
+	}
+
+	next, err := s.NextRuns(time.Now(), previewCount(c))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"cron":     s.Cron,
+		"timezone": s.Timezone,
+		"nextRuns": next,
+	})
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/config"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/templates"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// SetupTemplates registers the pipeline template endpoints
+func SetupTemplates(app *fiber.App) {
+	templatesGroup := app.Group("/templates")
+
+	// Open database connection
+	db, err := gorm.Open(postgres.Open(config.PostgresConnectionString), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	manager, err := templates.NewTemplateManager(db)
+	if err != nil {
+		log.Fatalf("Failed to initialize template manager: %v", err)
+	}
+
+	// Register routes
+	templatesGroup.Get("/", listTemplates(manager))
+	templatesGroup.Post("/", createTemplate(manager))
+	templatesGroup.Get("/:name", getTemplate(manager))
+	templatesGroup.Put("/:name", updateTemplate(manager))
+	templatesGroup.Delete("/:name", deleteTemplate(manager))
+}
+
+// TemplateRequest is the body of template create and update requests
+type TemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Content     string `json:"content"`
+}
+
+// listTemplates returns a handler for listing pipeline templates
+func listTemplates(manager *templates.TemplateManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		list, err := manager.ListTemplates(c.Context())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to list templates: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"templates": list,
+		})
+	}
+}
+
+// createTemplate returns a handler for creating a pipeline template
+func createTemplate(manager *templates.TemplateManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req TemplateRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		t := &templates.PipelineTemplate{
+			Name:        strings.TrimSpace(req.Name),
+			Description: req.Description,
+			Content:     req.Content,
+		}
+		if err := manager.CreateTemplate(c.Context(), t); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to create template: " + err.Error(),
+			})
+		}
+
+		return c.Status(201).JSON(t)
+	}
+}
+
+// getTemplate returns a handler for getting a pipeline template by name
+func getTemplate(manager *templates.TemplateManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		t, err := manager.GetTemplate(c.Context(), c.Params("name"))
+		if err != nil {
+			if errors.Is(err, templates.ErrTemplateNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to get template: " + err.Error(),
+			})
+		}
+
+		return c.JSON(t)
+	}
+}
+
+// updateTemplate returns a handler for replacing the content of a pipeline template
+func updateTemplate(manager *templates.TemplateManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req TemplateRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid request body: " + err.Error(),
+			})
+		}
+
+		t := &templates.PipelineTemplate{
+			Name:        c.Params("name"),
+			Description: req.Description,
+			Content:     req.Content,
+		}
+		if err := manager.UpdateTemplate(c.Context(), t); err != nil {
+			if errors.Is(err, templates.ErrTemplateNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Failed to update template: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Template updated",
+		})
+	}
+}
+
+// deleteTemplate returns a handler for deleting a pipeline template
+func deleteTemplate(manager *templates.TemplateManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := manager.DeleteTemplate(c.Context(), c.Params("name")); err != nil {
+			if errors.Is(err, templates.ErrTemplateNotFound) {
+				return c.Status(404).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to delete template: " + err.Error(),
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"message": "Template deleted",
+		})
+	}
+}
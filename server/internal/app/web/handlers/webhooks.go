@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/webhooks"
+)
+
+// setupWebhooks registers the webhook endpoints that queue runs on queue.
+// It is called by SetupPipelines, which owns the run queue.
+func setupWebhooks(app *fiber.App, queue *runs.RunQueue, repoManager *repository.RepositoryManager) {
+	webhooksGroup := app.Group("/webhooks")
+
+	webhooksGroup.Post("/github", receiveWebhook(webhooks.GitHub, queue, repoManager))
+	webhooksGroup.Post("/gitlab", receiveWebhook(webhooks.GitLab, queue, repoManager))
+	webhooksGroup.Post("/gitea", receiveWebhook(webhooks.Gitea, queue, repoManager))
+}
+
+// receiveWebhook returns a handler that verifies a webhook from provider
+// and queues a pipeline run for the pushed commit of the matching repository
+func receiveWebhook(provider string, queue *runs.RunQueue, repoManager *repository.RepositoryManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		body := c.Body()
+		header := func(key string) string { return c.Get(key) }
+
+		event, err := webhooks.Parse(provider, header, body)
+		if errors.Is(err, webhooks.ErrIgnoredEvent) {
+			return c.JSON(fiber.Map{
+				"status": "ignored",
+				"reason": err.Error(),
+			})
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid webhook payload: " + err.Error(),
+			})
+		}
+
+		repo, err := findWebhookRepository(c.Context(), repoManager, event.RepositoryURLs)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to list repositories: " + err.Error(),
+			})
+		}
+		if repo == nil {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "No repository registered for this webhook",
+			})
+		}
+		if repo.WebhookSecret == "" {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "Webhooks are not enabled for this repository",
+			})
+		}
+		if err := webhooks.Verify(provider, header, body, repo.WebhookSecret); err != nil {
+			return c.Status(401).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		req, reason := webhookRunRequest(repo, event)
+		if reason != "" {
+			return c.JSON(fiber.Map{
+				"status": "ignored",
+				"reason": reason,
+			})
+		}
+
+		log.Printf("Received %s %s webhook for %s: Branch=%s, Commit=%s", provider, event.Kind, repo.URL, req.Branch, event.Commit)
+
+		run, err := queue.Submit(c.Context(), req)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to queue pipeline run: " + err.Error(),
+			})
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"id":     run.ID,
+			"status": run.Status,
+		})
+	}
+}
+
+// webhookRunRequest returns the run to queue for event on repo, or the
+// reason the event is ignored. Pushes and pull requests build the pushed
+// commit itself, even when the branch moves on before the run starts.
+// Pushes pass the files their commits changed on to step conditions.
+func webhookRunRequest(repo *repository.RepositoryMetadata, event *webhooks.Event) (runs.RunRequest, string) {
+	req := runs.RunRequest{
+		URL:          repo.URL,
+		Commit:       event.Commit,
+		PipelinePath: repo.PipelinePath,
+	}
+	var reason string
+	switch event.Kind {
+	case webhooks.EventPush:
+		req.Branch = event.Branch
+		req.Pinned = true
+		req.Trigger = runs.TriggerPush
+		req.ChangedFiles = event.ChangedFiles
+		if !webhooks.MatchFilter(repo.BranchFilter, event.Branch) {
+			reason = fmt.Sprintf("branch %q does not match the branch filter", event.Branch)
+		}
+	case webhooks.EventTag:
+		req.Branch = "refs/tags/" + event.Tag
+		req.Trigger = runs.TriggerTag
+		if !webhooks.MatchFilter(repo.TagFilter, event.Tag) {
+			reason = fmt.Sprintf("tag %q does not match the tag filter", event.Tag)
+		}
+	case webhooks.EventPullRequest:
+		req.Branch = event.Branch
+		req.Pinned = true
+		req.Trigger = runs.TriggerPullRequest
+		req.PullRequest = event.PullRequest
+		switch {
+		case event.Fork:
+			reason = "pull requests from forks are not built"
+		case !webhooks.MatchFilter(repo.BranchFilter, event.TargetBranch):
+			reason = fmt.Sprintf("target branch %q does not match the branch filter", event.TargetBranch)
+		}
+	}
+	return req, reason
+}
+
+// findWebhookRepository returns the registered repository with one of urls, or nil
+func findWebhookRepository(ctx context.Context, repoManager *repository.RepositoryManager, urls []string) (*repository.RepositoryMetadata, error) {
+	repositories, err := repoManager.ListRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range repositories {
+		for _, url := range urls {
+			if webhooks.SameRepository(repositories[i].URL, url) {
+				return &repositories[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
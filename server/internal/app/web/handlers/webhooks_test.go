@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/webhooks"
+)
+
+const webhookCommit = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// revisionOf returns the revision the run queued for req builds
+func revisionOf(req runs.RunRequest) ci.Revision {
+	run := &runs.PipelineRun{Branch: req.Branch, Commit: req.Commit, Pinned: req.Pinned}
+	return run.Revision()
+}
+
+func TestWebhookRunRequest(t *testing.T) {
+	repo := &repository.RepositoryMetadata{
+		URL:          "https://github.com/acme/shop.git",
+		PipelinePath: ".ci/pipeline.yaml",
+		BranchFilter: []string{"main", "release/*"},
+	}
+
+	// Pushes build the pushed commit rather than the head of the branch
+	req, reason := webhookRunRequest(repo, &webhooks.Event{Kind: webhooks.EventPush, Branch: "main", Commit: webhookCommit, ChangedFiles: []string{"go.mod"}})
+	assert.Empty(t, reason)
+	assert.Equal(t, runs.TriggerPush, req.Trigger)
+	assert.Equal(t, []string{"go.mod"}, req.ChangedFiles)
+	assert.Equal(t, ".ci/pipeline.yaml", req.PipelinePath)
+	assert.Equal(t, ci.Revision{Ref: "main", Commit: webhookCommit}, revisionOf(req))
+
+	req, reason = webhookRunRequest(repo, &webhooks.Event{
+		Kind:         webhooks.EventPullRequest,
+		Branch:       "feature",
+		TargetBranch: "release/1.0",
+		Commit:       webhookCommit,
+		PullRequest:  12,
+	})
+	assert.Empty(t, reason)
+	assert.Equal(t, runs.TriggerPullRequest, req.Trigger)
+	assert.Equal(t, 12, req.PullRequest)
+	assert.Equal(t, ci.Revision{Ref: "feature", Commit: webhookCommit}, revisionOf(req))
+
+	req, reason = webhookRunRequest(repo, &webhooks.Event{Kind: webhooks.EventTag, Tag: "v1.0", Commit: webhookCommit})
+	assert.Empty(t, reason)
+	assert.Equal(t, runs.TriggerTag, req.Trigger)
+	assert.Equal(t, ci.Revision{Ref: "refs/tags/v1.0"}, revisionOf(req))
+
+	_, reason = webhookRunRequest(repo, &webhooks.Event{Kind: webhooks.EventPush, Branch: "feature", Commit: webhookCommit})
+	assert.Equal(t, `branch "feature" does not match the branch filter`, reason)
+	_, reason = webhookRunRequest(repo, &webhooks.Event{Kind: webhooks.EventPullRequest, Branch: "feature", TargetBranch: "main", Fork: true})
+	assert.Equal(t, "pull requests from forks are not built", reason)
+}
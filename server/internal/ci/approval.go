@@ -0,0 +1,115 @@
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StepTypeApproval marks a step that runs no commands and instead waits
+// for someone to approve or reject it. Its timeout bounds the wait.
+const StepTypeApproval = "approval"
+
+// ErrWaitingForApproval is returned by Run when the pipeline stopped at
+// approval steps. The run continues with SetResume once they are decided.
+var ErrWaitingForApproval = errors.New("waiting for approval")
+
+// Approval is the decision taken on an approval step
+type Approval struct {
+	Approved  bool      `json:"approved"`
+	By        string    `json:"by"`
+	Comment   string    `json:"comment,omitempty"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// SetResume makes Run continue a run that stopped to wait for approval.
+// The steps that finished in previous are not run again, and the approval
+// steps found in approvals, by step name, pass or fail with the decision.
+func (e *Executor) SetResume(previous *RunResult, approvals map[string]Approval) {
+	e.previous = previous
+	e.approvals = approvals
+}
+
+// restore copies the outcome of the step at index i from the run being
+// resumed, and reports whether the step had finished there
+func (e *Executor) restore(i int, step Step, result *stepResult) bool {
+	if e.previous == nil {
+		return false
+	}
+	var prev *StepResult
+	for j := range e.previous.Steps {
+		if e.previous.Steps[j].Name == step.Name {
+			prev = &e.previous.Steps[j]
+			break
+		}
+	}
+	if prev == nil {
+		return false
+	}
+	switch prev.Status {
+	case StepPending, StepRunning, StepWaiting:
+		return false
+	}
+
+	result.status = prev.Status
+	if prev.StartedAt != nil && prev.FinishedAt != nil {
+		result.startedAt, result.finishedAt = *prev.StartedAt, *prev.FinishedAt
+	}
+	result.output.WriteString(prev.Output)
+	result.attempts = prev.Attempts
+	result.commands = prev.Commands
+	result.approval = prev.Approval
+	if prev.Artifact != nil {
+		artifact := *prev.Artifact
+		artifact.Key = e.artifactKey(i, step)
+		result.artifact = &artifact
+	}
+	if prev.Error != "" {
+		result.err = &restoredError{message: prev.Error, code: prev.ExitCode}
+	}
+	return true
+}
+
+// decide applies the decision taken on an approval step, and reports
+// false when the step is still waiting for one
+func (e *Executor) decide(step Step, result *stepResult) bool {
+	result.startedAt = time.Now()
+	if e.previous != nil {
+		// Keep when the wait started
+		for _, prev := range e.previous.Steps {
+			if prev.Name == step.Name && prev.StartedAt != nil {
+				result.startedAt = *prev.StartedAt
+			}
+		}
+	}
+
+	approval, ok := e.approvals[step.Name]
+	if !ok {
+		result.status = StepWaiting
+		return false
+	}
+
+	result.approval = &approval
+	result.finishedAt = approval.DecidedAt
+	verdict := "Approved"
+	if !approval.Approved {
+		verdict = "Rejected"
+		result.err = fmt.Errorf("step %q was rejected by %s", step.Name, approval.By)
+	}
+	fmt.Fprintf(&result.output, "%s by %s at %s\n", verdict, approval.By, approval.DecidedAt.Format(time.RFC3339))
+	if approval.Comment != "" {
+		fmt.Fprintf(&result.output, "%s\n", approval.Comment)
+	}
+	return true
+}
+
+// restoredError is the error of a step restored from the run being
+// resumed, keeping its message and exit code
+type restoredError struct {
+	message string
+	code    int
+}
+
+func (e *restoredError) Error() string {
+	return e.message
+}
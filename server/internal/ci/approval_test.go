@@ -0,0 +1,113 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func approvalPipeline() *Pipeline {
+	return &Pipeline{
+		Name: "Release",
+		Steps: []Step{
+			{Name: "Build", Commands: []string{"build"}},
+			{Name: "Sign-off", Type: StepTypeApproval, Needs: []string{"Build"}},
+			{Name: "Scan", Commands: []string{"scan"}, Needs: []string{"Build"}},
+			{Name: "Promote", Commands: []string{"promote"}, Needs: []string{"Sign-off", "Scan"}},
+		},
+	}
+}
+
+func TestRunWaitsForApprovalAndResumes(t *testing.T) {
+	ws := newFakeWorkspace()
+	paused, err := NewExecutor(ws).Run(context.Background(), approvalPipeline())
+	assert.ErrorIs(t, err, ErrWaitingForApproval)
+	assert.ErrorContains(t, err, "Sign-off")
+	assert.Equal(t, StepWaiting, paused.Status)
+	assert.Empty(t, paused.Error)
+	assert.Equal(t, []string{"build", "scan"}, ws.calls)
+
+	statuses := func(result *RunResult) []StepStatus {
+		var list []StepStatus
+		for _, step := range result.Steps {
+			list = append(list, step.Status)
+		}
+		return list
+	}
+	assert.Equal(t, []StepStatus{StepSuccess, StepWaiting, StepSuccess, StepPending}, statuses(paused))
+	assert.NotNil(t, paused.Steps[1].StartedAt)
+	assert.Nil(t, paused.Steps[1].FinishedAt)
+
+	// An unrelated resume keeps waiting without running anything again
+	ws = newFakeWorkspace()
+	executor := NewExecutor(ws)
+	executor.SetResume(paused, nil)
+	again, err := executor.Run(context.Background(), approvalPipeline())
+	assert.ErrorIs(t, err, ErrWaitingForApproval)
+	assert.Empty(t, ws.calls)
+	assert.Equal(t, *paused.Steps[1].StartedAt, *again.Steps[1].StartedAt)
+
+	decidedAt := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	executor = NewExecutor(ws)
+	executor.SetResume(again, map[string]Approval{
+		"Sign-off": {Approved: true, By: "alice", Comment: "Ship it", DecidedAt: decidedAt},
+	})
+	result, err := executor.Run(context.Background(), approvalPipeline())
+	assert.Nil(t, err)
+	assert.Equal(t, StepSuccess, result.Status)
+	assert.Equal(t, paused.StartedAt, result.StartedAt)
+	assert.Equal(t, []string{"promote"}, ws.calls)
+	assert.Equal(t, []StepStatus{StepSuccess, StepSuccess, StepSuccess, StepSuccess}, statuses(result))
+	assert.Equal(t, "alice", result.Steps[1].Approval.By)
+	assert.Equal(t, decidedAt, *result.Steps[1].FinishedAt)
+	assert.Contains(t, result.Steps[1].Output, "Approved by alice at 2024-05-01T09:30:00Z\nShip it\n")
+	assert.Equal(t, paused.Steps[0].Output, result.Steps[0].Output)
+}
+
+func TestRunRejectedApprovalFailsRun(t *testing.T) {
+	paused, err := NewExecutor(newFakeWorkspace()).Run(context.Background(), approvalPipeline())
+	assert.ErrorIs(t, err, ErrWaitingForApproval)
+
+	ws := newFakeWorkspace()
+	executor := NewExecutor(ws)
+	executor.SetResume(paused, map[string]Approval{
+		"Sign-off": {Approved: false, By: "bob", DecidedAt: time.Now()},
+	})
+	result, err := executor.Run(context.Background(), approvalPipeline())
+	assert.ErrorContains(t, err, `step "Sign-off" was rejected by bob`)
+	assert.Equal(t, StepFailed, result.Status)
+	assert.Equal(t, StepFailed, result.Steps[1].Status)
+	assert.Equal(t, StepSkipped, result.Steps[3].Status)
+	assert.Empty(t, ws.calls)
+}
+
+func TestRunFailureWhileWaitingSkipsApproval(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["scan"] = func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("exit status 1")
+	}
+
+	result, err := NewExecutor(ws).Run(context.Background(), approvalPipeline())
+	assert.ErrorContains(t, err, "exit status 1")
+	assert.False(t, errors.Is(err, ErrWaitingForApproval))
+	assert.Equal(t, StepFailed, result.Status)
+	assert.Equal(t, StepSkipped, result.Steps[1].Status)
+	assert.Equal(t, StepSkipped, result.Steps[3].Status)
+}
+
+func TestRestoredStepKeepsExitCode(t *testing.T) {
+	previous := &RunResult{Steps: []StepResult{
+		{Name: "Lint", Status: StepFailed, ExitCode: 3, Error: "exit status 3"},
+	}}
+	executor := NewExecutor(newFakeWorkspace())
+	executor.SetResume(previous, nil)
+	result, err := executor.Run(context.Background(), &Pipeline{Steps: []Step{
+		{Name: "Lint", ContinueOnError: true, Commands: []string{"lint"}},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.Steps[0].ExitCode)
+	assert.Equal(t, "exit status 3", result.Steps[0].Error)
+}
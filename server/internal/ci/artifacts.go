@@ -0,0 +1,130 @@
+package ci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+)
+
+// DefaultArtifactExpiry is how long artifacts are kept when a step sets no expire_in
+const DefaultArtifactExpiry = 30 * 24 * time.Hour
+
+// ArtifactReport describes the archive stored for the artifacts of a step
+type ArtifactReport struct {
+	Key      string    `json:"-"`
+	Size     int64     `json:"size"`
+	Files    []string  `json:"files"`
+	ExpireAt time.Time `json:"expireAt"`
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// artifactKey names the archive of the step at index i
+func (e *Executor) artifactKey(i int, step Step) string {
+	name := strings.Trim(unsafeKeyChars.ReplaceAllString(step.Name, "-"), "-")
+	return fmt.Sprintf("%s/%d-%s.tar.gz", e.artifactPrefix, i+1, name)
+}
+
+// wantsArtifacts reports whether a step that ended with err should upload artifacts
+func wantsArtifacts(step Step, err error) bool {
+	if step.Artifacts == nil || len(step.Artifacts.Paths) == 0 {
+		return false
+	}
+	switch step.Artifacts.When {
+	case WhenAlways:
+		return true
+	case WhenOnFailure:
+		return err != nil
+	default:
+		return err == nil
+	}
+}
+
+// saveArtifacts archives the files matching the step's artifact paths into
+// the artifact store. It returns nil when no file matched.
+func (e *Executor) saveArtifacts(ctx context.Context, key string, step Step) (*ArtifactReport, error) {
+	root := e.ws.Dir()
+	files, err := matchWorkspaceFiles(root, step.Artifacts.Paths)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(artifacts.Archive(pw, root, files))
+	}()
+	size, err := e.artifactStore.Put(ctx, key, pr)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload artifacts: %w", err)
+	}
+
+	expireIn := step.Artifacts.ExpireIn
+	if expireIn <= 0 {
+		expireIn = DefaultArtifactExpiry
+	}
+	return &ArtifactReport{
+		Key:      key,
+		Size:     size,
+		Files:    files,
+		ExpireAt: time.Now().Add(expireIn),
+	}, nil
+}
+
+// restoreArtifacts extracts an artifact archive into the workspace
+func (e *Executor) restoreArtifacts(ctx context.Context, report *ArtifactReport) (int, error) {
+	r, err := e.artifactStore.Open(ctx, report.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files, err := artifacts.Extract(r, e.ws.Dir())
+	return len(files), err
+}
+
+// matchWorkspaceFiles returns the regular files and links below root, as
+// slash-separated relative paths, that match one of patterns
+func matchWorkspaceFiles(root string, patterns []string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		for _, pattern := range patterns {
+			pattern = strings.TrimPrefix(pattern, "./")
+			if MatchGlob(pattern, rel) || MatchGlob(strings.TrimSuffix(pattern, "/")+"/**", rel) {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect files: %w", err)
+	}
+	return files, nil
+}
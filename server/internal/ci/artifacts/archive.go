@@ -0,0 +1,205 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Archive writes the given files, relative to root, to w as a gzipped tarball
+func Archive(w io.Writer, root string, files []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range files {
+		if err := addFile(tw, root, name); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return gz.Close()
+}
+
+func addFile(tw *tar.Writer, root, name string) error {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	var link string
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(path); err != nil {
+			return fmt.Errorf("failed to read link %s: %w", name, err)
+		}
+	case !info.Mode().IsRegular():
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", name, err)
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", name, err)
+	}
+	if link != "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", name, err)
+	}
+	return nil
+}
+
+// maxLinks bounds the symbolic links followed while resolving one path
+const maxLinks = 255
+
+// errOutside is returned by resolve for paths that lead outside their root
+var errOutside = errors.New("leads outside the workspace")
+
+// Extract unpacks a tarball written by Archive into root, overwriting
+// existing files, and returns the names of the extracted files. Symbolic
+// links are only restored when they point inside root, and entries are
+// only written when the directories holding them, links included, resolve
+// inside root.
+func Extract(r io.Reader, root string) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+
+	var files []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return files, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+
+		clean := filepath.Clean(filepath.FromSlash(header.Name))
+		if escapes(clean) {
+			return files, fmt.Errorf("archive entry %q escapes the workspace", header.Name)
+		}
+		dir, err := resolve(root, filepath.Dir(clean))
+		if errors.Is(err, errOutside) {
+			return files, fmt.Errorf("archive entry %q escapes the workspace", header.Name)
+		}
+		if err != nil {
+			return files, fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return files, fmt.Errorf("failed to create directory for %s: %w", header.Name, err)
+		}
+		dest := filepath.Join(root, dir, filepath.Base(clean))
+
+		if header.Typeflag == tar.TypeSymlink {
+			target := filepath.FromSlash(header.Linkname)
+			if filepath.IsAbs(target) {
+				return files, fmt.Errorf("archive link %q points outside the workspace", header.Name)
+			}
+			if _, err := resolve(root, dir+string(filepath.Separator)+target); err != nil {
+				return files, fmt.Errorf("archive link %q points outside the workspace", header.Name)
+			}
+			os.Remove(dest)
+			if err := os.Symlink(target, dest); err != nil {
+				return files, fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+		} else if err := writeFile(dest, tr, os.FileMode(header.Mode).Perm()); err != nil {
+			return files, fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+		files = append(files, header.Name)
+	}
+}
+
+// escapes reports whether a cleaned relative path leaves its root
+func escapes(clean string) bool {
+	return filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// resolve follows name, relative to root, one element at a time the way
+// the kernel would, symbolic links included, and returns the path it leads
+// to relative to root. Elements that do not exist yet are kept as they are.
+// Paths leading outside root fail with errOutside, even when they come back.
+func resolve(root, name string) (string, error) {
+	current := ""
+	pending := strings.Split(filepath.ToSlash(name), "/")
+	links := 0
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if current == "" {
+				return "", errOutside
+			}
+			if current = filepath.Dir(current); current == "." {
+				current = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(current, elem)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("too many links in %s", name)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			return "", errOutside
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+	return current, nil
+}
+
+func writeFile(dest string, r io.Reader, mode os.FileMode) error {
+	// Replace a link rather than writing through it
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.Remove(dest)
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package artifacts
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveRoundTripThroughLocalStore(t *testing.T) {
+	src := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "reports"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "reports", "junit.xml"), []byte("<testsuite/>"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "app"), []byte("binary"), 0755))
+
+	var buf bytes.Buffer
+	assert.Nil(t, Archive(&buf, src, []string{"reports/junit.xml", "app"}))
+
+	store, err := NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+	ctx := context.Background()
+	size, err := store.Put(ctx, "runs/1/build.tar.gz", &buf)
+	assert.Nil(t, err)
+	assert.Greater(t, size, int64(0))
+
+	r, err := store.Open(ctx, "runs/1/build.tar.gz")
+	assert.Nil(t, err)
+	dest := t.TempDir()
+	files, err := Extract(r, dest)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"reports/junit.xml", "app"}, files)
+
+	data, err := os.ReadFile(filepath.Join(dest, "reports", "junit.xml"))
+	assert.Nil(t, err)
+	assert.Equal(t, "<testsuite/>", string(data))
+
+	assert.Nil(t, store.Delete(ctx, "runs/1/build.tar.gz"))
+	_, err = store.Open(ctx, "runs/1/build.tar.gz")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.Put(ctx, "../escape", &buf)
+	assert.NotNil(t, err)
+}
+
+// tarball returns a gzipped tarball of entries, a link when target is set
+func tarball(t *testing.T, entries ...[2]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry[0], Mode: 0644, Typeflag: tar.TypeReg}
+		if entry[1] != "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry[1]
+		}
+		assert.Nil(t, tw.WriteHeader(header))
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	return &buf
+}
+
+func TestExtractRejectsLinksLeavingRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "workspace")
+	assert.Nil(t, os.MkdirAll(root, 0755))
+
+	// d2 cleans to the root but resolves to its parent
+	files, err := Extract(tarball(t, [2]string{"d", "."}, [2]string{"d2", "d/.."}, [2]string{"d2/x", ""}), root)
+	assert.ErrorContains(t, err, "outside the workspace")
+	assert.Equal(t, []string{"d"}, files)
+	assert.NoFileExists(t, filepath.Join(parent, "x"))
+
+	// Links left in the workspace by a step are not written through
+	outside := t.TempDir()
+	assert.Nil(t, os.Symlink(outside, filepath.Join(root, "out")))
+	assert.Nil(t, os.Symlink("d/../..", filepath.Join(root, "up")))
+	_, err = Extract(tarball(t, [2]string{"out/x", ""}), root)
+	assert.ErrorContains(t, err, `archive entry "out/x" escapes the workspace`)
+	_, err = Extract(tarball(t, [2]string{"up/x", ""}), root)
+	assert.ErrorContains(t, err, `archive entry "up/x" escapes the workspace`)
+	assert.NoFileExists(t, filepath.Join(outside, "x"))
+	assert.NoFileExists(t, filepath.Join(parent, "x"))
+
+	// Links staying inside the root are followed
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "dist"), 0755))
+	files, err = Extract(tarball(t, [2]string{"latest", "d/dist"}, [2]string{"latest/app", ""}), root)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"latest", "latest/app"}, files)
+	assert.FileExists(t, filepath.Join(root, "dist", "app"))
+}
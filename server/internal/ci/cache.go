@@ -0,0 +1,114 @@
+package ci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/cache"
+)
+
+// restoreCache restores the step's cache entry into the workspace. It returns
+// the rendered key, or "" when the step has no cache, and whether it was found.
+// A missing or broken entry is only noted, since the step can run without it.
+func (e *Executor) restoreCache(ctx context.Context, step Step, note func(format string, args ...interface{})) (string, bool, error) {
+	if e.stepCache == nil || step.Cache == nil || step.Cache.Key == "" {
+		return "", false, nil
+	}
+	key, err := e.renderCacheKey(step.Cache.Key)
+	if err != nil {
+		return "", false, err
+	}
+
+	err = e.stepCache.Restore(ctx, e.scopedCacheKey(key), e.ws.Dir())
+	switch {
+	case err == nil:
+		note("Restored cache %s\n", key)
+		return key, true, nil
+	case errors.Is(err, cache.ErrNotFound):
+		note("No cache found for key %s\n", key)
+	default:
+		note("Ignoring cache %s: %v\n", key, err)
+	}
+	return key, false, nil
+}
+
+// saveCache stores the step's cache paths under key. Failures are noted
+// but do not fail the step.
+func (e *Executor) saveCache(ctx context.Context, step Step, key string, note func(format string, args ...interface{})) {
+	files, err := matchWorkspaceFiles(e.ws.Dir(), step.Cache.Paths)
+	if err != nil {
+		note("Failed to save cache %s: %v\n", key, err)
+		return
+	}
+	if len(files) == 0 {
+		note("No files matched the cache paths\n")
+		return
+	}
+	entry, err := e.stepCache.Save(ctx, e.scopedCacheKey(key), e.ws.Dir(), files)
+	if err != nil {
+		note("Failed to save cache %s: %v\n", key, err)
+		return
+	}
+	note("Saved cache %s (%d bytes)\n", key, entry.Size)
+}
+
+// renderCacheKey expands a cache key template against the workspace
+func (e *Executor) renderCacheKey(key string) (string, error) {
+	tmpl, err := template.New("key").Funcs(template.FuncMap{
+		"hashFiles": func(patterns ...string) (string, error) {
+			return hashFiles(e.ws.Dir(), patterns)
+		},
+		"branch": e.ws.Branch,
+	}).Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid cache key %q: %w", key, err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", fmt.Errorf("invalid cache key %q: %w", key, err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// scopedCacheKey prefixes a rendered cache key with a hash of the
+// repository the cache is scoped to
+func (e *Executor) scopedCacheKey(key string) string {
+	sum := sha256.Sum256([]byte(e.cacheScope))
+	return hex.EncodeToString(sum[:8]) + "/" + key
+}
+
+// hashFiles returns a SHA-256 over the names and contents of the workspace
+// files matching patterns, or an empty string when nothing matches
+func hashFiles(root string, patterns []string) (string, error) {
+	files, err := matchWorkspaceFiles(root, patterns)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	h := sha256.New()
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+		io.WriteString(h, name+"\x00")
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
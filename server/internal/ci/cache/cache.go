@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+)
+
+// ErrNotFound is returned when a cache key has no entry
+var ErrNotFound = errors.New("cache entry not found")
+
+// indexFile is the name of the file listing the entries of a Cache
+const indexFile = "index.json"
+
+// Entry describes a cached archive
+type Entry struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// Cache keeps archives of dependency and build directories on local disk,
+// keyed by arbitrary strings. Once the total size exceeds the limit, the
+// least recently used entries are evicted.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewCache creates a new Cache in dir holding at most maxSize bytes
+func NewCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*Entry),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read cache index: %w", err)
+	}
+	if err == nil {
+		var entries []*Entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse cache index: %w", err)
+		}
+		for _, entry := range entries {
+			c.entries[entry.Key] = entry
+		}
+	}
+	return c, nil
+}
+
+// path returns the archive file of key
+func (c *Cache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".tar.gz")
+}
+
+// Has reports whether key has an entry
+func (c *Cache) Has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// Restore extracts the entry for key into root
+func (c *Cache) Restore(ctx context.Context, key, root string) error {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return ErrNotFound
+	}
+	// Open while holding the lock so that a concurrent eviction can only
+	// unlink the file, which stays readable until it is closed
+	f, err := os.Open(c.path(key))
+	if err == nil {
+		entry.LastUsedAt = time.Now()
+		// Losing a usage time only affects eviction order, so a failed
+		// write is not worth failing the restore over
+		c.writeIndex()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to open cache entry: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := artifacts.Extract(f, root); err != nil {
+		return fmt.Errorf("failed to restore cache: %w", err)
+	}
+	return nil
+}
+
+// Save archives files, relative to root, under key and evicts old entries
+// if the cache grew past its size limit
+func (c *Cache) Save(ctx context.Context, key, root string, files []string) (*Entry, error) {
+	tmp, err := os.CreateTemp(c.dir, ".save-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = artifacts.Archive(tmp, root, files)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive cache: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat cache file: %w", err)
+	}
+	if c.maxSize > 0 && info.Size() > c.maxSize {
+		return nil, fmt.Errorf("cache archive of %d bytes exceeds the %d byte limit", info.Size(), c.maxSize)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return nil, fmt.Errorf("failed to store cache entry: %w", err)
+	}
+	now := time.Now()
+	entry := &Entry{Key: key, Size: info.Size(), CreatedAt: now, LastUsedAt: now}
+	c.entries[key] = entry
+	c.evict()
+	return entry, c.writeIndex()
+}
+
+// evict removes least recently used entries until the cache fits its size limit
+func (c *Cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	var total int64
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		total += entry.Size
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsedAt.Before(entries[j].LastUsedAt)
+	})
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			return
+		}
+		os.Remove(c.path(entry.Key))
+		delete(c.entries, entry.Key)
+		total -= entry.Size
+	}
+}
+
+// List returns all entries, most recently used first
+func (c *Cache) List() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastUsedAt.After(list[j].LastUsedAt)
+	})
+	return list
+}
+
+// Purge removes the entry for key
+func (c *Cache) Purge(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		return ErrNotFound
+	}
+	if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete cache entry: %w", err)
+	}
+	delete(c.entries, key)
+	return c.writeIndex()
+}
+
+// PurgeAll removes every entry and returns how many there were
+func (c *Cache) PurgeAll() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	for key := range c.entries {
+		if err := os.Remove(c.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("failed to delete cache entry: %w", err)
+		}
+		delete(c.entries, key)
+	}
+	return n, c.writeIndex()
+}
+
+// writeIndex persists the entry list; the caller must hold c.mu
+func (c *Cache) writeIndex() error {
+	entries := make([]*Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache index: %w", err)
+	}
+	tmp := filepath.Join(c.dir, indexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, indexFile)); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	src := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "blob"), []byte("cached dependency"), 0644))
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	c, err := NewCache(dir, 1<<20)
+	assert.Nil(t, err)
+	first, err := c.Save(ctx, "a", src, []string{"blob"})
+	assert.Nil(t, err)
+
+	// Every archive has the same size, so allow exactly two of them
+	c.maxSize = first.Size*2 + 1
+	_, err = c.Save(ctx, "b", src, []string{"blob"})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Restore(ctx, "a", t.TempDir()))
+	_, err = c.Save(ctx, "c", src, []string{"blob"})
+	assert.Nil(t, err)
+
+	assert.True(t, c.Has("a"))
+	assert.False(t, c.Has("b"))
+	assert.True(t, c.Has("c"))
+
+	// The index survives a restart
+	reopened, err := NewCache(dir, c.maxSize)
+	assert.Nil(t, err)
+	assert.Len(t, reopened.List(), 2)
+
+	dest := t.TempDir()
+	assert.Nil(t, reopened.Restore(ctx, "c", dest))
+	assert.FileExists(t, filepath.Join(dest, "blob"))
+	assert.ErrorIs(t, reopened.Restore(ctx, "b", dest), ErrNotFound)
+
+	assert.Nil(t, reopened.Purge("a"))
+	n, err := reopened.PurgeAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, reopened.List())
+}
@@ -0,0 +1,457 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ConditionContext holds the values an `if:` expression can refer to
+type ConditionContext struct {
+	Branch       string
+	Commit       string
+	Status       string
+	ChangedFiles []string
+}
+
+// Condition is a parsed `if:` expression.
+//
+// The grammar is deliberately small:
+//
+//	expr    = or
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = primary [ ("==" | "!=") primary ]
+//	primary = string | ident | ident "(" [ expr { "," expr } ] ")" | "(" expr ")"
+//
+// Identifiers are branch, commit and status. The functions are
+// startsWith(s, prefix), endsWith(s, suffix), contains(s, sub),
+// matches(s, glob) and changed(glob...), which is true when any changed
+// file matches one of the globs. Unknown identifiers and functions are
+// rejected when the expression is parsed.
+type Condition struct {
+	source string
+	root   condNode
+}
+
+// conditionIdents are the identifiers an expression can refer to
+var conditionIdents = map[string]bool{
+	"branch": true,
+	"commit": true,
+	"status": true,
+	"true":   true,
+	"false":  true,
+}
+
+// conditionFuncs are the functions an expression can call, with their
+// number of arguments; changed takes any number of globs but at least one
+var conditionFuncs = map[string]int{
+	"startsWith": 2,
+	"endsWith":   2,
+	"contains":   2,
+	"matches":    2,
+	"changed":    -1,
+}
+
+// ParseCondition parses an `if:` expression
+func ParseCondition(expr string) (*Condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", expr, err)
+	}
+	p := &condParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", expr, err)
+	}
+	return &Condition{source: expr, root: root}, nil
+}
+
+// Eval evaluates the condition, treating any non-empty string as true
+func (c *Condition) Eval(ctx ConditionContext) (bool, error) {
+	v, err := c.root.eval(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate condition %q: %w", c.source, err)
+	}
+	return truthy(v), nil
+}
+
+func (c *Condition) String() string {
+	return c.source
+}
+
+type condValue interface{}
+
+type condNode interface {
+	eval(ctx ConditionContext) (condValue, error)
+}
+
+type literalNode struct{ value string }
+
+type identNode struct{ name string }
+
+type notNode struct{ operand condNode }
+
+type binaryNode struct {
+	op          string
+	left, right condNode
+}
+
+type callNode struct {
+	name string
+	args []condNode
+}
+
+func (n literalNode) eval(ConditionContext) (condValue, error) {
+	return n.value, nil
+}
+
+func (n identNode) eval(ctx ConditionContext) (condValue, error) {
+	switch n.name {
+	case "branch":
+		return ctx.Branch, nil
+	case "commit":
+		return ctx.Commit, nil
+	case "status":
+		return ctx.Status, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return nil, fmt.Errorf("unknown identifier %q", n.name)
+}
+
+func (n notNode) eval(ctx ConditionContext) (condValue, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+func (n binaryNode) eval(ctx ConditionContext) (condValue, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "&&", "||":
+		return truthy(right), nil
+	case "==":
+		return fmt.Sprint(left) == fmt.Sprint(right), nil
+	case "!=":
+		return fmt.Sprint(left) != fmt.Sprint(right), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func (n callNode) eval(ctx ConditionContext) (condValue, error) {
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = fmt.Sprint(v)
+	}
+
+	if n.name == "changed" {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("changed() needs at least one pattern")
+		}
+		for _, file := range ctx.ChangedFiles {
+			for _, pattern := range args {
+				if MatchGlob(pattern, file) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s() takes 2 arguments, got %d", n.name, len(args))
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(args[0], args[1]), nil
+	case "endsWith":
+		return strings.HasSuffix(args[0], args[1]), nil
+	case "contains":
+		return strings.Contains(args[0], args[1]), nil
+	case "matches":
+		return MatchGlob(args[1], args[0]), nil
+	}
+	return nil, fmt.Errorf("unknown function %q", n.name)
+}
+
+func truthy(v condValue) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+type condToken struct {
+	kind string // "str", "ident" or "op"
+	text string
+}
+
+func tokenizeCondition(expr string) ([]condToken, error) {
+	var tokens []condToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, condToken{kind: "str", text: string(runes[i+1 : j])})
+			i = j + 1
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, condToken{kind: "ident", text: string(runes[i:j])})
+			i = j
+		default:
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				if two == "==" || two == "!=" || two == "&&" || two == "||" {
+					tokens = append(tokens, condToken{kind: "op", text: two})
+					i += 2
+					continue
+				}
+			}
+			if strings.ContainsRune("!(),", r) {
+				tokens = append(tokens, condToken{kind: "op", text: string(r)})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return tokens, nil
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+}
+
+func (p *condParser) peekOp(op string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].text == op
+}
+
+func (p *condParser) expectOp(op string) error {
+	if !p.peekOp(op) {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expected %q, got %q", op, p.tokens[p.pos].text)
+		}
+		return fmt.Errorf("expected %q at end of expression", op)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekOp("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	if p.peekOp("!") {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *condParser) parseCompare() (condNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.peekOp(op) {
+			p.pos++
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return binaryNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *condParser) parsePrimary() (condNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case "str":
+		return literalNode{value: tok.text}, nil
+	case "ident":
+		if !p.peekOp("(") {
+			if !conditionIdents[tok.text] {
+				return nil, fmt.Errorf("unknown identifier %q", tok.text)
+			}
+			return identNode{name: tok.text}, nil
+		}
+		p.pos++
+		call := callNode{name: tok.text}
+		if p.peekOp(")") {
+			p.pos++
+			return call, checkCall(call)
+		}
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peekOp(",") {
+				p.pos++
+				continue
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return call, checkCall(call)
+		}
+	case "op":
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+// checkCall checks that call names a known function with the right number
+// of arguments
+func checkCall(call callNode) error {
+	arity, ok := conditionFuncs[call.name]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown function %q", call.name)
+	case arity < 0 && len(call.args) == 0:
+		return fmt.Errorf("%s() needs at least one pattern", call.name)
+	case arity >= 0 && len(call.args) != arity:
+		return fmt.Errorf("%s() takes %d arguments, got %d", call.name, arity, len(call.args))
+	}
+	return nil
+}
+
+// MatchGlob reports whether name matches pattern. `*` and `?` stay within a
+// path segment, while `**` matches across directories.
+func MatchGlob(pattern, name string) bool {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(name)
+}
+
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				// "**/" also matches zero directories
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,57 @@
+package ci
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionEval(t *testing.T) {
+	ctx := ConditionContext{
+		Branch:       "feature/login",
+		Commit:       "abc123",
+		Status:       "success",
+		ChangedFiles: []string{"micro-services/auth/main.go", "README.md"},
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`branch == 'main'`, false},
+		{`branch != "main"`, true},
+		{`startsWith(branch, 'feature/') && status == 'success'`, true},
+		{`!(branch == 'main' || endsWith(branch, 'login'))`, false},
+		{`changed('micro-services/auth/**')`, true},
+		{`changed('micro-services/payment/**', 'docs/*.md')`, false},
+		{`changed('**/*.md')`, true},
+		{`matches(branch, 'feature/*') && contains(commit, '12')`, true},
+		{`status == 'failure'`, false},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseCondition(tt.expr)
+		if assert.Nil(t, err, tt.expr) {
+			got, err := cond.Eval(ctx)
+			assert.Nil(t, err, tt.expr)
+			assert.Equal(t, tt.want, got, tt.expr)
+		}
+	}
+}
+
+func TestConditionParseErrors(t *testing.T) {
+	for _, expr := range []string{``, `branch ==`, `(branch == 'main'`, `branch = 'main'`, `'unterminated`} {
+		_, err := ParseCondition(expr)
+		assert.NotNil(t, err, expr)
+	}
+
+	for expr, want := range map[string]string{
+		`tag == 'v1'`:                   `unknown identifier "tag"`,
+		`sucess()`:                      `unknown function "sucess"`,
+		`startsWith(branch)`:            `startsWith() takes 2 arguments, got 1`,
+		`branch == 'main' || changed()`: `changed() needs at least one pattern`,
+	} {
+		_, err := ParseCondition(expr)
+		assert.ErrorContains(t, err, want, expr)
+	}
+}
@@ -0,0 +1,154 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ContainerWorkspace is where the workspace is mounted inside step containers
+const ContainerWorkspace = "/workspace"
+
+// containerLabel marks every container and network created for a pipeline
+const containerLabel = "io.pipeslicer.ci"
+
+// ContainerExitError is returned when a command run in a container exits non-zero
+type ContainerExitError struct {
+	Image string
+	Code  int
+}
+
+func (e *ContainerExitError) Error() string {
+	return fmt.Sprintf("command in %s exited with status %d", e.Image, e.Code)
+}
+
+var (
+	dockerOnce   sync.Once
+	dockerClient *client.Client
+	dockerErr    error
+)
+
+// sharedDockerClient lazily connects to the Docker daemon configured in the environment
+func sharedDockerClient() (*client.Client, error) {
+	dockerOnce.Do(func() {
+		dockerClient, dockerErr = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if dockerErr != nil {
+			dockerErr = fmt.Errorf("failed to create Docker client: %w", dockerErr)
+		}
+	})
+	return dockerClient, dockerErr
+}
+
+// ensureImage pulls image unless it is already present locally
+func ensureImage(ctx context.Context, cli *client.Client, image string, output io.Writer) error {
+	_, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect image %s: %w", image, err)
+	}
+
+	fmt.Fprintf(output, "Pulling image %s\n", image)
+	reader, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	defer reader.Close()
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", image, err)
+	}
+	return nil
+}
+
+// executeInContainer runs a command in a throwaway container with the
+// workspace bind-mounted at ContainerWorkspace, as the user of the server
+// unless it is root. The container is removed afterwards, including when
+// ctx is cancelled.
+func (ws *workspaceImpl) executeInContainer(ctx context.Context, cmd string, args []string, opts ExecOptions) ([]byte, error) {
+	cli, err := sharedDockerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	var writer io.Writer = &output
+	if opts.Output != nil {
+		writer = io.MultiWriter(&output, opts.Output)
+	}
+
+	if err := ensureImage(ctx, cli, opts.Image, writer); err != nil {
+		return output.Bytes(), err
+	}
+
+	user := containerUser()
+	env := append([]string{}, ws.Env()...)
+	env = append(env, "CI_WORKSPACE="+ContainerWorkspace)
+	if user != "" {
+		// The user of the server has no home directory in the image
+		env = append(env, "HOME=/tmp")
+	}
+	env = append(env, opts.Env...)
+
+	created, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Labels:     map[string]string{containerLabel: "step"},
+			Image:      opts.Image,
+			Cmd:        append([]string{cmd}, args...),
+			Env:        env,
+			User:       user,
+			WorkingDir: path.Join(ContainerWorkspace, opts.Dir),
+		},
+		&container.HostConfig{
+			Binds:       []string{ws.dir + ":" + ContainerWorkspace},
+			NetworkMode: container.NetworkMode(opts.Network),
+		},
+		nil, nil, "")
+	if err != nil {
+		return output.Bytes(), fmt.Errorf("failed to create container from %s: %w", opts.Image, err)
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	})
+
+	waitC, errC := cli.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+	if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return output.Bytes(), fmt.Errorf("failed to start container: %w", err)
+	}
+
+	logs, err := cli.ContainerLogs(ctx, created.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return output.Bytes(), fmt.Errorf("failed to attach to container logs: %w", err)
+	}
+	defer logs.Close()
+	// Both streams go to one writer, which stdcopy only calls sequentially
+	if _, err := stdcopy.StdCopy(writer, writer, logs); err != nil && ctx.Err() == nil {
+		return output.Bytes(), fmt.Errorf("failed to read container logs: %w", err)
+	}
+
+	select {
+	case result := <-waitC:
+		if result.Error != nil {
+			return output.Bytes(), fmt.Errorf("failed waiting for container: %s", result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return output.Bytes(), &ContainerExitError{Image: opts.Image, Code: int(result.StatusCode)}
+		}
+		return output.Bytes(), nil
+	case err := <-errC:
+		return output.Bytes(), fmt.Errorf("failed waiting for container: %w", err)
+	}
+}
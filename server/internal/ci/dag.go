@@ -0,0 +1,134 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stepGraph is the dependency graph built from the `needs` of pipeline steps
+type stepGraph struct {
+	steps      []Step
+	conds      []*Condition
+	index      map[string]int
+	deps       [][]int
+	dependents [][]int
+}
+
+// newStepGraph builds the dependency graph for steps and rejects unknown
+// dependencies and cycles. When no step declares `needs`, the steps keep
+// their historical behaviour and run one after another in file order.
+func newStepGraph(steps []Step) (*stepGraph, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("pipeline has no steps")
+	}
+	g := &stepGraph{
+		steps:      steps,
+		conds:      make([]*Condition, len(steps)),
+		index:      make(map[string]int, len(steps)),
+		deps:       make([][]int, len(steps)),
+		dependents: make([][]int, len(steps)),
+	}
+
+	usesNeeds := false
+	for i, step := range steps {
+		if step.Name == "" {
+			return nil, fmt.Errorf("step %d has no name", i+1)
+		}
+		if _, exists := g.index[step.Name]; exists {
+			return nil, fmt.Errorf("duplicate step name %q", step.Name)
+		}
+		g.index[step.Name] = i
+		if step.Needs != nil {
+			usesNeeds = true
+		}
+
+		switch step.When {
+		case "", WhenOnSuccess, WhenOnFailure, WhenAlways:
+		default:
+			return nil, fmt.Errorf("step %q has invalid when %q", step.Name, step.When)
+		}
+		if step.If != "" {
+			cond, err := ParseCondition(step.If)
+			if err != nil {
+				return nil, fmt.Errorf("step %q: %w", step.Name, err)
+			}
+			g.conds[i] = cond
+		}
+	}
+
+	for i, step := range steps {
+		if !usesNeeds {
+			if i > 0 {
+				g.addEdge(i-1, i)
+			}
+			continue
+		}
+		for _, need := range step.Needs {
+			j, ok := g.index[need]
+			if !ok {
+				return nil, fmt.Errorf("step %q needs unknown step %q", step.Name, need)
+			}
+			if j == i {
+				return nil, fmt.Errorf("step %q needs itself", step.Name)
+			}
+			g.addEdge(j, i)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle between steps: %s", strings.Join(cycle, " -> "))
+	}
+
+	return g, nil
+}
+
+func (g *stepGraph) addEdge(from, to int) {
+	g.deps[to] = append(g.deps[to], from)
+	g.dependents[from] = append(g.dependents[from], to)
+}
+
+// findCycle returns the names of the steps forming a cycle, or nil if the graph is acyclic
+func (g *stepGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(g.steps))
+	var stack []int
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		stack = append(stack, i)
+		for _, next := range g.dependents[i] {
+			switch state[next] {
+			case visiting:
+				var cycle []string
+				for k := len(stack) - 1; k >= 0; k-- {
+					cycle = append([]string{g.steps[stack[k]].Name}, cycle...)
+					if stack[k] == next {
+						break
+					}
+				}
+				return append(cycle, g.steps[next].Name)
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+		return nil
+	}
+
+	for i := range g.steps {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepGraphRejectsCycles(t *testing.T) {
+	_, err := newStepGraph([]Step{
+		{Name: "a", Needs: []string{"c"}},
+		{Name: "b", Needs: []string{"a"}},
+		{Name: "c", Needs: []string{"b"}},
+	})
+	assert.ErrorContains(t, err, "dependency cycle")
+
+	_, err = newStepGraph([]Step{
+		{Name: "a", Needs: []string{"missing"}},
+	})
+	assert.ErrorContains(t, err, "unknown step")
+
+	_, err = newStepGraph([]Step{{Name: "a"}, {Name: "a"}})
+	assert.ErrorContains(t, err, "duplicate step name")
+}
+
+func TestStepGraphSequentialWithoutNeeds(t *testing.T) {
+	g, err := newStepGraph([]Step{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{nil, {0}, {1}}, g.deps)
+}
+
+func TestRunIndependentStepsConcurrently(t *testing.T) {
+	ws := newFakeWorkspace()
+	// lint and test each wait for the other to start, so the run only
+	// completes if they are executed at the same time
+	lintStarted := make(chan struct{})
+	testStarted := make(chan struct{})
+	ws.handlers["lint"] = func(ctx context.Context) ([]byte, error) {
+		close(lintStarted)
+		return waitFor(testStarted, "lint output")
+	}
+	ws.handlers["unit"] = func(ctx context.Context) ([]byte, error) {
+		close(testStarted)
+		return waitFor(lintStarted, "test output")
+	}
+
+	pipeline := &Pipeline{
+		Name: "DAG",
+		Steps: []Step{
+			{Name: "Lint", Needs: []string{}, Commands: []string{"lint"}},
+			{Name: "Test", Needs: []string{}, Commands: []string{"unit"}},
+			{Name: "Build", Needs: []string{"Lint", "Test"}, Commands: []string{"build"}},
+		},
+	}
+
+	result, err := NewExecutor(ws).Run(context.Background(), pipeline)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"build"}, ws.calls[2:])
+	assert.Equal(t, `Executing pipeline: DAG
+Step: Lint
+lint output
+Step: Test
+test output
+Step: Build
+build
+`, result.Log())
+}
+
+func TestRunStopsSchedulingAfterFailure(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["fail"] = func(ctx context.Context) ([]byte, error) {
+		return []byte("boom"), errors.New("exit status 1")
+	}
+
+	pipeline := &Pipeline{
+		Name:        "DAG",
+		MaxParallel: 1,
+		Steps: []Step{
+			{Name: "Compile", Needs: []string{}, Commands: []string{"fail"}},
+			{Name: "Package", Needs: []string{"Compile"}, Commands: []string{"package"}},
+			{Name: "Docs", Needs: []string{}, Commands: []string{"docs"}},
+		},
+	}
+
+	_, err := NewExecutor(ws).Run(context.Background(), pipeline)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"fail"}, ws.calls)
+}
+
+func waitFor(ch chan struct{}, output string) ([]byte, error) {
+	select {
+	case <-ch:
+		return []byte(output), nil
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("timed out waiting for concurrent step")
+	}
+}
+
+// fakeWorkspace runs commands through handlers keyed by the command line
+// a step passed to its shell
+type fakeWorkspace struct {
+	mu       sync.Mutex
+	calls    []string
+	handlers map[string]func(ctx context.Context) ([]byte, error)
+}
+
+func newFakeWorkspace() *fakeWorkspace {
+	return &fakeWorkspace{handlers: make(map[string]func(ctx context.Context) ([]byte, error))}
+}
+
+func (ws *fakeWorkspace) Branch() string { return "main" }
+func (ws *fakeWorkspace) Commit() string { return "0000000" }
+func (ws *fakeWorkspace) Dir() string    { return "." }
+func (ws *fakeWorkspace) Env() []string  { return nil }
+
+func (ws *fakeWorkspace) LoadPipeline(yamlContent []byte) (*Pipeline, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (ws *fakeWorkspace) ExecuteCommand(ctx context.Context, cmd string, args []string) ([]byte, error) {
+	return ws.ExecuteCommandWithOptions(ctx, cmd, args, ExecOptions{})
+}
+
+func (ws *fakeWorkspace) ExecuteCommandWithOptions(ctx context.Context, cmd string, args []string, opts ExecOptions) ([]byte, error) {
+	if n := len(args); n >= 2 && args[n-2] == "-c" {
+		cmd = args[n-1]
+	}
+	ws.mu.Lock()
+	ws.calls = append(ws.calls, cmd)
+	handler := ws.handlers[cmd]
+	ws.mu.Unlock()
+	if handler == nil {
+		return []byte(cmd), nil
+	}
+	return handler(ctx)
+}
+
+func (ws *fakeWorkspace) Close(failed bool) error { return nil }
+
+func TestRunCleanupStepsAfterFailure(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["flaky"] = func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("exit status 1")
+	}
+	ws.handlers["test"] = func(ctx context.Context) ([]byte, error) {
+		return nil, errors.New("exit status 2")
+	}
+
+	pipeline := &Pipeline{
+		Name: "Cleanup",
+		Steps: []Step{
+			{Name: "Up", Commands: []string{"up"}},
+			{Name: "Lint", ContinueOnError: true, Commands: []string{"flaky"}},
+			{Name: "Test", Commands: []string{"test"}},
+			{Name: "Deploy", If: "branch == 'main'", Commands: []string{"deploy"}},
+			{Name: "Report", When: WhenOnFailure, Commands: []string{"report"}},
+			{Name: "Down", When: WhenAlways, Commands: []string{"down"}},
+			{Name: "Notify", When: WhenAlways, If: "branch == 'release'", Commands: []string{"notify"}},
+		},
+	}
+
+	_, err := NewExecutor(ws).Run(context.Background(), pipeline)
+
+	assert.ErrorContains(t, err, "exit status 2")
+	assert.Equal(t, []string{"up", "flaky", "test", "report", "down"}, ws.calls)
+}
+
+func TestRunRetriesAndTimeouts(t *testing.T) {
+	ws := newFakeWorkspace()
+	flakyRuns := 0
+	ws.handlers["flaky"] = func(ctx context.Context) ([]byte, error) {
+		flakyRuns++
+		if flakyRuns < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return []byte("ok"), nil
+	}
+	ws.handlers["hang"] = func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	pipeline := &Pipeline{
+		Name:  "Retry",
+		Retry: &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+		Steps: []Step{
+			{Name: "Integration", Commands: []string{"flaky"}},
+			{Name: "Push", Timeout: 20 * time.Millisecond, Retry: &RetryPolicy{Attempts: 2}, Commands: []string{"hang"}},
+		},
+	}
+	graph, err := newStepGraph(pipeline.Steps)
+	assert.Nil(t, err)
+
+	results, err := NewExecutor(ws).runGraph(context.Background(), pipeline, graph)
+
+	assert.ErrorContains(t, err, `step "Push" timed out`)
+	assert.Equal(t, StepSuccess, results[0].status)
+	assert.Len(t, results[0].attempts, 3)
+	assert.Equal(t, "connection reset", results[0].attempts[0].Error)
+	assert.Equal(t, StepFailed, results[1].status)
+	assert.Len(t, results[1].attempts, 2)
+	assert.True(t, results[1].attempts[1].TimedOut)
+}
+
+func TestRunPipelineTimeout(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["hang"] = func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	pipeline := &Pipeline{
+		Name:    "Timeout",
+		Timeout: 20 * time.Millisecond,
+		Steps:   []Step{{Name: "Hang", Commands: []string{"hang"}}},
+	}
+
+	_, err := NewExecutor(ws).Run(context.Background(), pipeline)
+
+	assert.ErrorContains(t, err, "pipeline timed out after 20ms")
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package ci
+
+import "os/exec"
+
+// killProcessGroup leaves cmd alone where process groups are not
+// available; cancelling it only kills the command itself
+func killProcessGroup(cmd *exec.Cmd) {}
+
+// containerUser leaves step containers to the user of their image where
+// the server has no Unix user
+func containerUser() string { return "" }
@@ -0,0 +1,36 @@
+//go:build unix
+
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup runs cmd in a process group of its own and makes
+// cancelling it kill the whole group, so that children a shell started do
+// not outlive a timed out step
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+}
+
+// containerUser is the user step containers run as. A server that is not
+// root runs them as itself, so that it can delete the files they write to
+// the workspace; a root server leaves the user of the image.
+func containerUser() string {
+	uid := os.Getuid()
+	if uid == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", uid, os.Getgid())
+}
@@ -2,13 +2,52 @@ package ci
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/cache"
 )
 
+// DefaultShell is the interpreter that runs the commands of steps which
+// name no shell of their own
+const DefaultShell = "/bin/sh"
+
+// DefaultMaxParallel is the number of independent steps run at once
+// when neither the executor nor the pipeline configures a limit
+const DefaultMaxParallel = 4
+
 type Executor struct {
-	ws Workspace
+	ws           Workspace
+	maxParallel  int
+	changedFiles []string
+	listener     RunListener
+	logSink      LogSink
+	services     ServiceRunner
+
+	artifactStore  artifacts.Store
+	artifactPrefix string
+	stepCache      *cache.Cache
+	cacheScope     string
+	logURL         string
+
+	// previous and approvals are set when resuming a run, see SetResume
+	previous  *RunResult
+	approvals map[string]Approval
+
+	// running holds the services of the pipeline currently being run
+	running RunningServices
 }
 
+// Workspace is a checked out repository that steps run in. Env holds the
+// variables that describe the checkout, such as CI_BRANCH; the env of the
+// pipeline and the step reaches a command through ExecOptions.Env instead.
+// Close cleans the workspace up once its run is over; failed keeps it for
+// the retention of failed runs.
 type Workspace interface {
 	Branch() string
 	Commit() string
@@ -16,42 +55,637 @@ type Workspace interface {
 	Env() []string
 	LoadPipeline(yamlContent []byte) (*Pipeline, error)
 	ExecuteCommand(ctx context.Context, cmd string, args []string) ([]byte, error)
+	ExecuteCommandWithOptions(ctx context.Context, cmd string, args []string, opts ExecOptions) ([]byte, error)
+	Close(failed bool) error
 }
 
 func NewExecutor(ws Workspace) *Executor {
 	return &Executor{
-		ws: ws,
+		ws:          ws,
+		maxParallel: DefaultMaxParallel,
+		services:    dockerServiceRunner{},
 	}
 }
 
-func (e *Executor) RunDefault(ctx context.Context, yamlContent []byte) (string, error) {
+// SetMaxParallel limits how many steps may run concurrently. A pipeline's
+// own `max_parallel` takes precedence over this value.
+func (e *Executor) SetMaxParallel(n int) {
+	if n > 0 {
+		e.maxParallel = n
+	}
+}
+
+// SetChangedFiles sets the files changed by the commit being built, which
+// `if:` conditions can inspect through changed()
+func (e *Executor) SetChangedFiles(files []string) {
+	e.changedFiles = files
+}
+
+// SetListener registers l to be told about step progress during Run
+func (e *Executor) SetListener(l RunListener) {
+	e.listener = l
+}
+
+// SetLogSink streams the output of every step to sink while the pipeline runs
+func (e *Executor) SetLogSink(sink LogSink) {
+	e.logSink = sink
+}
+
+// SetArtifactStore enables step artifacts, stored in store under keys
+// starting with prefix. Without a store, `artifacts:` sections are ignored.
+func (e *Executor) SetArtifactStore(store artifacts.Store, prefix string) {
+	e.artifactStore = store
+	e.artifactPrefix = prefix
+}
+
+// SetCache enables the `cache:` directive of steps. Without a cache it is
+// ignored. Keys are scoped to repository, usually its URL, so that the
+// pipelines of different repositories never share an entry.
+func (e *Executor) SetCache(c *cache.Cache, repository string) {
+	e.stepCache = c
+	e.cacheScope = repository
+}
+
+// SetLogURL sets where the full logs of the run can be read, referenced by
+// step and command results whose output had to be truncated
+func (e *Executor) SetLogURL(url string) {
+	e.logURL = url
+}
+
+// SetServiceRunner replaces the Docker backend used to start pipeline services
+func (e *Executor) SetServiceRunner(r ServiceRunner) {
+	e.services = r
+}
+
+func (e *Executor) RunDefault(ctx context.Context, yamlContent []byte) (*RunResult, error) {
 	pipeline, err := e.ws.LoadPipeline(yamlContent)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
 	}
 	return e.Run(ctx, pipeline)
 }
 
-func (e *Executor) Run(ctx context.Context, pipeline *Pipeline) (string, error) {
-	output := strings.Builder{}
-	output.WriteString("Executing pipeline: ")
-	output.WriteString(pipeline.Name)
-	output.WriteRune('\n')
-	for _, step := range pipeline.Steps {
-		output.WriteString("Step: ")
-		output.WriteString(step.Name)
-		output.WriteRune('\n')
-		for _, cmd := range step.Commands {
-			withArgs := strings.Fields(cmd)
-			cmd = withArgs[:1][0]
-			args := withArgs[1:]
-			out, err := e.ws.ExecuteCommand(ctx, cmd, args)
-			output.Write(out)
-			output.WriteRune('\n')
+// Run executes pipeline and returns the result of every step, along with
+// the error that failed the run. The result is nil when the pipeline could
+// not be started at all.
+func (e *Executor) Run(ctx context.Context, pipeline *Pipeline) (*RunResult, error) {
+	steps, err := expandMatrix(pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	graph, err := newStepGraph(steps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	result := &RunResult{Pipeline: pipeline.Name, StartedAt: time.Now()}
+
+	if pipeline.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pipeline.Timeout)
+		defer cancel()
+	}
+
+	if len(pipeline.Services) > 0 {
+		if err := validateServices(pipeline.Services); err != nil {
+			return nil, fmt.Errorf("invalid pipeline: %w", err)
+		}
+		running, err := e.startServices(ctx, pipeline.Services)
+		if err != nil {
+			return nil, err
+		}
+		e.running = running
+		defer func() {
+			running.Stop()
+			e.running = nil
+		}()
+	}
+
+	results, err := e.runGraph(ctx, pipeline, graph)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("pipeline timed out after %s: %w", pipeline.Timeout, err)
+	}
+
+	result.FinishedAt = time.Now()
+	if e.previous != nil {
+		result.StartedAt = e.previous.StartedAt
+		result.Services = appendUnique(result.Services, e.previous.Services...)
+		result.Images = appendUnique(result.Images, e.previous.Images...)
+	}
+	for i, step := range graph.steps {
+		result.Steps = append(result.Steps, results[i].result(step.Name, e.logURL))
+		result.Services = appendUnique(result.Services, results[i].services...)
+		result.Images = appendUnique(result.Images, results[i].images...)
+	}
+	switch {
+	case err == nil:
+		result.Status = StepSuccess
+	case errors.Is(err, ErrWaitingForApproval):
+		result.Status = StepWaiting
+		return result, err
+	case errors.Is(ctx.Err(), context.Canceled):
+		result.Status = StepCancelled
+	default:
+		result.Status = StepFailed
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// runGraph executes the steps of graph, considering each one as soon as all
+// of the steps it needs have finished. Whether a ready step actually runs
+// depends on its `when` mode and `if` condition, evaluated against the
+// pipeline status so far: once a step fails without `continue_on_error`,
+// only `on_failure` and `always` steps are started. Approval steps without
+// a decision wait, holding back the steps that need them; once nothing
+// else can run, runGraph returns ErrWaitingForApproval.
+func (e *Executor) runGraph(ctx context.Context, pipeline *Pipeline, graph *stepGraph) ([]*stepResult, error) {
+	maxParallel := e.maxParallel
+	if pipeline.MaxParallel > 0 {
+		maxParallel = pipeline.MaxParallel
+	}
+
+	results := make([]*stepResult, len(graph.steps))
+	restored := make([]bool, len(graph.steps))
+	pending := make([]int, len(graph.steps))
+	var ready []int
+	for i := range graph.steps {
+		results[i] = &stepResult{status: StepPending}
+		pending[i] = len(graph.deps[i])
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	complete := func(i int) {
+		if results[i].finishedAt.IsZero() {
+			results[i].finishedAt = time.Now()
+		}
+		if e.listener != nil && !restored[i] {
+			e.listener.StepFinished(results[i].report(graph.steps[i].Name))
+		}
+		for _, next := range graph.dependents[i] {
+			pending[next]--
+			if pending[next] == 0 {
+				ready = insertSorted(ready, next)
+			}
+		}
+	}
+
+	done := make(chan int)
+	running := 0
+	cancels := make(map[int]context.CancelFunc)
+	var firstErr error
+	var failures []int
+	var waiting []int
+
+	fail := func(i int, err error) {
+		results[i].status = StepFailed
+		results[i].err = err
+		if graph.steps[i].ContinueOnError {
+			return
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures = append(failures, i)
+
+		// Fail fast: stop the other jobs of the same matrix
+		job := graph.steps[i].job
+		if job == nil || !job.failFast {
+			return
+		}
+		for j, cancel := range cancels {
+			if other := graph.steps[j].job; other != nil && other.group == job.group && other.combo != job.combo {
+				results[j].failFastBy = graph.steps[i].Name
+				cancel()
+			}
+		}
+	}
+
+	// healthy tells whether the pipeline has not failed as far as step i is
+	// concerned: a job of a matrix without fail_fast ignores failures of
+	// the other jobs of its matrix
+	healthy := func(i int) bool {
+		for _, f := range failures {
+			failed, job := graph.steps[f].job, graph.steps[i].job
+			if failed != nil && job != nil && failed.group == job.group && failed.combo != job.combo && !failed.failFast {
+				continue
+			}
+			return false
+		}
+		return true
+	}
+
+	for {
+		for running < maxParallel && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+
+			if e.restore(i, graph.steps[i], results[i]) {
+				restored[i] = true
+				if results[i].status == StepFailed {
+					fail(i, results[i].err)
+				}
+				complete(i)
+				continue
+			}
+
+			run, err := e.shouldRun(graph, i, healthy(i))
 			if err != nil {
-				return output.String(), err
+				fail(i, err)
+				complete(i)
+				continue
+			}
+			if !run {
+				results[i].status = StepSkipped
+				if errors.Is(ctx.Err(), context.Canceled) {
+					results[i].status = StepCancelled
+				}
+				complete(i)
+				continue
+			}
+
+			if graph.steps[i].Type == StepTypeApproval {
+				if !e.decide(graph.steps[i], results[i]) {
+					waiting = append(waiting, i)
+					if e.listener != nil {
+						e.listener.StepFinished(results[i].report(graph.steps[i].Name))
+					}
+					continue
+				}
+				if results[i].err != nil {
+					fail(i, results[i].err)
+				} else {
+					results[i].status = StepSuccess
+				}
+				complete(i)
+				continue
+			}
+
+			running++
+			results[i].status = StepRunning
+			results[i].startedAt = time.Now()
+			if e.listener != nil {
+				e.listener.StepStarted(graph.steps[i].Name, results[i].startedAt)
+			}
+			var needed []*ArtifactReport
+			for _, dep := range graph.deps[i] {
+				if results[dep].artifact != nil {
+					needed = append(needed, results[dep].artifact)
+				}
+			}
+			stepCtx := ctx
+			if job := graph.steps[i].job; job != nil && job.failFast {
+				stepCtx, cancels[i] = context.WithCancel(ctx)
 			}
+			go func(i int) {
+				results[i].err = e.executeStep(stepCtx, pipeline, i, graph.steps[i], results[i], needed)
+				done <- i
+			}(i)
+		}
+		if running == 0 {
+			if len(waiting) == 0 || firstErr == nil {
+				break
+			}
+			// The pipeline failed meanwhile, so the pending approvals
+			// are moot; their dependents decide for themselves whether to run
+			for _, w := range waiting {
+				results[w].status = StepSkipped
+				complete(w)
+			}
+			waiting = nil
+			continue
+		}
+
+		i := <-done
+		running--
+		if cancel, ok := cancels[i]; ok {
+			cancel()
+			delete(cancels, i)
+		}
+		results[i].finishedAt = time.Now()
+		if by := results[i].failFastBy; by != "" && results[i].err != nil {
+			results[i].err = fmt.Errorf("cancelled because %q failed: %w", by, results[i].err)
+			fmt.Fprintf(&results[i].output, "Cancelled because %q failed\n", by)
+		}
+		if err := results[i].err; err != nil {
+			fail(i, err)
+			if results[i].failFastBy != "" || errors.Is(ctx.Err(), context.Canceled) {
+				results[i].status = StepCancelled
+			}
+		} else {
+			results[i].status = StepSuccess
+		}
+		complete(i)
+	}
+
+	if len(waiting) > 0 {
+		names := make([]string, len(waiting))
+		for k, w := range waiting {
+			names[k] = graph.steps[w].Name
 		}
+		return results, fmt.Errorf("%w: %s", ErrWaitingForApproval, strings.Join(names, ", "))
 	}
-	return output.String(), nil
-}
\ No newline at end of file
+	return results, firstErr
+}
+
+// shouldRun decides whether the step at index i runs given the pipeline status so far
+func (e *Executor) shouldRun(graph *stepGraph, i int, healthy bool) (bool, error) {
+	step := graph.steps[i]
+	status := "success"
+	if !healthy {
+		status = "failure"
+	}
+
+	switch step.When {
+	case WhenAlways:
+	case WhenOnFailure:
+		if healthy {
+			return false, nil
+		}
+	default:
+		if !healthy {
+			return false, nil
+		}
+	}
+
+	cond := graph.conds[i]
+	if cond == nil {
+		return true, nil
+	}
+	return cond.Eval(ConditionContext{
+		Branch:       e.ws.Branch(),
+		Commit:       e.ws.Commit(),
+		Status:       status,
+		ChangedFiles: e.changedFiles,
+	})
+}
+
+// executeStep restores the artifacts of the steps the step at index i
+// needs and its cache, runs it with retries, then saves its cache and
+// uploads its own artifacts
+func (e *Executor) executeStep(ctx context.Context, pipeline *Pipeline, i int, step Step, result *stepResult, needed []*ArtifactReport) error {
+	var live io.WriteCloser
+	if e.logSink != nil {
+		live = e.logSink.StepWriter(step.Name)
+		defer live.Close()
+	}
+	note := func(format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		result.output.WriteString(line)
+		if live != nil {
+			io.WriteString(live, line)
+		}
+	}
+
+	if e.artifactStore != nil {
+		for _, artifact := range needed {
+			n, err := e.restoreArtifacts(ctx, artifact)
+			if err != nil {
+				return fmt.Errorf("failed to restore artifacts %s: %w", artifact.Key, err)
+			}
+			note("Restored %d artifact file(s) from %s\n", n, artifact.Key)
+		}
+	}
+
+	cacheKey, cacheHit, err := e.restoreCache(ctx, step, note)
+	if err != nil {
+		return err
+	}
+
+	err = e.runStepWithRetry(ctx, pipeline, step, result, live, note)
+	if err == nil && cacheKey != "" && !cacheHit {
+		e.saveCache(ctx, step, cacheKey, note)
+	}
+	if e.artifactStore == nil || !wantsArtifacts(step, err) {
+		return err
+	}
+
+	// Upload even when the run was cancelled or timed out, if `when` asks for it
+	artifact, saveErr := e.saveArtifacts(context.WithoutCancel(ctx), e.artifactKey(i, step), step)
+	switch {
+	case saveErr != nil:
+		note("%v\n", saveErr)
+		if err == nil {
+			err = saveErr
+		}
+	case artifact == nil:
+		note("No files matched the artifact paths\n")
+	default:
+		result.artifact = artifact
+		note("Uploaded %d artifact file(s) (%d bytes)\n", len(artifact.Files), artifact.Size)
+	}
+	return err
+}
+
+// runStepWithRetry runs step until it succeeds or its retry policy is used
+// up, recording every attempt. The step timeout applies to each attempt.
+func (e *Executor) runStepWithRetry(ctx context.Context, pipeline *Pipeline, step Step, result *stepResult, live io.Writer, note func(format string, args ...interface{})) error {
+	retry := step.Retry
+	if retry == nil {
+		retry = pipeline.Retry
+	}
+	attempts := 1
+	var backoff time.Duration
+	if retry != nil && retry.Attempts > 1 {
+		attempts = retry.Attempts
+		backoff = retry.Backoff
+	}
+
+	var err error
+	for n := 1; n <= attempts; n++ {
+		if n > 1 {
+			note("Retrying step (attempt %d/%d)\n", n, attempts)
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if step.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+		}
+		attempt := StepAttempt{Number: n, StartedAt: time.Now()}
+		err = e.runStep(attemptCtx, pipeline, step, n, result, live)
+		attempt.FinishedAt = time.Now()
+		if err != nil {
+			attempt.Error = err.Error()
+			attempt.TimedOut = errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+			if attempt.TimedOut {
+				err = fmt.Errorf("step %q timed out: %w", step.Name, err)
+				note("Step timed out after %s\n", attempt.FinishedAt.Sub(attempt.StartedAt).Round(time.Millisecond))
+			}
+		}
+		cancel()
+		result.attempts = append(result.attempts, attempt)
+
+		if err == nil || ctx.Err() != nil || n == attempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// runStep runs every command of step in order, stopping at the first failure,
+// and records each command under the given attempt number. Output is
+// collected into result and, when live is set, streamed to it as well.
+func (e *Executor) runStep(ctx context.Context, pipeline *Pipeline, step Step, attempt int, result *stepResult, live io.Writer) error {
+	opts := ExecOptions{
+		Dir:   step.Workdir,
+		Env:   mergeEnv(pipeline.Env, step.Env),
+		Image: step.Image,
+	}
+	if opts.Image == "" {
+		opts.Image = pipeline.Image
+	}
+	if e.running != nil {
+		opts.Env = append(e.running.Env(opts.Image != ""), opts.Env...)
+		if opts.Image != "" {
+			opts.Network = e.running.Network()
+		}
+	}
+	if live != nil {
+		opts.Output = live
+	}
+	shell := step.Shell
+	if shell == "" {
+		shell = pipeline.Shell
+	}
+	var err error
+	for _, cmd := range step.Commands {
+		command := CommandResult{Command: cmd, Attempt: attempt, Status: StepSkipped}
+		if err == nil {
+			err = e.runCommand(ctx, shell, opts, &command, result)
+			if errors.Is(err, errEmptyCommand) || errors.Is(err, errBlankShell) {
+				err = fmt.Errorf("step %q: %w", step.Name, err)
+			}
+		}
+		result.commands = append(result.commands, command)
+	}
+	return err
+}
+
+// runCommand runs one command line, filling in command with its outcome
+// and adding its output to result
+func (e *Executor) runCommand(ctx context.Context, shell string, opts ExecOptions, command *CommandResult, result *stepResult) error {
+	startedAt := time.Now()
+	command.StartedAt = &startedAt
+
+	name, args, err := buildCommand(shell, command.Command)
+	var out []byte
+	if err == nil {
+		out, err = e.ws.ExecuteCommandWithOptions(ctx, name, args, opts)
+		result.output.Write(out)
+		result.output.WriteRune('\n')
+		result.collectAnnotations(out)
+	}
+
+	finishedAt := time.Now()
+	command.FinishedAt = &finishedAt
+	command.ExitCode = exitCode(err)
+	command.Output, command.Truncated = truncateOutput(string(out))
+	switch {
+	case err == nil:
+		command.Status = StepSuccess
+	case errors.Is(ctx.Err(), context.Canceled):
+		command.Status = StepCancelled
+		command.Error = err.Error()
+	default:
+		command.Status = StepFailed
+		command.Error = err.Error()
+	}
+	return err
+}
+
+// startServices starts the pipeline's sidecars, logging their progress
+// under a "services" entry of the log sink
+func (e *Executor) startServices(ctx context.Context, services []Service) (RunningServices, error) {
+	output := io.Discard
+	if e.logSink != nil {
+		w := e.logSink.StepWriter("services")
+		defer w.Close()
+		output = w
+	}
+	running, err := e.services.Start(ctx, services, output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start services: %w", err)
+	}
+	return running, nil
+}
+
+// validateServices checks that every service has a unique name and an image
+func validateServices(services []Service) error {
+	seen := make(map[string]bool)
+	for i, svc := range services {
+		if svc.Name == "" {
+			return fmt.Errorf("service %d has no name", i+1)
+		}
+		if svc.Image == "" {
+			return fmt.Errorf("service %q has no image", svc.Name)
+		}
+		if seen[svc.Name] {
+			return fmt.Errorf("duplicate service name %q", svc.Name)
+		}
+		seen[svc.Name] = true
+	}
+	return nil
+}
+
+// insertSorted keeps the ready queue in file order so scheduling is deterministic
+func insertSorted(queue []int, i int) []int {
+	pos := sort.SearchInts(queue, i)
+	queue = append(queue, 0)
+	copy(queue[pos+1:], queue[pos:])
+	queue[pos] = i
+	return queue
+}
+
+var errEmptyCommand = errors.New("empty command")
+
+var errBlankShell = errors.New("blank shell")
+
+// buildCommand turns a pipeline command line into an executable and its
+// arguments: the line is passed to `<shell> -c`, where shell is an
+// interpreter with its flags, such as "bash -e", and DefaultShell when empty.
+func buildCommand(shell, line string) (string, []string, error) {
+	if strings.TrimSpace(line) == "" {
+		return "", nil, errEmptyCommand
+	}
+	if shell == "" {
+		shell = DefaultShell
+	}
+	interpreter := strings.Fields(shell)
+	if len(interpreter) == 0 {
+		return "", nil, errBlankShell
+	}
+	args := append(interpreter[1:], "-c", line)
+	return interpreter[0], args, nil
+}
+
+// mergeEnv flattens env maps into KEY=VALUE pairs, later maps overriding earlier ones
+func mergeEnv(envs ...map[string]string) []string {
+	merged := make(map[string]string)
+	for _, env := range envs {
+		for k, v := range env {
+			merged[k] = v
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+merged[k])
+	}
+	return pairs
+}
@@ -2,10 +2,19 @@ package ci
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/cache"
 )
 
 func TestRunDefaultHappyPath(t *testing.T) {
@@ -27,13 +36,13 @@ steps:
 		},
 		nil,
 	)
-	wsMock.On("ExecuteCommand", context.Background(), "cmd1", []string{"arg1", "arg2"}).Return(
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), DefaultShell, []string{"-c", "cmd1 arg1 arg2"}, ExecOptions{}).Return(
 		[]byte("Output"),
 		nil,
 	)
 
 	executor := NewExecutor(&wsMock)
-	str, err := executor.RunDefault(context.Background(), yamlContent) // Pass YAML content
+	result, err := executor.RunDefault(context.Background(), yamlContent) // Pass YAML content
 
 	assert.Nil(t, err)
 
@@ -41,7 +50,306 @@ steps:
 Step: Step 1
 Output
 `
-	assert.Equal(t, expectedOutput, str, "wrong output")
+	assert.Equal(t, expectedOutput, result.Log(), "wrong output")
+}
+
+func TestRunShellStepWithEnvAndWorkdir(t *testing.T) {
+	wsMock := mockWorkspace{}
+	pipeline := &Pipeline{
+		Name:  "Shell Pipeline",
+		Env:   map[string]string{"GOFLAGS": "-mod=mod", "STAGE": "ci"},
+		Shell: "bash -e",
+		Steps: []Step{
+			{
+				Name:     "Build",
+				Env:      map[string]string{"STAGE": "build"},
+				Workdir:  "services/api",
+				Commands: []string{"cd cmd && make build"},
+			},
+			{
+				Name:     "Lint",
+				Shell:    "/bin/sh -eu",
+				Commands: []string{"golangci-lint run ./..."},
+			},
+		},
+	}
+
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), "bash", []string{"-e", "-c", "cd cmd && make build"}, ExecOptions{
+		Dir: "services/api",
+		Env: []string{"GOFLAGS=-mod=mod", "STAGE=build"},
+	}).Return([]byte("built"), nil)
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), "/bin/sh", []string{"-eu", "-c", "golangci-lint run ./..."}, ExecOptions{
+		Env: []string{"GOFLAGS=-mod=mod", "STAGE=ci"},
+	}).Return([]byte("linted"), nil)
+
+	executor := NewExecutor(&wsMock)
+	_, err := executor.Run(context.Background(), pipeline)
+
+	assert.Nil(t, err)
+	wsMock.AssertExpectations(t)
+}
+
+func TestRunStepsInContainerImages(t *testing.T) {
+	wsMock := mockWorkspace{}
+	pipeline := &Pipeline{
+		Name:  "Polyglot",
+		Image: "golang:1.21",
+		Steps: []Step{
+			{Name: "Go", Commands: []string{"go test ./..."}},
+			{Name: "Node", Image: "node:20", Workdir: "web", Commands: []string{"npm ci"}},
+		},
+	}
+
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), DefaultShell, []string{"-c", "go test ./..."}, ExecOptions{
+		Image: "golang:1.21",
+	}).Return([]byte("ok"), nil)
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), DefaultShell, []string{"-c", "npm ci"}, ExecOptions{
+		Dir:   "web",
+		Image: "node:20",
+	}).Return([]byte("added 1 package"), nil)
+
+	_, err := NewExecutor(&wsMock).Run(context.Background(), pipeline)
+
+	assert.Nil(t, err)
+	wsMock.AssertExpectations(t)
+}
+
+func TestRunServicesExposeHostsAndStopOnFailure(t *testing.T) {
+	wsMock := mockWorkspace{}
+	services := &fakeServices{}
+	pipeline := &Pipeline{
+		Name:     "Integration",
+		Services: []Service{{Name: "postgres", Image: "postgres:15"}},
+		Steps: []Step{
+			{Name: "Migrate", Commands: []string{"migrate up"}},
+			{Name: "Test", Image: "golang:1.21", Commands: []string{"go test"}},
+		},
+	}
+
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), DefaultShell, []string{"-c", "migrate up"}, ExecOptions{
+		Env: []string{"POSTGRES_HOST=172.18.0.2"},
+	}).Return([]byte("migrated"), nil)
+	wsMock.On("ExecuteCommandWithOptions", context.Background(), DefaultShell, []string{"-c", "go test"}, ExecOptions{
+		Env:     []string{"POSTGRES_HOST=postgres"},
+		Image:   "golang:1.21",
+		Network: "pipeslicer-test",
+	}).Return([]byte("FAIL"), errors.New("exit status 1"))
+
+	executor := NewExecutor(&wsMock)
+	executor.SetServiceRunner(services)
+	_, err := executor.Run(context.Background(), pipeline)
+
+	assert.NotNil(t, err)
+	assert.True(t, services.stopped)
+	wsMock.AssertExpectations(t)
+}
+
+type fakeServices struct {
+	stopped bool
+}
+
+func (f *fakeServices) Start(ctx context.Context, services []Service, output io.Writer) (RunningServices, error) {
+	return f, nil
+}
+
+func (f *fakeServices) Env(containerized bool) []string {
+	if containerized {
+		return []string{"POSTGRES_HOST=postgres"}
+	}
+	return []string{"POSTGRES_HOST=172.18.0.2"}
+}
+
+func (f *fakeServices) Network() string {
+	return "pipeslicer-test"
+}
+
+func (f *fakeServices) Stop() error {
+	f.stopped = true
+	return nil
+}
+
+func TestRunRestoresArtifactsOfNeededSteps(t *testing.T) {
+	ws := &workspaceImpl{dir: t.TempDir()}
+	store, err := artifacts.NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+
+	pipeline := &Pipeline{
+		Name: "Artifacts",
+		Steps: []Step{
+			{Name: "Build", Needs: []string{}, Commands: []string{"mkdir -p dist && echo binary > dist/app && echo log > build.log"},
+				Artifacts: &Artifacts{Paths: []string{"dist"}}},
+			{Name: "Wipe", Needs: []string{"Build"}, Commands: []string{"rm -rf dist"}},
+			{Name: "Ship", Needs: []string{"Build", "Wipe"}, Commands: []string{"cat dist/app"}},
+		},
+	}
+
+	executor := NewExecutor(ws)
+	executor.SetArtifactStore(store, "runs/1")
+	result, err := executor.Run(context.Background(), pipeline)
+
+	assert.Nil(t, err)
+	output := result.Log()
+	assert.Contains(t, output, "Uploaded 1 artifact file(s)")
+	assert.Contains(t, output, "Restored 1 artifact file(s) from runs/1/1-Build.tar.gz\nbinary\n")
+}
+
+func TestRunResultRecordsCommands(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["vet"] = func(ctx context.Context) ([]byte, error) {
+		return []byte("vet failed"), &ContainerExitError{Image: "golang", Code: 3}
+	}
+	ws.handlers["noisy"] = func(ctx context.Context) ([]byte, error) {
+		return []byte("start\n" + strings.Repeat("x", MaxOutputSize) + "\nend"), nil
+	}
+
+	pipeline := &Pipeline{
+		Name: "Result",
+		Steps: []Step{
+			{Name: "Noisy", Commands: []string{"noisy"}},
+			{Name: "Check", Commands: []string{"fmt", "vet", "test"}},
+			{Name: "Deploy", Commands: []string{"deploy"}},
+		},
+	}
+
+	executor := NewExecutor(ws)
+	executor.SetLogURL("/pipelines/runs/7/logs")
+	result, err := executor.Run(context.Background(), pipeline)
+	assert.ErrorContains(t, err, "exited with status 3")
+
+	assert.Equal(t, "Result", result.Pipeline)
+	assert.Equal(t, StepFailed, result.Status)
+	assert.Len(t, result.Steps, 3)
+
+	noisy := result.Steps[0]
+	assert.Equal(t, StepSuccess, noisy.Status)
+	assert.True(t, noisy.Commands[0].Truncated)
+	assert.Equal(t, "/pipelines/runs/7/logs", noisy.Commands[0].LogURL)
+	assert.True(t, strings.HasSuffix(noisy.Commands[0].Output, "x\nend"))
+	assert.NotContains(t, noisy.Commands[0].Output, "start")
+
+	check := result.Steps[1]
+	assert.Equal(t, StepFailed, check.Status)
+	assert.Equal(t, 3, check.ExitCode)
+	var statuses []StepStatus
+	for _, command := range check.Commands {
+		statuses = append(statuses, command.Status)
+	}
+	assert.Equal(t, []StepStatus{StepSuccess, StepFailed, StepSkipped}, statuses)
+	assert.Equal(t, 3, check.Commands[1].ExitCode)
+	assert.Equal(t, "vet failed", check.Commands[1].Output)
+	assert.NotNil(t, check.Commands[1].FinishedAt)
+	assert.Nil(t, check.Commands[2].StartedAt)
+	assert.False(t, check.Truncated)
+
+	assert.Equal(t, StepSkipped, result.Steps[2].Status)
+	assert.Nil(t, result.Steps[2].StartedAt)
+
+	data, err := json.Marshal(result)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"status":"skipped"`)
+	assert.Contains(t, string(data), `"command":"vet","attempt":1,"status":"failed","exitCode":3`)
+}
+
+func TestRunResultMarksCancelledSteps(t *testing.T) {
+	ws := newFakeWorkspace()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ws.handlers["wait"] = func(ctx context.Context) ([]byte, error) {
+		cancel()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	pipeline := &Pipeline{
+		Name: "Cancel",
+		Steps: []Step{
+			{Name: "Wait", Commands: []string{"wait"}},
+			{Name: "Next", Commands: []string{"next"}},
+		},
+	}
+
+	result, err := NewExecutor(ws).Run(ctx, pipeline)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, StepCancelled, result.Status)
+	assert.Equal(t, StepCancelled, result.Steps[0].Status)
+	assert.Equal(t, StepCancelled, result.Steps[0].Commands[0].Status)
+	assert.Equal(t, StepCancelled, result.Steps[1].Status)
+}
+
+func TestRunRestoresAndSavesCache(t *testing.T) {
+	stepCache, err := cache.NewCache(t.TempDir(), 0)
+	assert.Nil(t, err)
+	pipeline := &Pipeline{
+		Name: "Cache",
+		Steps: []Step{{
+			Name:     "Deps",
+			Cache:    &Cache{Key: `deps-{{ hashFiles "deps.lock" }}`, Paths: []string{"vendor"}},
+			Commands: []string{"test -f vendor/lib || (mkdir -p vendor && echo lib > vendor/lib && echo downloaded)"},
+		}},
+	}
+
+	run := func(repository string) string {
+		dir := t.TempDir()
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, "deps.lock"), []byte("lib@1"), 0644))
+		executor := NewExecutor(&workspaceImpl{dir: dir})
+		executor.SetCache(stepCache, repository)
+		result, err := executor.Run(context.Background(), pipeline)
+		assert.Nil(t, err)
+		return result.Log()
+	}
+
+	cold := run("https://github.com/acme/shop.git")
+	assert.Contains(t, cold, "No cache found for key deps-")
+	assert.Contains(t, cold, "downloaded")
+	assert.Contains(t, cold, "Saved cache deps-")
+
+	warm := run("https://github.com/acme/shop.git")
+	assert.Contains(t, warm, "Restored cache deps-")
+	assert.NotContains(t, warm, "downloaded")
+	assert.NotContains(t, warm, "Saved cache")
+	assert.Len(t, stepCache.List(), 1)
+
+	// The same key in another repository has an entry of its own
+	other := run("https://github.com/acme/blog.git")
+	assert.Contains(t, other, "No cache found for key deps-")
+	assert.Contains(t, other, "downloaded")
+	assert.Len(t, stepCache.List(), 2)
+}
+
+func TestWorkspaceExecuteShellCommand(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	ws := &workspaceImpl{dir: dir, env: []string{"BASE=base"}}
+
+	out, err := ws.ExecuteCommandWithOptions(context.Background(), DefaultShell, []string{"-c", `echo "$BASE $EXTRA" > out.txt && cat out.txt | tr a-z A-Z`}, ExecOptions{
+		Dir: "sub",
+		Env: []string{"EXTRA=extra"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "BASE EXTRA\n", string(out))
+	assert.FileExists(t, filepath.Join(dir, "sub", "out.txt"))
+
+	_, err = ws.ExecuteCommandWithOptions(context.Background(), "true", nil, ExecOptions{Dir: "../outside"})
+	assert.NotNil(t, err)
+}
+
+func TestStepTimeoutKillsChildProcesses(t *testing.T) {
+	ws := &workspaceImpl{dir: t.TempDir()}
+	pipeline := &Pipeline{
+		Name: "Hung",
+		Steps: []Step{
+			// The shell's child keeps the output pipe open after the shell is killed
+			{Name: "Push", Timeout: 500 * time.Millisecond, Commands: []string{"sleep 5; echo pushed"}},
+		},
+	}
+
+	start := time.Now()
+	result, err := NewExecutor(ws).Run(context.Background(), pipeline)
+
+	assert.ErrorContains(t, err, "timed out")
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.True(t, result.Steps[0].Attempts[0].TimedOut)
+	assert.NotContains(t, result.Log(), "pushed")
 }
 
 type mockWorkspace struct {
@@ -77,3 +385,90 @@ func (ws *mockWorkspace) ExecuteCommand(ctx context.Context, cmd string, argumen
 	args := ws.Called(ctx, cmd, arguments)
 	return args.Get(0).([]byte), args.Error(1)
 }
+
+func (ws *mockWorkspace) ExecuteCommandWithOptions(ctx context.Context, cmd string, arguments []string, opts ExecOptions) ([]byte, error) {
+	args := ws.Called(ctx, cmd, arguments, opts)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (ws *mockWorkspace) Close(failed bool) error {
+	args := ws.Called(failed)
+	return args.Error(0)
+}
+
+func TestLoadPipelineDecodesTimeoutsAndRetry(t *testing.T) {
+	ws := &workspaceImpl{dir: t.TempDir()}
+	pipeline, err := ws.LoadPipeline([]byte(`
+name: Release
+timeout: 30m
+steps:
+  - name: Push
+    timeout: 90s
+    retry:
+      attempts: 3
+      backoff: 5s
+    commands:
+      - docker push registry.local/api:latest
+`))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Minute, pipeline.Timeout)
+	assert.Equal(t, 90*time.Second, pipeline.Steps[0].Timeout)
+	assert.Equal(t, &RetryPolicy{Attempts: 3, Backoff: 5 * time.Second}, pipeline.Steps[0].Retry)
+}
+
+func TestRunResultCollectsAnnotations(t *testing.T) {
+	ws := newFakeWorkspace()
+	ws.handlers["orders"] = func(ctx context.Context) ([]byte, error) {
+		return []byte("building\n::service::orders\n::image::registry.local/orders:abc\n"), nil
+	}
+	ws.handlers["all"] = func(ctx context.Context) ([]byte, error) {
+		return []byte("::service::orders\n::service::payments\n"), nil
+	}
+
+	pipeline := &Pipeline{
+		Name: "Annotations",
+		Steps: []Step{
+			{Name: "Orders", Commands: []string{"orders"}},
+			{Name: "All", Commands: []string{"all"}},
+		},
+	}
+
+	result, err := NewExecutor(ws).Run(context.Background(), pipeline)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"orders", "payments"}, result.Services)
+	assert.Equal(t, []string{"registry.local/orders:abc"}, result.Images)
+}
+
+func TestPipelineOverrideEnv(t *testing.T) {
+	pipeline := &Pipeline{
+		Env: map[string]string{"MODE": "fast", "KEEP": "1"},
+		Steps: []Step{
+			{Name: "Scan", Env: map[string]string{"MODE": "quick", "OTHER": "x"}},
+			{Name: "Build"},
+		},
+	}
+	pipeline.OverrideEnv(map[string]string{"MODE": "full", "NIGHTLY": "true"})
+
+	assert.Equal(t, map[string]string{"MODE": "full", "KEEP": "1", "NIGHTLY": "true"}, pipeline.Env)
+	assert.Equal(t, map[string]string{"MODE": "full", "OTHER": "x"}, pipeline.Steps[0].Env)
+	assert.Nil(t, pipeline.Steps[1].Env)
+}
+
+func TestBuildCommand(t *testing.T) {
+	name, args, err := buildCommand("bash -e", "make test")
+	assert.Nil(t, err)
+	assert.Equal(t, "bash", name)
+	assert.Equal(t, []string{"-e", "-c", "make test"}, args)
+
+	name, args, err = buildCommand("", "go build ./...")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultShell, name)
+	assert.Equal(t, []string{"-c", "go build ./..."}, args)
+
+	_, _, err = buildCommand("", "  ")
+	assert.ErrorIs(t, err, errEmptyCommand)
+
+	_, _, err = buildCommand(" ", "make test")
+	assert.ErrorIs(t, err, errBlankShell)
+}
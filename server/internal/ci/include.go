@@ -0,0 +1,452 @@
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIncludeDepth bounds how deeply includes may nest
+const maxIncludeDepth = 10
+
+// TemplateSource looks up pipeline templates stored outside the repository
+type TemplateSource interface {
+	Template(name string) ([]byte, error)
+}
+
+// TemplateSourceFunc adapts a function to a TemplateSource
+type TemplateSourceFunc func(name string) ([]byte, error)
+
+func (f TemplateSourceFunc) Template(name string) ([]byte, error) {
+	return f(name)
+}
+
+// Include is an entry of a pipeline's `include:` list. A plain string is
+// shorthand for a local file.
+type Include struct {
+	// Local is a YAML file relative to the workspace root
+	Local string `yaml:"local"`
+	// Template names a template from the TemplateSource
+	Template string `yaml:"template"`
+	// Params fill in ${{ params.name }} references of the included file
+	Params map[string]string `yaml:"params"`
+}
+
+func (inc *Include) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		inc.Local = value.Value
+		return nil
+	}
+	type plain Include
+	return value.Decode((*plain)(inc))
+}
+
+// StringList is a list of strings that may be written as a single string
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(l))
+}
+
+// pipelineResolver merges the includes of a pipeline into a single document
+type pipelineResolver struct {
+	dir       string
+	templates TemplateSource
+	stack     []string
+
+	// problems collects structural errors across all included files
+	problems []ValidationError
+	warnings []ValidationError
+	// skippedLocal is set when local includes were skipped for lack of a workspace
+	skippedLocal bool
+	// steps holds the step nodes of the top-level file by name
+	steps map[string]*yaml.Node
+}
+
+// ResolvePipeline expands the `include:` and `extends:` directives of a
+// pipeline and returns the merged YAML.
+//
+// Included files are merged in order, then the including file on top of
+// them: mappings are merged key by key, steps and services are matched by
+// name, and every other value is replaced. Every file may declare
+// `params:` with default values and refer to them as ${{ params.name }};
+// the includer of a file can override them.
+// A step with `extends: base` starts from a copy of the step named base.
+// Steps whose name starts with a dot only serve as bases and are dropped.
+func (ws *workspaceImpl) ResolvePipeline(yamlContent []byte) ([]byte, error) {
+	r := &pipelineResolver{dir: ws.dir, templates: ws.templates}
+	root, err := r.resolveAll(yamlContent)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode resolved pipeline: %w", err)
+	}
+	return out, nil
+}
+
+// resolveAll resolves the includes and extends of a top-level pipeline and
+// checks the structure of every file involved
+func (r *pipelineResolver) resolveAll(content []byte) (*yaml.Node, error) {
+	root, err := r.resolve(content, "pipeline", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.problems) > 0 {
+		return nil, ValidationErrors(r.problems)
+	}
+	if r.skippedLocal {
+		return root, nil
+	}
+	if err := applyExtends(root); err != nil {
+		return nil, ValidationErrors{{Path: "steps", Message: err.Error()}}
+	}
+	return root, nil
+}
+
+// resolve parses content and merges its includes beneath it. params are the
+// values given by the includer; nil means content is the top-level pipeline.
+func (r *pipelineResolver) resolve(content []byte, source string, params map[string]string) (*yaml.Node, error) {
+	for _, s := range r.stack {
+		if s == source {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(r.stack, " -> "), source)
+		}
+	}
+	if len(r.stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested more than %d levels deep", source, maxIncludeDepth)
+	}
+	r.stack = append(r.stack, source)
+	defer func() { r.stack = r.stack[:len(r.stack)-1] }()
+
+	file := source
+	if params == nil {
+		file = ""
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, syntaxError(file, err)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, ValidationError{File: file, Line: root.Line, Column: root.Column, Message: "pipeline must be a mapping"}
+	}
+
+	defaults := removeKey(root, "params")
+	values := make(map[string]string)
+	if defaults != nil {
+		if err := defaults.Decode(&values); err != nil {
+			return nil, fmt.Errorf("%s: params: %w", source, err)
+		}
+	}
+	for k, v := range params {
+		values[k] = v
+	}
+	if err := substituteParams(root, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if params == nil {
+		r.steps = make(map[string]*yaml.Node)
+		if i := keyIndex(root, "steps"); i >= 0 {
+			for _, step := range root.Content[i+1].Content {
+				if name := entryName(step); name != "" {
+					r.steps[name] = step
+				}
+			}
+		}
+	}
+	r.problems = append(r.problems, checkStructure(root, reflect.TypeOf(Pipeline{}), file, "")...)
+
+	includeNode := removeKey(root, "include")
+	if includeNode == nil {
+		return root, nil
+	}
+	var includes []Include
+	if err := includeNode.Decode(&includes); err != nil {
+		return nil, fmt.Errorf("%s: include: %w", source, err)
+	}
+
+	var base *yaml.Node
+	for _, inc := range includes {
+		if inc.Local != "" && r.dir == "" {
+			r.skippedLocal = true
+			r.warnings = append(r.warnings, ValidationError{
+				File:    file,
+				Line:    includeNode.Line,
+				Column:  includeNode.Column,
+				Path:    "include",
+				Message: fmt.Sprintf("local include %q not checked without a repository", inc.Local),
+			})
+			continue
+		}
+		content, name, err := r.load(inc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		incParams := inc.Params
+		if incParams == nil {
+			incParams = map[string]string{}
+		}
+		node, err := r.resolve(content, name, incParams)
+		if err != nil {
+			return nil, err
+		}
+		base = mergeDocuments(base, node)
+	}
+	return mergeDocuments(base, root), nil
+}
+
+// load reads the content of an include and names it for error messages
+func (r *pipelineResolver) load(inc Include) ([]byte, string, error) {
+	switch {
+	case inc.Local != "" && inc.Template != "":
+		return nil, "", errors.New("include must set either local or template, not both")
+	case inc.Local != "":
+		clean, ok := workspacePath(inc.Local)
+		if !ok {
+			return nil, "", fmt.Errorf("include %q is outside the workspace", inc.Local)
+		}
+		content, err := os.ReadFile(filepath.Join(r.dir, clean))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read include %q: %w", inc.Local, err)
+		}
+		return content, filepath.ToSlash(clean), nil
+	case inc.Template != "":
+		if r.templates == nil {
+			return nil, "", fmt.Errorf("template %q: no template source configured", inc.Template)
+		}
+		content, err := r.templates.Template(inc.Template)
+		if err != nil {
+			return nil, "", fmt.Errorf("template %q: %w", inc.Template, err)
+		}
+		return content, "template " + inc.Template, nil
+	}
+	return nil, "", errors.New("include must set local or template")
+}
+
+var paramRef = regexp.MustCompile(`\$\{\{\s*params\.([A-Za-z0-9_-]+)\s*\}\}`)
+
+// substituteParams replaces ${{ params.name }} in every scalar below node
+func substituteParams(node *yaml.Node, params map[string]string) error {
+	if node.Kind == yaml.ScalarNode {
+		if !paramRef.MatchString(node.Value) {
+			return nil
+		}
+		var missing string
+		node.Value = paramRef.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			key := paramRef.FindStringSubmatch(ref)[1]
+			value, ok := params[key]
+			if !ok && missing == "" {
+				missing = key
+			}
+			return value
+		})
+		if missing != "" {
+			return fmt.Errorf("line %d: parameter %q has no value", node.Line, missing)
+		}
+		// Let unquoted values such as numbers resolve to their own type
+		if node.Style == 0 {
+			node.Tag = ""
+		}
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := substituteParams(child, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namedLists are the top-level sequences whose entries are merged by name
+var namedLists = map[string]bool{"steps": true, "services": true}
+
+// mergeDocuments merges the top-level mapping over on top of base
+func mergeDocuments(base, over *yaml.Node) *yaml.Node {
+	if base == nil {
+		return over
+	}
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: append([]*yaml.Node(nil), base.Content...)}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		j := keyIndex(merged, key.Value)
+		switch {
+		case j < 0:
+			merged.Content = append(merged.Content, key, value)
+		case namedLists[key.Value]:
+			merged.Content[j+1] = mergeNamed(merged.Content[j+1], value)
+		default:
+			merged.Content[j+1] = mergeNodes(merged.Content[j+1], value)
+		}
+	}
+	return merged
+}
+
+// mergeNodes merges two mappings key by key; any other value of over replaces base
+func mergeNodes(base, over *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: append([]*yaml.Node(nil), base.Content...)}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		if j := keyIndex(merged, key.Value); j >= 0 {
+			merged.Content[j+1] = mergeNodes(merged.Content[j+1], value)
+		} else {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return merged
+}
+
+// mergeNamed merges two lists of mappings, merging entries with the same
+// name in place and appending the others
+func mergeNamed(base, over *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.SequenceNode || over.Kind != yaml.SequenceNode {
+		return over
+	}
+	merged := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: append([]*yaml.Node(nil), base.Content...)}
+	for _, item := range over.Content {
+		name := entryName(item)
+		replaced := false
+		if name != "" {
+			for j, existing := range merged.Content {
+				if entryName(existing) == name {
+					merged.Content[j] = mergeNodes(existing, item)
+					replaced = true
+					break
+				}
+			}
+		}
+		if !replaced {
+			merged.Content = append(merged.Content, item)
+		}
+	}
+	return merged
+}
+
+// applyExtends resolves `extends:` on every step and drops hidden steps
+func applyExtends(root *yaml.Node) error {
+	j := keyIndex(root, "steps")
+	if j < 0 || root.Content[j+1].Kind != yaml.SequenceNode {
+		return nil
+	}
+	steps := root.Content[j+1]
+
+	byName := make(map[string]*yaml.Node)
+	for _, step := range steps.Content {
+		if name := entryName(step); name != "" {
+			byName[name] = step
+		}
+	}
+
+	resolved := make(map[*yaml.Node]*yaml.Node)
+	var extend func(step *yaml.Node, chain []string) (*yaml.Node, error)
+	extend = func(step *yaml.Node, chain []string) (*yaml.Node, error) {
+		if done, ok := resolved[step]; ok {
+			return done, nil
+		}
+		name := entryName(step)
+		for _, seen := range chain {
+			if seen == name {
+				return nil, fmt.Errorf("extends cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+		chain = append(chain, name)
+
+		k := keyIndex(step, "extends")
+		if k < 0 {
+			resolved[step] = step
+			return step, nil
+		}
+		var bases StringList
+		if err := step.Content[k+1].Decode(&bases); err != nil {
+			return nil, fmt.Errorf("step %q: extends: %w", name, err)
+		}
+
+		own := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		own.Content = append(own.Content, step.Content[:k]...)
+		own.Content = append(own.Content, step.Content[k+2:]...)
+
+		var merged *yaml.Node
+		for _, baseName := range bases {
+			base, ok := byName[baseName]
+			if !ok {
+				return nil, fmt.Errorf("step %q extends unknown step %q", name, baseName)
+			}
+			base, err := extend(base, chain)
+			if err != nil {
+				return nil, err
+			}
+			if merged == nil {
+				merged = base
+			} else {
+				merged = mergeNodes(merged, base)
+			}
+		}
+		merged = mergeNodes(merged, own)
+		resolved[step] = merged
+		return merged, nil
+	}
+
+	var kept []*yaml.Node
+	for _, step := range steps.Content {
+		full, err := extend(step, nil)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(entryName(full), ".") {
+			kept = append(kept, full)
+		}
+	}
+	steps.Content = kept
+	return nil
+}
+
+// keyIndex returns the index of key in the content of a mapping, or -1
+func keyIndex(mapping *yaml.Node, key string) int {
+	if mapping.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeKey deletes key from a mapping and returns its value, if any
+func removeKey(mapping *yaml.Node, key string) *yaml.Node {
+	i := keyIndex(mapping, key)
+	if i < 0 {
+		return nil
+	}
+	value := mapping.Content[i+1]
+	mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+	return value
+}
+
+// entryName returns the `name` of a mapping in a list, or ""
+func entryName(node *yaml.Node) string {
+	if i := keyIndex(node, "name"); i >= 0 {
+		return node.Content[i+1].Value
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package ci
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPipelineMergesIncludes(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "ci"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ci", "common.yaml"), []byte(`
+env:
+  CGO_ENABLED: "0"
+steps:
+- name: Lint
+  commands: [golangci-lint run]
+`), 0644))
+
+	ws := &workspaceImpl{dir: dir}
+	ws.SetTemplateSource(TemplateSourceFunc(func(name string) ([]byte, error) {
+		if name != "go-service" {
+			return nil, errors.New("not found")
+		}
+		return []byte(`
+params:
+  go_version: "1.21"
+image: golang:${{ params.go_version }}
+max_parallel: ${{ params.parallel }}
+steps:
+- name: .go-test
+  timeout: 10m
+  commands: [go test ./...]
+- name: Build
+  commands: [go build ./...]
+`), nil
+	}))
+
+	pipeline, err := ws.LoadPipeline([]byte(`
+include:
+- ci/common.yaml
+- template: go-service
+  params:
+    go_version: "1.22"
+    parallel: "2"
+name: Orders
+env:
+  SERVICE: orders
+steps:
+- name: Test
+  extends: .go-test
+  commands: [go test -race ./...]
+- name: Build
+  workdir: cmd/orders
+`))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "Orders", pipeline.Name)
+	assert.Equal(t, "golang:1.22", pipeline.Image)
+	assert.Equal(t, 2, pipeline.MaxParallel)
+	assert.Equal(t, map[string]string{"CGO_ENABLED": "0", "SERVICE": "orders"}, pipeline.Env)
+
+	var names []string
+	for _, step := range pipeline.Steps {
+		names = append(names, step.Name)
+	}
+	assert.Equal(t, []string{"Lint", "Build", "Test"}, names)
+	assert.Equal(t, "cmd/orders", pipeline.Steps[1].Workdir)
+	assert.Equal(t, []string{"go build ./..."}, pipeline.Steps[1].Commands)
+	assert.Equal(t, "10m0s", pipeline.Steps[2].Timeout.String())
+	assert.Equal(t, []string{"go test -race ./..."}, pipeline.Steps[2].Commands)
+}
+
+func TestLoadPipelineIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("include: [b.yaml]\n"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("include: [a.yaml]\n"), 0644))
+	ws := &workspaceImpl{dir: dir}
+
+	_, err := ws.LoadPipeline([]byte("include: [a.yaml]\n"))
+	assert.ErrorContains(t, err, "include cycle: pipeline -> a.yaml -> b.yaml -> a.yaml")
+
+	_, err = ws.LoadPipeline([]byte("include: [../secrets.yaml]\n"))
+	assert.ErrorContains(t, err, "outside the workspace")
+
+	_, err = ws.LoadPipeline([]byte("include:\n- template: shared\n"))
+	assert.ErrorContains(t, err, "no template source configured")
+
+	_, err = ws.LoadPipeline([]byte("steps:\n- name: A\n  extends: B\n- name: B\n  extends: A\n"))
+	assert.ErrorContains(t, err, "extends cycle")
+}
+
+func TestLoadPipelineSubstitutesTopLevelParams(t *testing.T) {
+	ws := &workspaceImpl{dir: t.TempDir()}
+
+	pipeline, err := ws.LoadPipeline([]byte(`
+params:
+  go_version: "1.22"
+image: golang:${{ params.go_version }}
+steps:
+- name: Test
+  commands:
+  - go${{ params.go_version }} test ./...
+`))
+	assert.Nil(t, err)
+	assert.Empty(t, pipeline.Params)
+	assert.Equal(t, "golang:1.22", pipeline.Image)
+	assert.Equal(t, []string{"go1.22 test ./..."}, pipeline.Steps[0].Commands)
+
+	_, err = ws.LoadPipeline([]byte(`
+image: golang:${{ params.go_version }}
+steps:
+- name: Test
+  commands: [go test ./...]
+`))
+	assert.ErrorContains(t, err, `pipeline: line 2: parameter "go_version" has no value`)
+}
@@ -0,0 +1,191 @@
+package logs
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLinesPerStream is the number of lines kept for one run; older lines
+	// are dropped but offsets keep counting so clients can still resume.
+	// Streams grow to twice as many lines before they are trimmed back in
+	// one copy, so that appending stays cheap on long runs.
+	maxLinesPerStream = 100000
+	// maxFinishedStreams is how many finished runs stay available for replay
+	maxFinishedStreams = 100
+)
+
+// Line is a single line of output from a pipeline run
+type Line struct {
+	Offset int       `json:"offset"`
+	Step   string    `json:"step,omitempty"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// Broker keeps the live log streams of pipeline runs
+type Broker struct {
+	mu       sync.Mutex
+	streams  map[int64]*Stream
+	finished []int64
+}
+
+// NewBroker creates a new Broker instance
+func NewBroker() *Broker {
+	return &Broker{
+		streams: make(map[int64]*Stream),
+	}
+}
+
+// Open returns the stream for a run, creating it if needed
+func (b *Broker) Open(runID int64) *Stream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.streams[runID]; ok {
+		return s
+	}
+	s := NewStream()
+	b.streams[runID] = s
+	return s
+}
+
+// Get returns the stream for a run if the broker still holds it
+func (b *Broker) Get(runID int64) (*Stream, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[runID]
+	return s, ok
+}
+
+// Close marks the stream of a run as complete. The stream stays readable
+// until enough newer runs have finished to push it out.
+func (b *Broker) Close(runID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.streams[runID]
+	if !ok {
+		return
+	}
+	s.Close()
+
+	b.finished = append(b.finished, runID)
+	for len(b.finished) > maxFinishedStreams {
+		delete(b.streams, b.finished[0])
+		b.finished = b.finished[1:]
+	}
+}
+
+// NewStream creates a stream that is not tracked by any broker, for
+// example to replay the stored output of an old run
+func NewStream() *Stream {
+	return &Stream{changed: make(chan struct{})}
+}
+
+// Stream is the append-only log of one run
+type Stream struct {
+	mu      sync.Mutex
+	base    int
+	lines   []Line
+	closed  bool
+	changed chan struct{}
+}
+
+// Append adds a line of text attributed to step
+func (s *Stream) Append(step, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.lines = append(s.lines, Line{
+		Offset: s.base + len(s.lines),
+		Step:   step,
+		Text:   text,
+		Time:   time.Now(),
+	})
+	if len(s.lines) > 2*maxLinesPerStream {
+		drop := len(s.lines) - maxLinesPerStream
+		s.lines = append([]Line(nil), s.lines[drop:]...)
+		s.base += drop
+	}
+	s.notify()
+}
+
+// ReadFrom returns the lines starting at offset, whether the stream is
+// complete, and a channel that is closed when more lines arrive
+func (s *Stream) ReadFrom(offset int) ([]Line, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset < s.base {
+		offset = s.base
+	}
+	var lines []Line
+	if i := offset - s.base; i < len(s.lines) {
+		lines = append(lines, s.lines[i:]...)
+	}
+	return lines, s.closed, s.changed
+}
+
+// StepWriter returns a writer that splits output into lines for step
+func (s *Stream) StepWriter(step string) io.WriteCloser {
+	return &lineWriter{stream: s, step: step}
+}
+
+// Close marks the stream as complete and wakes up all readers
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.notify()
+	}
+}
+
+// notify wakes up all readers waiting for changes; callers hold s.mu
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// lineWriter buffers partial lines until a newline or Close
+type lineWriter struct {
+	mu     sync.Mutex
+	stream *Stream
+	step   string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.stream.Append(w.step, string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.stream.Append(w.step, string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package logs
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamSplitsLinesAndReplaysFromOffset(t *testing.T) {
+	broker := NewBroker()
+	stream := broker.Open(7)
+
+	w := stream.StepWriter("build")
+	io.WriteString(w, "compiling")
+	io.WriteString(w, " main.go\r\nlinking\npartial")
+
+	lines, closed, changed := stream.ReadFrom(0)
+	assert.False(t, closed)
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "compiling main.go", lines[0].Text)
+	assert.Equal(t, "build", lines[1].Step)
+
+	w.Close()
+	select {
+	case <-changed:
+	default:
+		t.Fatal("readers were not notified of new output")
+	}
+
+	lines, _, _ = stream.ReadFrom(2)
+	assert.Equal(t, []string{"partial"}, texts(lines))
+	assert.Equal(t, 2, lines[0].Offset)
+
+	broker.Close(7)
+	same, ok := broker.Get(7)
+	assert.True(t, ok)
+	lines, closed, _ = same.ReadFrom(3)
+	assert.True(t, closed)
+	assert.Empty(t, lines)
+
+	stream.Append("build", "ignored after close")
+	lines, _, _ = stream.ReadFrom(0)
+	assert.Len(t, lines, 3)
+}
+
+func TestStreamDropsOldLines(t *testing.T) {
+	stream := NewStream()
+	for i := 0; i < 2*maxLinesPerStream; i++ {
+		stream.Append("", "line")
+	}
+	lines, _, _ := stream.ReadFrom(0)
+	assert.Len(t, lines, 2*maxLinesPerStream)
+
+	stream.Append("", "last")
+	lines, _, _ = stream.ReadFrom(0)
+	assert.Len(t, lines, maxLinesPerStream)
+	assert.Equal(t, maxLinesPerStream+1, lines[0].Offset)
+	assert.Equal(t, "last", lines[len(lines)-1].Text)
+	assert.Equal(t, 2*maxLinesPerStream, lines[len(lines)-1].Offset)
+}
+
+func TestBrokerEvictsOldFinishedStreams(t *testing.T) {
+	broker := NewBroker()
+	for id := int64(0); id <= maxFinishedStreams; id++ {
+		broker.Open(id).Append("", "line")
+		broker.Close(id)
+	}
+
+	_, ok := broker.Get(0)
+	assert.False(t, ok)
+	_, ok = broker.Get(maxFinishedStreams)
+	assert.True(t, ok)
+}
+
+func texts(lines []Line) []string {
+	var out []string
+	for _, line := range lines {
+		out = append(out, line.Text)
+	}
+	return out
+}
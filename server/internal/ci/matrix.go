@@ -0,0 +1,336 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Matrix expands a pipeline or step into one job per combination of its
+// axes. In YAML every key other than include, exclude and fail_fast is an
+// axis with a list of values:
+//
+//	matrix:
+//	  go: ["1.21", "1.22"]
+//	  db: [postgres, mysql]
+//	  exclude:
+//	    - {go: "1.21", db: mysql}
+//	  fail_fast: true
+type Matrix struct {
+	// Axes holds the values of every axis, in the order of AxisNames
+	Axes      map[string][]string
+	AxisNames []string
+	// Include adds jobs with these exact variables
+	Include []map[string]string
+	// Exclude drops the combinations that match every variable of an entry
+	Exclude []map[string]string
+	// FailFast cancels the other jobs of the matrix as soon as one fails
+	FailFast bool
+}
+
+func (m *Matrix) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: matrix must be a mapping", value.Line)
+	}
+
+	m.Axes = make(map[string][]string)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, node := value.Content[i].Value, value.Content[i+1]
+		var err error
+		switch key {
+		case "include":
+			err = node.Decode(&m.Include)
+		case "exclude":
+			err = node.Decode(&m.Exclude)
+		case "fail_fast":
+			err = node.Decode(&m.FailFast)
+		default:
+			if node.Kind != yaml.SequenceNode {
+				return fmt.Errorf("line %d: matrix axis %q must be a list of values", node.Line, key)
+			}
+			var values []string
+			err = node.Decode(&values)
+			m.Axes[key] = values
+			m.AxisNames = append(m.AxisNames, key)
+		}
+		if err != nil {
+			return fmt.Errorf("matrix %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// matrixJob ties a step expanded from a matrix to its siblings
+type matrixJob struct {
+	// group identifies the matrix the job belongs to
+	group int
+	// combo identifies the combination within the group
+	combo    int
+	failFast bool
+	vars     map[string]string
+	names    []string
+}
+
+// combinations returns the variables of every job of the matrix
+func (m *Matrix) combinations() ([]map[string]string, []string, error) {
+	names := append([]string(nil), m.AxisNames...)
+	known := make(map[string]bool)
+	for _, name := range names {
+		if len(m.Axes[name]) == 0 {
+			return nil, nil, fmt.Errorf("matrix axis %q has no values", name)
+		}
+		known[name] = true
+	}
+	for _, exclude := range m.Exclude {
+		for key := range exclude {
+			if !known[key] {
+				return nil, nil, fmt.Errorf("matrix exclude refers to unknown axis %q", key)
+			}
+		}
+	}
+
+	var combos []map[string]string
+	if len(names) > 0 {
+		combos = []map[string]string{{}}
+		for _, name := range names {
+			var next []map[string]string
+			for _, combo := range combos {
+				for _, value := range m.Axes[name] {
+					vars := make(map[string]string, len(combo)+1)
+					for k, v := range combo {
+						vars[k] = v
+					}
+					vars[name] = value
+					next = append(next, vars)
+				}
+			}
+			combos = next
+		}
+	}
+
+	kept := combos[:0]
+	for _, combo := range combos {
+		excluded := false
+		for _, exclude := range m.Exclude {
+			if matchesVars(combo, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, combo)
+		}
+	}
+	combos = kept
+
+	for _, include := range m.Include {
+		duplicate := false
+		for _, combo := range combos {
+			if len(combo) == len(include) && matchesVars(combo, include) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		combos = append(combos, include)
+		var extra []string
+		for key := range include {
+			if !known[key] {
+				extra = append(extra, key)
+				known[key] = true
+			}
+		}
+		sort.Strings(extra)
+		names = append(names, extra...)
+	}
+
+	if len(combos) == 0 {
+		return nil, nil, fmt.Errorf("matrix has no jobs")
+	}
+	return combos, names, nil
+}
+
+// matchesVars reports whether vars has every key and value of want
+func matchesVars(vars, want map[string]string) bool {
+	for k, v := range want {
+		if vars[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// jobName appends the variables of a job to name, in axis order
+func jobName(name string, vars map[string]string, names []string) string {
+	parts := make([]string, 0, len(vars))
+	for _, key := range names {
+		if value, ok := vars[key]; ok {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	return name + " (" + strings.Join(parts, ", ") + ")"
+}
+
+var matrixRef = regexp.MustCompile(`\$\{\{\s*matrix\.([A-Za-z0-9_-]+)\s*\}\}`)
+
+// substituteMatrix replaces ${{ matrix.key }} references in s
+func substituteMatrix(s string, vars map[string]string) (string, error) {
+	var missing string
+	out := matrixRef.ReplaceAllStringFunc(s, func(ref string) string {
+		key := matrixRef.FindStringSubmatch(ref)[1]
+		value, ok := vars[key]
+		if !ok && missing == "" {
+			missing = key
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown matrix variable %q", missing)
+	}
+	return out, nil
+}
+
+// expandJob returns a copy of step for one matrix job, with the job's
+// variables substituted and exported as MATRIX_<KEY>
+func expandJob(step Step, job *matrixJob) (Step, error) {
+	var err error
+	sub := func(s string) string {
+		if err != nil {
+			return s
+		}
+		var out string
+		out, err = substituteMatrix(s, job.vars)
+		return out
+	}
+
+	expanded := step
+	expanded.Name = jobName(step.Name, job.vars, job.names)
+	expanded.Matrix = nil
+	expanded.job = job
+	expanded.Image = sub(step.Image)
+	expanded.Workdir = sub(step.Workdir)
+	expanded.Commands = make([]string, len(step.Commands))
+	for i, cmd := range step.Commands {
+		expanded.Commands[i] = sub(cmd)
+	}
+	expanded.Env = make(map[string]string, len(step.Env)+len(job.vars))
+	for key, value := range job.vars {
+		expanded.Env["MATRIX_"+strings.ToUpper(nonIdentChars.ReplaceAllString(key, "_"))] = value
+	}
+	for key, value := range step.Env {
+		expanded.Env[key] = sub(value)
+	}
+	if err != nil {
+		return Step{}, fmt.Errorf("step %q: %w", step.Name, err)
+	}
+	return expanded, nil
+}
+
+// expandMatrix returns the steps of pipeline with every matrix expanded into
+// its jobs. Needs on a step that was expanded are rewritten to need all of
+// its jobs; with a pipeline matrix, each combination forms its own copy of
+// the whole graph. Pipelines without a matrix are returned unchanged.
+func expandMatrix(pipeline *Pipeline) ([]Step, error) {
+	hasMatrix := pipeline.Matrix != nil
+	for _, step := range pipeline.Steps {
+		if step.Matrix != nil {
+			if pipeline.Matrix != nil {
+				return nil, fmt.Errorf("step %q sets a matrix but the pipeline already has one", step.Name)
+			}
+			hasMatrix = true
+		}
+	}
+	if !hasMatrix {
+		return pipeline.Steps, nil
+	}
+
+	// Without needs, steps run in file order; make that explicit so it
+	// survives the renaming of expanded steps
+	steps := append([]Step(nil), pipeline.Steps...)
+	usesNeeds := false
+	for _, step := range steps {
+		if step.Needs != nil {
+			usesNeeds = true
+		}
+	}
+	if !usesNeeds {
+		for i := range steps {
+			steps[i].Needs = []string{}
+			if i > 0 {
+				steps[i].Needs = []string{steps[i-1].Name}
+			}
+		}
+	}
+
+	if pipeline.Matrix != nil {
+		return expandPipelineMatrix(pipeline.Matrix, steps)
+	}
+
+	jobNames := make(map[string][]string)
+	var expanded []Step
+	for i, step := range steps {
+		if step.Matrix == nil {
+			expanded = append(expanded, step)
+			continue
+		}
+		combos, names, err := step.Matrix.combinations()
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", step.Name, err)
+		}
+		for c, vars := range combos {
+			job := &matrixJob{group: i + 1, combo: c, failFast: step.Matrix.FailFast, vars: vars, names: names}
+			s, err := expandJob(step, job)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, s)
+			jobNames[step.Name] = append(jobNames[step.Name], s.Name)
+		}
+	}
+
+	for i := range expanded {
+		var needs []string
+		for _, need := range expanded[i].Needs {
+			if jobs, ok := jobNames[need]; ok {
+				needs = append(needs, jobs...)
+			} else {
+				needs = append(needs, need)
+			}
+		}
+		if needs != nil {
+			expanded[i].Needs = needs
+		}
+	}
+	return expanded, nil
+}
+
+// expandPipelineMatrix copies every step once per combination of m
+func expandPipelineMatrix(m *Matrix, steps []Step) ([]Step, error) {
+	combos, names, err := m.combinations()
+	if err != nil {
+		return nil, fmt.Errorf("pipeline: %w", err)
+	}
+
+	var expanded []Step
+	for c, vars := range combos {
+		job := &matrixJob{combo: c, failFast: m.FailFast, vars: vars, names: names}
+		for _, step := range steps {
+			s, err := expandJob(step, job)
+			if err != nil {
+				return nil, err
+			}
+			needs := make([]string, len(s.Needs))
+			for i, need := range s.Needs {
+				needs[i] = jobName(need, vars, names)
+			}
+			s.Needs = needs
+			expanded = append(expanded, s)
+		}
+	}
+	return expanded, nil
+}
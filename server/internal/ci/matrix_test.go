@@ -0,0 +1,124 @@
+package ci
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandStepMatrix(t *testing.T) {
+	var pipeline Pipeline
+	err := yaml.Unmarshal([]byte(`
+name: Matrix
+steps:
+- name: Lint
+  commands: [lint]
+- name: Test
+  image: golang:${{ matrix.go }}
+  matrix:
+    go: [1.21, 1.22]
+    db: [postgres, mysql]
+    exclude:
+    - {go: 1.21, db: mysql}
+    include:
+    - {go: "1.23", db: sqlite, race: "on"}
+  commands:
+  - go test -tags ${{ matrix.db }} ./...
+- name: Deploy
+  commands: [deploy]
+`), &pipeline)
+	assert.Nil(t, err)
+
+	steps, err := expandMatrix(&pipeline)
+	assert.Nil(t, err)
+
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	assert.Equal(t, []string{
+		"Lint",
+		"Test (go=1.21, db=postgres)",
+		"Test (go=1.22, db=postgres)",
+		"Test (go=1.22, db=mysql)",
+		"Test (go=1.23, db=sqlite, race=on)",
+		"Deploy",
+	}, names)
+
+	assert.Equal(t, "golang:1.22", steps[3].Image)
+	assert.Equal(t, []string{"go test -tags mysql ./..."}, steps[3].Commands)
+	assert.Equal(t, map[string]string{"MATRIX_GO": "1.22", "MATRIX_DB": "mysql"}, steps[3].Env)
+	assert.Equal(t, []string{"Lint"}, steps[1].Needs)
+	assert.Equal(t, names[1:5], steps[5].Needs)
+
+	pipeline.Steps[1].Commands = []string{"echo ${{ matrix.missing }}"}
+	_, err = expandMatrix(&pipeline)
+	assert.ErrorContains(t, err, `unknown matrix variable "missing"`)
+}
+
+func TestExpandPipelineMatrix(t *testing.T) {
+	pipeline := &Pipeline{
+		Matrix: &Matrix{Axes: map[string][]string{"node": {"18", "20"}}, AxisNames: []string{"node"}},
+		Steps: []Step{
+			{Name: "Install", Commands: []string{"npm ci"}},
+			{Name: "Test", Commands: []string{"npm test"}},
+		},
+	}
+
+	steps, err := expandMatrix(pipeline)
+	assert.Nil(t, err)
+	assert.Len(t, steps, 4)
+	assert.Equal(t, "Test (node=20)", steps[3].Name)
+	assert.Equal(t, []string{"Install (node=20)"}, steps[3].Needs)
+	assert.Equal(t, []string{}, steps[2].Needs)
+}
+
+func TestRunMatrixFailFast(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		ws := newFakeWorkspace()
+		ws.handlers["fail"] = func(ctx context.Context) ([]byte, error) {
+			return nil, errors.New("exit status 1")
+		}
+		ws.handlers["slow"] = func(ctx context.Context) ([]byte, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		pipeline := &Pipeline{
+			Name:        "Matrix",
+			MaxParallel: 2,
+			Steps: []Step{{
+				Name: "Test",
+				Matrix: &Matrix{
+					Axes:      map[string][]string{"cmd": {"slow", "fail", "ok"}},
+					AxisNames: []string{"cmd"},
+					FailFast:  failFast,
+				},
+				Commands: []string{"${{ matrix.cmd }}"},
+			}},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if !failFast {
+			// Without fail fast the slow job keeps running until the run ends
+			ws.handlers["ok"] = func(context.Context) ([]byte, error) {
+				cancel()
+				return nil, nil
+			}
+		}
+		result, err := NewExecutor(ws).Run(ctx, pipeline)
+		cancel()
+		output := result.Log()
+
+		assert.ErrorContains(t, err, "exit status 1")
+		if failFast {
+			assert.ElementsMatch(t, []string{"slow", "fail"}, ws.calls)
+			assert.Contains(t, output, `Cancelled because "Test (cmd=fail)" failed`)
+			assert.NotContains(t, output, "Step: Test (cmd=ok)")
+		} else {
+			assert.ElementsMatch(t, []string{"slow", "fail", "ok"}, ws.calls)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package mirrors
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+// indexFile is the name of the file listing the mirrors of a Cache
+const indexFile = "index.json"
+
+// prunedPrefix starts the name of the directories pruned mirrors are
+// moved to until they are deleted
+const prunedPrefix = "pruned"
+
+// mirrorRefSpec fetches every reference of the remote under its own name,
+// as git clone --mirror does
+const mirrorRefSpec = config.RefSpec("+refs/*:refs/*")
+
+// Mirror describes the bare mirror of a remote repository
+type Mirror struct {
+	URL        string    `json:"url"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"createdAt"`
+	FetchedAt  time.Time `json:"fetchedAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	Uses       int64     `json:"uses"`
+}
+
+// Stats reports the mirrors of a Cache. Hits counts the workspaces cloned
+// from an existing mirror and Misses the mirrors created, since the
+// process started.
+type Stats struct {
+	Mirrors   []Mirror `json:"mirrors"`
+	TotalSize int64    `json:"totalSize"`
+	Hits      int64    `json:"hits"`
+	Misses    int64    `json:"misses"`
+}
+
+// PruneResult reports what a prune removed
+type PruneResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// entry is a mirror along with the state of its users
+type entry struct {
+	Mirror
+	// fetch serializes the fetches into the mirror
+	fetch sync.Mutex
+	// users counts the clones reading the mirror, which is not pruned
+	// until they are done
+	users int
+}
+
+// Cache keeps one bare mirror per remote URL on local disk. Mirrors are
+// updated with an incremental fetch before every use, so that workspaces
+// are cloned from local disk rather than over the network.
+type Cache struct {
+	dir string
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	hits    int64
+	misses  int64
+}
+
+// NewCache creates a new Cache keeping mirrors in dir
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mirror directory: %w", err)
+	}
+
+	c := &Cache{
+		dir:     dir,
+		entries: make(map[string]*entry),
+	}
+
+	// Mirrors a previous process pruned but did not finish deleting
+	pruned, _ := filepath.Glob(filepath.Join(dir, prunedPrefix+"*"))
+	for _, path := range pruned {
+		os.RemoveAll(path)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read mirror index: %w", err)
+	}
+	if err == nil {
+		var mirrors []Mirror
+		if err := json.Unmarshal(data, &mirrors); err != nil {
+			return nil, fmt.Errorf("failed to parse mirror index: %w", err)
+		}
+		for _, mirror := range mirrors {
+			c.entries[mirror.URL] = &entry{Mirror: mirror}
+		}
+	}
+	return c, nil
+}
+
+// path returns the directory of the mirror of url
+func (c *Cache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".git")
+}
+
+// Acquire brings the mirror of url up to date, creating it on first use,
+// and returns its path along with the function to call once the mirror is
+// no longer read. The mirror is not pruned until then.
+func (c *Cache) Acquire(ctx context.Context, url string, auth transport.AuthMethod) (string, func(), error) {
+	requested := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[url]
+	if !ok {
+		e = &entry{Mirror: Mirror{URL: url, CreatedAt: requested}}
+		c.entries[url] = e
+	}
+	e.users++
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		e.users--
+		c.mu.Unlock()
+	}
+	if err := c.update(ctx, e, requested, auth); err != nil {
+		c.mu.Lock()
+		e.users--
+		// Forget a mirror that could not be created
+		if e.FetchedAt.IsZero() && e.users == 0 && c.entries[url] == e {
+			delete(c.entries, url)
+		}
+		c.mu.Unlock()
+		return "", nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.Uses++
+	e.LastUsedAt = time.Now()
+	// Losing a usage time only affects pruning, so a failed write is not
+	// worth failing the clone over
+	c.writeIndex()
+	return c.path(url), release, nil
+}
+
+// update fetches into the mirror of e unless another fetch started after
+// requested already did
+func (c *Cache) update(ctx context.Context, e *entry, requested time.Time, auth transport.AuthMethod) error {
+	e.fetch.Lock()
+	defer e.fetch.Unlock()
+
+	c.mu.Lock()
+	fetchedAt := e.FetchedAt
+	c.mu.Unlock()
+	if fetchedAt.After(requested) {
+		c.count(true)
+		return nil
+	}
+
+	dir := c.path(e.URL)
+	repo, err := git.PlainOpen(dir)
+	created := errors.Is(err, git.ErrRepositoryNotExists)
+	if created {
+		repo, err = initMirror(dir, e.URL)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open mirror of %s: %w", e.URL, err)
+	}
+
+	started := time.Now()
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{mirrorRefSpec},
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if created {
+			os.RemoveAll(dir)
+		}
+		return fmt.Errorf("failed to fetch mirror of %s: %w", e.URL, err)
+	}
+	c.count(!created)
+
+	size := ci.DirSize(dir)
+	c.mu.Lock()
+	e.FetchedAt = started
+	e.Size = size
+	c.mu.Unlock()
+	return nil
+}
+
+// initMirror creates an empty bare mirror of url in dir
+func initMirror(dir, url string) (*git.Repository, error) {
+	repo, err := git.PlainInit(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{url},
+		Fetch: []config.RefSpec{mirrorRefSpec},
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// Workspaces fetch single commits from the mirror
+	cfg, err := repo.Config()
+	if err == nil {
+		cfg.Raw.Section("uploadpack").SetOption("allowReachableSHA1InWant", "true")
+		err = repo.SetConfig(cfg)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (c *Cache) count(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// Stats returns every mirror, most recently used first, with the hit rate
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := Stats{Mirrors: make([]Mirror, 0, len(c.entries)), Hits: c.hits, Misses: c.misses}
+	for _, e := range c.entries {
+		if e.FetchedAt.IsZero() {
+			continue
+		}
+		stats.Mirrors = append(stats.Mirrors, e.Mirror)
+		stats.TotalSize += e.Size
+	}
+	sort.Slice(stats.Mirrors, func(i, j int) bool {
+		return stats.Mirrors[i].LastUsedAt.After(stats.Mirrors[j].LastUsedAt)
+	})
+	return stats
+}
+
+// Prune removes the mirrors last used before cutoff that no clone is
+// reading. A zero cutoff removes every mirror not in use.
+func (c *Cache) Prune(cutoff time.Time) (PruneResult, error) {
+	var result PruneResult
+	trash, err := os.MkdirTemp(c.dir, prunedPrefix)
+	if err != nil {
+		return result, fmt.Errorf("failed to prune mirrors: %w", err)
+	}
+
+	// The mirrors are moved aside under the lock and deleted after it, so
+	// that slow deletes do not hold up Acquire
+	c.mu.Lock()
+	for url, e := range c.entries {
+		if e.users > 0 || (!cutoff.IsZero() && !e.LastUsedAt.Before(cutoff)) {
+			continue
+		}
+		path := c.path(url)
+		err = os.Rename(path, filepath.Join(trash, filepath.Base(path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("failed to delete mirror of %s: %w", url, err)
+			break
+		}
+		err = nil
+		delete(c.entries, url)
+		result.Removed++
+		result.Freed += e.Size
+	}
+	if indexErr := c.writeIndex(); err == nil {
+		err = indexErr
+	}
+	c.mu.Unlock()
+
+	if removeErr := os.RemoveAll(trash); removeErr != nil && err == nil {
+		err = fmt.Errorf("failed to delete pruned mirrors: %w", removeErr)
+	}
+	return result, err
+}
+
+// writeIndex persists the mirror list; the caller must hold c.mu
+func (c *Cache) writeIndex() error {
+	mirrors := make([]Mirror, 0, len(c.entries))
+	for _, e := range c.entries {
+		// Mirrors are only listed once they were fetched
+		if !e.FetchedAt.IsZero() {
+			mirrors = append(mirrors, e.Mirror)
+		}
+	}
+	data, err := json.Marshal(mirrors)
+	if err != nil {
+		return fmt.Errorf("failed to encode mirror index: %w", err)
+	}
+	tmp := filepath.Join(c.dir, indexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write mirror index: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, indexFile)); err != nil {
+		return fmt.Errorf("failed to write mirror index: %w", err)
+	}
+	return nil
+}
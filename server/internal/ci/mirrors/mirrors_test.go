@@ -0,0 +1,100 @@
+package mirrors
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// commit writes VERSION in the worktree of repo and commits it
+func commit(t *testing.T, repo *git.Repository, version string) plumbing.Hash {
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(wt.Filesystem.Root(), "VERSION"), []byte(version), 0644))
+	_, err = wt.Add("VERSION")
+	assert.Nil(t, err)
+	hash, err := wt.Commit(version, &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+	return hash
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	remoteDir := t.TempDir()
+	remote, err := git.PlainInit(remoteDir, false)
+	assert.Nil(t, err)
+	first := commit(t, remote, "1")
+	url := "file://" + remoteDir
+
+	dir := t.TempDir()
+	c, err := NewCache(dir)
+	assert.Nil(t, err)
+
+	path, release, err := c.Acquire(ctx, url, nil)
+	assert.Nil(t, err)
+	release()
+	mirror, err := git.PlainOpen(path)
+	assert.Nil(t, err)
+	_, err = mirror.CommitObject(first)
+	assert.Nil(t, err)
+
+	// New commits are fetched into the existing mirror
+	second := commit(t, remote, "2")
+	path, release, err = c.Acquire(ctx, url, nil)
+	assert.Nil(t, err)
+	ref, err := mirror.Reference("refs/heads/master", true)
+	assert.Nil(t, err)
+	assert.Equal(t, second, ref.Hash())
+
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Len(t, stats.Mirrors, 1)
+	assert.Equal(t, url, stats.Mirrors[0].URL)
+	assert.Equal(t, int64(2), stats.Mirrors[0].Uses)
+	assert.Greater(t, stats.TotalSize, int64(0))
+
+	// The index survives a restart
+	reopened, err := NewCache(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, url, reopened.Stats().Mirrors[0].URL)
+
+	// Mirrors being read are not pruned
+	result, err := c.Prune(time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Removed)
+	release()
+
+	result, err = c.Prune(time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Removed)
+	result, err = c.Prune(time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.Equal(t, stats.TotalSize, result.Freed)
+	assert.NoDirExists(t, path)
+	assert.Empty(t, c.Stats().Mirrors)
+
+	_, _, err = c.Acquire(ctx, "file://"+filepath.Join(t.TempDir(), "missing"), nil)
+	assert.ErrorContains(t, err, "failed to fetch mirror")
+	assert.Empty(t, c.Stats().Mirrors)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1, "only the index is left")
+
+	// Mirrors left half deleted by a previous process are cleaned up
+	leftover := filepath.Join(dir, prunedPrefix+"123", "mirror.git")
+	assert.Nil(t, os.MkdirAll(leftover, 0755))
+	_, err = NewCache(dir)
+	assert.Nil(t, err)
+	assert.NoDirExists(t, filepath.Dir(leftover))
+}
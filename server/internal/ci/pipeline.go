@@ -1,11 +1,139 @@
 package ci
 
+import (
+	"io"
+	"time"
+)
+
 type Pipeline struct {
-	Name  string `yaml:"name"`
-	Steps []Step `yaml:"steps"`
+	// Include and Params are consumed by ResolvePipeline and are always
+	// empty on a loaded pipeline
+	Include     []Include         `yaml:"include"`
+	Params      map[string]string `yaml:"params"`
+	Name        string            `yaml:"name"`
+	Image       string            `yaml:"image"`
+	Env         map[string]string `yaml:"env"`
+	Shell       string            `yaml:"shell"`
+	MaxParallel int               `yaml:"max_parallel"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	Retry       *RetryPolicy      `yaml:"retry"`
+	Services    []Service         `yaml:"services"`
+	Matrix      *Matrix           `yaml:"matrix"`
+	Steps       []Step            `yaml:"steps"`
+}
+
+// Service is a sidecar container, such as a database, that runs for the
+// whole pipeline. Steps reach it through the <NAME>_HOST variable.
+type Service struct {
+	Name        string            `yaml:"name"`
+	Image       string            `yaml:"image"`
+	Env         map[string]string `yaml:"env"`
+	Command     []string          `yaml:"command"`
+	Healthcheck *Healthcheck      `yaml:"healthcheck"`
+}
+
+// Healthcheck is a command run inside a service container to decide when it is ready
+type Healthcheck struct {
+	Cmd         string        `yaml:"cmd"`
+	Interval    time.Duration `yaml:"interval"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Retries     int           `yaml:"retries"`
+	StartPeriod time.Duration `yaml:"start_period"`
 }
 
 type Step struct {
-	Name     string   `yaml:"name"`
-	Commands []string `yaml:"commands"`
-}
\ No newline at end of file
+	Name            string            `yaml:"name"`
+	Type            string            `yaml:"type"`
+	Extends         StringList        `yaml:"extends"`
+	Image           string            `yaml:"image"`
+	Env             map[string]string `yaml:"env"`
+	Workdir         string            `yaml:"workdir"`
+	Shell           string            `yaml:"shell"`
+	Needs           []string          `yaml:"needs"`
+	If              string            `yaml:"if"`
+	When            string            `yaml:"when"`
+	ContinueOnError bool              `yaml:"continue_on_error"`
+	Timeout         time.Duration     `yaml:"timeout"`
+	Retry           *RetryPolicy      `yaml:"retry"`
+	Artifacts       *Artifacts        `yaml:"artifacts"`
+	Cache           *Cache            `yaml:"cache"`
+	Matrix          *Matrix           `yaml:"matrix"`
+	Commands        []string          `yaml:"commands"`
+
+	// job is set on the steps expanded from a matrix
+	job *matrixJob
+}
+
+// Artifacts lists the files a step keeps after it finishes. Paths are globs
+// relative to the workspace root; a directory includes everything below it.
+// Steps that need this step get the files restored before they run.
+type Artifacts struct {
+	Paths    []string      `yaml:"paths"`
+	ExpireIn time.Duration `yaml:"expire_in"`
+	// When is on_success (the default), on_failure or always
+	When string `yaml:"when"`
+}
+
+// Cache restores directories such as dependency caches before a step and
+// saves them afterwards. Key is a template that may call
+// {{ hashFiles "go.sum" }} and {{ branch }}; a new entry is only saved when
+// no entry exists for the key yet.
+type Cache struct {
+	Key   string   `yaml:"key"`
+	Paths []string `yaml:"paths"`
+}
+
+// RetryPolicy re-runs a failed step. Attempts counts the first run, and the
+// delay before each further attempt starts at Backoff and doubles every time.
+type RetryPolicy struct {
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+// OverrideEnv sets variables for the whole pipeline, replacing the
+// values the pipeline and its steps define for them
+func (p *Pipeline) OverrideEnv(env map[string]string) {
+	if len(env) == 0 {
+		return
+	}
+	if p.Env == nil {
+		p.Env = make(map[string]string, len(env))
+	}
+	for key, value := range env {
+		p.Env[key] = value
+		for i := range p.Steps {
+			if _, ok := p.Steps[i].Env[key]; ok {
+				p.Steps[i].Env[key] = value
+			}
+		}
+	}
+}
+
+// Values accepted by Step.When
+const (
+	WhenOnSuccess = "on_success"
+	WhenOnFailure = "on_failure"
+	WhenAlways    = "always"
+)
+
+// ExecOptions controls how a single pipeline command is executed
+type ExecOptions struct {
+	// Dir is the working directory relative to the workspace root
+	Dir string
+	// Env holds the KEY=VALUE pairs of the pipeline env, the step env and
+	// the service hosts, appended after the workspace env
+	Env []string
+	// Output, when set, receives stdout and stderr while the command runs
+	Output io.Writer
+	// Image, when set, runs the command in a container from this image
+	// with the workspace mounted at ContainerWorkspace
+	Image string
+	// Network is the Docker network a containerized command joins
+	Network string
+}
+
+// LogSink receives the live output of a pipeline run, one writer per step.
+// The executor closes each writer when its step is done.
+type LogSink interface {
+	StepWriter(step string) io.WriteCloser
+}
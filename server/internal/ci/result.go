@@ -0,0 +1,271 @@
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// StepStatus is the outcome of a pipeline step
+type StepStatus string
+
+const (
+	StepPending StepStatus = "pending"
+	StepRunning StepStatus = "running"
+	StepSuccess StepStatus = "success"
+	StepFailed  StepStatus = "failed"
+	StepSkipped StepStatus = "skipped"
+	// StepCancelled marks a step or command stopped by a cancelled run or
+	// by the failure of another job of its matrix
+	StepCancelled StepStatus = "cancelled"
+	// StepWaiting marks an approval step, or a run, waiting for a decision
+	StepWaiting StepStatus = "waiting_for_approval"
+)
+
+// MaxOutputSize bounds the output kept for each step and command in a
+// RunResult. Longer output keeps its end, where errors usually are, and is
+// marked as truncated with a link to the full logs.
+const MaxOutputSize = 64 << 10
+
+// Steps describe what they built by printing these prefixes at the start
+// of a line, followed by a service name or an image reference. They are
+// collected into RunResult.Services and RunResult.Images.
+const (
+	ServiceAnnotation = "::service::"
+	ImageAnnotation   = "::image::"
+)
+
+// RunResult is the outcome of a pipeline run: the pipeline, its steps and
+// the commands of every step
+type RunResult struct {
+	Pipeline   string     `json:"pipeline"`
+	Status     StepStatus `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt time.Time  `json:"finishedAt"`
+	Error      string     `json:"error,omitempty"`
+	// Services and Images are the services and image tags the steps
+	// reported building
+	Services []string     `json:"services,omitempty"`
+	Images   []string     `json:"images,omitempty"`
+	Steps    []StepResult `json:"steps"`
+}
+
+// StepResult is the outcome of one step of a pipeline run
+type StepResult struct {
+	Name       string          `json:"name"`
+	Status     StepStatus      `json:"status"`
+	ExitCode   int             `json:"exitCode"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Attempts   []StepAttempt   `json:"attempts,omitempty"`
+	Commands   []CommandResult `json:"commands,omitempty"`
+	Artifact   *ArtifactReport `json:"artifact,omitempty"`
+	Approval   *Approval       `json:"approval,omitempty"`
+	// Output is everything the step printed, including executor notes
+	// such as restored artifacts and retries
+	Output    string `json:"output,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// LogURL points to the full logs when Output is truncated
+	LogURL string `json:"logUrl,omitempty"`
+}
+
+// CommandResult is the outcome of one command of a step. Commands left
+// after a failure are reported as skipped.
+type CommandResult struct {
+	Command    string     `json:"command"`
+	Attempt    int        `json:"attempt"`
+	Status     StepStatus `json:"status"`
+	ExitCode   int        `json:"exitCode"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Output     string     `json:"output,omitempty"`
+	Truncated  bool       `json:"truncated,omitempty"`
+	LogURL     string     `json:"logUrl,omitempty"`
+}
+
+// Log renders the run as plain text, the output of every step that ran
+// under a header with its name
+func (r *RunResult) Log() string {
+	var b strings.Builder
+	b.WriteString("Executing pipeline: ")
+	b.WriteString(r.Pipeline)
+	b.WriteRune('\n')
+	for _, step := range r.Steps {
+		if step.StartedAt == nil {
+			continue
+		}
+		b.WriteString("Step: ")
+		b.WriteString(step.Name)
+		b.WriteRune('\n')
+		b.WriteString(step.Output)
+	}
+	return b.String()
+}
+
+// stepResult holds the outcome of a single step; each step writes to its own
+// buffer so that concurrently running steps never interleave their output
+type stepResult struct {
+	status     StepStatus
+	output     strings.Builder
+	attempts   []StepAttempt
+	startedAt  time.Time
+	finishedAt time.Time
+	commands   []CommandResult
+	services   []string
+	images     []string
+	artifact   *ArtifactReport
+	approval   *Approval
+	err        error
+	// failFastBy names the matrix job whose failure cancelled this step
+	failFastBy string
+}
+
+// StepReport is a snapshot of a step handed to a RunListener
+type StepReport struct {
+	Name       string
+	Status     StepStatus
+	StartedAt  time.Time
+	FinishedAt time.Time
+	ExitCode   int
+	Attempts   []StepAttempt
+	Output     string
+	Error      string
+	// Artifact is set when the step uploaded artifacts
+	Artifact *ArtifactReport
+}
+
+// RunListener is notified as an Executor starts and finishes steps. The
+// calls are made from a single goroutine, one at a time.
+type RunListener interface {
+	StepStarted(name string, startedAt time.Time)
+	StepFinished(report StepReport)
+}
+
+func (r *stepResult) report(name string) StepReport {
+	report := StepReport{
+		Name:       name,
+		Status:     r.status,
+		StartedAt:  r.startedAt,
+		FinishedAt: r.finishedAt,
+		ExitCode:   exitCode(r.err),
+		Attempts:   r.attempts,
+		Output:     r.output.String(),
+		Artifact:   r.artifact,
+	}
+	if r.err != nil {
+		report.Error = r.err.Error()
+	}
+	return report
+}
+
+// result converts r into the StepResult of the step called name. Truncated
+// output points to logURL.
+func (r *stepResult) result(name, logURL string) StepResult {
+	step := StepResult{
+		Name:     name,
+		Status:   r.status,
+		ExitCode: exitCode(r.err),
+		Attempts: r.attempts,
+		Commands: r.commands,
+		Artifact: r.artifact,
+		Approval: r.approval,
+	}
+	if !r.startedAt.IsZero() {
+		startedAt := r.startedAt
+		step.StartedAt = &startedAt
+	}
+	if !r.finishedAt.IsZero() {
+		finishedAt := r.finishedAt
+		step.FinishedAt = &finishedAt
+	}
+	if r.err != nil {
+		step.Error = r.err.Error()
+	}
+	step.Output, step.Truncated = truncateOutput(r.output.String())
+	if step.Truncated {
+		step.LogURL = logURL
+	}
+	for i := range step.Commands {
+		if step.Commands[i].Truncated {
+			step.Commands[i].LogURL = logURL
+		}
+	}
+	return step
+}
+
+// truncateOutput keeps the last MaxOutputSize bytes of output
+func truncateOutput(output string) (string, bool) {
+	if len(output) <= MaxOutputSize {
+		return output, false
+	}
+	cut := len(output) - MaxOutputSize
+	for cut < len(output) && !utf8.RuneStart(output[cut]) {
+		cut++
+	}
+	return fmt.Sprintf("... (%d bytes truncated)\n", cut) + output[cut:], true
+}
+
+// collectAnnotations records the service and image annotations found in output
+func (r *stepResult) collectAnnotations(output []byte) {
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if name := strings.TrimPrefix(line, ServiceAnnotation); name != line && name != "" {
+			r.services = append(r.services, strings.TrimSpace(name))
+		}
+		if ref := strings.TrimPrefix(line, ImageAnnotation); ref != line && ref != "" {
+			r.images = append(r.images, strings.TrimSpace(ref))
+		}
+	}
+}
+
+// appendUnique appends the values not already in list
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// exitCode extracts the process exit code from a command error: 0 on
+// success and -1 when the command never produced an exit status
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var containerErr *ContainerExitError
+	if errors.As(err, &containerErr) {
+		return containerErr.Code
+	}
+	var restored *restoredError
+	if errors.As(err, &restored) {
+		return restored.code
+	}
+	return -1
+}
+
+// StepAttempt records a single try of a step
+type StepAttempt struct {
+	Number     int       `json:"number"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	TimedOut   bool      `json:"timedOut"`
+	Error      string    `json:"error,omitempty"`
+}
@@ -0,0 +1,151 @@
+package ci
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// ErrCommitMismatch is returned when a checkout is not at the requested commit
+var ErrCommitMismatch = errors.New("checked out commit does not match the requested commit")
+
+// fetchedCommitRef is where a commit fetched by its SHA is stored
+const fetchedCommitRef = plumbing.ReferenceName("refs/pipeslicer/commit")
+
+// unshallowDepth deepens a shallow history to all of it, as git fetch
+// --unshallow does
+const unshallowDepth = math.MaxInt32
+
+// Revision names what is checked out: a branch, a full reference such as
+// refs/tags/v1.0 or refs/pull/12/head, a commit, or a reference along with
+// the commit it is expected to be at. A commit that a reference has moved
+// on from is still checked out, from the history of the reference.
+type Revision struct {
+	Ref    string
+	Commit string
+}
+
+// Validate checks that the revision names something to check out
+func (r Revision) Validate() error {
+	if r.Ref == "" && r.Commit == "" {
+		return errors.New("a branch, ref or commit is required")
+	}
+	if r.Commit != "" && (len(r.Commit) != 40 || !plumbing.IsHash(r.Commit)) {
+		return fmt.Errorf("commit %q is not a full 40 character SHA", r.Commit)
+	}
+	return nil
+}
+
+// ReferenceName returns the full name of Ref. Names that do not start with
+// refs/ are branches.
+func (r Revision) ReferenceName() plumbing.ReferenceName {
+	if strings.HasPrefix(r.Ref, "refs/") {
+		return plumbing.ReferenceName(r.Ref)
+	}
+	return plumbing.NewBranchReferenceName(r.Ref)
+}
+
+// Branch returns the short name of Ref, such as main or v1.0
+func (r Revision) Branch() string {
+	if r.Ref == "" {
+		return ""
+	}
+	return r.ReferenceName().Short()
+}
+
+func (r Revision) String() string {
+	switch {
+	case r.Commit == "":
+		return r.Ref
+	case r.Ref == "":
+		return r.Commit
+	default:
+		return fmt.Sprintf("%s at %s", r.Ref, r.Commit)
+	}
+}
+
+// FetchRevision fetches rev from the origin remote of repo and returns the
+// commit to check out. depth limits the history fetched, 0 fetches all of
+// it. A commit that is not the head of Ref is fetched by its SHA, or when
+// the remote does not serve commits by SHA, from the whole history of Ref,
+// or of every branch and tag without one.
+func FetchRevision(repo *git.Repository, rev Revision, depth int, auth transport.AuthMethod) (plumbing.Hash, error) {
+	if err := rev.Validate(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var specs []config.RefSpec
+	if rev.Ref != "" {
+		name := rev.ReferenceName()
+		local := name
+		if name.IsBranch() {
+			local = plumbing.NewRemoteReferenceName("origin", name.Short())
+		}
+		specs = []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", name, local))}
+		if err := fetch(repo, auth, depth, specs...); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to fetch %s: %w", name, err)
+		}
+		hash, err := repo.ResolveRevision(plumbing.Revision(local))
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		if rev.Commit == "" || hash.String() == rev.Commit {
+			return *hash, nil
+		}
+	}
+
+	hash := plumbing.NewHash(rev.Commit)
+	if _, err := repo.CommitObject(hash); err == nil {
+		return hash, nil
+	}
+	err := fetch(repo, auth, depth, config.RefSpec(fmt.Sprintf("+%s:%s", rev.Commit, fetchedCommitRef)))
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		if specs == nil {
+			specs = []config.RefSpec{
+				"+refs/heads/*:refs/remotes/origin/*",
+				"+refs/tags/*:refs/tags/*",
+			}
+		}
+		err = fetch(repo, auth, unshallowDepth, specs...)
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to fetch commit %s: %w", rev.Commit, err)
+	}
+	if _, err := repo.CommitObject(hash); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("commit %s not found: %w", rev.Commit, err)
+	}
+	return hash, nil
+}
+
+// VerifyHead checks that the head of repo is at the commit of rev, if any
+func VerifyHead(repo *git.Repository, rev Revision) (plumbing.Hash, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get repository head: %w", err)
+	}
+	if rev.Commit != "" && head.Hash().String() != rev.Commit {
+		return plumbing.ZeroHash, fmt.Errorf("%w: wanted %s, got %s", ErrCommitMismatch, rev.Commit, head.Hash())
+	}
+	return head.Hash(), nil
+}
+
+func fetch(repo *git.Repository, auth transport.AuthMethod, depth int, specs ...config.RefSpec) error {
+	err := repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   specs,
+		Depth:      depth,
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package ci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// historyRemote creates a repository with three commits on master, the
+// first tagged v1.0, and a pull request ref on a commit of no branch
+func historyRemote(t *testing.T) (string, []plumbing.Hash, plumbing.Hash) {
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, false)
+	assert.Nil(t, err)
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+
+	commit := func(content string) plumbing.Hash {
+		assert.Nil(t, os.WriteFile(filepath.Join(remote, "VERSION"), []byte(content), 0644))
+		_, err := wt.Add("VERSION")
+		assert.Nil(t, err)
+		hash, err := wt.Commit(content, &git.CommitOptions{
+			Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+		})
+		assert.Nil(t, err)
+		return hash
+	}
+
+	var history []plumbing.Hash
+	for _, content := range []string{"1", "2", "3"} {
+		history = append(history, commit(content))
+	}
+	_, err = repo.CreateTag("v1.0", history[0], &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+		Message: "v1.0",
+	})
+	assert.Nil(t, err)
+
+	// The head of a pull request from a fork is on no branch
+	assert.Nil(t, wt.Checkout(&git.CheckoutOptions{Branch: "refs/heads/fork", Create: true}))
+	pull := commit("fork")
+	assert.Nil(t, repo.Storer.SetReference(plumbing.NewHashReference("refs/pull/1/head", pull)))
+	assert.Nil(t, wt.Checkout(&git.CheckoutOptions{Branch: "refs/heads/master"}))
+	assert.Nil(t, repo.Storer.RemoveReference("refs/heads/fork"))
+
+	return "file://" + remote, history, pull
+}
+
+func TestRevisionValidate(t *testing.T) {
+	assert.ErrorContains(t, Revision{}.Validate(), "is required")
+	assert.ErrorContains(t, Revision{Commit: "abc123"}.Validate(), "full 40 character SHA")
+	assert.Nil(t, Revision{Ref: "main"}.Validate())
+	assert.Nil(t, Revision{Commit: "0123456789abcdef0123456789abcdef01234567"}.Validate())
+
+	assert.Equal(t, "main", Revision{Ref: "main"}.Branch())
+	assert.Equal(t, "v1.0", Revision{Ref: "refs/tags/v1.0"}.Branch())
+	assert.Equal(t, plumbing.ReferenceName("refs/pull/1/head"), Revision{Ref: "refs/pull/1/head"}.ReferenceName())
+}
+
+func TestNewWorkspaceFromGitRevisions(t *testing.T) {
+	url, history, pull := historyRemote(t)
+
+	ws, err := NewWorkspaceFromGit(t.TempDir(), url, Revision{Ref: "refs/tags/v1.0"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, history[0].String(), ws.Commit())
+	assert.Equal(t, "v1.0", ws.Branch())
+
+	ws, err = NewWorkspaceFromGit(t.TempDir(), url, Revision{Ref: "refs/pull/1/head"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, pull.String(), ws.Commit())
+	content, err := os.ReadFile(filepath.Join(ws.Dir(), "VERSION"))
+	assert.Nil(t, err)
+	assert.Equal(t, "fork", string(content))
+
+	// The branch has moved on, its history is fetched to find the commit
+	ws, err = NewWorkspaceFromGit(t.TempDir(), url, Revision{Ref: "master", Commit: history[1].String()}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, history[1].String(), ws.Commit())
+	assert.Equal(t, "master", ws.Branch())
+	content, err = os.ReadFile(filepath.Join(ws.Dir(), "VERSION"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(content))
+
+	ws, err = NewWorkspaceFromGit(t.TempDir(), url, Revision{Commit: history[0].String()}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, history[0].String(), ws.Commit())
+
+	// The pull request commit is not in the history of master
+	_, err = NewWorkspaceFromGit(t.TempDir(), url, Revision{Ref: "master", Commit: pull.String()}, nil)
+	assert.ErrorContains(t, err, "not found")
+
+	_, err = NewWorkspaceFromGit(t.TempDir(), url, Revision{Commit: "abc"}, nil)
+	assert.ErrorContains(t, err, "full 40 character SHA")
+}
+
+func TestFetchRevisionBySHA(t *testing.T) {
+	url, history, _ := historyRemote(t)
+	remote, err := git.PlainOpen(url[len("file://"):])
+	assert.Nil(t, err)
+	cfg, err := remote.Config()
+	assert.Nil(t, err)
+	cfg.Raw.Section("uploadpack").SetOption("allowReachableSHA1InWant", "true")
+	assert.Nil(t, remote.SetConfig(cfg))
+
+	ws, err := NewWorkspaceFromGit(t.TempDir(), url, Revision{Commit: history[1].String()}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, history[1].String(), ws.Commit())
+
+	// Only the commit itself was fetched
+	repo, err := git.PlainOpen(ws.Dir())
+	assert.Nil(t, err)
+	_, err = repo.CommitObject(history[0])
+	assert.Equal(t, plumbing.ErrObjectNotFound, err)
+}
@@ -0,0 +1,151 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// KeyEnv is the environment variable holding the key secrets are
+// encrypted with. Any non-empty string works; it is hashed into an
+// AES-256 key.
+const KeyEnv = "PIPESLICER_SECRET_KEY"
+
+// ErrNoKey is returned when encrypting without a key configured
+var ErrNoKey = errors.New(KeyEnv + " is not set")
+
+// prefix marks encrypted values, so that values stored before encryption
+// was introduced still read back as plain text
+const prefix = "enc:v1:"
+
+// Cipher encrypts and decrypts secrets with AES-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a Cipher from a key of any length
+func NewCipher(key string) (*Cipher, error) {
+	if key == "" {
+		return nil, ErrNoKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt seals plaintext under a random nonce. The empty string is
+// stored as is.
+func (c *Cipher) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value returned by Encrypt. Values without the
+// encryption prefix are returned unchanged.
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret: %w", err)
+	}
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("failed to decrypt secret: value too short")
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultCipher *Cipher
+	defaultErr    error
+)
+
+// Default returns the Cipher keyed by KeyEnv
+func Default() (*Cipher, error) {
+	defaultOnce.Do(func() {
+		defaultCipher, defaultErr = NewCipher(os.Getenv(KeyEnv))
+	})
+	return defaultCipher, defaultErr
+}
+
+func init() {
+	schema.RegisterSerializer("encrypted", Serializer{})
+}
+
+// Serializer stores string fields tagged `gorm:"serializer:encrypted"`
+// encrypted with the Default cipher
+type Serializer struct{}
+
+// Scan decrypts a value read from the database
+func (Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("failed to decrypt %s: unexpected value %#v", field.Name, dbValue)
+	}
+
+	if strings.HasPrefix(value, prefix) {
+		c, err := Default()
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", field.Name, err)
+		}
+		if value, err = c.Decrypt(value); err != nil {
+			return err
+		}
+	}
+	field.ReflectValueOf(ctx, dst).SetString(value)
+	return nil
+}
+
+// Value encrypts a value written to the database
+func (Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("failed to encrypt %s: only strings are supported", field.Name)
+	}
+	if value == "" {
+		return "", nil
+	}
+	c, err := Default()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt %s: %w", field.Name, err)
+	}
+	return c.Encrypt(value)
+}
@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm/schema"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher("correct horse battery staple")
+	assert.Nil(t, err)
+
+	first, err := c.Encrypt("ghp_token")
+	assert.Nil(t, err)
+	second, err := c.Encrypt("ghp_token")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(first, prefix))
+	assert.NotContains(t, first, "ghp_token")
+	assert.NotEqual(t, first, second)
+
+	plaintext, err := c.Decrypt(first)
+	assert.Nil(t, err)
+	assert.Equal(t, "ghp_token", plaintext)
+
+	empty, err := c.Encrypt("")
+	assert.Nil(t, err)
+	assert.Equal(t, "", empty)
+
+	// Values stored before encryption read back unchanged
+	plaintext, err = c.Decrypt("legacy")
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", plaintext)
+}
+
+func TestCipherRejectsTamperingAndWrongKey(t *testing.T) {
+	c, err := NewCipher("key")
+	assert.Nil(t, err)
+	sealed, err := c.Encrypt("secret")
+	assert.Nil(t, err)
+
+	other, err := NewCipher("other key")
+	assert.Nil(t, err)
+	_, err = other.Decrypt(sealed)
+	assert.ErrorContains(t, err, "failed to decrypt secret")
+
+	tampered := sealed[:len(sealed)-4] + "AAA="
+	_, err = c.Decrypt(tampered)
+	assert.ErrorContains(t, err, "failed to decrypt secret")
+
+	_, err = c.Decrypt(prefix + "AAAA")
+	assert.ErrorContains(t, err, "value too short")
+
+	_, err = NewCipher("")
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestSerializer(t *testing.T) {
+	t.Setenv(KeyEnv, "test key")
+
+	type record struct {
+		Token string `gorm:"serializer:encrypted"`
+	}
+	s, err := schema.Parse(&record{}, &sync.Map{}, schema.NamingStrategy{})
+	assert.Nil(t, err)
+	field := s.LookUpField("Token")
+
+	stored, err := Serializer{}.Value(context.Background(), field, reflect.Value{}, "glpat-123")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(stored.(string), prefix))
+
+	var r record
+	dst := reflect.ValueOf(&r).Elem()
+	assert.Nil(t, Serializer{}.Scan(context.Background(), field, dst, []byte(stored.(string))))
+	assert.Equal(t, "glpat-123", r.Token)
+
+	assert.Nil(t, Serializer{}.Scan(context.Background(), field, dst, nil))
+	assert.Equal(t, "", r.Token)
+}
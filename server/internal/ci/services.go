@@ -0,0 +1,220 @@
+package ci
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// serviceStartTimeout bounds how long a service may take to become healthy
+	serviceStartTimeout = 2 * time.Minute
+	// serviceStopTimeout bounds the teardown of all services of a run
+	serviceStopTimeout = 30 * time.Second
+)
+
+// ServiceRunner starts the sidecar services of a pipeline
+type ServiceRunner interface {
+	Start(ctx context.Context, services []Service, output io.Writer) (RunningServices, error)
+}
+
+// RunningServices is a started set of services
+type RunningServices interface {
+	// Env returns the <NAME>_HOST variables for a step, which differ
+	// depending on whether the step itself runs in a container
+	Env(containerized bool) []string
+	// Network is the Docker network containerized steps must join
+	Network() string
+	// Stop removes every container and the network, even if ctx-bound work was cancelled
+	Stop() error
+}
+
+// serviceHostVar returns the name of the env var holding a service's hostname
+func serviceHostVar(name string) string {
+	return strings.ToUpper(nonIdentChars.ReplaceAllString(name, "_")) + "_HOST"
+}
+
+var nonIdentChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// dockerServiceRunner starts services as containers on a per-run bridge network
+type dockerServiceRunner struct{}
+
+type dockerServices struct {
+	cli        *client.Client
+	network    string
+	containers []string
+	aliases    map[string]string
+	addresses  map[string]string
+}
+
+func (dockerServiceRunner) Start(ctx context.Context, services []Service, output io.Writer) (RunningServices, error) {
+	cli, err := sharedDockerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to name service network: %w", err)
+	}
+	running := &dockerServices{
+		cli:       cli,
+		network:   "pipeslicer-" + hex.EncodeToString(suffix),
+		aliases:   make(map[string]string),
+		addresses: make(map[string]string),
+	}
+
+	_, err = cli.NetworkCreate(ctx, running.network, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Labels:         map[string]string{containerLabel: "network"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service network: %w", err)
+	}
+
+	for _, svc := range services {
+		fmt.Fprintf(output, "Starting service %s (%s)\n", svc.Name, svc.Image)
+		if err := running.start(ctx, svc, output); err != nil {
+			running.Stop()
+			return nil, fmt.Errorf("service %q: %w", svc.Name, err)
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, serviceStartTimeout)
+	defer cancel()
+	for i, svc := range services {
+		if err := running.waitHealthy(waitCtx, running.containers[i]); err != nil {
+			running.Stop()
+			return nil, fmt.Errorf("service %q did not become ready: %w", svc.Name, err)
+		}
+		fmt.Fprintf(output, "Service %s is ready at %s\n", svc.Name, running.addresses[svc.Name])
+	}
+
+	return running, nil
+}
+
+func (s *dockerServices) start(ctx context.Context, svc Service, output io.Writer) error {
+	if err := ensureImage(ctx, s.cli, svc.Image, output); err != nil {
+		return err
+	}
+
+	config := &container.Config{
+		Image:  svc.Image,
+		Env:    mergeEnv(svc.Env),
+		Cmd:    svc.Command,
+		Labels: map[string]string{containerLabel: "service"},
+	}
+	if hc := svc.Healthcheck; hc != nil && hc.Cmd != "" {
+		config.Healthcheck = &container.HealthConfig{
+			Test:        []string{"CMD-SHELL", hc.Cmd},
+			Interval:    hc.Interval,
+			Timeout:     hc.Timeout,
+			Retries:     hc.Retries,
+			StartPeriod: hc.StartPeriod,
+		}
+	}
+
+	created, err := s.cli.ContainerCreate(ctx, config,
+		&container.HostConfig{NetworkMode: container.NetworkMode(s.network)},
+		&network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				s.network: {Aliases: []string{svc.Name}},
+			},
+		},
+		nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container: %w", err)
+	}
+	s.containers = append(s.containers, created.ID)
+
+	if err := s.cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %w", err)
+	}
+
+	info, err := s.cli.ContainerInspect(ctx, created.ID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	s.aliases[svc.Name] = svc.Name
+	if endpoint, ok := info.NetworkSettings.Networks[s.network]; ok {
+		s.addresses[svc.Name] = endpoint.IPAddress
+	}
+	return nil
+}
+
+// waitHealthy waits for a container's health check to pass, or just for it
+// to be running when the image defines no health check
+func (s *dockerServices) waitHealthy(ctx context.Context, id string) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		info, err := s.cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		state := info.State
+		if !state.Running {
+			return fmt.Errorf("container exited with status %d", state.ExitCode)
+		}
+		if state.Health == nil || state.Health.Status == types.Healthy {
+			return nil
+		}
+		if state.Health.Status == types.Unhealthy {
+			return fmt.Errorf("health check failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *dockerServices) Env(containerized bool) []string {
+	hosts := make(map[string]string)
+	for name, alias := range s.aliases {
+		if containerized {
+			hosts[serviceHostVar(name)] = alias
+		} else {
+			hosts[serviceHostVar(name)] = s.addresses[name]
+		}
+	}
+	return mergeEnv(hosts)
+}
+
+func (s *dockerServices) Network() string {
+	return s.network
+}
+
+func (s *dockerServices) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), serviceStopTimeout)
+	defer cancel()
+
+	var errs []string
+	for _, id := range s.containers {
+		err := s.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+		if err != nil && !client.IsErrNotFound(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := s.cli.NetworkRemove(ctx, s.network); err != nil && !client.IsErrNotFound(err) {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove services: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package poller
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/webhooks"
+)
+
+// Poller watches repositories that cannot send webhooks. Every polled
+// repository is synced with its remote on its own interval, and a run is
+// queued for every watched branch whose head moved since the last poll.
+type Poller struct {
+	repoManager *repository.RepositoryManager
+	queue       *runs.RunQueue
+	interval    time.Duration
+}
+
+// NewPoller creates a Poller that looks for repositories due to be polled
+// every interval and submits their runs to queue
+func NewPoller(repoManager *repository.RepositoryManager, queue *runs.RunQueue, interval time.Duration) *Poller {
+	return &Poller{
+		repoManager: repoManager,
+		queue:       queue,
+		interval:    interval,
+	}
+}
+
+// Start polls repositories until ctx is cancelled
+func (p *Poller) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			p.tick(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// tick polls every repository that is due
+func (p *Poller) tick(ctx context.Context) {
+	repositories, err := p.repoManager.ListRepositories(ctx)
+	if err != nil {
+		log.Printf("Failed to list repositories to poll: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for i := range repositories {
+		repo := &repositories[i]
+		if !repo.PollEnabled || now.Before(repo.NextPoll()) {
+			continue
+		}
+		if err := p.poll(ctx, repo, now); err != nil {
+			log.Printf("Failed to poll %s: %v", repo.URL, err)
+		}
+	}
+}
+
+// poll syncs a repository and queues runs for the branches that moved.
+// The first poll of a repository only records the branch heads.
+func (p *Poller) poll(ctx context.Context, repo *repository.RepositoryMetadata, now time.Time) error {
+	claimed, err := p.repoManager.ClaimPoll(ctx, repo.ID, repo.LastPolledAt, now)
+	if err != nil || !claimed {
+		return err
+	}
+
+	if err := p.repoManager.SyncRepository(ctx, repo.ID); err != nil {
+		return err
+	}
+	heads, err := p.repoManager.RemoteBranchHeads(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+	seen, err := p.repoManager.GetBranchHeads(ctx, repo.ID)
+	if err != nil {
+		return err
+	}
+
+	branches := make([]string, 0, len(heads))
+	for branch := range heads {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		commit := heads[branch]
+		if !webhooks.MatchFilter(repo.PollBranches, branch) || seen[branch] == commit {
+			continue
+		}
+		if repo.LastPolledAt != nil {
+			if err := p.trigger(ctx, repo, branch, seen[branch], commit); err != nil {
+				log.Printf("Failed to queue run of %s for %s: %v", branch, repo.URL, err)
+				continue
+			}
+		}
+		if err := p.repoManager.SetBranchHead(ctx, repo.ID, branch, commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trigger queues a run of the new head of a branch, pinned to the commit
+// that was detected even if the branch moves on again. The services changed
+// since the previous head are passed to the pipeline in CI_CHANGED_SERVICES,
+// and the changed files to step conditions.
+func (p *Poller) trigger(ctx context.Context, repo *repository.RepositoryMetadata, branch, previous, commit string) error {
+	env := map[string]string{"CI_PREVIOUS_COMMIT": previous}
+	var files []string
+	if previous != "" {
+		services, err := p.repoManager.ChangedServices(ctx, repo.ID, previous, commit)
+		if err == nil {
+			files, err = p.repoManager.ChangedFiles(ctx, repo.ID, previous, commit)
+		}
+		if err != nil {
+			// The previous head may be gone after a force push
+			log.Printf("Failed to detect changes of %s in %s: %v", branch, repo.URL, err)
+		} else {
+			env["CI_CHANGED_SERVICES"] = strings.Join(services, ",")
+		}
+	}
+
+	run, err := p.queue.Submit(ctx, runs.RunRequest{
+		URL:          repo.URL,
+		Branch:       branch,
+		Commit:       commit,
+		Pinned:       true,
+		PipelinePath: repo.PipelinePath,
+		Trigger:      runs.TriggerPoll,
+		Env:          env,
+		ChangedFiles: files,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Queued pipeline run %d for %s@%s (%s)", run.ID, repo.URL, branch, commit)
+	return nil
+}
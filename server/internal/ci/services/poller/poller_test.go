@@ -0,0 +1,131 @@
+package poller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/repository"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// commitFile writes a file into the worktree of repo and commits it
+func commitFile(t *testing.T, repo *git.Repository, name, content string) string {
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(wt.Filesystem.Root(), name), []byte(content), 0644))
+	_, err = wt.Add(name)
+	assert.Nil(t, err)
+	hash, err := wt.Commit("change "+name, &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+	return hash.String()
+}
+
+// checkout switches the worktree of repo to branch, creating it when asked
+func checkout(t *testing.T, repo *git.Repository, branch string, create bool) {
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: create}))
+}
+
+// newTestPoller returns a Poller of a repository cloned from remote that
+// polls its master branch, along with the run manager of its queue
+func newTestPoller(t *testing.T, remote string) (*Poller, *runs.RunManager, int64) {
+	dsn := filepath.Join(t.TempDir(), "pipeslicer.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.Nil(t, err)
+	repoManager, err := repository.NewRepositoryManager(db, t.TempDir())
+	assert.Nil(t, err)
+	runManager, err := runs.NewRunManager(db)
+	assert.Nil(t, err)
+	store, err := artifacts.NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+	workspaces, err := ci.NewWorkspaceManager(t.TempDir(), ci.Retention{})
+	assert.Nil(t, err)
+	queue := runs.NewRunQueue(runManager, logs.NewBroker(), store, workspaces, 1)
+
+	ctx := context.Background()
+	metadata, err := repoManager.CloneRepository(ctx, "file://"+remote, "shop", "", nil)
+	assert.Nil(t, err)
+	enabled, branches := true, []string{"master"}
+	_, err = repoManager.UpdateSettings(ctx, metadata.ID, repository.RepositorySettings{
+		PollEnabled:  &enabled,
+		PollBranches: &branches,
+	})
+	assert.Nil(t, err)
+	return NewPoller(repoManager, queue, time.Minute), runManager, metadata.ID
+}
+
+func TestPollQueuesRunsOfMovedBranches(t *testing.T) {
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, false)
+	assert.Nil(t, err)
+	previous := commitFile(t, repo, "README.md", "shop")
+	checkout(t, repo, "feature", true)
+	checkout(t, repo, "master", false)
+
+	p, runManager, id := newTestPoller(t, remote)
+	ctx := context.Background()
+	poll := func() {
+		repo, err := p.repoManager.GetRepositoryByID(ctx, id)
+		assert.Nil(t, err)
+		assert.Nil(t, p.poll(ctx, repo, time.Now()))
+	}
+	listRuns := func() []runs.PipelineRun {
+		list, err := runManager.ListRuns(ctx, runs.ListFilter{})
+		assert.Nil(t, err)
+		return list
+	}
+
+	// The first poll only records the branch heads
+	poll()
+	assert.Empty(t, listRuns())
+
+	// Both branches move, only the polled one is built, and replicas
+	// polling at the same time build it once
+	commit := commitFile(t, repo, "main.go", "package main")
+	checkout(t, repo, "feature", false)
+	commitFile(t, repo, "feature.go", "package main")
+	checkout(t, repo, "master", false)
+
+	stale, err := p.repoManager.GetRepositoryByID(ctx, id)
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, p.poll(ctx, stale, time.Now()))
+		}()
+	}
+	wg.Wait()
+
+	list := listRuns()
+	assert.Len(t, list, 1)
+	run, err := runManager.GetRun(ctx, list[0].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, runs.TriggerPoll, run.Trigger)
+	assert.Equal(t, "master", run.Branch)
+	assert.Equal(t, ci.Revision{Ref: "master", Commit: commit}, run.Revision())
+	assert.Equal(t, []string{"main.go"}, run.ChangedFiles)
+	assert.Equal(t, previous, run.Env["CI_PREVIOUS_COMMIT"])
+
+	// Nothing is queued until the branch moves again
+	poll()
+	assert.Len(t, listRuns(), 1)
+}
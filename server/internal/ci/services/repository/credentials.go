@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	cryptossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	// Registers the encrypted serializer used by GitCredential
+	_ "github.com/vanhcao3/pipeslicerCI/internal/ci/secrets"
+)
+
+// Credential kinds
+const (
+	CredentialSSH   = "ssh"
+	CredentialHTTPS = "https"
+)
+
+// ErrNoCredential is returned when a repository has no Git credential
+var ErrNoCredential = errors.New("repository has no Git credential")
+
+// GitCredential authenticates clones and fetches of a private repository.
+// Secret is the PEM private key of an SSH deploy key, or the token or
+// password for HTTPS; it and Passphrase are encrypted at rest with the key
+// in PIPESLICER_SECRET_KEY. KnownHosts pins the SSH host keys in
+// known_hosts format; without it the system known_hosts files are used.
+type GitCredential struct {
+	ID           int64     `gorm:"primaryKey;autoIncrement"`
+	RepositoryID int64     `gorm:"not null;uniqueIndex"`
+	Kind         string    `gorm:"not null"`
+	Username     string    `gorm:""`
+	Secret       string    `gorm:"type:text;serializer:encrypted"`
+	Passphrase   string    `gorm:"type:text;serializer:encrypted"`
+	KnownHosts   string    `gorm:"type:text"`
+	CreatedAt    time.Time `gorm:"not null"`
+	UpdatedAt    time.Time `gorm:"not null"`
+}
+
+// AuthMethod returns the go-git authentication for the credential
+func (c *GitCredential) AuthMethod() (transport.AuthMethod, error) {
+	if c.Secret == "" {
+		return nil, fmt.Errorf("%s credential has no secret", c.Kind)
+	}
+	user := c.Username
+	if user == "" {
+		user = "git"
+	}
+
+	switch c.Kind {
+	case CredentialSSH:
+		auth, err := ssh.NewPublicKeys(user, []byte(c.Secret), c.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH private key: %w", err)
+		}
+		if c.KnownHosts != "" {
+			callback, err := knownHostsCallback(c.KnownHosts)
+			if err != nil {
+				return nil, err
+			}
+			auth.HostKeyCallback = callback
+		}
+		return auth, nil
+	case CredentialHTTPS:
+		return &http.BasicAuth{Username: user, Password: c.Secret}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credential kind %q, expected ssh or https", c.Kind)
+	}
+}
+
+// knownHostsCallback verifies host keys against known_hosts content
+func knownHostsCallback(content string) (cryptossh.HostKeyCallback, error) {
+	file, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write known hosts: %w", err)
+	}
+	// The callback reads the file once, when it is created
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write known hosts: %w", err)
+	}
+
+	callback, err := ssh.NewKnownHostsCallback(file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("invalid known hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// checkCredential verifies that a credential can authenticate to url
+func checkCredential(url string, credential *GitCredential) (transport.AuthMethod, error) {
+	auth, err := credential.AuthMethod()
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %w", err)
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		if credential.Kind != CredentialSSH {
+			return nil, fmt.Errorf("%s uses SSH, a %s credential cannot be used", url, credential.Kind)
+		}
+	case "http", "https":
+		if credential.Kind != CredentialHTTPS {
+			return nil, fmt.Errorf("%s uses HTTPS, a %s credential cannot be used", url, credential.Kind)
+		}
+	}
+	return auth, nil
+}
+
+// SetCredential stores the Git credential of a repository, replacing any
+// previous one
+func (m *RepositoryManager) SetCredential(ctx context.Context, id int64, credential *GitCredential) error {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := checkCredential(metadata.URL, credential); err != nil {
+		return err
+	}
+	return saveCredential(m.db.WithContext(ctx), id, credential)
+}
+
+func saveCredential(db *gorm.DB, id int64, credential *GitCredential) error {
+	now := time.Now()
+	credential.RepositoryID = id
+	credential.CreatedAt = now
+	credential.UpdatedAt = now
+
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "repository_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"kind", "username", "secret", "passphrase", "known_hosts", "updated_at"}),
+	}).Create(credential)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save Git credential: %w", result.Error)
+	}
+	return nil
+}
+
+// GetCredential gets the Git credential of a repository
+func (m *RepositoryManager) GetCredential(ctx context.Context, id int64) (*GitCredential, error) {
+	var credential GitCredential
+	result := m.db.WithContext(ctx).Where("repository_id = ?", id).First(&credential)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNoCredential
+		}
+		return nil, fmt.Errorf("failed to get Git credential: %w", result.Error)
+	}
+	return &credential, nil
+}
+
+// DeleteCredential removes the Git credential of a repository
+func (m *RepositoryManager) DeleteCredential(ctx context.Context, id int64) error {
+	result := m.db.WithContext(ctx).Where("repository_id = ?", id).Delete(&GitCredential{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete Git credential: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoCredential
+	}
+	return nil
+}
+
+// authFor returns the authentication for Git operations on a repository,
+// nil when it has no credential
+func (m *RepositoryManager) authFor(ctx context.Context, id int64) (transport.AuthMethod, error) {
+	credential, err := m.GetCredential(ctx, id)
+	if errors.Is(err, ErrNoCredential) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credential.AuthMethod()
+}
+
+// AuthForURL returns the authentication for cloning the registered
+// repository at url, nil when it is not registered or has no credential
+func (m *RepositoryManager) AuthForURL(ctx context.Context, url string) (transport.AuthMethod, error) {
+	var metadata RepositoryMetadata
+	result := m.db.WithContext(ctx).Where("url = ?", url).Limit(1).Find(&metadata)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get repository: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return m.authFor(ctx, metadata.ID)
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/stretchr/testify/assert"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// generateKey returns a PEM encoded SSH private key and its public key
+func generateKey(t *testing.T) (string, cryptossh.PublicKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.Nil(t, err)
+	sshPublic, err := cryptossh.NewPublicKey(public)
+	assert.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), sshPublic
+}
+
+func TestCredentialAuthMethod(t *testing.T) {
+	auth, err := (&GitCredential{Kind: CredentialHTTPS, Secret: "glpat-123"}).AuthMethod()
+	assert.Nil(t, err)
+	assert.Equal(t, &http.BasicAuth{Username: "git", Password: "glpat-123"}, auth)
+
+	auth, err = (&GitCredential{Kind: CredentialHTTPS, Username: "oauth2", Secret: "glpat-123"}).AuthMethod()
+	assert.Nil(t, err)
+	assert.Equal(t, "oauth2", auth.(*http.BasicAuth).Username)
+
+	key, _ := generateKey(t)
+	auth, err = (&GitCredential{Kind: CredentialSSH, Secret: key}).AuthMethod()
+	assert.Nil(t, err)
+	assert.Equal(t, "git", auth.(*ssh.PublicKeys).User)
+
+	_, err = (&GitCredential{Kind: CredentialSSH, Secret: "not a key"}).AuthMethod()
+	assert.ErrorContains(t, err, "invalid SSH private key")
+
+	_, err = (&GitCredential{Kind: CredentialHTTPS}).AuthMethod()
+	assert.ErrorContains(t, err, "https credential has no secret")
+
+	_, err = (&GitCredential{Kind: "ftp", Secret: "x"}).AuthMethod()
+	assert.ErrorContains(t, err, `unsupported credential kind "ftp"`)
+}
+
+func TestCredentialKnownHosts(t *testing.T) {
+	key, _ := generateKey(t)
+	_, hostKey := generateKey(t)
+	_, otherKey := generateKey(t)
+
+	credential := &GitCredential{
+		Kind:       CredentialSSH,
+		Secret:     key,
+		KnownHosts: "git.example.com " + string(cryptossh.MarshalAuthorizedKey(hostKey)),
+	}
+	auth, err := credential.AuthMethod()
+	assert.Nil(t, err)
+	config, err := auth.(*ssh.PublicKeys).ClientConfig()
+	assert.Nil(t, err)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	assert.Nil(t, config.HostKeyCallback("git.example.com:22", addr, hostKey))
+	assert.Error(t, config.HostKeyCallback("git.example.com:22", addr, otherKey))
+	assert.Error(t, config.HostKeyCallback("evil.example.com:22", addr, hostKey))
+
+	credential.KnownHosts = "git.example.com not-a-key"
+	_, err = credential.AuthMethod()
+	assert.ErrorContains(t, err, "invalid known hosts")
+}
+
+func TestCheckCredential(t *testing.T) {
+	key, _ := generateKey(t)
+	sshCredential := &GitCredential{Kind: CredentialSSH, Secret: key}
+	httpsCredential := &GitCredential{Kind: CredentialHTTPS, Secret: "token"}
+
+	_, err := checkCredential("git@github.com:acme/shop.git", sshCredential)
+	assert.Nil(t, err)
+	_, err = checkCredential("https://github.com/acme/shop.git", httpsCredential)
+	assert.Nil(t, err)
+
+	_, err = checkCredential("https://github.com/acme/shop.git", sshCredential)
+	assert.ErrorContains(t, err, "uses HTTPS, a ssh credential cannot be used")
+	_, err = checkCredential("ssh://git@github.com/acme/shop.git", httpsCredential)
+	assert.ErrorContains(t, err, "uses SSH, a https credential cannot be used")
+}
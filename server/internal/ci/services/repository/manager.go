@@ -14,19 +14,44 @@ import (
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
 	"gorm.io/gorm"
 )
 
 // RepositoryMetadata contains metadata about a Git repository
 type RepositoryMetadata struct {
-	ID          int64     `gorm:"primaryKey;autoIncrement"`
-	URL         string    `gorm:"not null;uniqueIndex"`
-	Name        string    `gorm:"not null"`
-	Description string    `gorm:""`
-	LocalPath   string    `gorm:"not null"`
-	LastUpdated time.Time `gorm:"not null"`
-	CreatedAt   time.Time `gorm:"not null"`
-	UpdatedAt   time.Time `gorm:"not null"`
+	ID          int64  `gorm:"primaryKey;autoIncrement"`
+	URL         string `gorm:"not null;uniqueIndex"`
+	Name        string `gorm:"not null"`
+	Description string `gorm:""`
+	LocalPath   string `gorm:"not null"`
+	// PipelinePath is the pipeline file inside the repository; when empty
+	// the default locations are tried
+	PipelinePath string `gorm:""`
+	// WebhookSecret verifies webhook requests for the repository. Like
+	// StatusToken it is encrypted at rest and only written by UpdateSettings.
+	WebhookSecret string `gorm:"type:text;serializer:encrypted"`
+	// BranchFilter and TagFilter are glob patterns selecting the branches
+	// and tags that webhooks build; an empty filter builds all of them
+	BranchFilter []string `gorm:"type:text;serializer:json"`
+	TagFilter    []string `gorm:"type:text;serializer:json"`
+	// GitProvider is github, gitlab or gitea; when empty it is guessed from the host
+	GitProvider string `gorm:""`
+	// StatusToken is the API token used to report commit statuses and
+	// comment on pull requests; nothing is reported without it. It is
+	// encrypted at rest like the secrets of GitCredential, and only written
+	// by UpdateSettings.
+	StatusToken string `gorm:"type:text;serializer:encrypted"`
+	// PollEnabled makes the poller fetch the repository every PollInterval
+	// and build the branches matching PollBranches whose head moved
+	PollEnabled  bool          `gorm:"not null;default:false"`
+	PollInterval time.Duration `gorm:""`
+	PollBranches []string      `gorm:"type:text;serializer:json"`
+	LastPolledAt *time.Time    `gorm:""`
+	LastUpdated  time.Time     `gorm:"not null"`
+	CreatedAt    time.Time     `gorm:"not null"`
+	UpdatedAt    time.Time     `gorm:"not null"`
 }
 
 // MicroserviceInfo contains information about a microservice in a repository branch
@@ -64,7 +89,7 @@ func NewRepositoryManager(db *gorm.DB, baseDir string) (*RepositoryManager, erro
 	}
 
 	// Auto migrate the schema
-	err := db.AutoMigrate(&RepositoryMetadata{}, &MicroserviceInfo{})
+	err := db.AutoMigrate(&RepositoryMetadata{}, &MicroserviceInfo{}, &BranchHead{}, &GitCredential{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -75,16 +100,31 @@ func NewRepositoryManager(db *gorm.DB, baseDir string) (*RepositoryManager, erro
 	}, nil
 }
 
-// CloneRepository clones a Git repository and stores its metadata
-func (m *RepositoryManager) CloneRepository(ctx context.Context, url, name, description string) (*RepositoryMetadata, error) {
+// CloneRepository clones a Git repository and stores its metadata. A
+// credential, when given, authenticates the clone and is stored with the
+// repository for later fetches.
+func (m *RepositoryManager) CloneRepository(ctx context.Context, url, name, description string, credential *GitCredential) (*RepositoryMetadata, error) {
 	// Check if repository already exists
 	var existingRepo RepositoryMetadata
 	result := m.db.WithContext(ctx).Where("url = ?", url).First(&existingRepo)
 	if result.Error == nil {
+		if credential != nil {
+			if err := m.SetCredential(ctx, existingRepo.ID, credential); err != nil {
+				return nil, err
+			}
+		}
 		// Repository exists, update it
 		return m.UpdateRepository(ctx, &existingRepo)
 	}
 
+	var auth transport.AuthMethod
+	if credential != nil {
+		var err error
+		if auth, err = checkCredential(url, credential); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a sanitized directory name from the repository name
 	sanitizedName := strings.ReplaceAll(name, "/", "-")
 	repoDir := filepath.Join(m.baseDir, sanitizedName)
@@ -99,6 +139,7 @@ func (m *RepositoryManager) CloneRepository(ctx context.Context, url, name, desc
 	log.Printf("Cloning repository %s to %s", url, repoDir)
 	_, err = git.PlainClone(repoDir, false, &git.CloneOptions{
 		URL:               url,
+		Auth:              auth,
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
 	})
 	if err != nil {
@@ -125,12 +166,20 @@ func (m *RepositoryManager) CloneRepository(ctx context.Context, url, name, desc
 		UpdatedAt:   now,
 	}
 
-	// Save metadata to database
-	result = m.db.WithContext(ctx).Create(metadata)
-	if result.Error != nil {
+	// Save metadata and credential to database
+	err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(metadata).Error; err != nil {
+			return fmt.Errorf("failed to save repository metadata: %w", err)
+		}
+		if credential != nil {
+			return saveCredential(tx, metadata.ID, credential)
+		}
+		return nil
+	})
+	if err != nil {
 		// Clean up the cloned repository if metadata save fails
 		os.RemoveAll(repoDir)
-		return nil, fmt.Errorf("failed to save repository metadata: %w", result.Error)
+		return nil, err
 	}
 
 	log.Printf("Successfully cloned repository to: %s", repoDir)
@@ -139,6 +188,14 @@ func (m *RepositoryManager) CloneRepository(ctx context.Context, url, name, desc
 
 // UpdateRepository updates an existing repository
 func (m *RepositoryManager) UpdateRepository(ctx context.Context, metadata *RepositoryMetadata) (*RepositoryMetadata, error) {
+	auth, err := m.authFor(ctx, metadata.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := lockRepository(metadata.LocalPath)
+	defer unlock()
+
 	// Pull the latest changes
 	repo, err := git.PlainOpen(metadata.LocalPath)
 	if err != nil {
@@ -153,6 +210,7 @@ func (m *RepositoryManager) UpdateRepository(ctx context.Context, metadata *Repo
 
 	// Pull the latest changes
 	err = worktree.Pull(&git.PullOptions{
+		Auth:              auth,
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
 	})
 	if err != nil && err != git.NoErrAlreadyUpToDate {
@@ -160,13 +218,107 @@ func (m *RepositoryManager) UpdateRepository(ctx context.Context, metadata *Repo
 	}
 
 	// Update metadata
-	metadata.LastUpdated = time.Now()
-	metadata.UpdatedAt = time.Now()
+	if err := m.touch(ctx, metadata); err != nil {
+		return nil, fmt.Errorf("failed to update repository metadata: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// touch records that the checkout of a repository was updated. Only the
+// timestamps are written, so that settings changed during a long fetch
+// are kept.
+func (m *RepositoryManager) touch(ctx context.Context, metadata *RepositoryMetadata) error {
+	now := time.Now()
+	metadata.LastUpdated = now
+	metadata.UpdatedAt = now
+	return m.db.WithContext(ctx).Model(metadata).Select("LastUpdated", "UpdatedAt").Updates(metadata).Error
+}
 
-	// Save metadata to database
-	result := m.db.WithContext(ctx).Save(metadata)
+// RepositorySettings holds the CI settings of a repository. Nil fields are left unchanged.
+type RepositorySettings struct {
+	PipelinePath  *string
+	WebhookSecret *string
+	BranchFilter  *[]string
+	TagFilter     *[]string
+	GitProvider   *string
+	StatusToken   *string
+	PollEnabled   *bool
+	PollInterval  *time.Duration
+	PollBranches  *[]string
+}
+
+// UpdateSettings changes the CI settings of a repository. An empty
+// pipeline path restores the default locations.
+func (m *RepositoryManager) UpdateSettings(ctx context.Context, id int64, settings RepositorySettings) (*RepositoryMetadata, error) {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the settings that were given are written
+	var columns []string
+	if settings.PipelinePath != nil {
+		path := *settings.PipelinePath
+		if path != "" {
+			clean := filepath.ToSlash(filepath.Clean(path))
+			if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+				return nil, fmt.Errorf("pipeline path %q is outside the repository", path)
+			}
+			path = clean
+		}
+		metadata.PipelinePath = path
+		columns = append(columns, "PipelinePath")
+	}
+	if settings.WebhookSecret != nil {
+		metadata.WebhookSecret = *settings.WebhookSecret
+		columns = append(columns, "WebhookSecret")
+	}
+	if settings.BranchFilter != nil {
+		metadata.BranchFilter = *settings.BranchFilter
+		columns = append(columns, "BranchFilter")
+	}
+	if settings.TagFilter != nil {
+		metadata.TagFilter = *settings.TagFilter
+		columns = append(columns, "TagFilter")
+	}
+	if settings.GitProvider != nil {
+		switch *settings.GitProvider {
+		case "", "github", "gitlab", "gitea":
+		default:
+			return nil, fmt.Errorf("unsupported Git provider %q", *settings.GitProvider)
+		}
+		metadata.GitProvider = *settings.GitProvider
+		columns = append(columns, "GitProvider")
+	}
+	if settings.StatusToken != nil {
+		metadata.StatusToken = *settings.StatusToken
+		columns = append(columns, "StatusToken")
+	}
+	if settings.PollEnabled != nil {
+		metadata.PollEnabled = *settings.PollEnabled
+		columns = append(columns, "PollEnabled")
+	}
+	if settings.PollInterval != nil {
+		if *settings.PollInterval != 0 && *settings.PollInterval < MinPollInterval {
+			return nil, fmt.Errorf("poll interval must be at least %s", MinPollInterval)
+		}
+		metadata.PollInterval = *settings.PollInterval
+		columns = append(columns, "PollInterval")
+	}
+	if settings.PollBranches != nil {
+		metadata.PollBranches = *settings.PollBranches
+		columns = append(columns, "PollBranches")
+	}
+	if len(columns) == 0 {
+		return metadata, nil
+	}
+
+	metadata.UpdatedAt = time.Now()
+	columns = append(columns, "UpdatedAt")
+	result := m.db.WithContext(ctx).Model(metadata).Select(columns).Updates(metadata)
 	if result.Error != nil {
-		return nil, fmt.Errorf("failed to update repository metadata: %w", result.Error)
+		return nil, fmt.Errorf("failed to update repository settings: %w", result.Error)
 	}
 
 	return metadata, nil
@@ -219,14 +371,22 @@ func (m *RepositoryManager) DeleteRepository(ctx context.Context, id int64) erro
 		return err
 	}
 
+	// Delete the stored credential
+	result := m.db.WithContext(ctx).Where("repository_id = ?", id).Delete(&GitCredential{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete Git credential: %w", result.Error)
+	}
+
 	// Delete the repository directory
+	unlock := lockRepository(metadata.LocalPath)
 	err = os.RemoveAll(metadata.LocalPath)
+	unlock()
 	if err != nil {
 		return fmt.Errorf("failed to delete repository directory: %w", err)
 	}
 
 	// Delete the repository metadata
-	result := m.db.WithContext(ctx).Delete(&RepositoryMetadata{}, id)
+	result = m.db.WithContext(ctx).Delete(&RepositoryMetadata{}, id)
 	if result.Error != nil {
 		return fmt.Errorf("failed to delete repository metadata: %w", result.Error)
 	}
@@ -242,6 +402,14 @@ func (m *RepositoryManager) CheckoutBranch(ctx context.Context, id int64, branch
 		return err
 	}
 
+	auth, err := m.authFor(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockRepository(metadata.LocalPath)
+	defer unlock()
+
 	// Open the repository
 	repo, err := git.PlainOpen(metadata.LocalPath)
 	if err != nil {
@@ -266,6 +434,7 @@ func (m *RepositoryManager) CheckoutBranch(ctx context.Context, id int64, branch
 		// We're already on the right branch, fetch and pull latest changes
 		// First fetch the specific branch
 		err = repo.Fetch(&git.FetchOptions{
+			Auth: auth,
 			RefSpecs: []config.RefSpec{
 				config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch)),
 			},
@@ -292,13 +461,8 @@ func (m *RepositoryManager) CheckoutBranch(ctx context.Context, id int64, branch
 		}
 
 		// Update metadata
-		metadata.LastUpdated = time.Now()
-		metadata.UpdatedAt = time.Now()
-
-		// Save metadata to database
-		result := m.db.WithContext(ctx).Save(metadata)
-		if result.Error != nil {
-			return fmt.Errorf("failed to update repository metadata: %w", result.Error)
+		if err := m.touch(ctx, metadata); err != nil {
+			return fmt.Errorf("failed to update repository metadata: %w", err)
 		}
 
 		return nil
@@ -306,6 +470,7 @@ func (m *RepositoryManager) CheckoutBranch(ctx context.Context, id int64, branch
 
 	// First, fetch all branches
 	err = repo.Fetch(&git.FetchOptions{
+		Auth: auth,
 		RefSpecs: []config.RefSpec{
 			config.RefSpec("+refs/heads/*:refs/remotes/origin/*"),
 		},
@@ -425,13 +590,8 @@ func (m *RepositoryManager) CheckoutBranch(ctx context.Context, id int64, branch
 	}
 
 	// Update metadata
-	metadata.LastUpdated = time.Now()
-	metadata.UpdatedAt = time.Now()
-
-	// Save metadata to database
-	result := m.db.WithContext(ctx).Save(metadata)
-	if result.Error != nil {
-		return fmt.Errorf("failed to update repository metadata: %w", result.Error)
+	if err := m.touch(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to update repository metadata: %w", err)
 	}
 
 	return nil
@@ -534,6 +694,14 @@ func (m *RepositoryManager) SyncRepository(ctx context.Context, id int64) error
 		return err
 	}
 
+	auth, err := m.authFor(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockRepository(metadata.LocalPath)
+	defer unlock()
+
 	// Open the repository
 	repo, err := git.PlainOpen(metadata.LocalPath)
 	if err != nil {
@@ -564,6 +732,7 @@ func (m *RepositoryManager) SyncRepository(ctx context.Context, id int64) error
 
 	// Fetch all branches and tags
 	err = repo.Fetch(&git.FetchOptions{
+		Auth: auth,
 		RefSpecs: []config.RefSpec{
 			config.RefSpec("+refs/heads/*:refs/remotes/origin/*"),
 			config.RefSpec("+refs/tags/*:refs/tags/*"),
@@ -637,13 +806,8 @@ func (m *RepositoryManager) SyncRepository(ctx context.Context, id int64) error
 	}
 
 	// Update metadata
-	metadata.LastUpdated = time.Now()
-	metadata.UpdatedAt = time.Now()
-
-	// Save metadata to database
-	result := m.db.WithContext(ctx).Save(metadata)
-	if result.Error != nil {
-		return fmt.Errorf("failed to update repository metadata: %w", result.Error)
+	if err := m.touch(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to update repository metadata: %w", err)
 	}
 
 	return nil
@@ -840,12 +1004,34 @@ func (m *RepositoryManager) GetMicroservices(ctx context.Context, id int64, bran
 
 // CheckoutCommit checks out a specific commit in the repository
 func (m *RepositoryManager) CheckoutCommit(ctx context.Context, id int64, commit string) error {
+	return m.CheckoutRevision(ctx, id, ci.Revision{Commit: commit})
+}
+
+// CheckoutRevision checks out a branch, a full reference such as
+// refs/pull/12/head, or a commit in the repository. Branches are checked out
+// as with CheckoutBranch and everything else on a detached head.
+func (m *RepositoryManager) CheckoutRevision(ctx context.Context, id int64, rev ci.Revision) error {
+	if err := rev.Validate(); err != nil {
+		return err
+	}
+	if rev.Commit == "" && rev.ReferenceName().IsBranch() {
+		return m.CheckoutBranch(ctx, id, rev.Branch())
+	}
+
 	// Get the repository
 	metadata, err := m.GetRepositoryByID(ctx, id)
 	if err != nil {
 		return err
 	}
 
+	auth, err := m.authFor(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockRepository(metadata.LocalPath)
+	defer unlock()
+
 	// Open the repository
 	repo, err := git.PlainOpen(metadata.LocalPath)
 	if err != nil {
@@ -874,34 +1060,27 @@ func (m *RepositoryManager) CheckoutCommit(ctx context.Context, id int64, commit
 		return fmt.Errorf("failed to reset worktree: %w", err)
 	}
 
-	// Fetch the commit
-	err = repo.Fetch(&git.FetchOptions{
-		RefSpecs: []config.RefSpec{
-			config.RefSpec(fmt.Sprintf("+%s:refs/remotes/origin/%s", commit, commit)),
-		},
-		Force: true,
-	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return fmt.Errorf("failed to fetch commit: %w", err)
+	// Fetch the revision, the repository already has the full history
+	hash, err := ci.FetchRevision(repo, rev, 0, auth)
+	if err != nil {
+		return err
 	}
 
 	// Checkout the commit
 	err = worktree.Checkout(&git.CheckoutOptions{
-		Hash:  plumbing.NewHash(commit),
+		Hash:  hash,
 		Force: true,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to checkout commit: %w", err)
+		return fmt.Errorf("failed to checkout %s: %w", rev, err)
+	}
+	if _, err := ci.VerifyHead(repo, rev); err != nil {
+		return err
 	}
 
 	// Update metadata
-	metadata.LastUpdated = time.Now()
-	metadata.UpdatedAt = time.Now()
-
-	// Save metadata to database
-	result := m.db.WithContext(ctx).Save(metadata)
-	if result.Error != nil {
-		return fmt.Errorf("failed to update repository metadata: %w", result.Error)
+	if err := m.touch(ctx, metadata); err != nil {
+		return fmt.Errorf("failed to update repository metadata: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestManager returns a RepositoryManager backed by a fresh SQLite database
+func newTestManager(t *testing.T) *RepositoryManager {
+	dsn := filepath.Join(t.TempDir(), "repositories.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.Nil(t, err)
+	manager, err := NewRepositoryManager(db, t.TempDir())
+	assert.Nil(t, err)
+	return manager
+}
+
+func TestUpdateRepositoryKeepsSettings(t *testing.T) {
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, false)
+	assert.Nil(t, err)
+	commitFiles(t, repo, map[string]string{".pipeslicer.yml": "name: Shop"})
+
+	m := newTestManager(t)
+	ctx := context.Background()
+	metadata, err := m.CloneRepository(ctx, "file://"+remote, "shop", "", nil)
+	assert.Nil(t, err)
+
+	// The settings change while the repository is being fetched
+	stale, err := m.GetRepositoryByID(ctx, metadata.ID)
+	assert.Nil(t, err)
+	path, branches, enabled := "ci/pipeline.yml", []string{"main"}, true
+	_, err = m.UpdateSettings(ctx, metadata.ID, RepositorySettings{
+		PipelinePath: &path,
+		PollEnabled:  &enabled,
+		PollBranches: &branches,
+	})
+	assert.Nil(t, err)
+	updated, err := m.UpdateRepository(ctx, stale)
+	assert.Nil(t, err)
+
+	stored, err := m.GetRepositoryByID(ctx, metadata.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci/pipeline.yml", stored.PipelinePath)
+	assert.True(t, stored.PollEnabled)
+	assert.Equal(t, []string{"main"}, stored.PollBranches)
+	assert.True(t, stored.LastUpdated.After(metadata.LastUpdated))
+	assert.WithinDuration(t, updated.LastUpdated, stored.LastUpdated, 0)
+}
@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultPollInterval is used for polled repositories without an interval
+const DefaultPollInterval = 5 * time.Minute
+
+// MinPollInterval is the shortest poll interval a repository may set
+const MinPollInterval = 30 * time.Second
+
+// BranchHead is the last commit of a branch seen by the poller
+type BranchHead struct {
+	ID           int64     `gorm:"primaryKey;autoIncrement"`
+	RepositoryID int64     `gorm:"not null;uniqueIndex:idx_branch_head"`
+	Branch       string    `gorm:"not null;uniqueIndex:idx_branch_head"`
+	Commit       string    `gorm:"not null"`
+	UpdatedAt    time.Time `gorm:"not null"`
+}
+
+// EffectivePollInterval returns the poll interval of the repository,
+// DefaultPollInterval when none is set
+func (r *RepositoryMetadata) EffectivePollInterval() time.Duration {
+	if r.PollInterval == 0 {
+		return DefaultPollInterval
+	}
+	return r.PollInterval
+}
+
+// NextPoll returns when the repository is due to be polled again
+func (r *RepositoryMetadata) NextPoll() time.Time {
+	if r.LastPolledAt == nil {
+		return time.Time{}
+	}
+	return r.LastPolledAt.Add(r.EffectivePollInterval())
+}
+
+// ClaimPoll records that the repository is polled at now, provided it was
+// last polled at previous. It returns false when another poller got there
+// first, so that replicas sharing the database poll every repository once.
+func (m *RepositoryManager) ClaimPoll(ctx context.Context, id int64, previous *time.Time, now time.Time) (bool, error) {
+	query := m.db.WithContext(ctx).Model(&RepositoryMetadata{}).Where("id = ?", id)
+	if previous == nil {
+		query = query.Where("last_polled_at IS NULL")
+	} else {
+		query = query.Where("last_polled_at = ?", *previous)
+	}
+
+	result := query.Update("last_polled_at", now)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim repository poll: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// GetBranchHeads returns the last seen commit of every branch of a repository
+func (m *RepositoryManager) GetBranchHeads(ctx context.Context, id int64) (map[string]string, error) {
+	var heads []BranchHead
+	result := m.db.WithContext(ctx).Where("repository_id = ?", id).Find(&heads)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get branch heads: %w", result.Error)
+	}
+
+	seen := make(map[string]string, len(heads))
+	for _, head := range heads {
+		seen[head.Branch] = head.Commit
+	}
+	return seen, nil
+}
+
+// SetBranchHead records the last seen commit of a branch
+func (m *RepositoryManager) SetBranchHead(ctx context.Context, id int64, branch, commit string) error {
+	head := BranchHead{
+		RepositoryID: id,
+		Branch:       branch,
+		Commit:       commit,
+		UpdatedAt:    time.Now(),
+	}
+	result := m.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "repository_id"}, {Name: "branch"}},
+		DoUpdates: clause.AssignmentColumns([]string{"commit", "updated_at"}),
+	}).Create(&head)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record head of branch %s: %w", branch, result.Error)
+	}
+	return nil
+}
+
+// RemoteBranchHeads returns the commit of every branch of origin as of
+// the last fetch of the local clone
+func (m *RepositoryManager) RemoteBranchHeads(ctx context.Context, id int64) (map[string]string, error) {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(metadata.LocalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return remoteBranchHeads(repo)
+}
+
+func remoteBranchHeads(repo *git.Repository) (map[string]string, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get references: %w", err)
+	}
+
+	heads := make(map[string]string)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() != plumbing.HashReference || !strings.HasPrefix(name, "refs/remotes/origin/") {
+			return nil
+		}
+		heads[strings.TrimPrefix(name, "refs/remotes/origin/")] = ref.Hash().String()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate references: %w", err)
+	}
+	return heads, nil
+}
+
+// ChangedServices returns the services touched between two commits of a
+// repository, using the same layout as DetectMicroservices: every
+// directory under micro-services/ is a service, and a change to shared/
+// or docker-compose.yml affects all of them
+func (m *RepositoryManager) ChangedServices(ctx context.Context, id int64, from, to string) ([]string, error) {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(metadata.LocalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return changedServices(repo, from, to)
+}
+
+func changedServices(repo *git.Repository, from, to string) ([]string, error) {
+	files, err := changedFiles(repo, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]bool)
+	for _, file := range files {
+		switch {
+		case strings.HasPrefix(file, "shared/") || file == "docker-compose.yml":
+			toTree, err := commitTree(repo, to)
+			if err != nil {
+				return nil, err
+			}
+			return allServices(toTree)
+		case strings.HasPrefix(file, "micro-services/"):
+			if parts := strings.SplitN(file, "/", 3); len(parts) == 3 {
+				services[path.Join(parts[0], parts[1])] = true
+			}
+		}
+	}
+
+	list := make([]string, 0, len(services))
+	for service := range services {
+		list = append(list, service)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// ChangedFiles returns the files added, modified or removed between two
+// commits of a repository
+func (m *RepositoryManager) ChangedFiles(ctx context.Context, id int64, from, to string) ([]string, error) {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(metadata.LocalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return changedFiles(repo, from, to)
+}
+
+// changedFiles lists the paths that differ between the trees of two
+// commits, sorted; a renamed file appears under both names
+func changedFiles(repo *git.Repository, from, to string) ([]string, error) {
+	toTree, err := commitTree(repo, to)
+	if err != nil {
+		return nil, err
+	}
+	fromTree, err := commitTree(repo, from)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff %s..%s: %w", from, to, err)
+	}
+
+	seen := make(map[string]bool)
+	files := []string{}
+	for _, change := range changes {
+		for _, file := range []string{change.From.Name, change.To.Name} {
+			if file != "" && !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// commitTree returns the tree of a commit
+func commitTree(repo *git.Repository, hash string) (*object.Tree, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree of commit %s: %w", hash, err)
+	}
+	return tree, nil
+}
+
+// allServices lists the service directories of a tree
+func allServices(tree *object.Tree) ([]string, error) {
+	dir, err := tree.Tree("micro-services")
+	if err == object.ErrDirectoryNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read micro-services: %w", err)
+	}
+
+	var list []string
+	for _, entry := range dir.Entries {
+		if !entry.Mode.IsFile() {
+			list = append(list, path.Join("micro-services", entry.Name))
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// commitFiles writes files into the worktree of repo and commits them
+func commitFiles(t *testing.T, repo *git.Repository, files map[string]string) string {
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	for name, content := range files {
+		path := filepath.Join(wt.Filesystem.Root(), name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+		_, err := wt.Add(name)
+		assert.Nil(t, err)
+	}
+	hash, err := wt.Commit("change", &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+	return hash.String()
+}
+
+func TestChangedServices(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	assert.Nil(t, err)
+
+	base := commitFiles(t, repo, map[string]string{
+		"micro-services/orders/main.go":   "package main",
+		"micro-services/payments/main.go": "package main",
+		"micro-services/users/main.go":    "package main",
+		"README.md":                       "shop",
+	})
+	orders := commitFiles(t, repo, map[string]string{
+		"micro-services/orders/main.go":          "package main // v2",
+		"micro-services/payments/api/handler.go": "package api",
+		"README.md":                              "shop v2",
+	})
+	shared := commitFiles(t, repo, map[string]string{
+		"shared/log/log.go": "package log",
+	})
+
+	files, err := changedFiles(repo, base, orders)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"README.md", "micro-services/orders/main.go", "micro-services/payments/api/handler.go"}, files)
+
+	services, err := changedServices(repo, base, orders)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"micro-services/orders", "micro-services/payments"}, services)
+
+	services, err = changedServices(repo, orders, shared)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"micro-services/orders", "micro-services/payments", "micro-services/users"}, services)
+
+	services, err = changedServices(repo, orders, orders)
+	assert.Nil(t, err)
+	assert.Empty(t, services)
+
+	_, err = changedServices(repo, "0123456789012345678901234567890123456789", orders)
+	assert.ErrorContains(t, err, "failed to get commit")
+}
+
+func TestRemoteBranchHeads(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	assert.Nil(t, err)
+	commit := commitFiles(t, repo, map[string]string{"README.md": "shop"})
+
+	hash := plumbing.NewHash(commit)
+	assert.Nil(t, repo.Storer.SetReference(plumbing.NewHashReference("refs/remotes/origin/main", hash)))
+	assert.Nil(t, repo.Storer.SetReference(plumbing.NewHashReference("refs/remotes/origin/release/1.0", hash)))
+	assert.Nil(t, repo.Storer.SetReference(plumbing.NewSymbolicReference("refs/remotes/origin/HEAD", "refs/remotes/origin/main")))
+
+	heads, err := remoteBranchHeads(repo)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"main": commit, "release/1.0": commit}, heads)
+}
+
+func TestNextPoll(t *testing.T) {
+	repo := &RepositoryMetadata{}
+	assert.True(t, repo.NextPoll().IsZero())
+
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	repo.LastPolledAt = &last
+	assert.Equal(t, last.Add(DefaultPollInterval), repo.NextPoll())
+
+	repo.PollInterval = time.Minute
+	assert.Equal(t, last.Add(time.Minute), repo.NextPoll())
+}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+// worktreesDir is the directory under the base directory holding the
+// worktrees of builds
+const worktreesDir = ".worktrees"
+
+// repoLocks serializes the Git operations that change a clone, by its
+// local path. They are shared by every RepositoryManager since several are
+// created over the same base directory.
+var repoLocks sync.Map
+
+// lockRepository locks the clone at path and returns the function
+// unlocking it
+func lockRepository(path string) func() {
+	mu, _ := repoLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Worktree is a checkout of a repository for a single build. It shares the
+// objects of the clone of the repository but has its own files, index and
+// head, so builds of different revisions do not disturb each other.
+type Worktree struct {
+	Dir    string
+	Commit string
+	clone  string
+}
+
+// CreateWorktree fetches rev into the clone of a repository and checks it
+// out in a new linked worktree. The worktree must be removed with
+// RemoveWorktree once the build is over.
+func (m *RepositoryManager) CreateWorktree(ctx context.Context, id int64, rev ci.Revision) (*Worktree, error) {
+	metadata, err := m.GetRepositoryByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := m.authFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return addWorktree(ctx, metadata.LocalPath, filepath.Join(m.baseDir, worktreesDir), rev, auth)
+}
+
+// addWorktree fetches rev into the clone at path and checks it out in a
+// new worktree under root
+func addWorktree(ctx context.Context, path, root string, rev ci.Revision, auth transport.AuthMethod) (*Worktree, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create worktree directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(root, "worktree")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create worktree directory: %w", err)
+	}
+
+	unlock := lockRepository(path)
+	defer unlock()
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	hash, err := ci.FetchRevision(repo, rev, 0, auth)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if _, err := runGit(ctx, path, "worktree", "add", "--detach", dir, hash.String()); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to add worktree: %w", err)
+	}
+	worktree := &Worktree{Dir: dir, Commit: hash.String(), clone: path}
+
+	linked, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{EnableDotGitCommonDir: true})
+	if err == nil {
+		_, err = ci.VerifyHead(linked, ci.Revision{Commit: hash.String()})
+	}
+	if err == nil {
+		err = updateSubmodules(linked, auth)
+	}
+	if err != nil {
+		removeWorktree(ctx, worktree)
+		return nil, err
+	}
+	return worktree, nil
+}
+
+// RemoveWorktree deletes a worktree created by CreateWorktree
+func (m *RepositoryManager) RemoveWorktree(ctx context.Context, worktree *Worktree) error {
+	unlock := lockRepository(worktree.clone)
+	defer unlock()
+	return removeWorktree(ctx, worktree)
+}
+
+func removeWorktree(ctx context.Context, worktree *Worktree) error {
+	if _, err := runGit(ctx, worktree.clone, "worktree", "remove", "--force", worktree.Dir); err == nil {
+		return nil
+	}
+
+	// The worktree is broken, delete it and forget about it
+	if err := os.RemoveAll(worktree.Dir); err != nil {
+		return fmt.Errorf("failed to remove worktree: %w", err)
+	}
+	if _, err := runGit(ctx, worktree.clone, "worktree", "prune"); err != nil {
+		return fmt.Errorf("failed to prune worktrees: %w", err)
+	}
+	return nil
+}
+
+// updateSubmodules checks out the submodules of a worktree
+func updateSubmodules(repo *git.Repository, auth transport.AuthMethod) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	submodules, err := worktree.Submodules()
+	if err == nil {
+		err = submodules.Update(&git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update submodules: %w", err)
+	}
+	return nil
+}
+
+// runGit runs a git command in the clone at dir
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("git %s: %w: %s", args[0], err, output)
+	}
+	return output, nil
+}
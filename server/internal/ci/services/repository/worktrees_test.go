@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+func TestWorktrees(t *testing.T) {
+	ctx := context.Background()
+	remoteDir := t.TempDir()
+	remote, err := git.PlainInit(remoteDir, false)
+	assert.Nil(t, err)
+	first := commitFiles(t, remote, map[string]string{"VERSION": "1"})
+
+	clone := filepath.Join(t.TempDir(), "shop")
+	_, err = git.PlainClone(clone, false, &git.CloneOptions{URL: "file://" + remoteDir})
+	assert.Nil(t, err)
+	second := commitFiles(t, remote, map[string]string{"VERSION": "2"})
+	root := filepath.Join(t.TempDir(), worktreesDir)
+
+	// Concurrent builds of different revisions get their own files
+	revisions := []ci.Revision{{Commit: first}, {Ref: "master"}}
+	worktrees := make([]*Worktree, len(revisions))
+	var wg sync.WaitGroup
+	for i, rev := range revisions {
+		wg.Add(1)
+		go func(i int, rev ci.Revision) {
+			defer wg.Done()
+			worktree, err := addWorktree(ctx, clone, root, rev, nil)
+			assert.Nil(t, err)
+			worktrees[i] = worktree
+		}(i, rev)
+	}
+	wg.Wait()
+	if worktrees[0] == nil || worktrees[1] == nil {
+		t.FailNow()
+	}
+
+	assert.Equal(t, first, worktrees[0].Commit)
+	assert.Equal(t, second, worktrees[1].Commit)
+	for i, version := range []string{"1", "2"} {
+		content, err := os.ReadFile(filepath.Join(worktrees[i].Dir, "VERSION"))
+		assert.Nil(t, err)
+		assert.Equal(t, version, string(content))
+	}
+
+	ws, err := ci.NewWorkspaceFromPath(worktrees[1].Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, second, ws.Commit())
+
+	// The checkout of the clone itself is untouched
+	content, err := os.ReadFile(filepath.Join(clone, "VERSION"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(content))
+
+	for _, worktree := range worktrees {
+		assert.Nil(t, removeWorktree(ctx, worktree))
+		assert.NoDirExists(t, worktree.Dir)
+	}
+	output, err := runGit(ctx, clone, "worktree", "list", "--porcelain")
+	assert.Nil(t, err)
+	assert.NotContains(t, string(output), root)
+
+	_, err = addWorktree(ctx, clone, root, ci.Revision{Ref: "missing"}, nil)
+	assert.ErrorContains(t, err, "failed to fetch")
+	entries, err := os.ReadDir(root)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
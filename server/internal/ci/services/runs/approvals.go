@@ -0,0 +1,140 @@
+package runs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"gorm.io/gorm/clause"
+)
+
+// Approval statuses
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// ErrApprovalNotPending is returned when deciding an approval step that is
+// not waiting for a decision
+var ErrApprovalNotPending = errors.New("no pending approval for this step")
+
+// Approval is the sign-off requested by an approval step of a run.
+// ExpiresAt is set when the step has a timeout, after which the approval
+// is rejected automatically.
+type Approval struct {
+	ID          int64      `json:"id" gorm:"primaryKey;autoIncrement"`
+	RunID       int64      `json:"runId" gorm:"not null;uniqueIndex:idx_run_approval_step"`
+	Step        string     `json:"step" gorm:"not null;uniqueIndex:idx_run_approval_step"`
+	Status      string     `json:"status" gorm:"not null;index"`
+	DecidedBy   string     `json:"decidedBy,omitempty"`
+	Comment     string     `json:"comment,omitempty"`
+	RequestedAt time.Time  `json:"requestedAt" gorm:"not null"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" gorm:"index"`
+	DecidedAt   *time.Time `json:"decidedAt,omitempty"`
+}
+
+// decision returns the approval as handed to the executor
+func (a *Approval) decision() ci.Approval {
+	decision := ci.Approval{
+		Approved: a.Status == ApprovalApproved,
+		By:       a.DecidedBy,
+		Comment:  a.Comment,
+	}
+	if a.DecidedAt != nil {
+		decision.DecidedAt = *a.DecidedAt
+	}
+	return decision
+}
+
+// RequestApproval records a pending approval, unless the step of the run
+// already has one
+func (m *RunManager) RequestApproval(ctx context.Context, approval *Approval) error {
+	approval.Status = ApprovalPending
+	result := m.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(approval)
+	if result.Error != nil {
+		return fmt.Errorf("failed to request approval: %w", result.Error)
+	}
+	return nil
+}
+
+// ListApprovals lists the approvals of a run
+func (m *RunManager) ListApprovals(ctx context.Context, runID int64) ([]Approval, error) {
+	var approvals []Approval
+	result := m.db.WithContext(ctx).Where("run_id = ?", runID).Order("id").Find(&approvals)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list approvals: %w", result.Error)
+	}
+	return approvals, nil
+}
+
+// DecideApproval approves or rejects the pending approval of a step
+func (m *RunManager) DecideApproval(ctx context.Context, runID int64, step string, approved bool, by, comment string) error {
+	status := ApprovalRejected
+	if approved {
+		status = ApprovalApproved
+	}
+	now := time.Now()
+
+	result := m.db.WithContext(ctx).Model(&Approval{}).
+		Where("run_id = ? AND step = ? AND status = ?", runID, step, ApprovalPending).
+		Updates(map[string]interface{}{
+			"status":     status,
+			"decided_by": by,
+			"comment":    comment,
+			"decided_at": now,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to record approval: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrApprovalNotPending
+	}
+	return nil
+}
+
+// ListExpiredApprovals lists pending approvals whose timeout has passed
+func (m *RunManager) ListExpiredApprovals(ctx context.Context, now time.Time) ([]Approval, error) {
+	var approvals []Approval
+	result := m.db.WithContext(ctx).
+		Where("status = ? AND expires_at < ?", ApprovalPending, now).
+		Order("id").
+		Find(&approvals)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list expired approvals: %w", result.Error)
+	}
+	return approvals, nil
+}
+
+// ResumeRun moves a run waiting for approval back to the queued state. It
+// returns false when the run was not waiting, for instance because another
+// decision resumed it already.
+func (m *RunManager) ResumeRun(ctx context.Context, id int64) (bool, error) {
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("id = ? AND status = ?", id, StatusWaitingForApproval).
+		Updates(map[string]interface{}{
+			"status":     StatusQueued,
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to resume pipeline run: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// approvalsFor returns the decided approvals of a run by step name
+func (m *RunManager) approvalsFor(ctx context.Context, runID int64) (map[string]ci.Approval, error) {
+	approvals, err := m.ListApprovals(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	decisions := make(map[string]ci.Approval)
+	for i := range approvals {
+		if approvals[i].Status != ApprovalPending {
+			decisions[approvals[i].Step] = approvals[i].decision()
+		}
+	}
+	return decisions, nil
+}
@@ -0,0 +1,147 @@
+package runs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+// releasePipeline builds, waits for a sign-off and deploys what it built.
+// Build appends to build.log, so running it again would show in Deploy.
+func releasePipeline(deploy string) string {
+	return `
+name: Release
+shell: /bin/sh
+steps:
+  - name: Build
+    commands:
+      - echo built >> build.log
+  - name: Sign-off
+    type: approval
+    timeout: 1h
+    needs: [Build]
+  - name: Deploy
+    needs: [Sign-off]
+    commands:
+      - ` + deploy + `
+`
+}
+
+// pauseRun submits a run of pipeline on q and executes it until it waits
+// for approval
+func pauseRun(t *testing.T, q *RunQueue, pipeline string) *PipelineRun {
+	run, err := q.Submit(context.Background(), RunRequest{URL: initRemote(t, pipeline), Branch: "master"})
+	assert.Nil(t, err)
+	q.execute(context.Background(), <-q.jobs)
+
+	run, err = q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusWaitingForApproval, run.Status, run.Error)
+	assert.Len(t, run.Approvals, 1)
+	assert.Equal(t, ApprovalPending, run.Approvals[0].Status)
+	assert.DirExists(t, run.WorkspaceDir)
+	return run
+}
+
+// stepOutput returns the output of the step of a run result with name
+func stepOutput(result *ci.RunResult, name string) string {
+	for _, step := range result.Steps {
+		if step.Name == name {
+			return step.Output
+		}
+	}
+	return ""
+}
+
+func TestApproveResumesWithoutRerunningSteps(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	run := pauseRun(t, q, releasePipeline("cat build.log"))
+
+	assert.Nil(t, q.Decide(context.Background(), run.ID, "Sign-off", true, "alice", "Ship it"))
+	assert.ErrorIs(t, q.Decide(context.Background(), run.ID, "Sign-off", false, "bob", ""), ErrApprovalNotPending)
+	q.execute(context.Background(), <-q.jobs)
+
+	run, err := q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusSuccess, run.Status, run.Error)
+	assert.Equal(t, map[string]ci.StepStatus{
+		"Build":    ci.StepSuccess,
+		"Sign-off": ci.StepSuccess,
+		"Deploy":   ci.StepSuccess,
+	}, stepStatuses(run.Result))
+	// Deploy ran in the paused workspace, where Build ran once
+	assert.Equal(t, 1, strings.Count(stepOutput(run.Result, "Deploy"), "built"))
+	assert.Equal(t, ApprovalApproved, run.Approvals[0].Status)
+	assert.Equal(t, "alice", run.Approvals[0].DecidedBy)
+	assert.NotNil(t, run.Approvals[0].DecidedAt)
+	assert.NoDirExists(t, run.WorkspaceDir)
+}
+
+func TestRejectFailsRun(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	run := pauseRun(t, q, releasePipeline("cat build.log"))
+
+	assert.Nil(t, q.Decide(context.Background(), run.ID, "Sign-off", false, "bob", "Not today"))
+	q.execute(context.Background(), <-q.jobs)
+
+	run, err := q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, run.Status)
+	assert.Contains(t, run.Error, `"Sign-off" was rejected by bob`)
+	assert.Equal(t, ci.StepSkipped, stepStatuses(run.Result)["Deploy"])
+	assert.Equal(t, ApprovalRejected, run.Approvals[0].Status)
+}
+
+func TestApprovalTimeoutRejects(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	run := pauseRun(t, q, releasePipeline("cat build.log"))
+	assert.NotNil(t, run.Approvals[0].ExpiresAt)
+
+	q.rejectExpiredApprovals(context.Background(), time.Now())
+	assert.Empty(t, q.jobs)
+
+	q.rejectExpiredApprovals(context.Background(), time.Now().Add(2*time.Hour))
+	q.execute(context.Background(), <-q.jobs)
+
+	run, err := q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, run.Status)
+	assert.Equal(t, ApprovalRejected, run.Approvals[0].Status)
+	assert.Equal(t, "timeout", run.Approvals[0].DecidedBy)
+	assert.Equal(t, ci.StepSkipped, stepStatuses(run.Result)["Deploy"])
+}
+
+func TestResumeOnAnotherServer(t *testing.T) {
+	manager := newTestManager(t)
+	paused, other := newTestQueue(t, manager), newTestQueue(t, manager)
+	run := pauseRun(t, paused, releasePipeline("echo deployed"))
+	dir := run.WorkspaceDir
+
+	// The run is approved through the other server, which executes it
+	// without the paused workspace
+	assert.Nil(t, other.Decide(context.Background(), run.ID, "Sign-off", true, "alice", ""))
+	paused.releaseAbandonedWorkspaces(context.Background())
+	assert.DirExists(t, dir)
+	other.execute(context.Background(), <-other.jobs)
+
+	run, err := manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusSuccess, run.Status, run.Error)
+	assert.Contains(t, stepOutput(run.Result, "Deploy"), "deployed")
+	stream, ok := other.broker.Get(run.ID)
+	assert.True(t, ok)
+	lines, _, _ := stream.ReadFrom(0)
+	var log []string
+	for _, line := range lines {
+		log = append(log, line.Text)
+	}
+	assert.Contains(t, strings.Join(log, "\n"), "Workspace is not on this server")
+
+	// The server it paused on lets go of the workspace
+	paused.releaseAbandonedWorkspaces(context.Background())
+	assert.NoDirExists(t, dir)
+}
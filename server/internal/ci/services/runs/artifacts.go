@@ -0,0 +1,82 @@
+package runs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrArtifactNotFound is returned when an artifact does not exist
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// Artifact is an archive of files uploaded by a step of a pipeline run
+type Artifact struct {
+	ID        int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	RunID     int64     `json:"runId" gorm:"not null;index"`
+	StepName  string    `json:"stepName" gorm:"not null"`
+	Key       string    `json:"-" gorm:"not null"`
+	Size      int64     `json:"size"`
+	Files     []string  `json:"files" gorm:"serializer:json"`
+	ExpireAt  time.Time `json:"expireAt" gorm:"not null;index"`
+	CreatedAt time.Time `json:"createdAt" gorm:"not null"`
+}
+
+// Expired reports whether the artifact is past its expiry time
+func (a *Artifact) Expired() bool {
+	return time.Now().After(a.ExpireAt)
+}
+
+// SaveArtifact records an uploaded artifact
+func (m *RunManager) SaveArtifact(ctx context.Context, artifact *Artifact) error {
+	artifact.CreatedAt = time.Now()
+	result := m.db.WithContext(ctx).Create(artifact)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save artifact: %w", result.Error)
+	}
+	return nil
+}
+
+// ListArtifacts lists the artifacts of a run
+func (m *RunManager) ListArtifacts(ctx context.Context, runID int64) ([]Artifact, error) {
+	var artifacts []Artifact
+	result := m.db.WithContext(ctx).Where("run_id = ?", runID).Order("id").Find(&artifacts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list artifacts: %w", result.Error)
+	}
+	return artifacts, nil
+}
+
+// GetArtifact gets an artifact of a run by ID
+func (m *RunManager) GetArtifact(ctx context.Context, runID, id int64) (*Artifact, error) {
+	var artifact Artifact
+	result := m.db.WithContext(ctx).Where("run_id = ?", runID).First(&artifact, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrArtifactNotFound
+		}
+		return nil, fmt.Errorf("failed to get artifact: %w", result.Error)
+	}
+	return &artifact, nil
+}
+
+// ListExpiredArtifacts lists artifacts whose expiry time has passed
+func (m *RunManager) ListExpiredArtifacts(ctx context.Context, now time.Time) ([]Artifact, error) {
+	var artifacts []Artifact
+	result := m.db.WithContext(ctx).Where("expire_at < ?", now).Order("id").Limit(500).Find(&artifacts)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list expired artifacts: %w", result.Error)
+	}
+	return artifacts, nil
+}
+
+// DeleteArtifact removes the record of an artifact
+func (m *RunManager) DeleteArtifact(ctx context.Context, id int64) error {
+	result := m.db.WithContext(ctx).Delete(&Artifact{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete artifact: %w", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package runs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"gorm.io/gorm"
+)
+
+// Run statuses
+const (
+	StatusQueued             = "queued"
+	StatusRunning            = "running"
+	StatusWaitingForApproval = "waiting_for_approval"
+	StatusSuccess            = "success"
+	StatusFailed             = "failed"
+	StatusCancelled          = "cancelled"
+)
+
+// Trigger types
+const (
+	TriggerManual      = "manual"
+	TriggerPush        = "push"
+	TriggerTag         = "tag"
+	TriggerPullRequest = "pull_request"
+	TriggerScheduled   = "scheduled"
+	TriggerPoll        = "poll"
+)
+
+// ErrRunNotFound is returned when a pipeline run does not exist
+var ErrRunNotFound = errors.New("pipeline run not found")
+
+// PipelineRun is a persisted execution of a pipeline. PipelinePath is the
+// file the pipeline was read from in the repository, empty when it was
+// uploaded with the run; PullRequest is the pull or merge request the run
+// was triggered for; Env overrides the variables of the pipeline;
+// ChangedFiles are the files changed by the triggering commits; Result
+// holds the outcome of every step and command. WorkspaceDir keeps the
+// checkout of a run waiting for approval so it can resume there.
+// HeartbeatAt is refreshed by the server executing the run, so that the
+// runs of a server that went away can be told apart from those still
+// executing on another one.
+type PipelineRun struct {
+	ID           int64             `json:"id" gorm:"primaryKey;autoIncrement"`
+	URL          string            `json:"url" gorm:"not null;index"`
+	Branch       string            `json:"branch" gorm:"not null"`
+	Commit       string            `json:"commit"`
+	Pinned       bool              `json:"pinned,omitempty"`
+	PipelineName string            `json:"pipelineName"`
+	PipelinePath string            `json:"pipelinePath,omitempty"`
+	PipelineYAML string            `json:"-" gorm:"type:text"`
+	ResolvedYAML string            `json:"-" gorm:"type:text"`
+	Trigger      string            `json:"trigger" gorm:"not null"`
+	PullRequest  int               `json:"pullRequest,omitempty"`
+	Env          map[string]string `json:"env,omitempty" gorm:"type:text;serializer:json"`
+	ChangedFiles []string          `json:"changedFiles,omitempty" gorm:"type:text;serializer:json"`
+	Status       string            `json:"status" gorm:"not null;index"`
+	Error        string            `json:"error,omitempty"`
+	Output       string            `json:"output,omitempty" gorm:"type:text"`
+	Result       *ci.RunResult     `json:"result,omitempty" gorm:"type:text;serializer:json"`
+	WorkspaceDir string            `json:"-"`
+	HeartbeatAt  *time.Time        `json:"-" gorm:"index"`
+	QueuedAt     time.Time         `json:"queuedAt" gorm:"not null"`
+	StartedAt    *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time        `json:"finishedAt,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt" gorm:"not null"`
+	UpdatedAt    time.Time         `json:"updatedAt" gorm:"not null"`
+	Steps        []StepRun         `json:"steps,omitempty" gorm:"foreignKey:RunID"`
+	Artifacts    []Artifact        `json:"artifacts,omitempty" gorm:"foreignKey:RunID"`
+	Approvals    []Approval        `json:"approvals,omitempty" gorm:"foreignKey:RunID"`
+}
+
+// StepRun is the persisted state of one step of a pipeline run
+type StepRun struct {
+	ID         int64      `json:"id" gorm:"primaryKey;autoIncrement"`
+	RunID      int64      `json:"runId" gorm:"not null;index"`
+	Name       string     `json:"name" gorm:"not null"`
+	Status     string     `json:"status" gorm:"not null"`
+	ExitCode   int        `json:"exitCode"`
+	Attempts   int        `json:"attempts"`
+	TimedOut   bool       `json:"timedOut"`
+	Error      string     `json:"error,omitempty"`
+	Output     string     `json:"output,omitempty" gorm:"type:text"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" gorm:"not null"`
+	UpdatedAt  time.Time  `json:"updatedAt" gorm:"not null"`
+}
+
+// Finished reports whether the run has reached a final status
+func (r *PipelineRun) Finished() bool {
+	return r.Status == StatusSuccess || r.Status == StatusFailed || r.Status == StatusCancelled
+}
+
+// Revision returns the revision the run builds: the commit it was pinned
+// to, or else the head of its branch
+func (r *PipelineRun) Revision() ci.Revision {
+	rev := ci.Revision{Ref: r.Branch}
+	if r.Pinned {
+		rev.Commit = r.Commit
+	}
+	return rev
+}
+
+// ListFilter narrows down the runs returned by ListRuns
+type ListFilter struct {
+	URL    string
+	Branch string
+	Status string
+	Limit  int
+}
+
+// RunManager stores pipeline runs and their steps
+type RunManager struct {
+	db *gorm.DB
+}
+
+// NewRunManager creates a new RunManager instance
+func NewRunManager(db *gorm.DB) (*RunManager, error) {
+	// Auto migrate the schema
+	err := db.AutoMigrate(&PipelineRun{}, &StepRun{}, &Artifact{}, &Approval{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &RunManager{db: db}, nil
+}
+
+// CreateRun stores a new run in the queued state
+func (m *RunManager) CreateRun(ctx context.Context, run *PipelineRun) error {
+	return createRun(m.db.WithContext(ctx), run)
+}
+
+// createRun stores a new run in the queued state with db, which may be a
+// transaction
+func createRun(db *gorm.DB, run *PipelineRun) error {
+	now := time.Now()
+	run.Status = StatusQueued
+	run.QueuedAt = now
+	run.CreatedAt = now
+	run.UpdatedAt = now
+	if run.Trigger == "" {
+		run.Trigger = TriggerManual
+	}
+
+	result := db.Create(run)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create pipeline run: %w", result.Error)
+	}
+	return nil
+}
+
+// GetRun gets a run with its steps, artifacts and approvals by ID
+func (m *RunManager) GetRun(ctx context.Context, id int64) (*PipelineRun, error) {
+	var run PipelineRun
+	result := m.db.WithContext(ctx).
+		Preload("Steps", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Artifacts", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Preload("Approvals", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		First(&run, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrRunNotFound
+		}
+		return nil, fmt.Errorf("failed to get pipeline run: %w", result.Error)
+	}
+	return &run, nil
+}
+
+// ListRuns lists runs, newest first, without their step output and changed files
+func (m *RunManager) ListRuns(ctx context.Context, filter ListFilter) ([]PipelineRun, error) {
+	query := m.db.WithContext(ctx).Omit("output", "result", "pipeline_yaml", "resolved_yaml", "changed_files").Order("id DESC")
+	if filter.URL != "" {
+		query = query.Where("url = ?", filter.URL)
+	}
+	if filter.Branch != "" {
+		query = query.Where("branch = ?", filter.Branch)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Limit <= 0 || filter.Limit > 500 {
+		filter.Limit = 50
+	}
+
+	var runs []PipelineRun
+	result := query.Limit(filter.Limit).Find(&runs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list pipeline runs: %w", result.Error)
+	}
+	return runs, nil
+}
+
+// QueuedRunIDs lists the IDs of up to limit queued runs, oldest first
+func (m *RunManager) QueuedRunIDs(ctx context.Context, limit int) ([]int64, error) {
+	var ids []int64
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("status = ?", StatusQueued).
+		Order("id").
+		Limit(limit).
+		Pluck("id", &ids)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list queued pipeline runs: %w", result.Error)
+	}
+	return ids, nil
+}
+
+// UpdateRun saves the run's own columns, provided the stored run is still
+// in the status from. It returns false when it is not, for instance
+// because the run was cancelled from another server meanwhile. The
+// heartbeat is left alone, it is only written by ClaimRun and Heartbeat.
+func (m *RunManager) UpdateRun(ctx context.Context, run *PipelineRun, from string) (bool, error) {
+	run.UpdatedAt = time.Now()
+	result := m.db.WithContext(ctx).Model(run).
+		Where("status = ?", from).
+		Select("*").
+		Omit("ID", "CreatedAt", "HeartbeatAt", "Steps", "Artifacts", "Approvals").
+		Updates(run)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to update pipeline run: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// SaveStep creates or updates the step of a run with the same name
+func (m *RunManager) SaveStep(ctx context.Context, step *StepRun) error {
+	now := time.Now()
+	step.UpdatedAt = now
+
+	var existing StepRun
+	result := m.db.WithContext(ctx).Where("run_id = ? AND name = ?", step.RunID, step.Name).First(&existing)
+	if result.Error == nil {
+		step.ID = existing.ID
+		step.CreatedAt = existing.CreatedAt
+	} else if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		step.CreatedAt = now
+	} else {
+		return fmt.Errorf("failed to look up step run: %w", result.Error)
+	}
+
+	result = m.db.WithContext(ctx).Save(step)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save step run: %w", result.Error)
+	}
+	return nil
+}
+
+// ClaimRun moves a queued run to the running state, recording its start
+// time. It returns false when the run is no longer queued, for instance
+// because another server claimed it first.
+func (m *RunManager) ClaimRun(ctx context.Context, run *PipelineRun) (bool, error) {
+	now := time.Now()
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("id = ? AND status = ?", run.ID, StatusQueued).
+		Updates(map[string]interface{}{
+			"status":       StatusRunning,
+			"started_at":   run.StartedAt,
+			"heartbeat_at": now,
+			"updated_at":   now,
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to claim pipeline run: %w", result.Error)
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	run.Status = StatusRunning
+	run.HeartbeatAt = &now
+	run.UpdatedAt = now
+	return true, nil
+}
+
+// Heartbeat records that a running run is still being executed. It
+// returns false when the run is no longer running, because it was
+// cancelled or failed as interrupted, so its execution should stop.
+func (m *RunManager) Heartbeat(ctx context.Context, id int64) (bool, error) {
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("id = ? AND status = ?", id, StatusRunning).
+		UpdateColumn("heartbeat_at", time.Now())
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record heartbeat of pipeline run: %w", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// WorkspaceInUse reports whether a run that has not finished keeps its
+// workspace in dir
+func (m *RunManager) WorkspaceInUse(ctx context.Context, dir string) (bool, error) {
+	var count int64
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("workspace_dir = ? AND status IN ?", dir, []string{StatusQueued, StatusRunning, StatusWaitingForApproval}).
+		Count(&count)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to look up pipeline runs: %w", result.Error)
+	}
+	return count > 0, nil
+}
+
+// FailInterruptedRuns marks the running runs without a heartbeat since
+// cutoff as failed, since the server executing them went away
+func (m *RunManager) FailInterruptedRuns(ctx context.Context, cutoff time.Time) error {
+	now := time.Now()
+	result := m.db.WithContext(ctx).Model(&PipelineRun{}).
+		Where("status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)", StatusRunning, cutoff).
+		Updates(map[string]interface{}{
+			"status":      StatusFailed,
+			"error":       "run interrupted, the server executing it stopped",
+			"finished_at": now,
+			"updated_at":  now,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to fail interrupted runs: %w", result.Error)
+	}
+	return nil
+}
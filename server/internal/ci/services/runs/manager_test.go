@@ -0,0 +1,112 @@
+package runs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestRun stores a queued run
+func createTestRun(t *testing.T, manager *RunManager) *PipelineRun {
+	run := &PipelineRun{URL: "https://git.example.com/acme/shop.git", Branch: "main"}
+	assert.Nil(t, manager.CreateRun(context.Background(), run))
+	return run
+}
+
+// setHeartbeat moves the heartbeat of a run, as if it was recorded at at
+func setHeartbeat(t *testing.T, manager *RunManager, id int64, at time.Time) {
+	assert.Nil(t, manager.db.Model(&PipelineRun{}).Where("id = ?", id).UpdateColumn("heartbeat_at", at).Error)
+}
+
+func TestClaimRunOnlyOnce(t *testing.T) {
+	manager := newTestManager(t)
+	run := createTestRun(t, manager)
+
+	// Servers sharing the database race for the same queued run
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claims := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := time.Now()
+			claimed, err := manager.ClaimRun(context.Background(), &PipelineRun{ID: run.ID, StartedAt: &now})
+			assert.Nil(t, err)
+			if claimed {
+				mu.Lock()
+				claims++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, claims)
+
+	stored, err := manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusRunning, stored.Status)
+	assert.NotNil(t, stored.StartedAt)
+	assert.NotNil(t, stored.HeartbeatAt)
+
+	claimed, err := manager.ClaimRun(context.Background(), stored)
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+}
+
+func TestFailInterruptedRuns(t *testing.T) {
+	manager := newTestManager(t)
+	now := time.Now()
+
+	stale, alive, queued := createTestRun(t, manager), createTestRun(t, manager), createTestRun(t, manager)
+	for _, run := range []*PipelineRun{stale, alive} {
+		claimed, err := manager.ClaimRun(context.Background(), run)
+		assert.Nil(t, err)
+		assert.True(t, claimed)
+	}
+	setHeartbeat(t, manager, stale.ID, now.Add(-time.Hour))
+
+	assert.Nil(t, manager.FailInterruptedRuns(context.Background(), now.Add(-runLeaseTimeout)))
+
+	run, err := manager.GetRun(context.Background(), stale.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, run.Status)
+	assert.Contains(t, run.Error, "interrupted")
+	assert.NotNil(t, run.FinishedAt)
+
+	run, err = manager.GetRun(context.Background(), alive.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusRunning, run.Status)
+	run, err = manager.GetRun(context.Background(), queued.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusQueued, run.Status)
+
+	// The server of the failed run learns it at its next heartbeat
+	beating, err := manager.Heartbeat(context.Background(), stale.ID)
+	assert.Nil(t, err)
+	assert.False(t, beating)
+	beating, err = manager.Heartbeat(context.Background(), alive.ID)
+	assert.Nil(t, err)
+	assert.True(t, beating)
+}
+
+func TestUpdateRunFromStatus(t *testing.T) {
+	manager := newTestManager(t)
+	run := createTestRun(t, manager)
+
+	run.Status = StatusCancelled
+	updated, err := manager.UpdateRun(context.Background(), run, StatusRunning)
+	assert.Nil(t, err)
+	assert.False(t, updated)
+
+	updated, err = manager.UpdateRun(context.Background(), run, StatusQueued)
+	assert.Nil(t, err)
+	assert.True(t, updated)
+	stored, err := manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusCancelled, stored.Status)
+	assert.Equal(t, run.QueuedAt.Unix(), stored.QueuedAt.Unix())
+}
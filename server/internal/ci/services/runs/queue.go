@@ -0,0 +1,973 @@
+package runs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/cache"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/status"
+	"gorm.io/gorm"
+)
+
+// ErrRunFinished is returned when cancelling a run that already ended
+var ErrRunFinished = errors.New("pipeline run already finished")
+
+// queueCapacity bounds the number of runs waiting for a worker
+const queueCapacity = 1024
+
+// artifactPruneInterval is how often expired artifacts are deleted
+const artifactPruneInterval = time.Hour
+
+// queuedCheckInterval is how often the database is looked for queued runs
+// that are not waiting for a worker, because the queue was full or they
+// were queued by another server
+const queuedCheckInterval = 5 * time.Second
+
+// approvalCheckInterval is how often approvals are checked for timeouts
+const approvalCheckInterval = 30 * time.Second
+
+// heartbeatInterval is how often the server executing a run records that
+// it is still alive, and how often runs without a heartbeat are looked for
+const heartbeatInterval = 30 * time.Second
+
+// runLeaseTimeout is how long a running run may go without a heartbeat
+// before it is considered interrupted
+const runLeaseTimeout = 4 * heartbeatInterval
+
+// RunRequest describes a pipeline run to enqueue. When PipelineYAML is
+// empty the pipeline is read from the cloned repository, from PipelinePath
+// or else from the first of ci.DefaultPipelinePaths that exists.
+type RunRequest struct {
+	URL string
+	// Branch is a branch name or a full reference such as refs/tags/v1.0
+	// or refs/pull/12/head. It may be empty for a pinned commit.
+	Branch string
+	// Commit is the commit that triggered the run, when known
+	Commit string
+	// Pinned runs build Commit itself rather than the head of Branch
+	Pinned       bool
+	PipelineYAML []byte
+	PipelinePath string
+	Trigger      string
+	PullRequest  int
+	Env          map[string]string
+	// ChangedFiles are the files changed by the commits that triggered
+	// the run, for the changed() function of step conditions
+	ChangedFiles []string
+}
+
+// StatusReporterFunc returns the reporter for the repository at url, or nil
+// when results are not reported for that repository
+type StatusReporterFunc func(ctx context.Context, url string) status.StatusReporter
+
+// AuthFunc returns the authentication for cloning the repository at url,
+// or nil when the repository is public
+type AuthFunc func(ctx context.Context, url string) (transport.AuthMethod, error)
+
+// RunQueue executes queued pipeline runs on a fixed pool of workers
+type RunQueue struct {
+	manager    *RunManager
+	broker     *logs.Broker
+	artifacts  artifacts.Store
+	cache      *cache.Cache
+	templates  ci.TemplateSource
+	reporters  StatusReporterFunc
+	auth       AuthFunc
+	baseURL    string
+	workspaces *ci.WorkspaceManager
+	workers    int
+	jobs       chan int64
+	// heartbeatEvery is how often executing runs record their heartbeat
+	// and check that they were not stopped from another server
+	heartbeatEvery time.Duration
+
+	mu sync.Mutex
+	// queued holds the runs sent to jobs that are not executed yet
+	queued    map[int64]bool
+	active    map[int64]context.CancelFunc
+	cancelled map[int64]bool
+	// pausing holds the workspaces of runs being paused, which are held
+	// before their run refers to them
+	pausing map[string]bool
+}
+
+// NewRunQueue creates a new RunQueue that clones workspaces with workspaces,
+// streams the output of every run through broker and keeps step artifacts in store
+func NewRunQueue(manager *RunManager, broker *logs.Broker, store artifacts.Store, workspaces *ci.WorkspaceManager, workers int) *RunQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &RunQueue{
+		manager:    manager,
+		broker:     broker,
+		artifacts:  store,
+		workspaces: workspaces,
+		workers:    workers,
+		jobs:       make(chan int64, queueCapacity),
+		queued:     make(map[int64]bool),
+		active:     make(map[int64]context.CancelFunc),
+		cancelled:  make(map[int64]bool),
+		pausing:    make(map[string]bool),
+
+		heartbeatEvery: heartbeatInterval,
+	}
+}
+
+// Start recovers runs left over by a previous process and starts the workers,
+// the queued run dispatcher, the artifact pruner, the approval expirer and
+// the interrupted run reaper. They stop when ctx is cancelled. Several
+// servers may share the database: a queued run is executed by the first
+// one to claim it, and running runs are only failed once their heartbeat
+// has stopped.
+func (q *RunQueue) Start(ctx context.Context) error {
+	if err := q.manager.FailInterruptedRuns(ctx, time.Now().Add(-runLeaseTimeout)); err != nil {
+		return err
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+	go q.dispatch(ctx)
+	go q.pruneArtifacts(ctx)
+	go q.expireApprovals(ctx)
+	go q.failInterruptedRuns(ctx)
+	return nil
+}
+
+// SetCache lets pipeline steps restore and save caches in c
+func (q *RunQueue) SetCache(c *cache.Cache) {
+	q.cache = c
+}
+
+// SetTemplateSource lets pipelines include templates from src
+func (q *RunQueue) SetTemplateSource(src ci.TemplateSource) {
+	q.templates = src
+}
+
+// SetStatusReporter reports run results to the Git host of each repository
+// through the reporter f returns. Links back to a run start with baseURL.
+func (q *RunQueue) SetStatusReporter(f StatusReporterFunc, baseURL string) {
+	q.reporters = f
+	q.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// SetAuth authenticates the clones of run workspaces with the credential f
+// returns for each repository
+func (q *RunQueue) SetAuth(f AuthFunc) {
+	q.auth = f
+}
+
+// OpenArtifact returns the archive of an artifact
+func (q *RunQueue) OpenArtifact(ctx context.Context, artifact *Artifact) (io.ReadCloser, error) {
+	return q.artifacts.Open(ctx, artifact.Key)
+}
+
+// dispatch periodically sends the queued runs of the database to the workers
+func (q *RunQueue) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(queuedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		q.dispatchQueued(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchQueued sends the queued runs of the database to the workers,
+// oldest first, until jobs is full
+func (q *RunQueue) dispatchQueued(ctx context.Context) {
+	ids, err := q.manager.QueuedRunIDs(ctx, cap(q.jobs))
+	if err != nil {
+		log.Printf("Failed to list queued pipeline runs: %v", err)
+		return
+	}
+	for _, id := range ids {
+		if !q.push(id) {
+			return
+		}
+	}
+}
+
+// push sends run id to the workers unless it waits in jobs already. It
+// returns false when jobs is full; the run stays queued in the database
+// and dispatch sends it once a worker is free.
+func (q *RunQueue) push(id int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[id] {
+		return true
+	}
+	select {
+	case q.jobs <- id:
+		q.queued[id] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// pruneArtifacts periodically deletes artifacts past their expiry time
+func (q *RunQueue) pruneArtifacts(ctx context.Context) {
+	ticker := time.NewTicker(artifactPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := q.manager.ListExpiredArtifacts(ctx, time.Now())
+		if err != nil {
+			log.Printf("Failed to list expired artifacts: %v", err)
+		}
+		for _, artifact := range expired {
+			if err := q.artifacts.Delete(ctx, artifact.Key); err != nil {
+				log.Printf("Failed to delete artifact %s: %v", artifact.Key, err)
+				continue
+			}
+			if err := q.manager.DeleteArtifact(ctx, artifact.ID); err != nil {
+				log.Printf("Failed to delete artifact %d: %v", artifact.ID, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// failInterruptedRuns periodically fails the runs whose server stopped
+// sending heartbeats
+func (q *RunQueue) failInterruptedRuns(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := q.manager.FailInterruptedRuns(ctx, time.Now().Add(-runLeaseTimeout)); err != nil {
+			log.Printf("Failed to fail interrupted runs: %v", err)
+		}
+	}
+}
+
+// heartbeat records that run id is alive until ctx is cancelled. Once the
+// stored run is no longer running, because it was cancelled from another
+// server or failed as interrupted, its execution is stopped with cancel.
+func (q *RunQueue) heartbeat(ctx context.Context, id int64, cancel context.CancelFunc) {
+	ticker := time.NewTicker(q.heartbeatEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		alive, err := q.manager.Heartbeat(ctx, id)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to record heartbeat of pipeline run %d: %v", id, err)
+			}
+			continue
+		}
+		if !alive {
+			log.Printf("Pipeline run %d was stopped from elsewhere", id)
+			q.mu.Lock()
+			if _, ok := q.active[id]; ok {
+				q.cancelled[id] = true
+			}
+			q.mu.Unlock()
+			cancel()
+			return
+		}
+	}
+}
+
+// expireApprovals periodically rejects the approvals whose timeout has
+// passed and resumes their runs, and releases the workspaces no run waits
+// for any more
+func (q *RunQueue) expireApprovals(ctx context.Context) {
+	ticker := time.NewTicker(approvalCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		q.rejectExpiredApprovals(ctx, time.Now())
+		q.releaseAbandonedWorkspaces(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rejectExpiredApprovals rejects the approvals whose timeout passed
+// before now and resumes their runs
+func (q *RunQueue) rejectExpiredApprovals(ctx context.Context, now time.Time) {
+	expired, err := q.manager.ListExpiredApprovals(ctx, now)
+	if err != nil {
+		log.Printf("Failed to list expired approvals: %v", err)
+	}
+	for _, approval := range expired {
+		comment := "No decision before " + approval.ExpiresAt.Format(time.RFC3339)
+		err := q.manager.DecideApproval(ctx, approval.RunID, approval.Step, false, "timeout", comment)
+		if errors.Is(err, ErrApprovalNotPending) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to expire approval of step %q in run %d: %v", approval.Step, approval.RunID, err)
+			continue
+		}
+		if err := q.resume(ctx, approval.RunID); err != nil {
+			log.Printf("Failed to resume pipeline run %d: %v", approval.RunID, err)
+		}
+	}
+}
+
+// releaseAbandonedWorkspaces releases the held workspaces that no run
+// waits to resume in, such as the workspace of a run that was cancelled,
+// or resumed on another server, after it paused here
+func (q *RunQueue) releaseAbandonedWorkspaces(ctx context.Context) {
+	held, err := q.workspaces.Held()
+	if err != nil {
+		log.Printf("Failed to list held workspaces: %v", err)
+		return
+	}
+	for _, dir := range held {
+		q.mu.Lock()
+		pausing := q.pausing[dir]
+		q.mu.Unlock()
+		if pausing {
+			continue
+		}
+		used, err := q.manager.WorkspaceInUse(ctx, dir)
+		if err != nil {
+			log.Printf("Failed to look up the run of workspace %s: %v", dir, err)
+			continue
+		}
+		if used {
+			continue
+		}
+		if err := q.workspaces.Release(dir, false); err != nil {
+			log.Printf("Failed to release workspace %s: %v", dir, err)
+		}
+	}
+}
+
+// Submit records a new run and queues it for execution
+func (q *RunQueue) Submit(ctx context.Context, req RunRequest) (*PipelineRun, error) {
+	run := newRun(req)
+	if err := q.manager.CreateRun(ctx, run); err != nil {
+		return nil, err
+	}
+	q.Enqueue(run)
+	return run, nil
+}
+
+// Prepare records a new run with tx without queueing it, for callers that
+// create runs as part of their own transaction. The run is passed to
+// Enqueue once the transaction is committed; should the process stop in
+// between, the run is dispatched from the database like any queued run.
+func (q *RunQueue) Prepare(tx *gorm.DB, req RunRequest) (*PipelineRun, error) {
+	run := newRun(req)
+	if err := createRun(tx, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Enqueue queues a recorded run for execution. When the queue is full the
+// run waits in the database until dispatch sends it to a worker.
+func (q *RunQueue) Enqueue(run *PipelineRun) {
+	if !q.push(run.ID) {
+		log.Printf("Run queue full, run %d waits for a free worker", run.ID)
+	}
+}
+
+// newRun returns the run requested by req
+func newRun(req RunRequest) *PipelineRun {
+	return &PipelineRun{
+		URL:          req.URL,
+		Branch:       req.Branch,
+		Commit:       req.Commit,
+		Pinned:       req.Pinned,
+		PipelineYAML: string(req.PipelineYAML),
+		PipelinePath: req.PipelinePath,
+		Trigger:      req.Trigger,
+		PullRequest:  req.PullRequest,
+		Env:          req.Env,
+		ChangedFiles: req.ChangedFiles,
+	}
+}
+
+// Cancel stops a running run or prevents a queued or waiting one from
+// starting again. A run executing on another server sharing the database
+// is recorded as cancelled, and that server stops it at its next heartbeat.
+func (q *RunQueue) Cancel(ctx context.Context, id int64) error {
+	for {
+		run, err := q.manager.GetRun(ctx, id)
+		if err != nil {
+			return err
+		}
+		if run.Finished() {
+			return ErrRunFinished
+		}
+
+		q.mu.Lock()
+		cancel, running := q.active[id]
+		if running {
+			q.cancelled[id] = true
+		}
+		q.mu.Unlock()
+		if running {
+			cancel()
+			return nil
+		}
+
+		waiting := run.Status == StatusWaitingForApproval
+		var output string
+		if waiting {
+			output = run.Output
+		}
+		if q.finish(run, StatusCancelled, output, nil) {
+			if waiting {
+				q.release(run, nil, run.WorkspaceDir)
+			}
+			return nil
+		}
+		// The run moved on meanwhile, for instance it was claimed by a
+		// worker, so look at it again
+	}
+}
+
+// Decide approves or rejects the approval step of a run and resumes the
+// run when it is waiting for the decision
+func (q *RunQueue) Decide(ctx context.Context, id int64, step string, approved bool, by, comment string) error {
+	run, err := q.manager.GetRun(ctx, id)
+	if err != nil {
+		return err
+	}
+	if run.Finished() {
+		return ErrRunFinished
+	}
+	if err := q.manager.DecideApproval(ctx, id, step, approved, by, comment); err != nil {
+		return err
+	}
+	return q.resume(ctx, id)
+}
+
+// resume queues a run waiting for approval again. Nothing happens when the
+// run is not waiting; it picks the decision up when it next pauses.
+func (q *RunQueue) resume(ctx context.Context, id int64) error {
+	resumed, err := q.manager.ResumeRun(ctx, id)
+	if err != nil || !resumed {
+		return err
+	}
+	if !q.push(id) {
+		log.Printf("Run queue full, run %d waits for a free worker", id)
+	}
+	return nil
+}
+
+func (q *RunQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-q.jobs:
+			q.execute(ctx, id)
+		}
+	}
+}
+
+// execute runs a single queued pipeline run to completion
+func (q *RunQueue) execute(parent context.Context, id int64) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	q.mu.Lock()
+	delete(q.queued, id)
+	q.active[id] = cancel
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		delete(q.active, id)
+		delete(q.cancelled, id)
+		q.mu.Unlock()
+	}()
+
+	// Bookkeeping uses its own context so that a cancellation arriving
+	// right now still ends with the run recorded as cancelled
+	run, err := q.manager.GetRun(context.Background(), id)
+	if err != nil {
+		log.Printf("Failed to load pipeline run %d: %v", id, err)
+		return
+	}
+	if run.Status != StatusQueued {
+		return
+	}
+
+	// A run resumed after an approval continues in the workspace it
+	// stopped in, with the pipeline it resolved then
+	resuming := run.Result != nil && run.WorkspaceDir != ""
+
+	if !resuming {
+		now := time.Now()
+		run.StartedAt = &now
+	}
+	// Another server sharing the database may have claimed the run already
+	claimed, err := q.manager.ClaimRun(context.Background(), run)
+	if err != nil {
+		log.Printf("Failed to mark pipeline run %d as running: %v", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	go q.heartbeat(ctx, id, cancel)
+	if ctx.Err() != nil {
+		q.finish(run, q.failureStatus(id), "", ctx.Err())
+		return
+	}
+
+	stream := q.broker.Open(run.ID)
+	var ws ci.Workspace
+	dir := run.WorkspaceDir
+	if resuming {
+		log.Printf("Resuming pipeline run %d in %s", run.ID, run.WorkspaceDir)
+		stream.Append("", "Resuming after approval")
+		ws, err = q.reopen(run, stream)
+		q.reportStatus(run, status.StatePending, "Pipeline is running")
+	} else {
+		log.Printf("Starting pipeline run %d: URL=%s, Branch=%s", run.ID, run.URL, run.Branch)
+		ws, err = q.checkout(run, stream)
+	}
+	if ws != nil {
+		dir = ws.Dir()
+	}
+	if dir != "" {
+		// Runs once the run is finished or paused
+		defer q.release(run, ws, dir)
+	}
+	if err != nil {
+		q.finish(run, q.failureStatus(id), "", err)
+		return
+	}
+
+	pipeline, err := ws.LoadPipeline([]byte(run.ResolvedYAML))
+	if err != nil {
+		q.finish(run, StatusFailed, "", fmt.Errorf("invalid pipeline: %w", err))
+		return
+	}
+	run.PipelineName = pipeline.Name
+	pipeline.OverrideEnv(run.Env)
+
+	executor := ci.NewExecutor(ws)
+	executor.SetChangedFiles(run.ChangedFiles)
+	executor.SetListener(&stepRecorder{manager: q.manager, runID: run.ID})
+	executor.SetLogSink(stream)
+	executor.SetArtifactStore(q.artifacts, fmt.Sprintf("runs/%d", run.ID))
+	if q.cache != nil {
+		executor.SetCache(q.cache, run.URL)
+	}
+	executor.SetLogURL(fmt.Sprintf("/pipelines/runs/%d/logs", run.ID))
+	if resuming {
+		decisions, err := q.manager.approvalsFor(context.Background(), run.ID)
+		if err != nil {
+			q.finish(run, StatusFailed, "", err)
+			return
+		}
+		executor.SetResume(run.Result, decisions)
+	}
+	result, err := executor.Run(ctx, pipeline)
+	if errors.Is(err, ci.ErrWaitingForApproval) {
+		q.pause(run, pipeline, result, ws.Dir())
+		return
+	}
+	var output string
+	if result != nil {
+		run.Result = result
+		output = result.Log()
+	}
+	if err != nil {
+		q.finish(run, q.failureStatus(id), output, err)
+		return
+	}
+	q.finish(run, StatusSuccess, output, nil)
+}
+
+// checkout clones the workspace of a new run and resolves its pipeline.
+// The workspace is returned along with errors that happen after the clone.
+func (q *RunQueue) checkout(run *PipelineRun, stream *logs.Stream) (ci.Workspace, error) {
+	rev := run.Revision()
+	stream.Append("", fmt.Sprintf("Cloning %s (%s)", run.URL, rev))
+
+	auth, err := q.credential(run)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := q.workspaces.Clone(run.URL, rev, auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	if run.Commit != "" && run.Commit != ws.Commit() {
+		stream.Append("", fmt.Sprintf("%s has moved on from %s since the run was queued", run.Branch, run.Commit))
+	}
+	run.Commit = ws.Commit()
+	stream.Append("", "Checked out commit "+run.Commit)
+	q.reportStatus(run, status.StatePending, "Pipeline is running")
+
+	if run.PipelineYAML == "" {
+		path, content, err := ws.FindPipeline(run.PipelinePath)
+		if err != nil {
+			return ws, err
+		}
+		run.PipelinePath = path
+		run.PipelineYAML = string(content)
+		stream.Append("", "Using pipeline "+path)
+	}
+
+	if q.templates != nil {
+		ws.SetTemplateSource(q.templates)
+	}
+	resolved, err := ws.ResolvePipeline([]byte(run.PipelineYAML))
+	if err != nil {
+		return ws, fmt.Errorf("invalid pipeline: %w", err)
+	}
+	run.ResolvedYAML = string(resolved)
+	return ws, nil
+}
+
+// reopen returns the workspace a run resuming after an approval continues
+// in. When the run was decided on another server than the one it paused
+// on, its workspace is not here and the commit it built is cloned again:
+// files left behind by its finished steps are lost, but the artifacts of
+// the steps they need are restored as usual.
+func (q *RunQueue) reopen(run *PipelineRun, stream *logs.Stream) (ci.Workspace, error) {
+	ws, err := q.workspaces.Reopen(run.WorkspaceDir, run.Revision())
+	if err == nil {
+		return ws, nil
+	}
+	if !errors.Is(err, ci.ErrWorkspaceNotFound) {
+		return nil, fmt.Errorf("failed to reopen workspace: %w", err)
+	}
+
+	rev := ci.Revision{Ref: run.Branch, Commit: run.Commit}
+	stream.Append("", fmt.Sprintf("Workspace is not on this server, cloning %s (%s) again", run.URL, rev))
+	auth, err := q.credential(run)
+	if err != nil {
+		return nil, err
+	}
+	ws, err = q.workspaces.Clone(run.URL, rev, auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	return ws, nil
+}
+
+// credential returns the authentication for cloning the repository of run
+func (q *RunQueue) credential(run *PipelineRun) (transport.AuthMethod, error) {
+	if q.auth == nil {
+		return nil, nil
+	}
+	auth, err := q.auth(context.Background(), run.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Git credential: %w", err)
+	}
+	return auth, nil
+}
+
+// pause records a run that stopped at approval steps and requests their
+// approval. The workspace and the log stream are kept for when it resumes.
+func (q *RunQueue) pause(run *PipelineRun, pipeline *ci.Pipeline, result *ci.RunResult, dir string) {
+	q.mu.Lock()
+	q.pausing[dir] = true
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.pausing, dir)
+		q.mu.Unlock()
+	}()
+
+	// Hold the workspace before the run can be resumed
+	if err := q.workspaces.Hold(dir); err != nil {
+		log.Printf("Failed to hold workspace of pipeline run %d: %v", run.ID, err)
+	}
+	from := run.Status
+	run.Status = StatusWaitingForApproval
+	run.Result = result
+	run.Output = result.Log()
+	run.WorkspaceDir = dir
+	paused, err := q.manager.UpdateRun(context.Background(), run, from)
+	if err != nil || !paused {
+		if err != nil {
+			log.Printf("Failed to record pause of pipeline run %d: %v", run.ID, err)
+		} else {
+			log.Printf("Pipeline run %d was stopped from elsewhere before it paused", run.ID)
+		}
+		// Nothing will resume the run, so its workspace is released
+		run.Status = from
+		q.broker.Close(run.ID)
+		return
+	}
+
+	stream, _ := q.broker.Get(run.ID)
+	now := time.Now()
+	waiting := make(map[string]bool)
+	for _, step := range result.Steps {
+		if step.Status != ci.StepWaiting {
+			continue
+		}
+		waiting[step.Name] = true
+		approval := &Approval{RunID: run.ID, Step: step.Name, RequestedAt: now}
+		for _, s := range pipeline.Steps {
+			if s.Name == step.Name && s.Timeout > 0 {
+				expiresAt := now.Add(s.Timeout)
+				approval.ExpiresAt = &expiresAt
+			}
+		}
+		if err := q.manager.RequestApproval(context.Background(), approval); err != nil {
+			log.Printf("Failed to request approval of step %q in run %d: %v", step.Name, run.ID, err)
+		}
+		if stream != nil {
+			stream.Append("", fmt.Sprintf("Step %s is waiting for approval", step.Name))
+		}
+	}
+	q.reportStatus(run, status.StatePending, "Waiting for approval")
+	log.Printf("Pipeline run %d is waiting for approval", run.ID)
+
+	// A decision taken while the run was still executing resumes it now
+	approvals, err := q.manager.ListApprovals(context.Background(), run.ID)
+	if err != nil {
+		log.Printf("Failed to list approvals of pipeline run %d: %v", run.ID, err)
+		return
+	}
+	for _, approval := range approvals {
+		if waiting[approval.Step] && approval.Status != ApprovalPending {
+			if err := q.resume(context.Background(), run.ID); err != nil {
+				log.Printf("Failed to resume pipeline run %d: %v", run.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// release closes the workspace of a run once the run is over, to be
+// deleted or kept depending on its outcome. The workspace of a run waiting
+// for approval stays held. ws is nil for the workspace in dir of a run
+// that is not executing here, or that could not be reopened.
+func (q *RunQueue) release(run *PipelineRun, ws ci.Workspace, dir string) {
+	if run.Status == StatusWaitingForApproval {
+		return
+	}
+	failed := run.Status != StatusSuccess
+	var err error
+	if ws != nil {
+		err = ws.Close(failed)
+	} else {
+		err = q.workspaces.Release(dir, failed)
+	}
+	if err != nil {
+		log.Printf("Failed to release workspace of pipeline run %d: %v", run.ID, err)
+	}
+}
+
+// failureStatus tells a run cancelled by a user apart from one that failed
+func (q *RunQueue) failureStatus(id int64) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cancelled[id] {
+		return StatusCancelled
+	}
+	return StatusFailed
+}
+
+// finish records the final state of a run and completes its log stream. It
+// uses a fresh context so the result is saved even when the run itself was
+// cancelled. Nothing is recorded when the stored run has left the status
+// run had, for instance because it was cancelled from another server
+// while it was executing here; finish then returns false.
+func (q *RunQueue) finish(run *PipelineRun, status, output string, runErr error) bool {
+	from := run.Status
+	now := time.Now()
+	run.Status = status
+	run.Output = output
+	run.FinishedAt = &now
+	if runErr != nil {
+		run.Error = runErr.Error()
+	}
+
+	updated, err := q.manager.UpdateRun(context.Background(), run, from)
+	if err != nil {
+		log.Printf("Failed to record result of pipeline run %d: %v", run.ID, err)
+	} else if !updated {
+		log.Printf("Pipeline run %d is no longer %s, not recording status %s", run.ID, from, status)
+		if from == StatusRunning {
+			// Its execution here is over all the same
+			if stream, ok := q.broker.Get(run.ID); ok {
+				stream.Append("", "Pipeline run was stopped from elsewhere")
+			}
+			q.broker.Close(run.ID)
+		}
+		return false
+	}
+	q.reportResult(run)
+	if stream, ok := q.broker.Get(run.ID); ok {
+		if runErr != nil {
+			stream.Append("", "Error: "+runErr.Error())
+		}
+		stream.Append("", "Pipeline run finished with status "+status)
+	}
+	q.broker.Close(run.ID)
+	log.Printf("Pipeline run %d finished with status %s", run.ID, status)
+	return true
+}
+
+// reporter returns the status reporter for the repository of run, or nil
+func (q *RunQueue) reporter(run *PipelineRun) status.StatusReporter {
+	if q.reporters == nil || run.Commit == "" {
+		return nil
+	}
+	return q.reporters(context.Background(), run.URL)
+}
+
+// reportStatus sets the commit status of run on its Git host
+func (q *RunQueue) reportStatus(run *PipelineRun, state status.State, description string) {
+	if reporter := q.reporter(run); reporter != nil {
+		q.sendStatus(reporter, run, state, description)
+	}
+}
+
+// sendStatus sets the commit status of run through reporter
+func (q *RunQueue) sendStatus(reporter status.StatusReporter, run *PipelineRun, state status.State, description string) {
+	err := reporter.ReportStatus(context.Background(), status.Status{
+		Commit:      run.Commit,
+		State:       state,
+		Description: description,
+		TargetURL:   q.runURL(run),
+	})
+	if err != nil {
+		log.Printf("Failed to report status of pipeline run %d: %v", run.ID, err)
+	}
+}
+
+// reportResult reports the final status of run and, for pull requests,
+// updates the summary comment
+func (q *RunQueue) reportResult(run *PipelineRun) {
+	reporter := q.reporter(run)
+	if reporter == nil {
+		return
+	}
+
+	state, description := status.StateFailure, "Pipeline failed"
+	switch run.Status {
+	case StatusSuccess:
+		state, description = status.StateSuccess, "Pipeline passed"
+	case StatusCancelled:
+		state, description = status.StateError, "Pipeline was cancelled"
+	}
+	if run.FinishedAt != nil && run.StartedAt != nil {
+		description += " in " + run.FinishedAt.Sub(*run.StartedAt).Round(time.Second).String()
+	}
+	q.sendStatus(reporter, run, state, description)
+
+	if run.PullRequest == 0 {
+		return
+	}
+	summary := status.Summary{
+		Pipeline: run.PipelineName,
+		Commit:   run.Commit,
+		State:    state,
+		RunURL:   q.runURL(run),
+		Error:    run.Error,
+		Result:   run.Result,
+	}
+	if err := reporter.UpsertComment(context.Background(), run.PullRequest, summary.Markdown()); err != nil {
+		log.Printf("Failed to comment on pull request %d for pipeline run %d: %v", run.PullRequest, run.ID, err)
+	}
+}
+
+// runURL links to run in the API
+func (q *RunQueue) runURL(run *PipelineRun) string {
+	if q.baseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/pipelines/runs/%d", q.baseURL, run.ID)
+}
+
+// stepRecorder persists step progress reported by the executor
+type stepRecorder struct {
+	manager *RunManager
+	runID   int64
+}
+
+func (r *stepRecorder) StepStarted(name string, startedAt time.Time) {
+	step := &StepRun{
+		RunID:     r.runID,
+		Name:      name,
+		Status:    string(ci.StepRunning),
+		StartedAt: &startedAt,
+	}
+	if err := r.manager.SaveStep(context.Background(), step); err != nil {
+		log.Printf("Failed to record start of step %q in run %d: %v", name, r.runID, err)
+	}
+}
+
+func (r *stepRecorder) StepFinished(report ci.StepReport) {
+	step := &StepRun{
+		RunID:    r.runID,
+		Name:     report.Name,
+		Status:   string(report.Status),
+		ExitCode: report.ExitCode,
+		Attempts: len(report.Attempts),
+		Error:    report.Error,
+		Output:   report.Output,
+	}
+	if !report.StartedAt.IsZero() {
+		step.StartedAt = &report.StartedAt
+	}
+	if !report.FinishedAt.IsZero() {
+		step.FinishedAt = &report.FinishedAt
+	}
+	if n := len(report.Attempts); n > 0 {
+		step.TimedOut = report.Attempts[n-1].TimedOut
+	}
+	if err := r.manager.SaveStep(context.Background(), step); err != nil {
+		log.Printf("Failed to record result of step %q in run %d: %v", report.Name, r.runID, err)
+	}
+
+	if report.Artifact != nil {
+		artifact := &Artifact{
+			RunID:    r.runID,
+			StepName: report.Name,
+			Key:      report.Artifact.Key,
+			Size:     report.Artifact.Size,
+			Files:    report.Artifact.Files,
+			ExpireAt: report.Artifact.ExpireAt,
+		}
+		if err := r.manager.SaveArtifact(context.Background(), artifact); err != nil {
+			log.Printf("Failed to record artifacts of step %q in run %d: %v", report.Name, r.runID, err)
+		}
+	}
+}
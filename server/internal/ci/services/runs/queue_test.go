@@ -0,0 +1,285 @@
+package runs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestManager returns a RunManager backed by a fresh SQLite database
+func newTestManager(t *testing.T) *RunManager {
+	dsn := filepath.Join(t.TempDir(), "runs.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.Nil(t, err)
+	manager, err := NewRunManager(db)
+	assert.Nil(t, err)
+	return manager
+}
+
+// newTestQueue returns a RunQueue on manager with workers that are not
+// started, so that tests execute runs themselves. Queues sharing a
+// manager behave like servers sharing a database.
+func newTestQueue(t *testing.T, manager *RunManager) *RunQueue {
+	store, err := artifacts.NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+	workspaces, err := ci.NewWorkspaceManager(t.TempDir(), ci.Retention{})
+	assert.Nil(t, err)
+	q := NewRunQueue(manager, logs.NewBroker(), store, workspaces, 1)
+	q.heartbeatEvery = 50 * time.Millisecond
+	return q
+}
+
+// initRemote creates a repository holding pipeline as .pipeslicer.yml
+// and returns its URL
+func initRemote(t *testing.T, pipeline string) string {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	assert.Nil(t, err)
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".pipeslicer.yml"), []byte(pipeline), 0644))
+	_, err = wt.Add(".pipeslicer.yml")
+	assert.Nil(t, err)
+	_, err = wt.Commit("init", &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+	return "file://" + dir
+}
+
+// waitForStatus waits until the run id is stored with status
+func waitForStatus(t *testing.T, manager *RunManager, id int64, status string) {
+	assert.Eventually(t, func() bool {
+		run, err := manager.GetRun(context.Background(), id)
+		return err == nil && run.Status == status
+	}, 5*time.Second, 10*time.Millisecond, "run %d never became %s", id, status)
+}
+
+// executeAsync executes the run id on q and returns a channel closed once
+// the execution is over
+func executeAsync(q *RunQueue, id int64) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		q.execute(context.Background(), id)
+		close(done)
+	}()
+	return done
+}
+
+// stepStatuses returns the status of every step of a run result by name
+func stepStatuses(result *ci.RunResult) map[string]ci.StepStatus {
+	statuses := make(map[string]ci.StepStatus)
+	for _, step := range result.Steps {
+		statuses[step.Name] = step.Status
+	}
+	return statuses
+}
+
+func TestExecutePassesChangedFilesToConditions(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	url := initRemote(t, `
+name: Monorepo
+steps:
+  - name: Docs
+    if: changed("docs/**")
+    commands:
+      - echo docs
+  - name: API
+    if: changed("api/**")
+    commands:
+      - echo api
+`)
+
+	run, err := q.Submit(context.Background(), RunRequest{
+		URL:          url,
+		Branch:       "master",
+		Trigger:      TriggerPush,
+		ChangedFiles: []string{"docs/index.md"},
+	})
+	assert.Nil(t, err)
+	q.execute(context.Background(), run.ID)
+
+	run, err = q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusSuccess, run.Status, run.Error)
+	assert.Equal(t, []string{"docs/index.md"}, run.ChangedFiles)
+	assert.Equal(t, map[string]ci.StepStatus{
+		"Docs": ci.StepSuccess,
+		"API":  ci.StepSkipped,
+	}, stepStatuses(run.Result))
+}
+
+const slowPipeline = `
+name: Slow
+steps:
+  - name: Wait
+    commands:
+      - sleep 30
+`
+
+func TestCancelQueuedRun(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	run, err := q.Submit(context.Background(), RunRequest{URL: initRemote(t, slowPipeline), Branch: "master"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, q.Cancel(context.Background(), run.ID))
+	assert.ErrorIs(t, q.Cancel(context.Background(), run.ID), ErrRunFinished)
+
+	// The worker picking the run up leaves it alone
+	q.execute(context.Background(), <-q.jobs)
+	run, err = q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusCancelled, run.Status)
+	assert.Nil(t, run.StartedAt)
+	assert.Empty(t, q.cancelled)
+}
+
+func TestCancelRunningRun(t *testing.T) {
+	q := newTestQueue(t, newTestManager(t))
+	run, err := q.Submit(context.Background(), RunRequest{URL: initRemote(t, slowPipeline), Branch: "master"})
+	assert.Nil(t, err)
+
+	done := executeAsync(q, <-q.jobs)
+	waitForStatus(t, q.manager, run.ID, StatusRunning)
+	assert.Nil(t, q.Cancel(context.Background(), run.ID))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled run kept executing")
+	}
+	run, err = q.manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusCancelled, run.Status)
+	assert.Equal(t, ci.StepCancelled, run.Result.Steps[0].Status)
+	assert.Empty(t, q.active)
+	assert.Empty(t, q.cancelled)
+}
+
+func TestCancelRunExecutingOnAnotherServer(t *testing.T) {
+	manager := newTestManager(t)
+	executing, other := newTestQueue(t, manager), newTestQueue(t, manager)
+	run, err := executing.Submit(context.Background(), RunRequest{URL: initRemote(t, slowPipeline), Branch: "master"})
+	assert.Nil(t, err)
+
+	done := executeAsync(executing, <-executing.jobs)
+	waitForStatus(t, manager, run.ID, StatusRunning)
+	assert.Nil(t, other.Cancel(context.Background(), run.ID))
+	assert.Empty(t, other.cancelled)
+
+	// The executing server notices at its next heartbeat
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run cancelled from another server kept executing")
+	}
+	run, err = manager.GetRun(context.Background(), run.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusCancelled, run.Status)
+	assert.Empty(t, run.Error)
+	assert.Empty(t, executing.active)
+	assert.Empty(t, executing.cancelled)
+	stream, ok := executing.broker.Get(run.ID)
+	assert.True(t, ok)
+	lines, complete, _ := stream.ReadFrom(0)
+	assert.True(t, complete)
+	assert.Equal(t, "Pipeline run was stopped from elsewhere", lines[len(lines)-1].Text)
+}
+
+func TestWorkersExecuteQueuedRuns(t *testing.T) {
+	manager := newTestManager(t)
+	url := initRemote(t, `
+name: Quick
+steps:
+  - name: Echo
+    commands:
+      - echo done
+`)
+
+	// Left over by a previous process: a run still queued, and a running
+	// one whose server stopped sending heartbeats
+	leftover := &PipelineRun{URL: url, Branch: "master"}
+	assert.Nil(t, manager.CreateRun(context.Background(), leftover))
+	interrupted := &PipelineRun{URL: url, Branch: "master"}
+	assert.Nil(t, manager.CreateRun(context.Background(), interrupted))
+	claimed, err := manager.ClaimRun(context.Background(), interrupted)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	setHeartbeat(t, manager, interrupted.ID, time.Now().Add(-time.Hour))
+
+	store, err := artifacts.NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+	workspaces, err := ci.NewWorkspaceManager(t.TempDir(), ci.Retention{})
+	assert.Nil(t, err)
+	q := NewRunQueue(manager, logs.NewBroker(), store, workspaces, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, q.Start(ctx))
+
+	ids := []int64{leftover.ID}
+	for i := 0; i < 3; i++ {
+		run, err := q.Submit(context.Background(), RunRequest{URL: url, Branch: "master"})
+		assert.Nil(t, err)
+		ids = append(ids, run.ID)
+	}
+	for _, id := range ids {
+		waitForStatus(t, manager, id, StatusSuccess)
+	}
+	run, err := manager.GetRun(context.Background(), interrupted.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, run.Status)
+}
+
+func TestDispatchQueuedRuns(t *testing.T) {
+	manager := newTestManager(t)
+	q := newTestQueue(t, manager)
+	q.jobs = make(chan int64, 2)
+	other := newTestQueue(t, manager)
+	ctx := context.Background()
+	url := initRemote(t, slowPipeline)
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		run, err := q.Submit(ctx, RunRequest{URL: url, Branch: "master"})
+		assert.Nil(t, err)
+		ids = append(ids, run.ID)
+	}
+	// Queued by another server sharing the database
+	run, err := other.Submit(ctx, RunRequest{URL: url, Branch: "master"})
+	assert.Nil(t, err)
+	ids = append(ids, run.ID)
+
+	// The run that did not fit stays queued
+	run, err = manager.GetRun(ctx, ids[2])
+	assert.Nil(t, err)
+	assert.Equal(t, StatusQueued, run.Status)
+
+	// take cancels the next run of jobs, which its worker then skips
+	take := func() int64 {
+		id := <-q.jobs
+		assert.Nil(t, q.Cancel(ctx, id))
+		q.execute(ctx, id)
+		return id
+	}
+
+	q.dispatchQueued(ctx)
+	assert.Equal(t, []int64{ids[0], ids[1]}, []int64{take(), take()})
+	q.dispatchQueued(ctx)
+	q.dispatchQueued(ctx)
+	assert.Len(t, q.jobs, 2)
+	assert.Equal(t, []int64{ids[2], ids[3]}, []int64{take(), take()})
+	q.dispatchQueued(ctx)
+	assert.Empty(t, q.jobs)
+}
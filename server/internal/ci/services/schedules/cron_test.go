@@ -0,0 +1,79 @@
+package schedules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for expr, msg := range map[string]string{
+		"* * * *":       "expected 5 fields",
+		"60 * * * *":    "minute 60 out of range",
+		"* 24 * * *":    "hour 24 out of range",
+		"* * 0 * *":     "day of month 0 out of range",
+		"* * * foo *":   `invalid value "foo" in month field`,
+		"*/0 * * * *":   "invalid step",
+		"5-1 * * * *":   "invalid range",
+		"* * * * mon-x": `invalid value "x" in day of week field`,
+	} {
+		_, err := ParseCron(expr)
+		assert.ErrorContains(t, err, msg, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 31, 22, 47, 30, 0, time.UTC) // a Wednesday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 22, 48, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 3 * * sun", time.Date(2024, 2, 4, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, 2, 4, 3, 0, 0, 0, time.UTC)},
+		{"0 9 * * MON-FRI", time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2024, 2, 1, 10, 5, 0, 0, time.UTC)},
+		// both day fields restricted: the 15th or any Monday
+		{"0 0 15 * 1", time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 feb *", time.Time{}},
+	}
+	for _, tt := range tests {
+		cron, err := ParseCron(tt.expr)
+		assert.Nil(t, err, tt.expr)
+		assert.Equal(t, tt.next, cron.Next(from), tt.expr)
+	}
+}
+
+func TestScheduleNextRunsInTimezone(t *testing.T) {
+	s := &Schedule{Cron: "0 2 * * *", Timezone: "Asia/Ho_Chi_Minh"}
+	runs, err := s.NextRuns(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 3)
+	assert.Nil(t, err)
+	assert.Len(t, runs, 3)
+	assert.Equal(t, time.Date(2024, 3, 1, 19, 0, 0, 0, time.UTC), runs[0].UTC())
+	assert.Equal(t, time.Date(2024, 3, 3, 19, 0, 0, 0, time.UTC), runs[2].UTC())
+
+	s.Timezone = "Mars/Olympus"
+	_, err = s.NextRuns(time.Now(), 1)
+	assert.ErrorContains(t, err, "invalid timezone")
+}
+
+func TestCronNextAcrossDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	cron, err := ParseCron("30 2 * * *")
+	assert.Nil(t, err)
+
+	// 02:30 does not exist on 31 March 2024 in Berlin
+	next := cron.Next(time.Date(2024, 3, 30, 12, 0, 0, 0, loc))
+	assert.Equal(t, time.Date(2024, 3, 30, 2, 30, 0, 0, loc).AddDate(0, 0, 2), next)
+}
@@ -0,0 +1,247 @@
+package schedules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrScheduleNotFound is returned when a schedule does not exist
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// Schedule runs the pipeline of a repository branch on a cron expression.
+// Cron is evaluated in Timezone, UTC when empty; Env overrides the
+// variables of the pipeline; NextRunAt is nil while the schedule is disabled.
+type Schedule struct {
+	ID           int64             `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name         string            `json:"name" gorm:"not null"`
+	URL          string            `json:"url" gorm:"not null;index"`
+	Branch       string            `json:"branch" gorm:"not null"`
+	PipelinePath string            `json:"pipelinePath"`
+	Cron         string            `json:"cron" gorm:"not null"`
+	Timezone     string            `json:"timezone"`
+	Env          map[string]string `json:"env,omitempty" gorm:"type:text;serializer:json"`
+	Enabled      bool              `json:"enabled" gorm:"not null"`
+	NextRunAt    *time.Time        `json:"nextRunAt,omitempty" gorm:"index"`
+	LastRunAt    *time.Time        `json:"lastRunAt,omitempty"`
+	LastRunID    int64             `json:"lastRunId,omitempty"`
+	LastError    string            `json:"lastError,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt" gorm:"not null"`
+	UpdatedAt    time.Time         `json:"updatedAt" gorm:"not null"`
+}
+
+// Location returns the time zone the cron expression is evaluated in
+func (s *Schedule) Location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+	}
+	return loc, nil
+}
+
+// NextRuns returns the next n activations of the schedule after t
+func (s *Schedule) NextRuns(t time.Time, n int) ([]time.Time, error) {
+	cron, err := ParseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := s.Location()
+	if err != nil {
+		return nil, err
+	}
+	return cron.NextRuns(t.In(loc), n), nil
+}
+
+// ScheduleManager stores schedules and hands out the due ones
+type ScheduleManager struct {
+	db *gorm.DB
+}
+
+// NewScheduleManager creates a new ScheduleManager instance
+func NewScheduleManager(db *gorm.DB) (*ScheduleManager, error) {
+	// Auto migrate the schema
+	err := db.AutoMigrate(&Schedule{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &ScheduleManager{db: db}, nil
+}
+
+// prepare validates a schedule and computes its next run after now
+func prepare(s *Schedule, now time.Time) error {
+	s.Name = strings.TrimSpace(s.Name)
+	s.URL = strings.TrimSpace(s.URL)
+	s.Branch = strings.TrimSpace(s.Branch)
+	if s.URL == "" {
+		return errors.New("repository URL is required")
+	}
+	if s.Branch == "" {
+		return errors.New("branch is required")
+	}
+	if s.Name == "" {
+		s.Name = s.Branch + " " + s.Cron
+	}
+
+	next, err := s.NextRuns(now, 1)
+	if err != nil {
+		return err
+	}
+	if len(next) == 0 {
+		return fmt.Errorf("cron expression %q never fires", s.Cron)
+	}
+	s.NextRunAt = nil
+	if s.Enabled {
+		s.NextRunAt = &next[0]
+	}
+	return nil
+}
+
+// CreateSchedule stores a new schedule
+func (m *ScheduleManager) CreateSchedule(ctx context.Context, s *Schedule) error {
+	now := time.Now()
+	if err := prepare(s, now); err != nil {
+		return err
+	}
+	s.CreatedAt = now
+	s.UpdatedAt = now
+
+	result := m.db.WithContext(ctx).Create(s)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create schedule: %w", result.Error)
+	}
+	return nil
+}
+
+// UpdateSchedule replaces the definition of a schedule, keeping its run history
+func (m *ScheduleManager) UpdateSchedule(ctx context.Context, s *Schedule) error {
+	now := time.Now()
+	if err := prepare(s, now); err != nil {
+		return err
+	}
+	s.UpdatedAt = now
+
+	result := m.db.WithContext(ctx).Model(&Schedule{ID: s.ID}).
+		Select("Name", "URL", "Branch", "PipelinePath", "Cron", "Timezone", "Env", "Enabled", "NextRunAt", "UpdatedAt").
+		Updates(s)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update schedule: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// GetSchedule gets a schedule by ID
+func (m *ScheduleManager) GetSchedule(ctx context.Context, id int64) (*Schedule, error) {
+	var s Schedule
+	result := m.db.WithContext(ctx).First(&s, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrScheduleNotFound
+		}
+		return nil, fmt.Errorf("failed to get schedule: %w", result.Error)
+	}
+	return &s, nil
+}
+
+// ListSchedules lists all schedules by ID
+func (m *ScheduleManager) ListSchedules(ctx context.Context) ([]Schedule, error) {
+	var list []Schedule
+	result := m.db.WithContext(ctx).Order("id").Find(&list)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", result.Error)
+	}
+	return list, nil
+}
+
+// DeleteSchedule deletes a schedule by ID
+func (m *ScheduleManager) DeleteSchedule(ctx context.Context, id int64) error {
+	result := m.db.WithContext(ctx).Delete(&Schedule{}, id)
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete schedule: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// TriggerDue calls trigger for up to limit enabled schedules whose next
+// run is at or before now, then records the run and moves them to their
+// following activation. trigger records the run with tx, so that it is
+// only kept when the schedule is updated too; runs must not be queued
+// before TriggerDue returns. The schedules stay locked with SELECT ... FOR
+// UPDATE SKIP LOCKED until the transaction commits, so that replicas
+// sharing the database never trigger the same activation twice.
+// Activations missed while no replica was running collapse into a single run.
+// It returns the number of due schedules it found, including those whose
+// trigger failed, so that fewer than limit means none are left.
+func (m *ScheduleManager) TriggerDue(ctx context.Context, now time.Time, limit int, trigger func(tx *gorm.DB, s *Schedule) (int64, error)) (int, error) {
+	found := 0
+	err := m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var due []Schedule
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("enabled AND next_run_at <= ?", now).
+			Order("next_run_at").
+			Limit(limit).
+			Find(&due)
+		if result.Error != nil {
+			return fmt.Errorf("failed to find due schedules: %w", result.Error)
+		}
+		found = len(due)
+
+		for i := range due {
+			s := &due[i]
+			// A failed trigger only rolls back to the savepoint of the
+			// nested transaction, the schedule still records the error
+			var runID int64
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				runID, err = trigger(tx, s)
+				return err
+			})
+			s.LastRunAt = &now
+			s.LastRunID = runID
+			s.LastError = ""
+			if err != nil {
+				s.LastError = err.Error()
+			}
+
+			// A schedule without a next run stops, and says why in
+			// LastError until it is updated
+			s.NextRunAt = nil
+			next, err := s.NextRuns(now, 1)
+			if err == nil && len(next) == 0 {
+				err = fmt.Errorf("cron expression %q never fires", s.Cron)
+			}
+			if err != nil {
+				if s.LastError != "" {
+					s.LastError += "; "
+				}
+				s.LastError += fmt.Sprintf("schedule stopped: %v", err)
+			} else {
+				s.NextRunAt = &next[0]
+			}
+			s.UpdatedAt = time.Now()
+
+			result := tx.Model(&Schedule{ID: s.ID}).
+				Select("LastRunAt", "LastRunID", "LastError", "NextRunAt", "UpdatedAt").
+				Updates(s)
+			if result.Error != nil {
+				return fmt.Errorf("failed to update schedule %d: %w", s.ID, result.Error)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,146 @@
+package schedules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// triggered is a row written by the triggers of the tests
+type triggered struct {
+	ID         int64 `gorm:"primaryKey;autoIncrement"`
+	ScheduleID int64
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	dsn := filepath.Join(t.TempDir(), "pipeslicer.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	assert.Nil(t, err)
+	assert.Nil(t, db.AutoMigrate(&triggered{}))
+	return db
+}
+
+// createDue stores n enabled schedules that are due at now
+func createDue(t *testing.T, m *ScheduleManager, n int, now time.Time) []int64 {
+	var ids []int64
+	for i := 0; i < n; i++ {
+		s := &Schedule{
+			Name:    fmt.Sprintf("nightly %d", i),
+			URL:     "https://example.com/shop.git",
+			Branch:  "master",
+			Cron:    "@daily",
+			Enabled: true,
+		}
+		assert.Nil(t, m.CreateSchedule(context.Background(), s))
+		due := now.Add(-time.Duration(n-i) * time.Minute)
+		assert.Nil(t, m.db.Model(s).Update("next_run_at", due).Error)
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestTriggerDue(t *testing.T) {
+	db := newTestDB(t)
+	m, err := NewScheduleManager(db)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	ids := createDue(t, m, 3, now)
+
+	disabled := &Schedule{URL: "https://example.com/shop.git", Branch: "master", Cron: "@daily"}
+	assert.Nil(t, m.CreateSchedule(ctx, disabled))
+	later := &Schedule{URL: "https://example.com/shop.git", Branch: "master", Cron: "@daily", Enabled: true}
+	assert.Nil(t, m.CreateSchedule(ctx, later))
+	assert.Nil(t, db.Model(later).Update("next_run_at", now.Add(time.Hour)).Error)
+
+	// The trigger of the second schedule fails after writing its row
+	trigger := func(tx *gorm.DB, s *Schedule) (int64, error) {
+		row := triggered{ScheduleID: s.ID}
+		if err := tx.Create(&row).Error; err != nil {
+			return 0, err
+		}
+		if s.ID == ids[1] {
+			return 0, errors.New("no such branch")
+		}
+		return row.ID, nil
+	}
+	n, err := m.TriggerDue(ctx, now, 2, trigger)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	n, err = m.TriggerDue(ctx, now, 2, trigger)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	n, err = m.TriggerDue(ctx, now, 2, trigger)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	var rows []triggered
+	assert.Nil(t, db.Order("id").Find(&rows).Error)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, ids[0], rows[0].ScheduleID)
+		assert.Equal(t, ids[2], rows[1].ScheduleID)
+	}
+
+	tomorrow := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	for i, id := range ids {
+		s, err := m.GetSchedule(ctx, id)
+		assert.Nil(t, err)
+		assert.True(t, s.LastRunAt.Equal(now))
+		assert.True(t, s.NextRunAt.Equal(tomorrow), "schedule %d runs at %v", id, s.NextRunAt)
+		if i == 1 {
+			assert.Equal(t, "no such branch", s.LastError)
+			assert.Zero(t, s.LastRunID)
+		} else {
+			assert.Empty(t, s.LastError)
+			assert.NotZero(t, s.LastRunID)
+		}
+	}
+
+	s, err := m.GetSchedule(ctx, disabled.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, s.LastRunAt)
+	s, err = m.GetSchedule(ctx, later.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, s.LastRunAt)
+}
+
+func TestTriggerDueRecordsScheduleWithoutNextRun(t *testing.T) {
+	db := newTestDB(t)
+	m, err := NewScheduleManager(db)
+	assert.Nil(t, err)
+	ctx := context.Background()
+	now := time.Now()
+	ids := createDue(t, m, 2, now)
+	assert.Nil(t, db.Model(&Schedule{ID: ids[0]}).Update("timezone", "Nowhere/Shop").Error)
+	assert.Nil(t, db.Model(&Schedule{ID: ids[1]}).Update("cron", "0 0 30 2 *").Error)
+
+	n, err := m.TriggerDue(ctx, now, 10, func(tx *gorm.DB, s *Schedule) (int64, error) {
+		if s.ID == ids[1] {
+			return 0, errors.New("no such branch")
+		}
+		return 7, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	s, err := m.GetSchedule(ctx, ids[0])
+	assert.Nil(t, err)
+	assert.True(t, s.Enabled)
+	assert.Nil(t, s.NextRunAt)
+	assert.Equal(t, int64(7), s.LastRunID)
+	assert.Contains(t, s.LastError, `schedule stopped: invalid timezone "Nowhere/Shop"`)
+
+	s, err = m.GetSchedule(ctx, ids[1])
+	assert.Nil(t, err)
+	assert.True(t, s.Enabled)
+	assert.Nil(t, s.NextRunAt)
+	assert.Equal(t, `no such branch; schedule stopped: cron expression "0 0 30 2 *" never fires`, s.LastError)
+}
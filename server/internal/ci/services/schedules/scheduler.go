@@ -0,0 +1,90 @@
+package schedules
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+	"gorm.io/gorm"
+)
+
+// dueBatch is the number of due schedules claimed per transaction
+const dueBatch = 20
+
+// Scheduler queues a pipeline run whenever a schedule is due
+type Scheduler struct {
+	manager  *ScheduleManager
+	queue    *runs.RunQueue
+	interval time.Duration
+}
+
+// NewScheduler creates a Scheduler that checks for due schedules every
+// interval and submits their runs to queue
+func NewScheduler(manager *ScheduleManager, queue *runs.RunQueue, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		manager:  manager,
+		queue:    queue,
+		interval: interval,
+	}
+}
+
+// Start checks for due schedules until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.tick(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// tick triggers every schedule that is due, a batch at a time. The runs of
+// a batch are queued once the batch is committed.
+func (s *Scheduler) tick(ctx context.Context) {
+	for {
+		var prepared []*runs.PipelineRun
+		n, err := s.manager.TriggerDue(ctx, time.Now(), dueBatch, func(tx *gorm.DB, schedule *Schedule) (int64, error) {
+			run, err := s.prepare(tx, schedule)
+			if err != nil {
+				return 0, err
+			}
+			prepared = append(prepared, run)
+			return run.ID, nil
+		})
+		if err != nil {
+			log.Printf("Failed to trigger scheduled runs: %v", err)
+			return
+		}
+		for _, run := range prepared {
+			s.queue.Enqueue(run)
+		}
+		if n < dueBatch {
+			return
+		}
+	}
+}
+
+// prepare records the run of a schedule like a manual build
+func (s *Scheduler) prepare(tx *gorm.DB, schedule *Schedule) (*runs.PipelineRun, error) {
+	run, err := s.queue.Prepare(tx, runs.RunRequest{
+		URL:          schedule.URL,
+		Branch:       schedule.Branch,
+		PipelinePath: schedule.PipelinePath,
+		Trigger:      runs.TriggerScheduled,
+		Env:          schedule.Env,
+	})
+	if err != nil {
+		log.Printf("Failed to record run of schedule %d: %v", schedule.ID, err)
+		return nil, err
+	}
+	log.Printf("Recorded pipeline run %d for schedule %d (%s)", run.ID, schedule.ID, schedule.Name)
+	return run, nil
+}
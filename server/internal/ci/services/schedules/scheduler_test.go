@@ -0,0 +1,45 @@
+package schedules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/artifacts"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/logs"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci/services/runs"
+)
+
+func TestTickTriggersEveryDueBatch(t *testing.T) {
+	db := newTestDB(t)
+	m, err := NewScheduleManager(db)
+	assert.Nil(t, err)
+	runManager, err := runs.NewRunManager(db)
+	assert.Nil(t, err)
+	store, err := artifacts.NewLocalStore(t.TempDir())
+	assert.Nil(t, err)
+	workspaces, err := ci.NewWorkspaceManager(t.TempDir(), ci.Retention{})
+	assert.Nil(t, err)
+	queue := runs.NewRunQueue(runManager, logs.NewBroker(), store, workspaces, 1)
+
+	ctx := context.Background()
+	ids := createDue(t, m, 2*dueBatch+1, time.Now())
+	NewScheduler(m, queue, time.Minute).tick(ctx)
+
+	list, err := runManager.ListRuns(ctx, runs.ListFilter{Limit: 100})
+	assert.Nil(t, err)
+	assert.Len(t, list, len(ids))
+	for _, id := range ids {
+		s, err := m.GetSchedule(ctx, id)
+		assert.Nil(t, err)
+		assert.Empty(t, s.LastError)
+		assert.NotZero(t, s.LastRunID)
+		assert.True(t, s.NextRunAt.After(time.Now()))
+	}
+	for _, run := range list {
+		assert.Equal(t, runs.TriggerScheduled, run.Trigger)
+		assert.Equal(t, runs.StatusQueued, run.Status)
+	}
+}
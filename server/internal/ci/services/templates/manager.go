@@ -0,0 +1,136 @@
+package templates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// ErrTemplateNotFound is returned when a pipeline template does not exist
+var ErrTemplateNotFound = errors.New("pipeline template not found")
+
+// PipelineTemplate is a reusable piece of pipeline YAML that pipelines
+// pull in with `include: [{template: name, params: {...}}]`
+type PipelineTemplate struct {
+	ID          int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name        string    `json:"name" gorm:"not null;uniqueIndex"`
+	Description string    `json:"description"`
+	Content     string    `json:"content" gorm:"type:text;not null"`
+	CreatedAt   time.Time `json:"createdAt" gorm:"not null"`
+	UpdatedAt   time.Time `json:"updatedAt" gorm:"not null"`
+}
+
+// TemplateManager stores pipeline templates
+type TemplateManager struct {
+	db *gorm.DB
+}
+
+// NewTemplateManager creates a new TemplateManager instance
+func NewTemplateManager(db *gorm.DB) (*TemplateManager, error) {
+	// Auto migrate the schema
+	err := db.AutoMigrate(&PipelineTemplate{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &TemplateManager{db: db}, nil
+}
+
+// validate checks that the content of a template is a YAML mapping
+func validate(t *PipelineTemplate) error {
+	if t.Name == "" {
+		return errors.New("template name is required")
+	}
+	var content map[string]interface{}
+	if err := yaml.Unmarshal([]byte(t.Content), &content); err != nil {
+		return fmt.Errorf("invalid template content: %w", err)
+	}
+	return nil
+}
+
+// CreateTemplate stores a new template
+func (m *TemplateManager) CreateTemplate(ctx context.Context, t *PipelineTemplate) error {
+	if err := validate(t); err != nil {
+		return err
+	}
+	now := time.Now()
+	t.CreatedAt = now
+	t.UpdatedAt = now
+
+	result := m.db.WithContext(ctx).Create(t)
+	if result.Error != nil {
+		return fmt.Errorf("failed to create template: %w", result.Error)
+	}
+	return nil
+}
+
+// UpdateTemplate replaces the description and content of a template
+func (m *TemplateManager) UpdateTemplate(ctx context.Context, t *PipelineTemplate) error {
+	if err := validate(t); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now()
+
+	result := m.db.WithContext(ctx).Model(&PipelineTemplate{}).Where("name = ?", t.Name).
+		Updates(map[string]interface{}{
+			"description": t.Description,
+			"content":     t.Content,
+			"updated_at":  t.UpdatedAt,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update template: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// GetTemplate gets a template by name
+func (m *TemplateManager) GetTemplate(ctx context.Context, name string) (*PipelineTemplate, error) {
+	var t PipelineTemplate
+	result := m.db.WithContext(ctx).Where("name = ?", name).First(&t)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTemplateNotFound
+		}
+		return nil, fmt.Errorf("failed to get template: %w", result.Error)
+	}
+	return &t, nil
+}
+
+// ListTemplates lists all templates by name, without their content
+func (m *TemplateManager) ListTemplates(ctx context.Context) ([]PipelineTemplate, error) {
+	var list []PipelineTemplate
+	result := m.db.WithContext(ctx).Omit("content").Order("name").Find(&list)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", result.Error)
+	}
+	return list, nil
+}
+
+// DeleteTemplate deletes a template by name
+func (m *TemplateManager) DeleteTemplate(ctx context.Context, name string) error {
+	result := m.db.WithContext(ctx).Where("name = ?", name).Delete(&PipelineTemplate{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete template: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// Template returns the content of a template, making TemplateManager a
+// ci.TemplateSource
+func (m *TemplateManager) Template(name string) ([]byte, error) {
+	t, err := m.GetTemplate(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(t.Content), nil
+}
@@ -0,0 +1,92 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// githubReporter reports to GitHub and to Gitea, whose status and issue
+// comment APIs follow GitHub's
+type githubReporter struct {
+	api  *apiClient
+	repo string
+}
+
+// NewGitHubReporter creates a StatusReporter for the GitHub repository
+// owner/name served by the API at apiURL
+func NewGitHubReporter(apiURL, repo, token string) StatusReporter {
+	return &githubReporter{
+		api: &apiClient{
+			baseURL: strings.TrimSuffix(apiURL, "/"),
+			authorize: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+token)
+			},
+			client: http.DefaultClient,
+		},
+		repo: repo,
+	}
+}
+
+// NewGiteaReporter creates a StatusReporter for the Gitea repository
+// owner/name served by the API at apiURL
+func NewGiteaReporter(apiURL, repo, token string) StatusReporter {
+	return &githubReporter{
+		api: &apiClient{
+			baseURL: strings.TrimSuffix(apiURL, "/"),
+			authorize: func(req *http.Request) {
+				req.Header.Set("Authorization", "token "+token)
+			},
+			client: http.DefaultClient,
+		},
+		repo: repo,
+	}
+}
+
+func (r *githubReporter) ReportStatus(ctx context.Context, status Status) error {
+	if status.Context == "" {
+		status.Context = DefaultContext
+	}
+	body := map[string]string{
+		"state":       string(status.State),
+		"context":     status.Context,
+		"description": truncateDescription(status.Description),
+	}
+	// Without a public address for the server there is nothing to link to
+	if status.TargetURL != "" {
+		body["target_url"] = status.TargetURL
+	}
+	return r.api.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", r.repo, status.Commit), body, nil)
+}
+
+func (r *githubReporter) UpsertComment(ctx context.Context, pullRequest int, body string) error {
+	body = commentMarker + "\n" + body
+
+	var comments []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	err := r.api.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/issues/%d/comments?per_page=100", r.repo, pullRequest), nil, &comments)
+	if err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		if strings.HasPrefix(comment.Body, commentMarker) {
+			path := fmt.Sprintf("/repos/%s/issues/comments/%d", r.repo, comment.ID)
+			return r.api.do(ctx, http.MethodPatch, path, map[string]string{"body": body}, nil)
+		}
+	}
+
+	path := fmt.Sprintf("/repos/%s/issues/%d/comments", r.repo, pullRequest)
+	return r.api.do(ctx, http.MethodPost, path, map[string]string{"body": body}, nil)
+}
+
+// truncateDescription keeps a status description within the 140
+// characters GitHub accepts
+func truncateDescription(s string) string {
+	if r := []rune(s); len(r) > 140 {
+		return string(r[:139]) + "…"
+	}
+	return s
+}
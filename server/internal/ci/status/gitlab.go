@@ -0,0 +1,78 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitlabReporter reports to GitLab through commit statuses and merge request notes
+type gitlabReporter struct {
+	api *apiClient
+	// project is the URL-encoded namespace/name path
+	project string
+}
+
+// NewGitLabReporter creates a StatusReporter for the GitLab project
+// namespace/name served by the API at apiURL
+func NewGitLabReporter(apiURL, project, token string) StatusReporter {
+	return &gitlabReporter{
+		api: &apiClient{
+			baseURL: strings.TrimSuffix(apiURL, "/"),
+			authorize: func(req *http.Request) {
+				req.Header.Set("PRIVATE-TOKEN", token)
+			},
+			client: http.DefaultClient,
+		},
+		project: url.PathEscape(project),
+	}
+}
+
+// gitlabStates maps states to the names GitLab uses
+var gitlabStates = map[State]string{
+	StatePending: "pending",
+	StateSuccess: "success",
+	StateFailure: "failed",
+	StateError:   "canceled",
+}
+
+func (r *gitlabReporter) ReportStatus(ctx context.Context, status Status) error {
+	if status.Context == "" {
+		status.Context = DefaultContext
+	}
+	state, ok := gitlabStates[status.State]
+	if !ok {
+		return fmt.Errorf("unknown commit state %q", status.State)
+	}
+	body := map[string]string{
+		"state":       state,
+		"name":        status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		body["target_url"] = status.TargetURL
+	}
+	return r.api.do(ctx, http.MethodPost, fmt.Sprintf("/projects/%s/statuses/%s", r.project, status.Commit), body, nil)
+}
+
+func (r *gitlabReporter) UpsertComment(ctx context.Context, mergeRequest int, body string) error {
+	body = commentMarker + "\n" + body
+	notesPath := fmt.Sprintf("/projects/%s/merge_requests/%d/notes", r.project, mergeRequest)
+
+	var notes []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	if err := r.api.do(ctx, http.MethodGet, notesPath+"?per_page=100", nil, &notes); err != nil {
+		return err
+	}
+	for _, note := range notes {
+		if strings.HasPrefix(note.Body, commentMarker) {
+			return r.api.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesPath, note.ID), map[string]string{"body": body}, nil)
+		}
+	}
+
+	return r.api.do(ctx, http.MethodPost, notesPath, map[string]string{"body": body}, nil)
+}
@@ -0,0 +1,169 @@
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// State is the commit status reported to a Git host
+type State string
+
+const (
+	StatePending State = "pending"
+	StateSuccess State = "success"
+	StateFailure State = "failure"
+	// StateError marks runs that ended without a verdict, such as cancelled ones
+	StateError State = "error"
+)
+
+// Supported Git hosts
+const (
+	GitHub = "github"
+	GitLab = "gitlab"
+	Gitea  = "gitea"
+)
+
+// DefaultContext names the commit status set by PipeslicerCI
+const DefaultContext = "pipeslicer-ci"
+
+// commentMarker identifies the pull request comment owned by PipeslicerCI,
+// so that later runs update it instead of adding new ones
+const commentMarker = "<!-- pipeslicer-ci -->"
+
+// requestTimeout bounds every call to a Git host API
+const requestTimeout = 15 * time.Second
+
+// Status is a commit status
+type Status struct {
+	Commit      string
+	State       State
+	Context     string
+	Description string
+	TargetURL   string
+}
+
+// StatusReporter reports pipeline results back to the Git host of a repository
+type StatusReporter interface {
+	// ReportStatus sets the status of a commit
+	ReportStatus(ctx context.Context, status Status) error
+	// UpsertComment posts body on a pull request, replacing the comment
+	// posted by an earlier run if there is one
+	UpsertComment(ctx context.Context, pullRequest int, body string) error
+}
+
+// NewReporter creates a StatusReporter for the repository at repoURL.
+// provider may be empty, in which case it is guessed from the host name.
+// The API is expected on the same host as the repository.
+func NewReporter(provider, repoURL, token string) (StatusReporter, error) {
+	host, path, err := splitRepoURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	if provider == "" {
+		provider = DetectProvider(host)
+	}
+
+	switch provider {
+	case GitHub:
+		apiURL := "https://api.github.com"
+		if host != "github.com" {
+			// GitHub Enterprise Server
+			apiURL = "https://" + host + "/api/v3"
+		}
+		return NewGitHubReporter(apiURL, path, token), nil
+	case Gitea:
+		return NewGiteaReporter("https://"+host+"/api/v1", path, token), nil
+	case GitLab:
+		return NewGitLabReporter("https://"+host+"/api/v4", path, token), nil
+	}
+	return nil, fmt.Errorf("cannot tell the Git host of %s; set its provider to github, gitlab or gitea", repoURL)
+}
+
+// DetectProvider guesses the Git host software from a host name
+func DetectProvider(host string) string {
+	host = strings.ToLower(host)
+	switch {
+	case strings.Contains(host, "github"):
+		return GitHub
+	case strings.Contains(host, "gitlab"):
+		return GitLab
+	case strings.Contains(host, "gitea"):
+		return Gitea
+	}
+	return ""
+}
+
+// splitRepoURL returns the host and the owner/name path of a Git URL
+func splitRepoURL(raw string) (string, string, error) {
+	var host, path string
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		host, path = u.Hostname(), u.Path
+	} else if at := strings.Index(raw, "@"); at >= 0 && strings.Contains(raw[at:], ":") {
+		// scp-like syntax: git@host:owner/repo.git
+		rest := raw[at+1:]
+		colon := strings.Index(rest, ":")
+		host, path = rest[:colon], rest[colon+1:]
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if host == "" || !strings.Contains(path, "/") {
+		return "", "", fmt.Errorf("invalid repository URL %q", raw)
+	}
+	return host, path, nil
+}
+
+// apiClient sends JSON requests to a Git host API
+type apiClient struct {
+	baseURL string
+	// authorize adds the credentials of the host to a request
+	authorize func(req *http.Request)
+	client    *http.Client
+}
+
+// do sends a request with body encoded as JSON and decodes the response into out when set
+func (c *apiClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response of %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
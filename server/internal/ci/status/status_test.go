@@ -0,0 +1,212 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+// request is a call received by fakeHost
+type request struct {
+	Method string
+	Path   string
+	Auth   string
+	Body   map[string]string
+}
+
+// fakeHost is an in-process Git host API that records requests and
+// answers comment listings with comments
+type fakeHost struct {
+	mu       sync.Mutex
+	requests []request
+	comments []map[string]interface{}
+}
+
+func newFakeHost(t *testing.T) (*fakeHost, *httptest.Server) {
+	host := &fakeHost{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.mu.Lock()
+		defer host.mu.Unlock()
+
+		req := request{
+			Method: r.Method,
+			Path:   r.URL.EscapedPath(),
+			Auth:   r.Header.Get("Authorization") + r.Header.Get("PRIVATE-TOKEN"),
+		}
+		if r.Method != http.MethodGet {
+			if err := json.NewDecoder(r.Body).Decode(&req.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		host.requests = append(host.requests, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(host.comments)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return host, server
+}
+
+func TestGitHubReportStatus(t *testing.T) {
+	host, server := newFakeHost(t)
+	reporter := NewGitHubReporter(server.URL, "acme/shop", "t0ken")
+
+	err := reporter.ReportStatus(context.Background(), Status{
+		Commit:      "abc123",
+		State:       StateSuccess,
+		Description: strings.Repeat("x", 200),
+		TargetURL:   "http://ci/pipelines/runs/1",
+	})
+	assert.Nil(t, err)
+
+	assert.Len(t, host.requests, 1)
+	req := host.requests[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "/repos/acme/shop/statuses/abc123", req.Path)
+	assert.Equal(t, "Bearer t0ken", req.Auth)
+	assert.Equal(t, "success", req.Body["state"])
+	assert.Equal(t, DefaultContext, req.Body["context"])
+	assert.Equal(t, "http://ci/pipelines/runs/1", req.Body["target_url"])
+	assert.Len(t, []rune(req.Body["description"]), 140)
+}
+
+func TestGitHubUpsertComment(t *testing.T) {
+	host, server := newFakeHost(t)
+	reporter := NewGitHubReporter(server.URL, "acme/shop", "t0ken")
+
+	host.comments = []map[string]interface{}{{"id": 7, "body": "LGTM"}}
+	assert.Nil(t, reporter.UpsertComment(context.Background(), 42, "first"))
+	assert.Len(t, host.requests, 2)
+	assert.Equal(t, http.MethodPost, host.requests[1].Method)
+	assert.Equal(t, "/repos/acme/shop/issues/42/comments", host.requests[1].Path)
+	assert.Equal(t, commentMarker+"\nfirst", host.requests[1].Body["body"])
+
+	host.comments = append(host.comments, map[string]interface{}{"id": 9, "body": commentMarker + "\nfirst"})
+	assert.Nil(t, reporter.UpsertComment(context.Background(), 42, "second"))
+	assert.Len(t, host.requests, 4)
+	assert.Equal(t, http.MethodPatch, host.requests[3].Method)
+	assert.Equal(t, "/repos/acme/shop/issues/comments/9", host.requests[3].Path)
+	assert.Equal(t, commentMarker+"\nsecond", host.requests[3].Body["body"])
+}
+
+func TestGiteaReporter(t *testing.T) {
+	host, server := newFakeHost(t)
+	reporter := NewGiteaReporter(server.URL, "acme/shop", "t0ken")
+
+	assert.Nil(t, reporter.ReportStatus(context.Background(), Status{Commit: "abc123", State: StateFailure}))
+	assert.Nil(t, reporter.UpsertComment(context.Background(), 3, "summary"))
+
+	assert.Len(t, host.requests, 3)
+	assert.Equal(t, "token t0ken", host.requests[0].Auth)
+	assert.Equal(t, "/repos/acme/shop/statuses/abc123", host.requests[0].Path)
+	assert.Equal(t, "failure", host.requests[0].Body["state"])
+	assert.NotContains(t, host.requests[0].Body, "target_url")
+	assert.Equal(t, "/repos/acme/shop/issues/3/comments", host.requests[2].Path)
+}
+
+func TestGitLabReporter(t *testing.T) {
+	host, server := newFakeHost(t)
+	reporter := NewGitLabReporter(server.URL, "acme/shop", "t0ken")
+
+	assert.Nil(t, reporter.ReportStatus(context.Background(), Status{Commit: "abc123", State: StateFailure}))
+	assert.Len(t, host.requests, 1)
+	assert.Equal(t, "t0ken", host.requests[0].Auth)
+	assert.Equal(t, "/projects/acme%2Fshop/statuses/abc123", host.requests[0].Path)
+	assert.Equal(t, "failed", host.requests[0].Body["state"])
+	assert.Equal(t, DefaultContext, host.requests[0].Body["name"])
+	assert.NotContains(t, host.requests[0].Body, "target_url")
+
+	host.comments = []map[string]interface{}{{"id": 5, "body": commentMarker + "\nold"}}
+	assert.Nil(t, reporter.UpsertComment(context.Background(), 8, "new"))
+	assert.Len(t, host.requests, 3)
+	assert.Equal(t, http.MethodPut, host.requests[2].Method)
+	assert.Equal(t, "/projects/acme%2Fshop/merge_requests/8/notes/5", host.requests[2].Path)
+	assert.Equal(t, commentMarker+"\nnew", host.requests[2].Body["body"])
+}
+
+func TestReportStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	err := NewGitHubReporter(server.URL, "acme/shop", "bad").ReportStatus(context.Background(), Status{Commit: "abc123", State: StatePending})
+	assert.ErrorContains(t, err, "401")
+	assert.ErrorContains(t, err, "Bad credentials")
+}
+
+func TestNewReporter(t *testing.T) {
+	tests := []struct {
+		provider string
+		url      string
+		apiURL   string
+		path     string
+	}{
+		{"", "https://github.com/acme/shop.git", "https://api.github.com", "acme/shop"},
+		{"", "git@github.com:acme/shop.git", "https://api.github.com", "acme/shop"},
+		{GitHub, "https://git.acme.dev/acme/shop", "https://git.acme.dev/api/v3", "acme/shop"},
+		{"", "https://gitlab.com/acme/backend/shop.git", "https://gitlab.com/api/v4", "acme%2Fbackend%2Fshop"},
+		{Gitea, "https://git.acme.dev/acme/shop.git", "https://git.acme.dev/api/v1", "acme/shop"},
+	}
+	for _, tt := range tests {
+		reporter, err := NewReporter(tt.provider, tt.url, "t0ken")
+		assert.Nil(t, err, tt.url)
+		switch r := reporter.(type) {
+		case *githubReporter:
+			assert.Equal(t, tt.apiURL, r.api.baseURL, tt.url)
+			assert.Equal(t, tt.path, r.repo, tt.url)
+		case *gitlabReporter:
+			assert.Equal(t, tt.apiURL, r.api.baseURL, tt.url)
+			assert.Equal(t, tt.path, r.project, tt.url)
+		}
+	}
+
+	_, err := NewReporter("", "https://git.acme.dev/acme/shop.git", "t0ken")
+	assert.ErrorContains(t, err, "set its provider")
+	_, err = NewReporter(GitHub, "https://github.com/shop", "t0ken")
+	assert.ErrorContains(t, err, "invalid repository URL")
+}
+
+func TestSummaryMarkdown(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(42 * time.Second)
+	summary := Summary{
+		Pipeline: "build",
+		Commit:   "0123456789abcdef",
+		State:    StateFailure,
+		RunURL:   "http://ci/pipelines/runs/3",
+		Error:    "step \"test\" failed",
+		Result: &ci.RunResult{
+			Services: []string{"orders", "payments"},
+			Images:   []string{"registry.local/orders:0123456"},
+			Steps: []ci.StepResult{
+				{Name: "build", Status: ci.StepSuccess, StartedAt: &start, FinishedAt: &end},
+				{Name: "test", Status: ci.StepFailed, StartedAt: &start, FinishedAt: &end},
+				{Name: "deploy", Status: ci.StepSkipped},
+			},
+		},
+	}
+
+	markdown := summary.Markdown()
+	assert.Contains(t, markdown, "### ❌ Pipeline build failed")
+	assert.Contains(t, markdown, "Commit `0123456` · [View run](http://ci/pipelines/runs/3)")
+	assert.Contains(t, markdown, "> step \"test\" failed")
+	assert.Contains(t, markdown, "**Changed services:** `orders`, `payments`")
+	assert.Contains(t, markdown, "- `registry.local/orders:0123456`")
+	assert.Contains(t, markdown, "| build | success | 42s |")
+	assert.Contains(t, markdown, "| deploy | skipped | - |")
+}
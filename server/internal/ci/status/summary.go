@@ -0,0 +1,93 @@
+package status
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vanhcao3/pipeslicerCI/internal/ci"
+)
+
+// Summary describes a finished run for a pull request comment
+type Summary struct {
+	Pipeline string
+	Commit   string
+	State    State
+	RunURL   string
+	// Error is set when the run failed before or outside its steps
+	Error string
+	// Result is nil when the run never got to execute its steps
+	Result *ci.RunResult
+}
+
+var stateHeadings = map[State]string{
+	StatePending: "⏳ Pipeline %s is running",
+	StateSuccess: "✅ Pipeline %s passed",
+	StateFailure: "❌ Pipeline %s failed",
+	StateError:   "⚠️ Pipeline %s was cancelled",
+}
+
+// Markdown renders the summary with the changed services, the images
+// built and a table of the steps
+func (s Summary) Markdown() string {
+	var b strings.Builder
+
+	name := s.Pipeline
+	if name == "" {
+		name = "run"
+	}
+	fmt.Fprintf(&b, "### "+stateHeadings[s.State]+"\n\n", name)
+
+	var meta []string
+	if s.Commit != "" {
+		meta = append(meta, fmt.Sprintf("Commit `%s`", shortCommit(s.Commit)))
+	}
+	if s.RunURL != "" {
+		meta = append(meta, fmt.Sprintf("[View run](%s)", s.RunURL))
+	}
+	if len(meta) > 0 {
+		b.WriteString(strings.Join(meta, " · ") + "\n\n")
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&b, "> %s\n\n", strings.ReplaceAll(s.Error, "\n", " "))
+	}
+
+	if s.Result == nil {
+		return b.String()
+	}
+
+	if len(s.Result.Services) > 0 {
+		b.WriteString("**Changed services:** ")
+		for i, service := range s.Result.Services {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "`%s`", service)
+		}
+		b.WriteString("\n\n")
+	}
+	if len(s.Result.Images) > 0 {
+		b.WriteString("**Images built:**\n")
+		for _, image := range s.Result.Images {
+			fmt.Fprintf(&b, "- `%s`\n", image)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("| Step | Status | Duration |\n|---|---|---|\n")
+	for _, step := range s.Result.Steps {
+		duration := "-"
+		if step.StartedAt != nil && step.FinishedAt != nil {
+			duration = step.FinishedAt.Sub(*step.StartedAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", strings.ReplaceAll(step.Name, "|", "\\|"), step.Status, duration)
+	}
+	return b.String()
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -0,0 +1,312 @@
+package ci
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineSchema is the JSON Schema of the pipeline format, for editors
+//
+//go:embed pipeline.schema.json
+var PipelineSchema []byte
+
+// ValidationError is a problem found in a pipeline definition. Line and
+// Column are 1-based and zero when the problem has no single location.
+type ValidationError struct {
+	// File names the included file the problem is in; empty for the pipeline itself
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ": ")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d, column %d: ", e.Line, e.Column)
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors lists every problem found in a pipeline definition
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidatePipeline checks a pipeline definition on its own, without a
+// workspace. Templates are resolved through templates when it is set;
+// local includes cannot be read, so they are reported as warnings and
+// the checks that need the fully merged pipeline are skipped.
+func ValidatePipeline(yamlContent []byte, templates TemplateSource) (errs, warnings []ValidationError) {
+	r := &pipelineResolver{templates: templates}
+	root, err := r.resolveAll(yamlContent)
+	warnings = r.warnings
+	if err != nil {
+		return asValidationErrors(err), warnings
+	}
+	if r.skippedLocal {
+		return nil, warnings
+	}
+
+	var pipeline Pipeline
+	if err := root.Decode(&pipeline); err != nil {
+		return asValidationErrors(err), warnings
+	}
+	return validatePipeline(&pipeline, r.steps), warnings
+}
+
+// asValidationErrors turns any error from loading a pipeline into ValidationErrors
+func asValidationErrors(err error) ValidationErrors {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	var one ValidationError
+	if errors.As(err, &one) {
+		return ValidationErrors{one}
+	}
+	return ValidationErrors{{Message: err.Error()}}
+}
+
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// syntaxError converts an error from the YAML parser into a ValidationError
+func syntaxError(file string, err error) ValidationError {
+	msg := err.Error()
+	line := 0
+	if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+		line, _ = strconv.Atoi(m[1])
+		msg = msg[len(m[0]):]
+	}
+	return ValidationError{File: file, Line: line, Message: strings.TrimPrefix(msg, "yaml: ")}
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	matrixType      = reflect.TypeOf(Matrix{})
+)
+
+// checkStructure compares node against the fields of t, reporting unknown
+// fields and values of the wrong type with their position
+func checkStructure(node *yaml.Node, t reflect.Type, file, path string) []ValidationError {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return nil
+	}
+	problem := func(n *yaml.Node, path, format string, args ...interface{}) []ValidationError {
+		return []ValidationError{{File: file, Line: n.Line, Column: n.Column, Path: path, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	// Types with their own decoding are checked by decoding them, except
+	// structs written as mappings, whose fields can still be checked one by one
+	custom := reflect.PointerTo(t).Implements(unmarshalerType)
+	if custom && (t.Kind() != reflect.Struct || t == matrixType || node.Kind != yaml.MappingNode) {
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			return problem(node, path, "%s", decodeMessage(err))
+		}
+		return nil
+	}
+
+	var errs []ValidationError
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return problem(node, path, "expected a mapping")
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, problem(key, path, "unknown field %q", key.Value)...)
+				continue
+			}
+			errs = append(errs, checkStructure(value, field.Type, file, joinPath(path, key.Value))...)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return problem(node, path, "expected a list")
+		}
+		for i, item := range node.Content {
+			errs = append(errs, checkStructure(item, t.Elem(), file, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return problem(node, path, "expected a mapping")
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, checkStructure(node.Content[i+1], t.Elem(), file, joinPath(path, node.Content[i].Value))...)
+		}
+	default:
+		if node.Kind != yaml.ScalarNode {
+			return problem(node, path, "expected a single value")
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			return problem(node, path, "%s", decodeMessage(err))
+		}
+	}
+	return errs
+}
+
+var typeErrorLine = regexp.MustCompile(`^line \d+: `)
+
+// decodeMessage strips the position prefixes from a decoding error, since
+// the ValidationError carries the position itself
+func decodeMessage(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return strings.TrimPrefix(err.Error(), "yaml: ")
+	}
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		msgs[i] = typeErrorLine.ReplaceAllString(msg, "")
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// yamlFields maps the YAML keys of a struct to its fields
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// validatePipeline checks the rules a fully merged pipeline must follow.
+// steps holds the step nodes of the top-level file by name, to point
+// problems at the step they come from.
+func validatePipeline(pipeline *Pipeline, steps map[string]*yaml.Node) ValidationErrors {
+	var errs ValidationErrors
+	at := func(name, key, path, format string, args ...interface{}) {
+		err := ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+		if node, ok := steps[name]; ok {
+			if i := keyIndex(node, key); key != "" && i >= 0 {
+				node = node.Content[i+1]
+			}
+			err.Line, err.Column = node.Line, node.Column
+		}
+		errs = append(errs, err)
+	}
+
+	if len(pipeline.Steps) == 0 {
+		at("", "", "steps", "pipeline has no steps")
+		return errs
+	}
+
+	if isBlankShell(pipeline.Shell) {
+		at("", "", "shell", "blank shell, expected an interpreter such as /bin/sh")
+	}
+	names := make(map[string]bool)
+	for _, step := range pipeline.Steps {
+		if step.Name != "" {
+			names[step.Name] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for i, step := range pipeline.Steps {
+		path := fmt.Sprintf("steps[%d]", i)
+		if step.Name == "" {
+			at("", "", path, "step has no name")
+			continue
+		}
+		if seen[step.Name] {
+			at(step.Name, "name", path+".name", "duplicate step name %q", step.Name)
+		}
+		seen[step.Name] = true
+
+		switch step.Type {
+		case "":
+			if len(step.Commands) == 0 {
+				at(step.Name, "", path, "step %q has no commands", step.Name)
+			}
+		case StepTypeApproval:
+			if len(step.Commands) > 0 {
+				at(step.Name, "commands", path+".commands", "approval step %q cannot have commands", step.Name)
+			}
+			if step.Matrix != nil {
+				at(step.Name, "matrix", path+".matrix", "approval step %q cannot have a matrix", step.Name)
+			}
+		default:
+			at(step.Name, "type", path+".type", "invalid type %q, expected approval", step.Type)
+		}
+		if isBlankShell(step.Shell) {
+			at(step.Name, "shell", path+".shell", "blank shell, expected an interpreter such as /bin/sh")
+		}
+		switch step.When {
+		case "", WhenOnSuccess, WhenOnFailure, WhenAlways:
+		default:
+			at(step.Name, "when", path+".when", "invalid when %q, expected on_success, on_failure or always", step.When)
+		}
+		if step.If != "" {
+			if _, err := ParseCondition(step.If); err != nil {
+				at(step.Name, "if", path+".if", "%v", err)
+			}
+		}
+		for _, need := range step.Needs {
+			if !names[need] {
+				at(step.Name, "needs", path+".needs", "needs unknown step %q", need)
+			}
+		}
+	}
+	if err := validateServices(pipeline.Services); err != nil {
+		at("", "", "services", "%v", err)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// Matrix expansion and dependency cycles concern the whole graph
+	expanded, err := expandMatrix(pipeline)
+	if err == nil {
+		_, err = newStepGraph(expanded)
+	}
+	if err != nil {
+		at("", "", "steps", "%v", err)
+	}
+	return errs
+}
+
+// isBlankShell reports whether shell is set to nothing but whitespace,
+// which leaves no interpreter to run.
+func isBlankShell(shell string) bool {
+	return shell != "" && strings.TrimSpace(shell) == ""
+}
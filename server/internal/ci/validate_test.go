@@ -0,0 +1,124 @@
+package ci
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePipelineReportsPositions(t *testing.T) {
+	errs, warnings := ValidatePipeline([]byte(`name: Typos
+timeout: soon
+steps:
+- name: Build
+  comands:
+  - go build ./...
+- name: Test
+  when: sometimes
+  needs: [Compile]
+  commands: [go test ./...]
+`), nil)
+
+	assert.Empty(t, warnings)
+	assert.Equal(t, []ValidationError{
+		{Line: 2, Column: 10, Path: "timeout", Message: "cannot unmarshal !!str `soon` into time.Duration"},
+		{Line: 5, Column: 3, Path: "steps[0]", Message: `unknown field "comands"`},
+	}, errs)
+
+	errs, _ = ValidatePipeline([]byte(`steps:
+- name: Build
+  commands: [make]
+- name: Test
+  when: sometimes
+  needs: [Compile]
+  commands: [go test ./...]
+`), nil)
+	assert.Equal(t, []ValidationError{
+		{Line: 5, Column: 9, Path: "steps[1].when", Message: `invalid when "sometimes", expected on_success, on_failure or always`},
+		{Line: 6, Column: 10, Path: "steps[1].needs", Message: `needs unknown step "Compile"`},
+	}, errs)
+
+	errs, _ = ValidatePipeline([]byte(`shell: " "
+steps:
+- name: Build
+  shell: "\t"
+  commands: [make]
+`), nil)
+	assert.Equal(t, []ValidationError{
+		{Path: "shell", Message: "blank shell, expected an interpreter such as /bin/sh"},
+		{Line: 4, Column: 10, Path: "steps[0].shell", Message: "blank shell, expected an interpreter such as /bin/sh"},
+	}, errs)
+
+	errs, _ = ValidatePipeline([]byte(`steps:
+- name: Deploy
+  if: tag == 'v1'
+  commands: [make deploy]
+- name: Notify
+  if: sucess()
+  commands: [make notify]
+`), nil)
+	assert.Equal(t, []ValidationError{
+		{Line: 3, Column: 7, Path: "steps[0].if", Message: `invalid condition "tag == 'v1'": unknown identifier "tag"`},
+		{Line: 6, Column: 7, Path: "steps[1].if", Message: `invalid condition "sucess()": unknown function "sucess"`},
+	}, errs)
+
+	errs, _ = ValidatePipeline([]byte(`steps:
+- name: Sign-off
+  type: approval
+  commands: [make]
+- name: Promote
+  type: manual
+  commands: [make promote]
+- name: Gate
+  type: approval
+  timeout: 24h
+`), nil)
+	assert.Equal(t, []ValidationError{
+		{Line: 4, Column: 13, Path: "steps[0].commands", Message: `approval step "Sign-off" cannot have commands`},
+		{Line: 6, Column: 9, Path: "steps[1].type", Message: `invalid type "manual", expected approval`},
+	}, errs)
+
+	errs, _ = ValidatePipeline([]byte("name: Empty\n"), nil)
+	assert.Equal(t, []ValidationError{{Path: "steps", Message: "pipeline has no steps"}}, errs)
+
+	errs, _ = ValidatePipeline([]byte("steps:\n- name: a\n  x: : :\n"), nil)
+	assert.Equal(t, []ValidationError{{Line: 3, Message: "mapping values are not allowed in this context"}}, errs)
+
+	errs, warnings = ValidatePipeline([]byte("include: [ci/common.yaml]\nsteps:\n- name: Test\n  extends: .base\n"), nil)
+	assert.Empty(t, errs)
+	assert.Len(t, warnings, 1)
+}
+
+func TestPipelineSchemaCoversEveryField(t *testing.T) {
+	var schema interface{}
+	assert.Nil(t, json.Unmarshal(PipelineSchema, &schema))
+
+	properties := make(map[string]bool)
+	var collect func(v interface{})
+	collect = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if props, ok := v["properties"].(map[string]interface{}); ok {
+				for name := range props {
+					properties[name] = true
+				}
+			}
+			for _, child := range v {
+				collect(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				collect(child)
+			}
+		}
+	}
+	collect(schema)
+
+	for _, v := range []interface{}{Pipeline{}, Step{}, Service{}, Healthcheck{}, RetryPolicy{}, Artifacts{}, Cache{}, Include{}} {
+		for name := range yamlFields(reflect.TypeOf(v)) {
+			assert.True(t, properties[name], "schema has no property %q of %T", name, v)
+		}
+	}
+}
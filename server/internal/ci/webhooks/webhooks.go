@@ -0,0 +1,386 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Supported webhook providers
+const (
+	GitHub = "github"
+	GitLab = "gitlab"
+	Gitea  = "gitea"
+)
+
+// Kinds of events that trigger a build
+const (
+	EventPush        = "push"
+	EventTag         = "tag"
+	EventPullRequest = "pull_request"
+)
+
+// ErrInvalidSignature is returned when a webhook request is not signed with the repository secret
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ErrIgnoredEvent is returned for events that never trigger a build, such
+// as pings, closed pull requests and deleted branches
+var ErrIgnoredEvent = errors.New("event does not trigger a build")
+
+// zeroCommit is the commit a push reports for a deleted branch or tag
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+// Event is a push, tag or pull request event decoded from a webhook
+type Event struct {
+	Provider string
+	Kind     string
+	// RepositoryURLs are the clone and web URLs of the repository the
+	// event belongs to, for matching it against a registered repository
+	RepositoryURLs []string
+	// Branch is the branch pushed to, or the source branch of a pull request
+	Branch string
+	Tag    string
+	Commit string
+	// PullRequest is the pull or merge request number
+	PullRequest int
+	// TargetBranch is the branch a pull request merges into
+	TargetBranch string
+	// Fork is set for pull requests opened from another repository
+	Fork   bool
+	Sender string
+	// ChangedFiles are the files added, modified or removed by the commits
+	// of a push, when the payload lists all of them
+	ChangedFiles []string
+}
+
+// Verify checks that body was signed with secret. GitHub and Gitea sign
+// the body with HMAC-SHA256; GitLab sends the secret token itself.
+// header returns the value of a request header.
+func Verify(provider string, header func(string) string, body []byte, secret string) error {
+	switch provider {
+	case GitHub:
+		return verifyHMAC(strings.TrimPrefix(header("X-Hub-Signature-256"), "sha256="), body, secret)
+	case Gitea:
+		return verifyHMAC(header("X-Gitea-Signature"), body, secret)
+	case GitLab:
+		token := header("X-Gitlab-Token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported webhook provider %q", provider)
+}
+
+func verifyHMAC(signature string, body []byte, secret string) error {
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) == 0 {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Parse decodes the event of a webhook request from provider
+func Parse(provider string, header func(string) string, body []byte) (*Event, error) {
+	switch provider {
+	case GitHub:
+		return parseGitHub(GitHub, header("X-GitHub-Event"), body)
+	case Gitea:
+		return parseGitHub(Gitea, header("X-Gitea-Event"), body)
+	case GitLab:
+		return parseGitLab(header("X-Gitlab-Event"), body)
+	}
+	return nil, fmt.Errorf("unsupported webhook provider %q", provider)
+}
+
+// githubRepository is the repository object of GitHub and Gitea payloads
+type githubRepository struct {
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	HTMLURL  string `json:"html_url"`
+}
+
+func (r githubRepository) urls() []string {
+	return nonEmpty(r.CloneURL, r.SSHURL, r.HTMLURL)
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+// pushCommit is a commit listed in a push payload, in the format shared
+// by GitHub, Gitea and GitLab
+type pushCommit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+type githubPush struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Commits    []pushCommit     `json:"commits"`
+	Repository githubRepository `json:"repository"`
+	Sender     githubUser       `json:"sender"`
+}
+
+type githubPullRequest struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head struct {
+			Ref  string           `json:"ref"`
+			SHA  string           `json:"sha"`
+			Repo githubRepository `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref  string           `json:"ref"`
+			Repo githubRepository `json:"repo"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository githubRepository `json:"repository"`
+	Sender     githubUser       `json:"sender"`
+}
+
+// parseGitHub decodes GitHub events, which Gitea mirrors closely enough to share the code
+func parseGitHub(provider, kind string, body []byte) (*Event, error) {
+	switch kind {
+	case "push":
+		var payload githubPush
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode push event: %w", err)
+		}
+		if payload.Deleted || payload.After == zeroCommit {
+			return nil, fmt.Errorf("%w: %s was deleted", ErrIgnoredEvent, payload.Ref)
+		}
+		event, err := pushEvent(provider, payload.Ref, payload.After, payload.Repository.urls(), payload.Sender.Login)
+		if err != nil {
+			return nil, err
+		}
+		event.ChangedFiles = changedFiles(payload.Commits)
+		return event, nil
+	case "pull_request":
+		var payload githubPullRequest
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode pull request event: %w", err)
+		}
+		switch payload.Action {
+		case "opened", "reopened", "synchronize", "synchronized":
+		default:
+			return nil, fmt.Errorf("%w: pull request %s", ErrIgnoredEvent, payload.Action)
+		}
+		pr := payload.PullRequest
+		return &Event{
+			Provider:       provider,
+			Kind:           EventPullRequest,
+			RepositoryURLs: payload.Repository.urls(),
+			Branch:         pr.Head.Ref,
+			Commit:         pr.Head.SHA,
+			PullRequest:    payload.Number,
+			TargetBranch:   pr.Base.Ref,
+			Fork:           !SameRepository(pr.Head.Repo.CloneURL, pr.Base.Repo.CloneURL),
+			Sender:         payload.Sender.Login,
+		}, nil
+	case "":
+		return nil, errors.New("missing event type header")
+	}
+	return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, kind)
+}
+
+type gitlabProject struct {
+	HTTPURL string `json:"git_http_url"`
+	SSHURL  string `json:"git_ssh_url"`
+	WebURL  string `json:"web_url"`
+}
+
+type gitlabPush struct {
+	Ref          string        `json:"ref"`
+	After        string        `json:"after"`
+	CheckoutSHA  string        `json:"checkout_sha"`
+	UserUsername string        `json:"user_username"`
+	Project      gitlabProject `json:"project"`
+	Commits      []pushCommit  `json:"commits"`
+	// TotalCommits exceeds len(Commits) when GitLab left commits out
+	TotalCommits int `json:"total_commits_count"`
+}
+
+type gitlabMergeRequest struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project          gitlabProject `json:"project"`
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Action          string `json:"action"`
+		SourceBranch    string `json:"source_branch"`
+		TargetBranch    string `json:"target_branch"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		// OldRev is only set on updates that pushed new commits
+		OldRev     string `json:"oldrev"`
+		LastCommit struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+func parseGitLab(kind string, body []byte) (*Event, error) {
+	switch kind {
+	case "Push Hook", "Tag Push Hook":
+		var payload gitlabPush
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode push event: %w", err)
+		}
+		if payload.After == zeroCommit {
+			return nil, fmt.Errorf("%w: %s was deleted", ErrIgnoredEvent, payload.Ref)
+		}
+		commit := payload.CheckoutSHA
+		if commit == "" {
+			commit = payload.After
+		}
+		p := payload.Project
+		event, err := pushEvent(GitLab, payload.Ref, commit, nonEmpty(p.HTTPURL, p.SSHURL, p.WebURL), payload.UserUsername)
+		if err != nil {
+			return nil, err
+		}
+		if payload.TotalCommits <= len(payload.Commits) {
+			event.ChangedFiles = changedFiles(payload.Commits)
+		}
+		return event, nil
+	case "Merge Request Hook":
+		var payload gitlabMergeRequest
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, fmt.Errorf("failed to decode merge request event: %w", err)
+		}
+		mr := payload.ObjectAttributes
+		switch {
+		case mr.Action == "open", mr.Action == "reopen":
+		case mr.Action == "update" && mr.OldRev != "":
+		default:
+			return nil, fmt.Errorf("%w: merge request %s", ErrIgnoredEvent, mr.Action)
+		}
+		p := payload.Project
+		return &Event{
+			Provider:       GitLab,
+			Kind:           EventPullRequest,
+			RepositoryURLs: nonEmpty(p.HTTPURL, p.SSHURL, p.WebURL),
+			Branch:         mr.SourceBranch,
+			Commit:         mr.LastCommit.ID,
+			PullRequest:    mr.IID,
+			TargetBranch:   mr.TargetBranch,
+			Fork:           mr.SourceProjectID != mr.TargetProjectID,
+			Sender:         payload.User.Username,
+		}, nil
+	case "":
+		return nil, errors.New("missing event type header")
+	}
+	return nil, fmt.Errorf("%w: %s", ErrIgnoredEvent, kind)
+}
+
+// pushEvent builds the event of a push to ref, which names a branch or a tag
+func pushEvent(provider, ref, commit string, urls []string, sender string) (*Event, error) {
+	event := &Event{
+		Provider:       provider,
+		RepositoryURLs: urls,
+		Commit:         commit,
+		Sender:         sender,
+	}
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		event.Kind = EventPush
+		event.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		event.Kind = EventTag
+		event.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	default:
+		return nil, fmt.Errorf("%w: push to %s", ErrIgnoredEvent, ref)
+	}
+	return event, nil
+}
+
+// changedFiles returns the files touched by commits, sorted and without
+// duplicates
+func changedFiles(commits []pushCommit) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, commit := range commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// MatchFilter reports whether name matches one of the glob patterns, such
+// as "main" or "release/*". An empty filter matches every name.
+func MatchFilter(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SameRepository reports whether two Git URLs point to the same
+// repository, comparing host and path so that HTTPS, SSH and web URLs match
+func SameRepository(a, b string) bool {
+	na, nb := normalizeURL(a), normalizeURL(b)
+	return na != "" && na == nb
+}
+
+// normalizeURL reduces a Git URL to host/path in lower case
+func normalizeURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+
+	var host, p string
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		host, p = u.Hostname(), u.Path
+	} else if at := strings.Index(raw, "@"); at >= 0 && strings.Contains(raw[at:], ":") {
+		// scp-like syntax: git@host:owner/repo.git
+		rest := raw[at+1:]
+		colon := strings.Index(rest, ":")
+		host, p = rest[:colon], rest[colon+1:]
+	} else {
+		return ""
+	}
+
+	p = strings.TrimSuffix(strings.Trim(p, "/"), ".git")
+	return strings.ToLower(host + "/" + p)
+}
+
+func nonEmpty(values ...string) []string {
+	var out []string
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func headers(values map[string]string) func(string) string {
+	return func(key string) string { return values[key] }
+}
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+
+	assert.Nil(t, Verify(GitHub, headers(map[string]string{"X-Hub-Signature-256": "sha256=" + sign(body, "s3cret")}), body, "s3cret"))
+	assert.Nil(t, Verify(Gitea, headers(map[string]string{"X-Gitea-Signature": sign(body, "s3cret")}), body, "s3cret"))
+	assert.Nil(t, Verify(GitLab, headers(map[string]string{"X-Gitlab-Token": "s3cret"}), body, "s3cret"))
+
+	assert.ErrorIs(t, Verify(GitHub, headers(map[string]string{"X-Hub-Signature-256": "sha256=" + sign(body, "other")}), body, "s3cret"), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(GitHub, headers(nil), body, "s3cret"), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(Gitea, headers(map[string]string{"X-Gitea-Signature": sign([]byte("tampered"), "s3cret")}), body, "s3cret"), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify(GitLab, headers(map[string]string{"X-Gitlab-Token": "wrong"}), body, "s3cret"), ErrInvalidSignature)
+}
+
+func TestParseGitHub(t *testing.T) {
+	event, err := Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "push"}), []byte(`{
+		"ref": "refs/heads/feature/login",
+		"after": "1111111111111111111111111111111111111111",
+		"commits": [
+			{"added": ["web/login.go"], "modified": ["go.mod"], "removed": []},
+			{"added": [], "modified": ["web/login.go"], "removed": ["web/old.go"]}
+		],
+		"repository": {"clone_url": "https://github.com/acme/shop.git", "ssh_url": "git@github.com:acme/shop.git"},
+		"sender": {"login": "alice"}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &Event{
+		Provider:       GitHub,
+		Kind:           EventPush,
+		RepositoryURLs: []string{"https://github.com/acme/shop.git", "git@github.com:acme/shop.git"},
+		Branch:         "feature/login",
+		Commit:         "1111111111111111111111111111111111111111",
+		Sender:         "alice",
+		ChangedFiles:   []string{"go.mod", "web/login.go", "web/old.go"},
+	}, event)
+
+	event, err = Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "push"}), []byte(`{"ref": "refs/tags/v1.2.0", "after": "2222"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, EventTag, event.Kind)
+	assert.Equal(t, "v1.2.0", event.Tag)
+
+	event, err = Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "pull_request"}), []byte(`{
+		"action": "synchronize",
+		"number": 42,
+		"pull_request": {
+			"head": {"ref": "fix", "sha": "3333", "repo": {"clone_url": "https://github.com/bob/shop.git"}},
+			"base": {"ref": "main", "repo": {"clone_url": "https://github.com/acme/shop.git"}}
+		},
+		"repository": {"clone_url": "https://github.com/acme/shop.git"}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, EventPullRequest, event.Kind)
+	assert.Equal(t, 42, event.PullRequest)
+	assert.Equal(t, "fix", event.Branch)
+	assert.Equal(t, "main", event.TargetBranch)
+	assert.Equal(t, "3333", event.Commit)
+	assert.True(t, event.Fork)
+
+	_, err = Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "push"}), []byte(`{"ref": "refs/heads/old", "deleted": true}`))
+	assert.ErrorIs(t, err, ErrIgnoredEvent)
+	_, err = Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "pull_request"}), []byte(`{"action": "closed"}`))
+	assert.ErrorIs(t, err, ErrIgnoredEvent)
+	_, err = Parse(GitHub, headers(map[string]string{"X-GitHub-Event": "ping"}), []byte(`{}`))
+	assert.ErrorIs(t, err, ErrIgnoredEvent)
+	_, err = Parse(GitHub, headers(nil), []byte(`{}`))
+	assert.False(t, errors.Is(err, ErrIgnoredEvent))
+}
+
+func TestParseGitea(t *testing.T) {
+	event, err := Parse(Gitea, headers(map[string]string{"X-Gitea-Event": "pull_request"}), []byte(`{
+		"action": "opened",
+		"number": 7,
+		"pull_request": {
+			"head": {"ref": "feature", "sha": "4444", "repo": {"clone_url": "https://gitea.local/acme/shop.git"}},
+			"base": {"ref": "main", "repo": {"clone_url": "https://gitea.local/acme/shop.git"}}
+		},
+		"repository": {"clone_url": "https://gitea.local/acme/shop.git"},
+		"sender": {"login": "carol"}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Gitea, event.Provider)
+	assert.Equal(t, "feature", event.Branch)
+	assert.False(t, event.Fork)
+}
+
+func TestParseGitLab(t *testing.T) {
+	event, err := Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Tag Push Hook"}), []byte(`{
+		"ref": "refs/tags/v2",
+		"after": "5555",
+		"checkout_sha": "6666",
+		"user_username": "dave",
+		"project": {"git_http_url": "https://gitlab.com/acme/shop.git", "git_ssh_url": "git@gitlab.com:acme/shop.git", "web_url": "https://gitlab.com/acme/shop"}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, EventTag, event.Kind)
+	assert.Equal(t, "v2", event.Tag)
+	assert.Equal(t, "6666", event.Commit)
+	assert.Len(t, event.RepositoryURLs, 3)
+
+	event, err = Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Merge Request Hook"}), []byte(`{
+		"user": {"username": "erin"},
+		"project": {"git_http_url": "https://gitlab.com/acme/shop.git"},
+		"object_attributes": {"iid": 3, "action": "update", "oldrev": "7777", "source_branch": "fix", "target_branch": "main",
+			"source_project_id": 1, "target_project_id": 1, "last_commit": {"id": "8888"}}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, EventPullRequest, event.Kind)
+	assert.Equal(t, 3, event.PullRequest)
+	assert.Equal(t, "8888", event.Commit)
+	assert.False(t, event.Fork)
+
+	// Updates without new commits, such as a changed title, are ignored
+	_, err = Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Merge Request Hook"}), []byte(`{"object_attributes": {"action": "update"}}`))
+	assert.ErrorIs(t, err, ErrIgnoredEvent)
+	event, err = Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Push Hook"}), []byte(`{
+		"ref": "refs/heads/main",
+		"after": "7777",
+		"commits": [{"added": ["README.md"], "modified": [], "removed": []}],
+		"total_commits_count": 1
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"README.md"}, event.ChangedFiles)
+
+	// GitLab lists at most 20 commits, so a longer push has no file list
+	event, err = Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Push Hook"}), []byte(`{
+		"ref": "refs/heads/main",
+		"after": "8888",
+		"commits": [{"added": ["README.md"], "modified": [], "removed": []}],
+		"total_commits_count": 25
+	}`))
+	assert.Nil(t, err)
+	assert.Nil(t, event.ChangedFiles)
+
+	_, err = Parse(GitLab, headers(map[string]string{"X-Gitlab-Event": "Push Hook"}), []byte(`{"ref": "refs/heads/x", "after": "0000000000000000000000000000000000000000"}`))
+	assert.ErrorIs(t, err, ErrIgnoredEvent)
+}
+
+func TestMatchFilter(t *testing.T) {
+	assert.True(t, MatchFilter(nil, "anything"))
+	assert.True(t, MatchFilter([]string{"main", "release/*"}, "release/1.0"))
+	assert.False(t, MatchFilter([]string{"main", "release/*"}, "feature/x"))
+	assert.True(t, MatchFilter([]string{"v*"}, "v1.2.0"))
+}
+
+func TestSameRepository(t *testing.T) {
+	assert.True(t, SameRepository("https://github.com/Acme/Shop.git", "git@github.com:acme/shop.git"))
+	assert.True(t, SameRepository("https://github.com/acme/shop", "ssh://git@github.com:22/acme/shop.git"))
+	assert.False(t, SameRepository("https://github.com/acme/shop", "https://github.com/acme/shop-api"))
+	assert.False(t, SameRepository("", ""))
+}
@@ -1,84 +1,124 @@
 package ci
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-
-	//"strings"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing"
-	"gopkg.in/yaml.v3"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
-func NewWorkspaceFromGit(root, url, branch string) (*workspaceImpl, error) {
+// DefaultPipelinePaths are the files, relative to the repository root, that
+// FindPipeline tries in order when no pipeline path is configured
+var DefaultPipelinePaths = []string{
+	".pipeslicer.yml",
+	".pipeslicer.yaml",
+	"build/pipeslicer-ci.yaml",
+}
+
+// ErrPipelineNotFound is returned when a workspace has no pipeline file
+var ErrPipelineNotFound = errors.New("pipeline file not found")
+
+// commandWaitDelay bounds how long a cancelled command may keep its output
+// open, e.g. through a process that left its process group
+const commandWaitDelay = 2 * time.Second
+
+// NewWorkspaceFromGit clones the repository at url at rev into a new
+// directory under root. Only the history needed to check out rev is
+// fetched. auth authenticates the clone and may be nil for public
+// repositories.
+func NewWorkspaceFromGit(root, url string, rev Revision, auth transport.AuthMethod) (*workspaceImpl, error) {
 	dir, err := os.MkdirTemp(root, "workspace")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
-	// usr, err := user.Current()
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to get current user: %w", err)
-	// }
-
-	// // Try multiple possible SSH key locations
-	// possibleKeyPaths := []string{
-	// 	filepath.Join(usr.HomeDir, ".ssh", "vnist_e25519"),
-	// 	// Add other potential paths if needed
-	// }
-
-	// var sshAuth *ssh.PublicKeys
-	// var lastErr error
-
-	// for _, keyPath := range possibleKeyPaths {
-	// 	if _, err := os.Stat(keyPath); err == nil {
-	// 		sshAuth, err = ssh.NewPublicKeysFromFile("git", keyPath, "")
-	// 		if err == nil {
-	// 			// Successfully loaded the key
-	// 			break
-	// 		}
-	// 		lastErr = err
-	// 	}
-	// }
-
-	// if sshAuth == nil {
-	// 	if lastErr != nil {
-	// 		return nil, fmt.Errorf("failed to load any SSH key: %w", lastErr)
-	// 	}
-	// 	return nil, fmt.Errorf("no SSH keys found in ~/.ssh/id_rsa or ~/.ssh/id_ed25519")
-	// }
+	ws, err := cloneWorkspace(dir, url, url, rev, auth)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return ws, nil
+}
 
+// cloneWorkspace clones the repository at url at rev into the empty
+// directory dir, fetching from source, which is url itself or a local
+// mirror of it. Branches are checked out as a local branch and other
+// revisions on a detached head.
+func cloneWorkspace(dir, url, source string, rev Revision, auth transport.AuthMethod) (*workspaceImpl, error) {
 	// Debug output for troubleshooting
-	log.Printf("Cloning repository %s (branch: %s) to %s", url, branch, dir)
-
-	// Use HTTPS URL instead of SSH URL
-	//httpURL := strings.Replace(url, "git@github.com:", "https://github.com/", 1)
-	//log.Printf("Falling back to HTTPS URL: %s", httpURL)
-
-	repo, err := git.PlainClone(dir, false, &git.CloneOptions{
-		URL:               url,
-		ReferenceName:     plumbing.NewBranchReferenceName(branch),
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		Depth:             1,
-	})
+	log.Printf("Cloning repository %s (%s) from %s to %s", url, rev, source, dir)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize repository: %w", err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{source}}); err != nil {
+		return nil, fmt.Errorf("failed to add remote: %w", err)
+	}
+
+	hash, err := FetchRevision(repo, rev, 1, auth)
 	if err != nil {
 		return nil, fmt.Errorf("git clone failed: %w", err)
 	}
+	if source != url {
+		// Steps and relative submodule URLs see the real remote
+		cfg, err := repo.Config()
+		if err == nil {
+			cfg.Remotes["origin"].URLs = []string{url}
+			err = repo.SetConfig(cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to set remote: %w", err)
+		}
+	}
 
-	ref, err := repo.Head()
+	worktree, err := repo.Worktree()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get repository head: %w", err)
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	checkout := &git.CheckoutOptions{Hash: hash, Force: true}
+	if rev.Ref != "" && rev.ReferenceName().IsBranch() {
+		checkout.Branch = rev.ReferenceName()
+		checkout.Create = true
+	}
+	if err := worktree.Checkout(checkout); err != nil {
+		return nil, fmt.Errorf("failed to checkout %s: %w", rev, err)
+	}
+
+	submodules, err := worktree.Submodules()
+	if err == nil {
+		err = submodules.Update(&git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update submodules: %w", err)
+	}
+
+	hash, err = VerifyHead(repo, rev)
+	if err != nil {
+		return nil, err
 	}
 
+	branch := rev.Branch()
 	return &workspaceImpl{
 		dir:    dir,
 		branch: branch,
-		commit: ref.Hash().String(),
-		env:    []string{},
+		commit: hash.String(),
+		env:    defaultEnv(dir, branch, hash.String()),
 	}, nil
 }
 
@@ -97,7 +137,7 @@ func NewWorkspaceFromDir(dir string) (*workspaceImpl, error) {
 		dir:    dir,
 		branch: ref.Name().Short(),
 		commit: ref.Hash().String(),
-		env:    []string{},
+		env:    defaultEnv(dir, ref.Name().Short(), ref.Hash().String()),
 	}, nil
 }
 
@@ -124,15 +164,19 @@ func NewWorkspaceFromPath(path string) (*workspaceImpl, error) {
 		dir:    path,
 		branch: ref.Name().Short(),
 		commit: ref.Hash().String(),
-		env:    []string{},
+		env:    defaultEnv(path, ref.Name().Short(), ref.Hash().String()),
 	}, nil
 }
 
 type workspaceImpl struct {
-	branch string
-	commit string
-	dir    string
-	env    []string
+	branch    string
+	commit    string
+	dir       string
+	env       []string
+	templates TemplateSource
+	// manager is set on the workspaces of a WorkspaceManager until Close
+	// hands them back
+	manager *WorkspaceManager
 }
 
 func (ws *workspaceImpl) Branch() string {
@@ -151,19 +195,130 @@ func (ws *workspaceImpl) Env() []string {
 	return ws.env
 }
 
+// Close hands a workspace of a WorkspaceManager back to it, which deletes
+// it or keeps it for the retention of its outcome. Workspaces opened on an
+// existing directory are left in place, and closing twice does nothing.
+func (ws *workspaceImpl) Close(failed bool) error {
+	m := ws.manager
+	if m == nil {
+		return nil
+	}
+	ws.manager = nil
+	return m.Release(ws.dir, failed)
+}
+
+// SetTemplateSource lets pipelines include templates from src
+func (ws *workspaceImpl) SetTemplateSource(src TemplateSource) {
+	ws.templates = src
+}
+
+// FindPipeline reads the pipeline definition versioned in the workspace.
+// When path is empty the DefaultPipelinePaths are tried in order. It
+// returns the path that was read.
+func (ws *workspaceImpl) FindPipeline(path string) (string, []byte, error) {
+	candidates := DefaultPipelinePaths
+	if path != "" {
+		candidates = []string{path}
+	}
+
+	for _, candidate := range candidates {
+		clean, ok := workspacePath(candidate)
+		if !ok {
+			return "", nil, fmt.Errorf("pipeline path %q is outside the workspace", candidate)
+		}
+		content, err := os.ReadFile(filepath.Join(ws.dir, clean))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read pipeline %q: %w", candidate, err)
+		}
+		return filepath.ToSlash(clean), content, nil
+	}
+	return "", nil, fmt.Errorf("%w: tried %s", ErrPipelineNotFound, strings.Join(candidates, ", "))
+}
+
+// workspacePath cleans a path relative to the workspace root and reports
+// whether it stays inside the workspace
+func workspacePath(path string) (string, bool) {
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return clean, true
+}
+
+// LoadPipeline resolves, decodes and validates a pipeline definition.
+// Problems with the definition are returned as ValidationErrors.
 func (ws *workspaceImpl) LoadPipeline(yamlContent []byte) (*Pipeline, error) {
-	var pipeline Pipeline
-	err := yaml.Unmarshal(yamlContent, &pipeline)
+	r := &pipelineResolver{dir: ws.dir, templates: ws.templates}
+	root, err := r.resolveAll(yamlContent)
 	if err != nil {
 		return nil, err
 	}
+	var pipeline Pipeline
+	if err := root.Decode(&pipeline); err != nil {
+		return nil, err
+	}
+	if errs := validatePipeline(&pipeline, r.steps); len(errs) > 0 {
+		return nil, errs
+	}
 	return &pipeline, nil
 }
 
 func (ws *workspaceImpl) ExecuteCommand(ctx context.Context, cmd string, args []string) ([]byte, error) {
+	return ws.ExecuteCommandWithOptions(ctx, cmd, args, ExecOptions{})
+}
+
+func (ws *workspaceImpl) ExecuteCommandWithOptions(ctx context.Context, cmd string, args []string, opts ExecOptions) ([]byte, error) {
+	dir, err := ws.resolveDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Image != "" {
+		return ws.executeInContainer(ctx, cmd, args, opts)
+	}
+
 	command := exec.CommandContext(ctx, cmd, args...)
-	command.Dir = ws.dir
+	command.Dir = dir
+	command.WaitDelay = commandWaitDelay
+	killProcessGroup(command)
 	command.Env = append(command.Environ(), ws.Env()...)
+	command.Env = append(command.Env, opts.Env...)
+
+	if opts.Output == nil {
+		return command.CombinedOutput()
+	}
 
-	return command.CombinedOutput()
+	// Stdout and stderr share one writer so exec serialises the writes
+	var output bytes.Buffer
+	writer := io.MultiWriter(&output, opts.Output)
+	command.Stdout = writer
+	command.Stderr = writer
+	err = command.Run()
+	return output.Bytes(), err
+}
+
+// resolveDir maps a step workdir onto the workspace, refusing paths that escape it
+func (ws *workspaceImpl) resolveDir(workdir string) (string, error) {
+	if workdir == "" {
+		return ws.dir, nil
+	}
+	dir := filepath.Join(ws.dir, workdir)
+	rel, err := filepath.Rel(ws.dir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("workdir %q is outside the workspace", workdir)
+	}
+	return dir, nil
+}
+
+// defaultEnv returns the CI variables every command in a workspace can rely on
+func defaultEnv(dir, branch, commit string) []string {
+	return []string{
+		"CI=true",
+		"CI_WORKSPACE=" + dir,
+		"CI_BRANCH=" + branch,
+		"CI_COMMIT=" + commit,
+	}
 }
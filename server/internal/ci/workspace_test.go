@@ -0,0 +1,73 @@
+package ci
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindPipeline(t *testing.T) {
+	dir := t.TempDir()
+	ws := &workspaceImpl{dir: dir}
+
+	_, _, err := ws.FindPipeline("")
+	assert.True(t, errors.Is(err, ErrPipelineNotFound))
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "build"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "build", "pipeslicer-ci.yaml"), []byte("name: fallback\n"), 0644))
+	path, content, err := ws.FindPipeline("")
+	assert.Nil(t, err)
+	assert.Equal(t, "build/pipeslicer-ci.yaml", path)
+	assert.Equal(t, "name: fallback\n", string(content))
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".pipeslicer.yml"), []byte("name: root\n"), 0644))
+	path, _, err = ws.FindPipeline("")
+	assert.Nil(t, err)
+	assert.Equal(t, ".pipeslicer.yml", path)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ci.yaml"), []byte("name: custom\n"), 0644))
+	path, content, err = ws.FindPipeline("./ci.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "ci.yaml", path)
+	assert.Equal(t, "name: custom\n", string(content))
+
+	_, _, err = ws.FindPipeline("missing.yaml")
+	assert.True(t, errors.Is(err, ErrPipelineNotFound))
+
+	_, _, err = ws.FindPipeline("../outside.yaml")
+	assert.ErrorContains(t, err, "outside the workspace")
+}
+
+func TestNewWorkspaceFromGit(t *testing.T) {
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, false)
+	assert.Nil(t, err)
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(remote, ".pipeslicer.yml"), []byte("name: remote\n"), 0644))
+	_, err = wt.Add(".pipeslicer.yml")
+	assert.Nil(t, err)
+	hash, err := wt.Commit("init", &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+
+	auth := &http.BasicAuth{Username: "git", Password: "token"}
+	ws, err := NewWorkspaceFromGit(t.TempDir(), "file://"+remote, Revision{Ref: "master"}, auth)
+	assert.Nil(t, err)
+	assert.Equal(t, "master", ws.Branch())
+	assert.Equal(t, hash.String(), ws.Commit())
+	path, _, err := ws.FindPipeline("")
+	assert.Nil(t, err)
+	assert.Equal(t, ".pipeslicer.yml", path)
+
+	_, err = NewWorkspaceFromGit(t.TempDir(), "file://"+remote, Revision{Ref: "missing"}, nil)
+	assert.ErrorContains(t, err, "git clone failed")
+}
@@ -0,0 +1,475 @@
+package ci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Workspace states reported by WorkspaceManager.Usage
+const (
+	WorkspaceActive   = "active"
+	WorkspaceRetained = "retained"
+	WorkspaceHeld     = "held"
+	WorkspaceOrphaned = "orphaned"
+)
+
+// workspacePrefix starts the name of every workspace directory
+const workspacePrefix = "workspace"
+
+// markerSuffix ends the name of the file next to a workspace directory
+// that records why it is kept
+const markerSuffix = ".keep"
+
+// ErrWorkspaceNotFound is returned by Reopen when the directory is not a
+// workspace of the manager, such as one kept by another server
+var ErrWorkspaceNotFound = errors.New("workspace not found")
+
+// MirrorFunc returns the path of an up to date local mirror of the
+// repository at url, along with the function to call once it was cloned
+type MirrorFunc func(url string, auth transport.AuthMethod) (string, func(), error)
+
+// Retention says how long released workspaces are kept, by the outcome of
+// their run. Zero deletes them as soon as they are released.
+type Retention struct {
+	Succeeded time.Duration
+	Failed    time.Duration
+}
+
+// WorkspaceInfo describes a workspace directory
+type WorkspaceInfo struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"`
+	Size       int64      `json:"size"`
+	ModifiedAt time.Time  `json:"modifiedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+// WorkspaceUsage is the disk space taken by the workspaces of a manager
+type WorkspaceUsage struct {
+	Root       string          `json:"root"`
+	Size       int64           `json:"size"`
+	Workspaces []WorkspaceInfo `json:"workspaces"`
+}
+
+// CleanResult reports what a janitor pass reclaimed
+type CleanResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// marker records why a released workspace is kept. Held workspaces belong
+// to runs waiting for approval and are kept until released again.
+type marker struct {
+	Held      bool       `json:"held,omitempty"`
+	Failed    bool       `json:"failed,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// WorkspaceManager owns the workspace directories under root. Workspaces
+// are active from Clone or Reopen until Release, which deletes them or
+// keeps them for the retention of their outcome. The janitor deletes
+// expired workspaces and those a crashed process left behind, so root
+// must not be shared with another process.
+type WorkspaceManager struct {
+	root      string
+	retention Retention
+	mirror    MirrorFunc
+
+	mu     sync.Mutex
+	active map[string]bool
+	// removing holds the workspaces Clean is deleting, which cannot be
+	// reopened
+	removing map[string]bool
+}
+
+// NewWorkspaceManager creates a WorkspaceManager keeping workspaces under root
+func NewWorkspaceManager(root string, retention Retention) (*WorkspaceManager, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create workspace root: %w", err)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve workspace root: %w", err)
+	}
+	return &WorkspaceManager{
+		root:      root,
+		retention: retention,
+		active:    make(map[string]bool),
+		removing:  make(map[string]bool),
+	}, nil
+}
+
+// SetMirror makes Clone fetch from local mirrors rather than over the
+// network. Clones fall back to the network when the mirror fails.
+func (m *WorkspaceManager) SetMirror(mirror MirrorFunc) {
+	m.mirror = mirror
+}
+
+// Root returns the directory holding the workspaces
+func (m *WorkspaceManager) Root() string {
+	return m.root
+}
+
+// Clone clones the repository at url at rev into a new active workspace
+func (m *WorkspaceManager) Clone(url string, rev Revision, auth transport.AuthMethod) (*workspaceImpl, error) {
+	// The directory is registered before the janitor can see it
+	m.mu.Lock()
+	dir, err := os.MkdirTemp(m.root, workspacePrefix)
+	if err == nil {
+		m.active[filepath.Base(dir)] = true
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	ws, err := m.clone(dir, url, rev, auth)
+	if err != nil {
+		m.mu.Lock()
+		delete(m.active, filepath.Base(dir))
+		m.mu.Unlock()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	ws.manager = m
+	return ws, nil
+}
+
+// clone clones into dir from the mirror of url, if any, or else from url
+func (m *WorkspaceManager) clone(dir, url string, rev Revision, auth transport.AuthMethod) (*workspaceImpl, error) {
+	if m.mirror == nil {
+		return cloneWorkspace(dir, url, url, rev, auth)
+	}
+	mirror, release, err := m.mirror(url, auth)
+	if err != nil {
+		log.Printf("Cloning %s without a mirror: %v", url, err)
+		return cloneWorkspace(dir, url, url, rev, auth)
+	}
+	defer release()
+	return cloneWorkspace(dir, url, mirror, rev, auth)
+}
+
+// Reopen makes a kept workspace active again, such as the workspace of a
+// run resuming after an approval. rev is the revision the workspace was
+// cloned at, which names its branch: checkouts of tags, commits and pull
+// requests are on a detached HEAD.
+func (m *WorkspaceManager) Reopen(dir string, rev Revision) (*workspaceImpl, error) {
+	name, ok := m.name(dir)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not under %s", ErrWorkspaceNotFound, dir, m.root)
+	}
+	m.mu.Lock()
+	_, err := os.Stat(dir)
+	if err == nil && m.removing[name] {
+		err = fs.ErrNotExist
+	}
+	if err == nil {
+		m.active[name] = true
+	}
+	m.mu.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrWorkspaceNotFound, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workspace: %w", err)
+	}
+
+	ws, err := NewWorkspaceFromDir(dir)
+	if err == nil {
+		err = m.removeMarker(name)
+	}
+	if err != nil {
+		m.mu.Lock()
+		delete(m.active, name)
+		m.mu.Unlock()
+		return nil, err
+	}
+	ws.branch = rev.Branch()
+	ws.env = defaultEnv(dir, ws.branch, ws.commit)
+	ws.manager = m
+	return ws, nil
+}
+
+// Release hands back a workspace once its run is over. It is deleted, or
+// kept for the retention of a failed or successful run.
+func (m *WorkspaceManager) Release(dir string, failed bool) error {
+	name, ok := m.name(dir)
+	if !ok {
+		return fmt.Errorf("workspace %s is not under %s", dir, m.root)
+	}
+	defer func() {
+		m.mu.Lock()
+		delete(m.active, name)
+		m.mu.Unlock()
+	}()
+
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return m.removeMarker(name)
+	}
+
+	keep := m.retention.Succeeded
+	if failed {
+		keep = m.retention.Failed
+	}
+	if keep <= 0 {
+		return m.remove(name)
+	}
+	expiresAt := time.Now().Add(keep)
+	return m.writeMarker(name, marker{Failed: failed, ExpiresAt: &expiresAt})
+}
+
+// Hold keeps a workspace until it is reopened or released, whatever the
+// retention
+func (m *WorkspaceManager) Hold(dir string) error {
+	name, ok := m.name(dir)
+	if !ok {
+		return fmt.Errorf("workspace %s is not under %s", dir, m.root)
+	}
+	if err := m.writeMarker(name, marker{Held: true}); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.active, name)
+	m.mu.Unlock()
+	return nil
+}
+
+// Held lists the directories of the held workspaces
+func (m *WorkspaceManager) Held() ([]string, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspace root: %w", err)
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, workspacePrefix) {
+			continue
+		}
+		m.mu.Lock()
+		active := m.active[name]
+		m.mu.Unlock()
+		if mark, err := m.readMarker(name); !active && err == nil && mark != nil && mark.Held {
+			dirs = append(dirs, filepath.Join(m.root, name))
+		}
+	}
+	return dirs, nil
+}
+
+// Usage reports every workspace under root with its state and size
+func (m *WorkspaceManager) Usage() (*WorkspaceUsage, error) {
+	workspaces, err := m.scan()
+	if err != nil {
+		return nil, err
+	}
+	usage := &WorkspaceUsage{Root: m.root, Workspaces: workspaces}
+	for _, ws := range workspaces {
+		usage.Size += ws.Size
+	}
+	return usage, nil
+}
+
+// Clean deletes the workspaces whose retention ended before now and the
+// orphaned ones that no run owns
+func (m *WorkspaceManager) Clean(now time.Time) (CleanResult, error) {
+	var result CleanResult
+	workspaces, err := m.scan()
+	if err != nil {
+		return result, err
+	}
+
+	// The workspaces are claimed under the lock and deleted after it, so
+	// that slow deletes do not hold up Clone and Reopen
+	var expired []WorkspaceInfo
+	m.mu.Lock()
+	for _, ws := range workspaces {
+		switch ws.State {
+		case WorkspaceOrphaned:
+		case WorkspaceRetained:
+			if ws.ExpiresAt.After(now) {
+				continue
+			}
+		default:
+			continue
+		}
+		// It may have been reopened since the scan
+		if m.active[ws.Name] || m.removing[ws.Name] {
+			continue
+		}
+		m.removing[ws.Name] = true
+		expired = append(expired, ws)
+	}
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		for _, ws := range expired {
+			delete(m.removing, ws.Name)
+		}
+		m.mu.Unlock()
+	}()
+	for _, ws := range expired {
+		if err := m.remove(ws.Name); err != nil {
+			return result, err
+		}
+		result.Removed++
+		result.Freed += ws.Size
+	}
+	return result, nil
+}
+
+// StartJanitor cleans the workspaces every interval until ctx is cancelled
+func (m *WorkspaceManager) StartJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			result, err := m.Clean(time.Now())
+			if err != nil {
+				log.Printf("Failed to clean workspaces: %v", err)
+			} else if result.Removed > 0 {
+				log.Printf("Removed %d workspaces, freeing %d bytes", result.Removed, result.Freed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// scan lists the workspace directories under root, oldest first
+func (m *WorkspaceManager) scan() ([]WorkspaceInfo, error) {
+	entries, err := os.ReadDir(m.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspace root: %w", err)
+	}
+
+	var workspaces []WorkspaceInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, workspacePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		ws := WorkspaceInfo{Name: name, ModifiedAt: info.ModTime()}
+		m.mu.Lock()
+		active := m.active[name]
+		m.mu.Unlock()
+		mark, err := m.readMarker(name)
+		switch {
+		case active:
+			ws.State = WorkspaceActive
+		case err != nil:
+			log.Printf("Keeping workspace %s with unreadable marker: %v", name, err)
+			ws.State = WorkspaceHeld
+		case mark == nil:
+			ws.State = WorkspaceOrphaned
+		case mark.Held:
+			ws.State = WorkspaceHeld
+		default:
+			ws.State = WorkspaceRetained
+			ws.ExpiresAt = mark.ExpiresAt
+			if ws.ExpiresAt == nil {
+				ws.ExpiresAt = &time.Time{}
+			}
+		}
+		ws.Size = DirSize(filepath.Join(m.root, name))
+		workspaces = append(workspaces, ws)
+	}
+
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].ModifiedAt.Before(workspaces[j].ModifiedAt)
+	})
+	return workspaces, nil
+}
+
+// name returns the name of a workspace directory directly under root
+func (m *WorkspaceManager) name(dir string) (string, bool) {
+	abs, err := filepath.Abs(dir)
+	if err != nil || filepath.Dir(abs) != m.root {
+		return "", false
+	}
+	name := filepath.Base(abs)
+	return name, strings.HasPrefix(name, workspacePrefix)
+}
+
+// remove deletes a workspace directory and its marker
+func (m *WorkspaceManager) remove(name string) error {
+	if err := os.RemoveAll(filepath.Join(m.root, name)); err != nil {
+		return fmt.Errorf("failed to remove workspace %s: %w", name, err)
+	}
+	return m.removeMarker(name)
+}
+
+func (m *WorkspaceManager) readMarker(name string) (*marker, error) {
+	data, err := os.ReadFile(filepath.Join(m.root, name+markerSuffix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mark marker
+	if err := json.Unmarshal(data, &mark); err != nil {
+		return nil, err
+	}
+	return &mark, nil
+}
+
+func (m *WorkspaceManager) writeMarker(name string, mark marker) error {
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(m.root, name+markerSuffix), data, 0644); err != nil {
+		return fmt.Errorf("failed to keep workspace %s: %w", name, err)
+	}
+	return nil
+}
+
+func (m *WorkspaceManager) removeMarker(name string) error {
+	err := os.Remove(filepath.Join(m.root, name+markerSuffix))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove marker of workspace %s: %w", name, err)
+	}
+	return nil
+}
+
+// DirSize adds up the size of the regular files below dir. Files that
+// cannot be read are not counted.
+func DirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,206 @@
+package ci
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func initRemote(t *testing.T) string {
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, false)
+	assert.Nil(t, err)
+	wt, err := repo.Worktree()
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(remote, "README.md"), []byte("remote\n"), 0644))
+	_, err = wt.Add("README.md")
+	assert.Nil(t, err)
+	_, err = wt.Commit("init", &git.CommitOptions{
+		Author: &object.Signature{Name: "CI", Email: "ci@example.com", When: time.Now()},
+	})
+	assert.Nil(t, err)
+	return "file://" + remote
+}
+
+func TestWorkspaceManagerRelease(t *testing.T) {
+	url := initRemote(t)
+	m, err := NewWorkspaceManager(t.TempDir(), Retention{Failed: time.Hour})
+	assert.Nil(t, err)
+
+	ws, err := m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+	usage, err := m.Usage()
+	assert.Nil(t, err)
+	assert.Len(t, usage.Workspaces, 1)
+	assert.Equal(t, WorkspaceActive, usage.Workspaces[0].State)
+	assert.Greater(t, usage.Size, int64(0))
+
+	// Successful runs are not retained
+	assert.Nil(t, ws.Close(false))
+	assert.NoDirExists(t, ws.Dir())
+
+	ws, err = m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ws.Close(true))
+	assert.DirExists(t, ws.Dir())
+	usage, err = m.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, WorkspaceRetained, usage.Workspaces[0].State)
+	assert.NotNil(t, usage.Workspaces[0].ExpiresAt)
+
+	result, err := m.Clean(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Removed)
+	assert.DirExists(t, ws.Dir())
+
+	result, err = m.Clean(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Removed)
+	assert.Greater(t, result.Freed, int64(0))
+	assert.NoDirExists(t, ws.Dir())
+	assert.NoFileExists(t, ws.Dir()+markerSuffix)
+
+	_, err = m.Clone(url, Revision{Ref: "missing"}, nil)
+	assert.ErrorContains(t, err, "git clone failed")
+	usage, err = m.Usage()
+	assert.Nil(t, err)
+	assert.Empty(t, usage.Workspaces)
+
+	assert.ErrorContains(t, m.Release(t.TempDir(), true), "is not under")
+
+	// Workspaces opened on a directory of their own are left in place
+	dir := strings.TrimPrefix(url, "file://")
+	opened, err := NewWorkspaceFromDir(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, opened.Close(false))
+	assert.DirExists(t, dir)
+}
+
+func TestWorkspaceManagerCleansOrphans(t *testing.T) {
+	url := initRemote(t)
+	root := t.TempDir()
+	m, err := NewWorkspaceManager(root, Retention{})
+	assert.Nil(t, err)
+
+	// Left behind by a process that crashed
+	orphan := filepath.Join(root, workspacePrefix+"123")
+	assert.Nil(t, os.MkdirAll(orphan, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(orphan, "file"), []byte("data"), 0644))
+	unrelated := filepath.Join(root, "other")
+	assert.Nil(t, os.MkdirAll(unrelated, 0755))
+
+	active, err := m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+
+	result, err := m.Clean(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, CleanResult{Removed: 1, Freed: 4}, result)
+	assert.NoDirExists(t, orphan)
+	assert.DirExists(t, unrelated)
+	assert.DirExists(t, active.Dir())
+}
+
+func TestWorkspaceManagerHold(t *testing.T) {
+	url := initRemote(t)
+	m, err := NewWorkspaceManager(t.TempDir(), Retention{})
+	assert.Nil(t, err)
+
+	ws, err := m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+	commit := ws.Commit()
+	assert.Nil(t, m.Hold(ws.Dir()))
+	held, err := m.Held()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ws.Dir()}, held)
+
+	result, err := m.Clean(time.Now().Add(24 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Removed)
+	usage, err := m.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, WorkspaceHeld, usage.Workspaces[0].State)
+
+	reopened, err := m.Reopen(ws.Dir(), Revision{Ref: "master"})
+	assert.Nil(t, err)
+	assert.Equal(t, commit, reopened.Commit())
+	assert.Equal(t, "master", reopened.Branch())
+	assert.NoFileExists(t, ws.Dir()+markerSuffix)
+	usage, err = m.Usage()
+	assert.Nil(t, err)
+	assert.Equal(t, WorkspaceActive, usage.Workspaces[0].State)
+
+	held, err = m.Held()
+	assert.Nil(t, err)
+	assert.Empty(t, held)
+
+	// Workspaces kept elsewhere cannot be reopened
+	_, err = m.Reopen(filepath.Join(t.TempDir(), "workspace1"), Revision{Ref: "master"})
+	assert.ErrorIs(t, err, ErrWorkspaceNotFound)
+	_, err = m.Reopen(filepath.Join(m.Root(), "workspace-missing"), Revision{Ref: "master"})
+	assert.ErrorIs(t, err, ErrWorkspaceNotFound)
+
+	assert.Nil(t, reopened.Close(false))
+	assert.NoDirExists(t, ws.Dir())
+	assert.Nil(t, reopened.Close(false))
+	// Releasing a workspace that is already gone is not an error
+	assert.Nil(t, m.Release(ws.Dir(), false))
+}
+
+func TestWorkspaceManagerReopenDetached(t *testing.T) {
+	url, history, _ := historyRemote(t)
+	m, err := NewWorkspaceManager(t.TempDir(), Retention{})
+	assert.Nil(t, err)
+
+	rev := Revision{Ref: "refs/tags/v1.0"}
+	ws, err := m.Clone(url, rev, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Hold(ws.Dir()))
+
+	// The tag is checked out on a detached HEAD, the branch comes from rev
+	reopened, err := m.Reopen(ws.Dir(), rev)
+	assert.Nil(t, err)
+	assert.Equal(t, history[0].String(), reopened.Commit())
+	assert.Equal(t, "v1.0", reopened.Branch())
+	assert.Contains(t, reopened.Env(), "CI_BRANCH=v1.0")
+	assert.Nil(t, reopened.Close(false))
+	assert.NoDirExists(t, ws.Dir())
+}
+
+func TestWorkspaceManagerMirror(t *testing.T) {
+	url := initRemote(t)
+	mirror := t.TempDir()
+	_, err := git.PlainClone(mirror, true, &git.CloneOptions{URL: url})
+	assert.Nil(t, err)
+
+	m, err := NewWorkspaceManager(t.TempDir(), Retention{})
+	assert.Nil(t, err)
+	var released bool
+	m.SetMirror(func(string, transport.AuthMethod) (string, func(), error) {
+		return mirror, func() { released = true }, nil
+	})
+
+	ws, err := m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+	assert.True(t, released)
+	repo, err := git.PlainOpen(ws.Dir())
+	assert.Nil(t, err)
+	remote, err := repo.Remote("origin")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{url}, remote.Config().URLs)
+
+	// Clones fall back to the network when the mirror fails
+	m.SetMirror(func(string, transport.AuthMethod) (string, func(), error) {
+		return "", nil, errors.New("disk full")
+	})
+	fallback, err := m.Clone(url, Revision{Ref: "master"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ws.Commit(), fallback.Commit())
+}